@@ -17,7 +17,6 @@
 package main
 
 import (
-	"crypto/sha1"
 	"flag"
 	"fmt"
 	"os"
@@ -37,11 +36,9 @@ func main() {
 		return
 	}
 
-	var ownerAuth [20]byte
-	ownerInput := os.Getenv(ownerAuthEnvVar)
-	if ownerInput != "" {
-		oa := sha1.Sum([]byte(ownerInput))
-		copy(ownerAuth[:], oa[:])
+	ownerAuth := tpm.WellKnownAuth()
+	if ownerInput := os.Getenv(ownerAuthEnvVar); ownerInput != "" {
+		ownerAuth = tpm.SHA1Auth([]byte(ownerInput))
 	}
 	if err := tpm.OwnerClear(rwc, ownerAuth); err != nil {
 		fmt.Fprintf(os.Stderr, "Couldn't clear the TPM using owner auth: %s\n", err)
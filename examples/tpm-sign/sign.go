@@ -17,7 +17,6 @@
 package main
 
 import (
-	"crypto/sha1"
 	"flag"
 	"fmt"
 	"io"
@@ -48,25 +47,14 @@ func signAction() {
 	defer rwc.Close()
 
 	// Compute the auth values as needed.
-	var srkAuth [20]byte
-	srkInput := os.Getenv(srkAuthEnvVar)
-	if srkInput != "" {
-		sa := sha1.Sum([]byte(srkInput))
-		copy(srkAuth[:], sa[:])
+	srkAuth := tpm.WellKnownAuth()
+	if srkInput := os.Getenv(srkAuthEnvVar); srkInput != "" {
+		srkAuth = tpm.SHA1Auth([]byte(srkInput))
 	}
 
-	var usageAuth [20]byte
-	usageInput := os.Getenv(usageAuthEnvVar)
-	if usageInput != "" {
-		ua := sha1.Sum([]byte(usageInput))
-		copy(usageAuth[:], ua[:])
-	}
-
-	var migrationAuth [20]byte
-	migrationInput := os.Getenv(migrationAuthEnvVar)
-	if migrationInput != "" {
-		ma := sha1.Sum([]byte(migrationInput))
-		copy(migrationAuth[:], ma[:])
+	usageAuth := tpm.WellKnownAuth()
+	if usageInput := os.Getenv(usageAuthEnvVar); usageInput != "" {
+		usageAuth = tpm.SHA1Auth([]byte(usageInput))
 	}
 
 	keyblob, err := os.ReadFile(*keyblobPath)
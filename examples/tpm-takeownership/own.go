@@ -17,7 +17,6 @@
 package main
 
 import (
-	"crypto/sha1"
 	"flag"
 	"fmt"
 	"os"
@@ -41,18 +40,14 @@ func main() {
 	}
 
 	// Compute the auth values as needed.
-	var ownerAuth [20]byte
-	ownerInput := os.Getenv(ownerAuthEnvVar)
-	if ownerInput != "" {
-		oa := sha1.Sum([]byte(ownerInput))
-		copy(ownerAuth[:], oa[:])
+	ownerAuth := tpm.WellKnownAuth()
+	if ownerInput := os.Getenv(ownerAuthEnvVar); ownerInput != "" {
+		ownerAuth = tpm.SHA1Auth([]byte(ownerInput))
 	}
 
-	var srkAuth [20]byte
-	srkInput := os.Getenv(srkAuthEnvVar)
-	if srkInput != "" {
-		sa := sha1.Sum([]byte(srkInput))
-		copy(srkAuth[:], sa[:])
+	srkAuth := tpm.WellKnownAuth()
+	if srkInput := os.Getenv(srkAuthEnvVar); srkInput != "" {
+		srkAuth = tpm.SHA1Auth([]byte(srkInput))
 	}
 
 	pubEK, err := tpm.ReadPubEK(rwc)
@@ -17,24 +17,105 @@ package tpm
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/google/go-tpm/tpmutil"
 )
 
+// A responseHeader is the header of every response from a TPM 1.2.
+type responseHeader struct {
+	Tag  uint16
+	Size uint32
+	Res  uint32
+}
+
+// commandHeaderSize is the size of the tag, size, and ordinal that precede
+// the parameters of every TPM 1.2 command.
+const commandHeaderSize = 10
+
+// commandAuthSize and responseAuthSize are the sizes of a single auth section
+// at the end of a command and of a response.
+const (
+	commandAuthSize  = 45
+	responseAuthSize = 41
+)
+
+// responseTags maps each request tag to the response tag the TPM uses when a
+// command with that tag succeeds.
+var responseTags = map[uint16]uint16{
+	TagRQUCommand:      TagRSPCommand,
+	TagRQUAuth1Command: TagRSPAuth1Command,
+	TagRQUAuth2Command: TagRSPAuth2Command,
+}
+
 // submitTPMRequest sends a structure to the TPM device file and gets results
-// back, interpreting them as a new provided structure.
-func submitTPMRequest(rw io.ReadWriter, tag uint16, ord uint32, in []interface{}, out []interface{}) (uint32, error) {
-	resp, code, err := tpmutil.RunCommand(rw, tpmutil.Tag(tag), tpmutil.Command(ord), in...)
+// back, interpreting them as a new provided structure. If the TPM returns an
+// error, or if the response tag doesn't carry the auth sections implied by the
+// request tag, then the response body is not parsed at all.
+func submitTPMRequest(rw io.ReadWriter, tag uint16, ord Ordinal, in []interface{}, out []interface{}) (uint32, error) {
+	body, err := tpmutil.Pack(in...)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't pack message body: %v", err)
+	}
+	header, err := tpmutil.Pack(tag, uint32(commandHeaderSize+len(body)), ord)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't pack message header: %v", err)
+	}
+
+	Logger.Debug("tpm: sending command", "tag", tag, "ordinal", ord, "size", commandHeaderSize+len(body))
+	resp, err := tpmutil.RunCommandRaw(rw, append(header, body...))
+	if err != nil {
+		Logger.Debug("tpm: command failed", "ordinal", ord, "error", err)
+		return 0, err
+	}
+
+	var rh responseHeader
+	read, err := tpmutil.Unpack(resp, &rh)
 	if err != nil {
 		return 0, err
 	}
-	if code != tpmutil.RCSuccess {
-		return uint32(code), tpmError(code)
+	Logger.Debug("tpm: received response", "ordinal", ord, "tag", rh.Tag, "size", rh.Size, "result", rh.Res)
+	// TPM 1.2 responses don't echo the ordinal, so a response to another
+	// command can only be told by a size or a tag that doesn't fit.
+	if int(rh.Size) != len(resp) {
+		return 0, desyncError(rw, fmt.Errorf("the response header declares %d bytes, but %d were read", rh.Size, len(resp)))
+	}
+	// Error responses never carry auth sections, whatever the request tag, so
+	// the return code takes priority over the tag check.
+	if rh.Res != uint32(tpmutil.RCSuccess) {
+		return rh.Res, tpmError(rh.Res)
+	}
+	if want, ok := responseTags[tag]; !ok || rh.Tag != want {
+		return 0, desyncError(rw, fmt.Errorf("got response tag 0x%x for request tag 0x%x on %v", rh.Tag, tag, ord))
 	}
 
-	_, err = tpmutil.Unpack(resp, out...)
-	return 0, err
+	// The whole response has been read by now, so a body that doesn't fit
+	// the out parameters is a problem with the command's own definition, not
+	// with the framing of the device.
+	n, err := tpmutil.Unpack(resp[read:], out...)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse the response to %v: %v", ord, err)
+	}
+	if read+n != len(resp) {
+		return 0, fmt.Errorf("the response to %v has %d bytes left over", ord, len(resp)-read-n)
+	}
+	return 0, nil
+}
+
+// RunCommand sends a command that the package doesn't wrap to the TPM. in holds
+// the parameters of the command and out pointers to the values that the
+// response parameters are unpacked into, both encoded as by tpmutil.Pack, so
+// []byte values need a tpmutil.U32Bytes or tpmutil.U16Bytes to carry their
+// length. It returns the TPM return code along with an error if the TPM
+// returns an error or the response tag doesn't match tag.
+//
+// RunCommand does nothing about auth: for a command with TagRQUAuth1Command or
+// TagRQUAuth2Command, the caller must open the sessions, append the auth
+// sections to in and the response auth sections to out, and verify them, for
+// example with an OSAPSession.
+func RunCommand(rw io.ReadWriter, tag uint16, ord Ordinal, in []interface{}, out []interface{}) (uint32, error) {
+	return submitTPMRequest(rw, tag, ord, in, out)
 }
 
 // oiap sends an OIAP command to the TPM and gets back an auth value and a
@@ -44,9 +125,10 @@ func oiap(rw io.ReadWriter) (*oiapResponse, error) {
 	out := []interface{}{&resp}
 	// In this case, we don't need to check ret, since all the information is
 	// contained in err.
-	if _, err := submitTPMRequest(rw, tagRQUCommand, ordOIAP, nil, out); err != nil {
+	if _, err := submitTPMRequest(rw, TagRQUCommand, OrdOIAP, nil, out); err != nil {
 		return nil, err
 	}
+	Logger.Debug("tpm: opened OIAP session", "handle", resp.AuthHandle, "nonceEven", resp.NonceEven[:])
 
 	return &resp, nil
 }
@@ -59,9 +141,10 @@ func osap(rw io.ReadWriter, osap *osapCommand) (*osapResponse, error) {
 	out := []interface{}{&resp}
 	// In this case, we don't need to check the ret value, since all the
 	// information is contained in err.
-	if _, err := submitTPMRequest(rw, tagRQUCommand, ordOSAP, in, out); err != nil {
+	if _, err := submitTPMRequest(rw, TagRQUCommand, OrdOSAP, in, out); err != nil {
 		return nil, err
 	}
+	Logger.Debug("tpm: opened OSAP session", "handle", resp.AuthHandle, "entityType", osap.EntityType, "entityValue", osap.EntityValue, "nonceEven", resp.NonceEven[:])
 
 	return &resp, nil
 }
@@ -80,7 +163,7 @@ func seal(rw io.ReadWriter, sc *sealCommand, pcrs *pcrInfoLong, data tpmutil.U32
 	var tsd tpmStoredData
 	var ra responseAuth
 	out := []interface{}{&tsd, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordSeal, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdSeal, in, out)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -95,7 +178,7 @@ func unseal(rw io.ReadWriter, keyHandle tpmutil.Handle, sealed *tpmStoredData, c
 	var ra1 responseAuth
 	var ra2 responseAuth
 	out := []interface{}{&outb, &ra1, &ra2}
-	ret, err := submitTPMRequest(rw, tagRQUAuth2Command, ordUnseal, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth2Command, OrdUnseal, in, out)
 	if err != nil {
 		return nil, nil, nil, 0, err
 	}
@@ -109,7 +192,7 @@ func authorizeMigrationKey(rw io.ReadWriter, migrationScheme MigrationScheme, mi
 	var ra responseAuth
 	var migrationAuth migrationKeyAuth
 	out := []interface{}{&migrationAuth, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordAuthorizeMigrationKey, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdAuthorizeMigrationKey, in, out)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -129,7 +212,7 @@ func createMigrationBlob(rw io.ReadWriter, parentHandle tpmutil.Handle, migratio
 	var ra1 responseAuth
 	var ra2 responseAuth
 	out := []interface{}{&rand, &outData, &ra1, &ra2}
-	ret, err := submitTPMRequest(rw, tagRQUAuth2Command, ordCreateMigrationBlob, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth2Command, OrdCreateMigrationBlob, in, out)
 	if err != nil {
 		return nil, nil, nil, nil, 0, err
 	}
@@ -137,16 +220,31 @@ func createMigrationBlob(rw io.ReadWriter, parentHandle tpmutil.Handle, migratio
 	return rand, outData, &ra1, &ra2, ret, nil
 }
 
+// convertMigrationBlob rewraps a key blob created with the MSMigrate scheme so
+// that it can be loaded under parentHandle.
+func convertMigrationBlob(rw io.ReadWriter, parentHandle tpmutil.Handle, inData tpmutil.U32Bytes, random tpmutil.U32Bytes, ca *commandAuth) ([]byte, *responseAuth, uint32, error) {
+	in := []interface{}{parentHandle, inData, random, ca}
+	var outData tpmutil.U32Bytes
+	var ra responseAuth
+	out := []interface{}{&outData, &ra}
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdConvertMigrationBlob, in, out)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return outData, &ra, ret, nil
+}
+
 // flushSpecific removes a handle from the TPM. Note that removing a handle
 // doesn't require any authentication.
 func flushSpecific(rw io.ReadWriter, handle tpmutil.Handle, resourceType uint32) error {
 	// In this case, all the information is in err, so we don't check the
 	// specific return-value details.
-	_, err := submitTPMRequest(rw, tagRQUCommand, ordFlushSpecific, []interface{}{handle, resourceType}, nil)
+	_, err := submitTPMRequest(rw, TagRQUCommand, OrdFlushSpecific, []interface{}{handle, resourceType}, nil)
 	return err
 }
 
-// loadKey2 loads a key into the TPM. It's a tagRQUAuth1Command, so it only
+// loadKey2 loads a key into the TPM. It's a TagRQUAuth1Command, so it only
 // needs one auth parameter.
 // TODO(tmroeder): support key12, too.
 func loadKey2(rw io.ReadWriter, k *key, ca *commandAuth) (tpmutil.Handle, *responseAuth, uint32, error) {
@@ -155,7 +253,7 @@ func loadKey2(rw io.ReadWriter, k *key, ca *commandAuth) (tpmutil.Handle, *respo
 	var keyHandle tpmutil.Handle
 	var ra responseAuth
 	out := []interface{}{&keyHandle, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordLoadKey2, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdLoadKey2, in, out)
 	if err != nil {
 		return 0, nil, 0, err
 	}
@@ -169,7 +267,7 @@ func getPubKey(rw io.ReadWriter, keyHandle tpmutil.Handle, ca *commandAuth) (*pu
 	var pk pubKey
 	var ra responseAuth
 	out := []interface{}{&pk, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordGetPubKey, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdGetPubKey, in, out)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -177,16 +275,33 @@ func getPubKey(rw io.ReadWriter, keyHandle tpmutil.Handle, ca *commandAuth) (*pu
 	return &pk, &ra, ret, nil
 }
 
+// getPubKeyNoAuth gets a public key from the TPM without authorization, which
+// the TPM only allows for keys whose public key can be read without their usage
+// auth.
+func getPubKeyNoAuth(rw io.ReadWriter, keyHandle tpmutil.Handle) (*pubKey, error) {
+	var pk pubKey
+	if _, err := submitTPMRequest(rw, TagRQUCommand, OrdGetPubKey, []interface{}{keyHandle}, []interface{}{&pk}); err != nil {
+		return nil, err
+	}
+	return &pk, nil
+}
+
 // getCapability reads the requested capability and sub-capability from the TPM
 func getCapability(rw io.ReadWriter, cap, subcap uint32) ([]byte, error) {
 	subCapBytes, err := tpmutil.Pack(subcap)
 	if err != nil {
 		return nil, err
 	}
+	return getCapabilityBytes(rw, cap, subCapBytes)
+}
+
+// getCapabilityBytes is like getCapability, for capabilities whose subCap
+// isn't a 4-byte value.
+func getCapabilityBytes(rw io.ReadWriter, cap uint32, subCapBytes []byte) ([]byte, error) {
 	var b tpmutil.U32Bytes
 	in := []interface{}{cap, tpmutil.U32Bytes(subCapBytes)}
 	out := []interface{}{&b}
-	if _, err := submitTPMRequest(rw, tagRQUCommand, ordGetCapability, in, out); err != nil {
+	if _, err := submitTPMRequest(rw, TagRQUCommand, OrdGetCapability, in, out); err != nil {
 		return nil, err
 	}
 	return b, nil
@@ -200,7 +315,7 @@ func nvDefineSpace(rw io.ReadWriter, nvData NVDataPublic, enc Digest, ca *comman
 		in = append(in, ca)
 	}
 	out := []interface{}{&ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordNVDefineSpace, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdNVDefineSpace, in, out)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -221,11 +336,11 @@ func nvReadValue(rw io.ReadWriter, index, offset, len uint32, ca *commandAuth) (
 	// Auth is needed
 	if ca != nil {
 		in = append(in, ca)
-		out = append(out, ra)
-		ret, err = submitTPMRequest(rw, tagRQUAuth1Command, ordNVReadValue, in, out)
+		out = append(out, &ra)
+		ret, err = submitTPMRequest(rw, TagRQUAuth1Command, OrdNVReadValue, in, out)
 	} else {
 		// Auth is not needed
-		ret, err = submitTPMRequest(rw, tagRQUCommand, ordNVReadValue, in, out)
+		ret, err = submitTPMRequest(rw, TagRQUCommand, OrdNVReadValue, in, out)
 	}
 	if err != nil {
 		return nil, nil, 0, err
@@ -241,7 +356,7 @@ func nvReadValueAuth(rw io.ReadWriter, index, offset, len uint32, ca *commandAut
 	var ra responseAuth
 	in := []interface{}{index, offset, len, ca}
 	out := []interface{}{&b, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordNVReadValueAuth, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdNVReadValueAuth, in, out)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -250,35 +365,37 @@ func nvReadValueAuth(rw io.ReadWriter, index, offset, len uint32, ca *commandAut
 
 // nvWriteValue writes to the NVRAM
 // If TPM isn't locked, no authentication is needed.
+// TPM_NV_WriteValue returns no parameters, so there is only the response auth,
+// which is nil without ca.
 // See TPM-Main-Part-3-Commands-20.2
-func nvWriteValue(rw io.ReadWriter, index, offset, len uint32, data []byte, ca *commandAuth) ([]byte, *responseAuth, uint32, error) {
-	var b tpmutil.U32Bytes
-	var ra responseAuth
+func nvWriteValue(rw io.ReadWriter, index, offset, len uint32, data []byte, ca *commandAuth) (*responseAuth, uint32, error) {
 	in := []interface{}{index, offset, len, data}
-	if ca != nil {
-		in = append(in, ca)
+	if ca == nil {
+		ret, err := submitTPMRequest(rw, TagRQUCommand, OrdNVWriteValue, in, nil)
+		return nil, ret, err
 	}
-	out := []interface{}{&b, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordNVWriteValue, in, out)
+	var ra responseAuth
+	in = append(in, ca)
+	out := []interface{}{&ra}
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdNVWriteValue, in, out)
 	if err != nil {
-		return nil, nil, 0, err
+		return nil, 0, err
 	}
-	return b, &ra, ret, nil
+	return &ra, ret, nil
 }
 
 // nvWriteValue writes to the NVRAM
 // If TPM isn't locked, no authentication is needed.
 // See TPM-Main-Part-3-Commands-20.3
-func nvWriteValueAuth(rw io.ReadWriter, index, offset, len uint32, data []byte, ca *commandAuth) ([]byte, *responseAuth, uint32, error) {
-	var b tpmutil.U32Bytes
+func nvWriteValueAuth(rw io.ReadWriter, index, offset, len uint32, data []byte, ca *commandAuth) (*responseAuth, uint32, error) {
 	var ra responseAuth
 	in := []interface{}{index, offset, len, data, ca}
-	out := []interface{}{&b, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordNVWriteValueAuth, in, out)
+	out := []interface{}{&ra}
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdNVWriteValueAuth, in, out)
 	if err != nil {
-		return nil, nil, 0, err
+		return nil, 0, err
 	}
-	return b, &ra, ret, nil
+	return &ra, ret, nil
 }
 
 // quote2 signs arbitrary data under a given set of PCRs and using a key
@@ -294,7 +411,7 @@ func quote2(rw io.ReadWriter, keyHandle tpmutil.Handle, hash [20]byte, pcrs *pcr
 	var sig tpmutil.U32Bytes
 	var ra responseAuth
 	out := []interface{}{&pcrShort, &capBytes, &sig, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordQuote2, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdQuote2, in, out)
 	if err != nil {
 		return nil, nil, nil, nil, nil, 0, err
 	}
@@ -320,7 +437,7 @@ func quote(rw io.ReadWriter, keyHandle tpmutil.Handle, hash [20]byte, pcrs *pcrS
 	var sig tpmutil.U32Bytes
 	var ra responseAuth
 	out := []interface{}{&pcrc, &sig, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordQuote, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdQuote, in, out)
 	if err != nil {
 		return nil, nil, nil, 0, err
 	}
@@ -337,7 +454,7 @@ func makeIdentity(rw io.ReadWriter, encAuth Digest, idDigest Digest, k *key, ca1
 	var ra1 responseAuth
 	var ra2 responseAuth
 	out := []interface{}{&aik, &sig, &ra1, &ra2}
-	ret, err := submitTPMRequest(rw, tagRQUAuth2Command, ordMakeIdentity, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth2Command, OrdMakeIdentity, in, out)
 	if err != nil {
 		return nil, nil, nil, nil, 0, err
 	}
@@ -353,7 +470,7 @@ func activateIdentity(rw io.ReadWriter, keyHandle tpmutil.Handle, blob tpmutil.U
 	var ra1 responseAuth
 	var ra2 responseAuth
 	out := []interface{}{&symkey, &ra1, &ra2}
-	ret, err := submitTPMRequest(rw, tagRQUAuth2Command, ordActivateIdentity, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth2Command, OrdActivateIdentity, in, out)
 	if err != nil {
 		return nil, nil, nil, 0, err
 	}
@@ -367,7 +484,33 @@ func resetLockValue(rw io.ReadWriter, ca *commandAuth) (*responseAuth, uint32, e
 	in := []interface{}{ca}
 	var ra responseAuth
 	out := []interface{}{&ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordResetLockValue, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdResetLockValue, in, out)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &ra, ret, nil
+}
+
+// ownerSetDisable sets or clears the disable flag of the TPM, using owner auth.
+func ownerSetDisable(rw io.ReadWriter, disableState byte, ca *commandAuth) (*responseAuth, uint32, error) {
+	in := []interface{}{disableState, ca}
+	var ra responseAuth
+	out := []interface{}{&ra}
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdOwnerSetDisable, in, out)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &ra, ret, nil
+}
+
+// dirWriteAuth writes a DIR, using owner auth.
+func dirWriteAuth(rw io.ReadWriter, dirIndex uint32, contents Digest, ca *commandAuth) (*responseAuth, uint32, error) {
+	in := []interface{}{dirIndex, contents, ca}
+	var ra responseAuth
+	out := []interface{}{&ra}
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdDirWriteAuth, in, out)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -375,6 +518,13 @@ func resetLockValue(rw io.ReadWriter, ca *commandAuth) (*responseAuth, uint32, e
 	return &ra, ret, nil
 }
 
+// dirRead reads a DIR. It needs no auth.
+func dirRead(rw io.ReadWriter, dirIndex uint32) (Digest, error) {
+	var contents Digest
+	_, err := submitTPMRequest(rw, TagRQUCommand, OrdDirRead, []interface{}{dirIndex}, []interface{}{&contents})
+	return contents, err
+}
+
 // ownerReadInternalPub uses owner auth and OSAP to read either the endorsement
 // key (using khEK) or the SRK (using khSRK).
 func ownerReadInternalPub(rw io.ReadWriter, kh tpmutil.Handle, ca *commandAuth) (*pubKey, *responseAuth, uint32, error) {
@@ -382,7 +532,7 @@ func ownerReadInternalPub(rw io.ReadWriter, kh tpmutil.Handle, ca *commandAuth)
 	var pk pubKey
 	var ra responseAuth
 	out := []interface{}{&pk, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordOwnerReadInternalPub, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdOwnerReadInternalPub, in, out)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -399,7 +549,7 @@ func readPubEK(rw io.ReadWriter, n Nonce) (*pubKey, Digest, uint32, error) {
 	var pk pubKey
 	var d Digest
 	out := []interface{}{&pk, &d}
-	ret, err := submitTPMRequest(rw, tagRQUCommand, ordReadPubEK, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUCommand, OrdReadPubEK, in, out)
 	if err != nil {
 		return nil, d, 0, err
 	}
@@ -413,7 +563,7 @@ func ownerClear(rw io.ReadWriter, ca *commandAuth) (*responseAuth, uint32, error
 	in := []interface{}{ca}
 	var ra responseAuth
 	out := []interface{}{&ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordOwnerClear, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdOwnerClear, in, out)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -430,7 +580,7 @@ func takeOwnership(rw io.ReadWriter, encOwnerAuth tpmutil.U32Bytes, encSRKAuth t
 	var k key
 	var ra responseAuth
 	out := []interface{}{&k, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordTakeOwnership, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdTakeOwnership, in, out)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -444,7 +594,7 @@ func createWrapKey(rw io.ReadWriter, encUsageAuth Digest, encMigrationAuth Diges
 	var k key
 	var ra responseAuth
 	out := []interface{}{&k, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordCreateWrapKey, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdCreateWrapKey, in, out)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -457,7 +607,7 @@ func sign(rw io.ReadWriter, keyHandle tpmutil.Handle, data tpmutil.U32Bytes, ca
 	var signature tpmutil.U32Bytes
 	var ra responseAuth
 	out := []interface{}{&signature, &ra}
-	ret, err := submitTPMRequest(rw, tagRQUAuth1Command, ordSign, in, out)
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdSign, in, out)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -465,10 +615,52 @@ func sign(rw io.ReadWriter, keyHandle tpmutil.Handle, data tpmutil.U32Bytes, ca
 	return signature, &ra, ret, nil
 }
 
+// unbind decrypts data that was bound to the key at keyHandle.
+func unbind(rw io.ReadWriter, keyHandle tpmutil.Handle, inData tpmutil.U32Bytes, ca *commandAuth) ([]byte, *responseAuth, uint32, error) {
+	in := []interface{}{keyHandle, inData, ca}
+	var outData tpmutil.U32Bytes
+	var ra responseAuth
+	out := []interface{}{&outData, &ra}
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdUnBind, in, out)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return outData, &ra, ret, nil
+}
+
 func pcrReset(rw io.ReadWriter, pcrs *pcrSelection) error {
-	_, err := submitTPMRequest(rw, tagRQUCommand, ordPcrReset, []interface{}{pcrs}, nil)
+	_, err := submitTPMRequest(rw, TagRQUCommand, OrdPcrReset, []interface{}{pcrs}, nil)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// setTempDeactivated deactivates the TPM until the next startup. If ca is nil,
+// the command is sent without auth and needs physical presence; otherwise ca
+// carries operator auth.
+func setTempDeactivated(rw io.ReadWriter, ca *commandAuth) (*responseAuth, uint32, error) {
+	if ca == nil {
+		ret, err := submitTPMRequest(rw, TagRQUCommand, OrdSetTempDeactivated, nil, nil)
+		return nil, ret, err
+	}
+
+	in := []interface{}{ca}
+	var ra responseAuth
+	out := []interface{}{&ra}
+	ret, err := submitTPMRequest(rw, TagRQUAuth1Command, OrdSetTempDeactivated, in, out)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &ra, ret, nil
+}
+
+// physicalPresence sends a TSC_PhysicalPresence command with the given
+// physical presence bits.
+func physicalPresence(rw io.ReadWriter, pp uint16) error {
+	in := []interface{}{pp}
+	_, err := submitTPMRequest(rw, TagRQUCommand, OrdPhysicalPresence, in, nil)
+	return err
+}
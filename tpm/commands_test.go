@@ -0,0 +1,142 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// cannedTPM is an io.ReadWriter that discards every command written to it
+// and answers with a fixed response.
+type cannedTPM struct {
+	resp []byte
+}
+
+func (c *cannedTPM) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *cannedTPM) Read(p []byte) (int, error) {
+	return copy(p, c.resp), nil
+}
+
+func newCannedTPM(t *testing.T, tag uint16, res uint32, body []byte) *cannedTPM {
+	t.Helper()
+	resp, err := tpmutil.Pack(responseHeader{tag, uint32(commandHeaderSize + len(body)), res})
+	if err != nil {
+		t.Fatal("Couldn't pack the response header:", err)
+	}
+	return &cannedTPM{append(resp, body...)}
+}
+
+func TestSubmitTPMRequestAuthError(t *testing.T) {
+	// An auth failure comes back with a plain response tag and no responseAuth,
+	// even though ResetLockValue sends a TagRQUAuth1Command.
+	rw := newCannedTPM(t, TagRSPCommand, uint32(errAuthFail), nil)
+	_, _, err := resetLockValue(rw, &commandAuth{})
+	if err != tpmError(errAuthFail) {
+		t.Fatalf("resetLockValue returned error %v, want %v", err, tpmError(errAuthFail))
+	}
+}
+
+func TestSubmitTPMRequestTagMismatch(t *testing.T) {
+	// A successful response that claims to have no auth section can't be
+	// parsed as an auth1 response.
+	rw := newCannedTPM(t, TagRSPCommand, 0, bytes.Repeat([]byte{0xff}, 41))
+	if _, _, err := resetLockValue(rw, &commandAuth{}); err == nil {
+		t.Fatal("resetLockValue accepted a response with the wrong tag")
+	}
+}
+
+func TestSubmitTPMRequestSuccess(t *testing.T) {
+	rw := newCannedTPM(t, TagRSPAuth1Command, 0, bytes.Repeat([]byte{0x01}, 41))
+	ra, ret, err := resetLockValue(rw, &commandAuth{})
+	if err != nil {
+		t.Fatal("resetLockValue failed on a well-formed response:", err)
+	}
+	if ret != 0 {
+		t.Fatalf("resetLockValue returned %d, want 0", ret)
+	}
+	if ra.ContSession != 0x01 {
+		t.Fatalf("resetLockValue returned ContSession %d, want 1", ra.ContSession)
+	}
+}
+
+func TestSubmitTPMRequestLogs(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *slog.Logger) { Logger = l }(Logger)
+	Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	rw := newCannedTPM(t, TagRSPAuth1Command, 0, bytes.Repeat([]byte{0x01}, 41))
+	if _, _, err := resetLockValue(rw, &commandAuth{}); err != nil {
+		t.Fatal("resetLockValue failed on a well-formed response:", err)
+	}
+	for _, want := range []string{"ordinal=TPM_ResetLockValue", "result=0"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log output %q doesn't contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestOrdinalString(t *testing.T) {
+	for _, tt := range []struct {
+		ord  Ordinal
+		want string
+	}{
+		{OrdOIAP, "TPM_OIAP"},
+		{OrdSeal, "TPM_Seal"},
+		{OrdQuote2, "TPM_Quote2"},
+		{OrdPcrReset, "TPM_PCR_Reset"},
+		{OrdNVReadValueAuth, "TPM_NV_ReadValueAuth"},
+		{Ordinal(0xFFFF), "Ordinal(0x0000ffff)"},
+	} {
+		if got := tt.ord.String(); got != tt.want {
+			t.Errorf("Ordinal(0x%x).String() = %q, want %q", uint32(tt.ord), got, tt.want)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	want, err := GetRandom(testtpm.NewFake(), 32)
+	if err != nil {
+		t.Fatal("GetRandom failed:", err)
+	}
+
+	var got tpmutil.U32Bytes
+	ret, err := RunCommand(testtpm.NewFake(), TagRQUCommand, OrdGetRandom, []interface{}{uint32(32)}, []interface{}{&got})
+	if err != nil {
+		t.Fatal("RunCommand for TPM_GetRandom failed:", err)
+	}
+	if ret != 0 {
+		t.Fatalf("RunCommand returned %d, want 0", ret)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("RunCommand for TPM_GetRandom returned % x, want % x", got, want)
+	}
+
+	ret, err = RunCommand(testtpm.NewFake(), TagRQUCommand, Ordinal(0xFFFF), nil, nil)
+	if err != tpmError(errBadOrdinal) {
+		t.Fatalf("RunCommand for an unknown ordinal returned %v, want %v", err, tpmError(errBadOrdinal))
+	}
+	if ret != uint32(errBadOrdinal) {
+		t.Fatalf("RunCommand for an unknown ordinal returned %d, want %d", ret, errBadOrdinal)
+	}
+}
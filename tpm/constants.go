@@ -18,57 +18,142 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/google/go-tpm/tpm/verify"
 	"github.com/google/go-tpm/tpmutil"
 )
 
-// Supported TPM commands.
+// Structure tags.
 const (
-	tagPCRInfoLong     uint16 = 0x06
-	tagNVAttributes    uint16 = 0x0017
-	tagNVDataPublic    uint16 = 0x0018
-	tagRQUCommand      uint16 = 0x00C1
-	tagRQUAuth1Command uint16 = 0x00C2
-	tagRQUAuth2Command uint16 = 0x00C3
-	tagRSPCommand      uint16 = 0x00C4
-	tagRSPAuth1Command uint16 = 0x00C5
-	tagRSPAuth2Command uint16 = 0x00C6
+	tagPCRInfoLong    uint16 = 0x06
+	tagStoredData12   uint16 = 0x0016
+	tagNVAttributes   uint16 = 0x0017
+	tagNVDataPublic   uint16 = 0x0018
+	tagDAInfo         uint16 = 0x0037
+	tagDAInfoLimited  uint16 = 0x0038
+	tagKey12          uint16 = 0x0028
+	tagCapVersionInfo uint16 = 0x0030
 )
 
+// Command and response tags, which start every request to and response from
+// the TPM.
+const (
+	TagRQUCommand      uint16 = 0x00C1
+	TagRQUAuth1Command uint16 = 0x00C2
+	TagRQUAuth2Command uint16 = 0x00C3
+	TagRSPCommand      uint16 = 0x00C4
+	TagRSPAuth1Command uint16 = 0x00C5
+	TagRSPAuth2Command uint16 = 0x00C6
+)
+
+// An Ordinal identifies a TPM command.
+type Ordinal uint32
+
 // Supported TPM operations.
 const (
-	ordOIAP                     uint32 = 0x0000000A
-	ordOSAP                     uint32 = 0x0000000B
-	ordTakeOwnership            uint32 = 0x0000000D
-	ordExtend                   uint32 = 0x00000014
-	ordPCRRead                  uint32 = 0x00000015
-	ordQuote                    uint32 = 0x00000016
-	ordSeal                     uint32 = 0x00000017
-	ordUnseal                   uint32 = 0x00000018
-	ordCreateWrapKey            uint32 = 0x0000001F
-	ordGetPubKey                uint32 = 0x00000021
-	ordCreateMigrationBlob      uint32 = 0x00000028
-	ordAuthorizeMigrationKey    uint32 = 0x0000002b
-	ordSign                     uint32 = 0x0000003C
-	ordQuote2                   uint32 = 0x0000003E
-	ordResetLockValue           uint32 = 0x00000040
-	ordLoadKey2                 uint32 = 0x00000041
-	ordGetRandom                uint32 = 0x00000046
-	ordOwnerClear               uint32 = 0x0000005B
-	ordForceClear               uint32 = 0x0000005D
-	ordGetCapability            uint32 = 0x00000065
-	ordCreateEndorsementKeyPair uint32 = 0x00000078
-	ordMakeIdentity             uint32 = 0x00000079
-	ordActivateIdentity         uint32 = 0x0000007A
-	ordReadPubEK                uint32 = 0x0000007C
-	ordOwnerReadInternalPub     uint32 = 0x00000081
-	ordStartup                  uint32 = 0x00000099
-	ordFlushSpecific            uint32 = 0x000000BA
-	ordNVDefineSpace            uint32 = 0x000000CC
-	ordPcrReset                 uint32 = 0x000000C8
-	ordNVWriteValue             uint32 = 0x000000CD
-	ordNVWriteValueAuth         uint32 = 0x000000CE
-	ordNVReadValue              uint32 = 0x000000CF
-	ordNVReadValueAuth          uint32 = 0x000000D0
+	OrdOIAP                     Ordinal = 0x0000000A
+	OrdOSAP                     Ordinal = 0x0000000B
+	OrdTakeOwnership            Ordinal = 0x0000000D
+	OrdExtend                   Ordinal = 0x00000014
+	OrdPCRRead                  Ordinal = 0x00000015
+	OrdQuote                    Ordinal = 0x00000016
+	OrdSeal                     Ordinal = 0x00000017
+	OrdUnseal                   Ordinal = 0x00000018
+	OrdDirWriteAuth             Ordinal = 0x00000019
+	OrdDirRead                  Ordinal = 0x0000001A
+	OrdUnBind                   Ordinal = 0x0000001E
+	OrdCreateWrapKey            Ordinal = 0x0000001F
+	OrdGetPubKey                Ordinal = 0x00000021
+	OrdCreateMigrationBlob      Ordinal = 0x00000028
+	OrdConvertMigrationBlob     Ordinal = 0x0000002A
+	OrdAuthorizeMigrationKey    Ordinal = 0x0000002b
+	OrdSign                     Ordinal = 0x0000003C
+	OrdQuote2                   Ordinal = 0x0000003E
+	OrdResetLockValue           Ordinal = 0x00000040
+	OrdLoadKey2                 Ordinal = 0x00000041
+	OrdGetRandom                Ordinal = 0x00000046
+	OrdReset                    Ordinal = 0x0000005A
+	OrdOwnerClear               Ordinal = 0x0000005B
+	OrdForceClear               Ordinal = 0x0000005D
+	OrdGetCapability            Ordinal = 0x00000065
+	OrdOwnerSetDisable          Ordinal = 0x0000006E
+	OrdSetTempDeactivated       Ordinal = 0x00000073
+	OrdCreateEndorsementKeyPair Ordinal = 0x00000078
+	OrdMakeIdentity             Ordinal = 0x00000079
+	OrdActivateIdentity         Ordinal = 0x0000007A
+	OrdReadPubEK                Ordinal = 0x0000007C
+	OrdOwnerReadInternalPub     Ordinal = 0x00000081
+	OrdStartup                  Ordinal = 0x00000099
+	OrdFlushSpecific            Ordinal = 0x000000BA
+	OrdNVDefineSpace            Ordinal = 0x000000CC
+	OrdPcrReset                 Ordinal = 0x000000C8
+	OrdNVWriteValue             Ordinal = 0x000000CD
+	OrdNVWriteValueAuth         Ordinal = 0x000000CE
+	OrdNVReadValue              Ordinal = 0x000000CF
+	OrdNVReadValueAuth          Ordinal = 0x000000D0
+	OrdPhysicalPresence         Ordinal = 0x4000000A
+)
+
+// ordinalNames maps the supported ordinals to the names of their commands in
+// the TPM specification.
+var ordinalNames = map[Ordinal]string{
+	OrdOIAP:                     "TPM_OIAP",
+	OrdOSAP:                     "TPM_OSAP",
+	OrdTakeOwnership:            "TPM_TakeOwnership",
+	OrdExtend:                   "TPM_Extend",
+	OrdPCRRead:                  "TPM_PCRRead",
+	OrdQuote:                    "TPM_Quote",
+	OrdSeal:                     "TPM_Seal",
+	OrdUnseal:                   "TPM_Unseal",
+	OrdDirWriteAuth:             "TPM_DirWriteAuth",
+	OrdDirRead:                  "TPM_DirRead",
+	OrdUnBind:                   "TPM_UnBind",
+	OrdCreateWrapKey:            "TPM_CreateWrapKey",
+	OrdGetPubKey:                "TPM_GetPubKey",
+	OrdCreateMigrationBlob:      "TPM_CreateMigrationBlob",
+	OrdConvertMigrationBlob:     "TPM_ConvertMigrationBlob",
+	OrdAuthorizeMigrationKey:    "TPM_AuthorizeMigrationKey",
+	OrdSign:                     "TPM_Sign",
+	OrdQuote2:                   "TPM_Quote2",
+	OrdResetLockValue:           "TPM_ResetLockValue",
+	OrdLoadKey2:                 "TPM_LoadKey2",
+	OrdGetRandom:                "TPM_GetRandom",
+	OrdReset:                    "TPM_Reset",
+	OrdOwnerClear:               "TPM_OwnerClear",
+	OrdForceClear:               "TPM_ForceClear",
+	OrdGetCapability:            "TPM_GetCapability",
+	OrdOwnerSetDisable:          "TPM_OwnerSetDisable",
+	OrdSetTempDeactivated:       "TPM_SetTempDeactivated",
+	OrdCreateEndorsementKeyPair: "TPM_CreateEndorsementKeyPair",
+	OrdMakeIdentity:             "TPM_MakeIdentity",
+	OrdActivateIdentity:         "TPM_ActivateIdentity",
+	OrdReadPubEK:                "TPM_ReadPubEK",
+	OrdOwnerReadInternalPub:     "TPM_OwnerReadInternalPub",
+	OrdStartup:                  "TPM_Startup",
+	OrdFlushSpecific:            "TPM_FlushSpecific",
+	OrdNVDefineSpace:            "TPM_NV_DefineSpace",
+	OrdPcrReset:                 "TPM_PCR_Reset",
+	OrdNVWriteValue:             "TPM_NV_WriteValue",
+	OrdNVWriteValueAuth:         "TPM_NV_WriteValueAuth",
+	OrdNVReadValue:              "TPM_NV_ReadValue",
+	OrdNVReadValueAuth:          "TPM_NV_ReadValueAuth",
+	OrdPhysicalPresence:         "TSC_PhysicalPresence",
+}
+
+// String returns the name of the command in the TPM specification, like
+// "TPM_Seal", or the ordinal in hex if the package doesn't support it.
+func (o Ordinal) String() string {
+	if name, ok := ordinalNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("Ordinal(0x%08x)", uint32(o))
+}
+
+// Physical presence bits for TSC_PhysicalPresence.
+const (
+	ppPresent      uint16 = 0x0008
+	ppCMDEnable    uint16 = 0x0020
+	ppLifetimeLock uint16 = 0x0080
+	ppCMDDisable   uint16 = 0x0100
 )
 
 // Capability types.
@@ -79,13 +164,27 @@ const (
 	CapNVList   uint32 = 0x0000000D
 	CapNVIndex  uint32 = 0x00000011
 	CapHandle   uint32 = 0x00000014
-	CapVersion  uint32 = 0x0000001A
+	CapDALogic  uint32 = 0x00000019
+	CapVersion  uint32 = 0x0000001A // TPM_CAP_VERSION_VAL
+
+	// CapVersion11 is TPM_CAP_VERSION, the version capability of a TPM
+	// 1.1b. A TPM 1.2 always reports version 1.1.0.0 for it.
+	CapVersion11 uint32 = 0x00000006
 )
 
 // SubCapabilities
 const (
 	SubCapPropManufacturer uint32 = 0x00000103
+	SubCapPropKeys         uint32 = 0x00000104
+	SubCapPropAuthSess     uint32 = 0x0000010A
+	SubCapPropTranSess     uint32 = 0x0000010B
+	SubCapPropMaxAuthSess  uint32 = 0x0000010D
+	SubCapPropMaxTranSess  uint32 = 0x0000010E
+	SubCapPropMaxKeys      uint32 = 0x00000110
+	SubCapPropContext      uint32 = 0x00000112
+	SubCapPropMaxContext   uint32 = 0x00000113
 	SubCapFlagPermanent    uint32 = 0x00000108
+	SubCapFlagVolatile     uint32 = 0x00000109
 )
 
 // Permission type
@@ -157,6 +256,16 @@ const (
 	etRevoke
 )
 
+// EntityType is the type of entity an OSAP session is opened for.
+type EntityType uint16
+
+// Entity types that can be passed to OpenOSAPSession.
+const (
+	EntityKeyHandle EntityType = EntityType(etKeyHandle)
+	EntityOwner     EntityType = EntityType(etOwner)
+	EntitySRK       EntityType = EntityType(etSRK)
+)
+
 // Resource types.
 const (
 	_ uint32 = iota
@@ -293,32 +402,188 @@ const (
 	keyMigrate    uint16 = 0x0016
 )
 
+// KeyUsage is the type of key created by CreateWrapKeyWithSchemes.
+type KeyUsage uint16
+
+// Key usages that can be passed to CreateWrapKeyWithSchemes.
+const (
+	KeyUsageSigning KeyUsage = KeyUsage(keySigning)
+	KeyUsageStorage KeyUsage = KeyUsage(keyStorage)
+	KeyUsageBind    KeyUsage = KeyUsage(keyBind)
+	KeyUsageLegacy  KeyUsage = KeyUsage(keyLegacy)
+)
+
+// Key usages that the TPM creates with other commands, such as MakeIdentity,
+// and that InspectKeyBlob may report.
+const (
+	KeyUsageIdentity   KeyUsage = KeyUsage(keyIdentity)
+	KeyUsageAuthChange KeyUsage = KeyUsage(keyAuthChange)
+	KeyUsageMigrate    KeyUsage = KeyUsage(keyMigrate)
+)
+
+var keyUsageNames = map[KeyUsage]string{
+	KeyUsageSigning:    "TPM_KEY_SIGNING",
+	KeyUsageStorage:    "TPM_KEY_STORAGE",
+	KeyUsageIdentity:   "TPM_KEY_IDENTITY",
+	KeyUsageAuthChange: "TPM_KEY_AUTHCHANGE",
+	KeyUsageBind:       "TPM_KEY_BIND",
+	KeyUsageLegacy:     "TPM_KEY_LEGACY",
+	KeyUsageMigrate:    "TPM_KEY_MIGRATE",
+}
+
+// String returns the TPM_KEY_USAGE name of the key usage.
+func (u KeyUsage) String() string {
+	if n, ok := keyUsageNames[u]; ok {
+		return n
+	}
+	return fmt.Sprintf("KeyUsage(0x%04x)", uint16(u))
+}
+
+// EncScheme is the encryption scheme of an RSA key.
+type EncScheme uint16
+
+// Encryption schemes that can be passed to CreateWrapKeyWithSchemes.
+const (
+	EncSchemeNone              EncScheme = EncScheme(esNone)
+	EncSchemeRSAESPKCSv15      EncScheme = EncScheme(esRSAEsPKCSv15)
+	EncSchemeRSAESOAEPSHA1MGF1 EncScheme = EncScheme(esRSAEsOAEPSHA1MGF1)
+)
+
+var encSchemeNames = map[EncScheme]string{
+	EncSchemeNone:              "TPM_ES_NONE",
+	EncSchemeRSAESPKCSv15:      "TPM_ES_RSAESPKCSv15",
+	EncSchemeRSAESOAEPSHA1MGF1: "TPM_ES_RSAESOAEP_SHA1_MGF1",
+	EncScheme(esSymCTR):        "TPM_ES_SYM_CTR",
+	EncScheme(esSymOFB):        "TPM_ES_SYM_OFB",
+	EncScheme(esSymCBCPKCS5):   "TPM_ES_SYM_CBC_PKCS5PAD",
+}
+
+// String returns the TPM_ENC_SCHEME name of the encryption scheme.
+func (e EncScheme) String() string {
+	if n, ok := encSchemeNames[e]; ok {
+		return n
+	}
+	return fmt.Sprintf("EncScheme(0x%04x)", uint16(e))
+}
+
+// SigScheme is the signature scheme of an RSA key.
+type SigScheme = verify.SigScheme
+
+// Signature schemes. All but SigSchemeRSASSAPKCS1v15INFO can be passed to
+// CreateWrapKeyWithSchemes.
+const (
+	SigSchemeNone               = verify.SigSchemeNone
+	SigSchemeRSASSAPKCS1v15SHA1 = verify.SigSchemeRSASSAPKCS1v15SHA1
+	SigSchemeRSASSAPKCS1v15DER  = verify.SigSchemeRSASSAPKCS1v15DER
+	SigSchemeRSASSAPKCS1v15INFO = verify.SigSchemeRSASSAPKCS1v15INFO
+)
+
+// Payload types for TPM_BOUND_DATA.
+const (
+	ptBind byte = 0x02
+)
+
 const (
 	authNever       byte = 0x00
 	authAlways      byte = 0x01
 	authPrivUseOnly byte = 0x03
 )
 
+// AuthDataUsage represents TPM_AUTH_DATA_USAGE, which says when a key needs
+// its usage authorization.
+type AuthDataUsage byte
+
+// Values of AuthDataUsage.
+const (
+	AuthNever       AuthDataUsage = AuthDataUsage(authNever)
+	AuthAlways      AuthDataUsage = AuthDataUsage(authAlways)
+	AuthPrivUseOnly AuthDataUsage = AuthDataUsage(authPrivUseOnly)
+)
+
+var authDataUsageNames = map[AuthDataUsage]string{
+	AuthNever:       "TPM_AUTH_NEVER",
+	AuthAlways:      "TPM_AUTH_ALWAYS",
+	AuthPrivUseOnly: "TPM_AUTH_PRIV_USE_ONLY",
+}
+
+// String returns the TPM_AUTH_DATA_USAGE name of the value.
+func (a AuthDataUsage) String() string {
+	if n, ok := authDataUsageNames[a]; ok {
+		return n
+	}
+	return fmt.Sprintf("AuthDataUsage(0x%02x)", byte(a))
+}
+
 // KeyFlags represents TPM_KEY_FLAGS.
 type KeyFlags uint32
 
+// Key flags. A key that attestation relies on, like an AIK, must not be
+// migratable: a migratable key can be moved to a TPM, or into software, that
+// the verifier knows nothing about.
 const (
-	keyRedirection      KeyFlags = 0x00000001
-	keyMigratable       KeyFlags = 0x00000002
-	keyIsVolatile       KeyFlags = 0x00000004
-	keyPcrIgnoredOnRead KeyFlags = 0x00000008
-	keyMigrateAuthority KeyFlags = 0x00000010
+	// KeyFlagRedirection keys are used for output redirection.
+	KeyFlagRedirection KeyFlags = 0x00000001
+	// KeyFlagMigratable keys can be migrated to another TPM with their
+	// migration auth.
+	KeyFlagMigratable KeyFlags = 0x00000002
+	// KeyFlagVolatile keys are flushed by TPM_Startup(ST_CLEAR).
+	KeyFlagVolatile KeyFlags = 0x00000004
+	// KeyFlagPCRIgnoredOnRead keys don't check their PCR binding for
+	// commands that only read the key, like TPM_GetPubKey.
+	KeyFlagPCRIgnoredOnRead KeyFlags = 0x00000008
+	// KeyFlagMigrateAuthority keys are certified migratable keys, whose
+	// migration is controlled by a migration authority.
+	KeyFlagMigrateAuthority KeyFlags = 0x00000010
 )
 
+// Has reports whether all the flags in flag are set.
+func (f KeyFlags) Has(flag KeyFlags) bool {
+	return f&flag == flag
+}
+
+// keyFlagNames lists the key flags in the order that String prints them.
+var keyFlagNames = []struct {
+	flag KeyFlags
+	name string
+}{
+	{KeyFlagRedirection, "redirection"},
+	{KeyFlagMigratable, "migratable"},
+	{KeyFlagVolatile, "isVolatile"},
+	{KeyFlagPCRIgnoredOnRead, "pcrIgnoredOnRead"},
+	{KeyFlagMigrateAuthority, "migrateAuthority"},
+}
+
+// String returns the names of the flags that are set, separated by "|", along
+// with any unknown bits in hex.
+func (f KeyFlags) String() string {
+	var names []string
+	for _, n := range keyFlagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+			f &^= n.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(f)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
 // MigrationScheme represents TPM_MIGRATE_SCHEME.
 type MigrationScheme uint16
 
+// Migration schemes. MSRewrap produces a blob that the target TPM can load
+// directly; MSMigrate produces a blob that must be passed through
+// ConvertMigrationBlob on the target TPM before it can be loaded.
 const (
-	msMigrate         MigrationScheme = 0x0001
-	msRewrap          MigrationScheme = 0x0002
-	msMaint           MigrationScheme = 0x0003
-	msRestrictMigrate MigrationScheme = 0x0004
-	msRestrictApprove MigrationScheme = 0x0005
+	MSMigrate         MigrationScheme = 0x0001
+	MSRewrap          MigrationScheme = 0x0002
+	MSMaint           MigrationScheme = 0x0003
+	MSRestrictMigrate MigrationScheme = 0x0004
+	MSRestrictApprove MigrationScheme = 0x0005
 )
 
 // fixedQuote is the fixed constant string used in quoteInfo.
@@ -327,5 +592,8 @@ var fixedQuote = [4]byte{byte('Q'), byte('U'), byte('O'), byte('T')}
 // quoteVersion is the fixed version string for quoteInfo.
 const quoteVersion uint32 = 0x01010000
 
+// storedDataVersion is the version at the start of a TPM 1.1 TPM_STORED_DATA.
+const storedDataVersion uint32 = 0x01010000
+
 // oaepLabel is the label used for OEAP encryption in esRSAEsOAEPSHA1MGF1
 var oaepLabel = []byte{byte('T'), byte('C'), byte('P'), byte('A')}
@@ -0,0 +1,681 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/google/go-tpm/tpm/verify"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// A Device wraps an open TPM and keeps track of the auth sessions and keys
+// opened through it, so that Close can flush them and zero the cached auth
+// values of its keys before closing the TPM. A Device implements
+// io.ReadWriter, so it can be passed to every function in this package, but
+// only the methods that take a context.Context are safe for concurrent use:
+// they run one command at a time, and honor the deadline and cancellation of
+// the context. Only the most common commands have such a method; run any
+// other function of this package under a context with Run.
+type Device struct {
+	// OnCommand, if set, is called after each command sent through the
+	// Device, with the ordinal of the command, the time from sending the
+	// command to reading the whole response, and the error, if the command
+	// couldn't be sent or read or the TPM returned an error code. It lets
+	// callers export per-ordinal latency metrics, since some commands, like
+	// key creation and self-tests, can take seconds. It must not use the
+	// Device.
+	OnCommand func(ord Ordinal, dur time.Duration, err error)
+
+	// DefaultParent, if set, is the handle of the loaded storage key that
+	// Seal, Reseal, SealToFutureState and Unseal seal and unseal under when
+	// they're passed the Device, in place of the SRK. Their srkAuth is then
+	// the usage auth of that key. It's for virtual TPMs and test setups
+	// that treat another key as the root of their hierarchy. MakeIdentity
+	// always uses the SRK, since the TPM wraps every AIK with it. The seal
+	// functions still assume a 2048-bit parent for MaxSealSize.
+	DefaultParent tpmutil.Handle
+
+	// Reopen, if set, opens the TPM again, usually with OpenTPM and the path
+	// that the Device was opened with. Some TPMs that time out a command in
+	// firmware leave their device failing every later read and write with
+	// EIO until it's reopened. When sending a command fails with EIO, the
+	// Device closes the TPM, reopens it with Reopen and sends the command
+	// again. When reading the response fails with EIO, the command may
+	// already have run, so the Device only does the same for the commands
+	// in readOnlyOrdinals; for any other command, it returns the error and
+	// reopens the TPM before the next command. It retries at most once per
+	// command, and for no other error. After a command fails with
+	// ErrDesync, the Device also reopens the TPM before the next command.
+	Reopen func() (io.ReadWriteCloser, error)
+
+	// lock holds a value while a command runs through Run, so that waiting
+	// for it can be abandoned when a context is done.
+	lock    chan struct{}
+	rwc     io.ReadWriteCloser
+	lastOrd Ordinal
+	sent    time.Time
+	pending bool
+	keys    []*LoadedKey
+	closed  bool
+
+	// sessions is the set of auth sessions opened through the Device that
+	// may still be open. cmdAuths are the session handles in the auth
+	// sections of the command that was sent last, and flushed is the handle
+	// and resource type that it flushes if it's a FlushSpecific, so that the
+	// response can tell which of them are gone.
+	sessions    map[tpmutil.Handle]bool
+	cmdAuths    []tpmutil.Handle
+	flushed     tpmutil.Handle
+	flushedType uint32
+
+	// cmd is a copy of the command that was sent last, kept while Reopen
+	// is set so that it can be sent again after reopening the TPM, and
+	// reopened reports whether the TPM has been reopened for it.
+	cmd      []byte
+	reopened bool
+
+	// resp collects the response to the command that was sent last until
+	// all of it has been read, since a transport may return it in pieces.
+	resp []byte
+
+	// desynced is set when a response didn't fit the command it was read
+	// for, or couldn't be read at all, so the TPM has to be reopened before
+	// the next command.
+	desynced bool
+
+	// allowDestructive lets the commands in destructiveOrdinals through.
+	allowDestructive bool
+
+	// lostExtend is the last extend through PcrExtend that failed without
+	// an answer from the TPM, so that a retry of it can check whether it
+	// landed.
+	lostExtend *lostExtend
+}
+
+// A lostExtend is an extend whose outcome is unknown: the command may have
+// reached the TPM and run even though no response came back.
+type lostExtend struct {
+	pcrIndex uint32
+	digest   PCRValue
+	before   PCRValue
+}
+
+// destructiveOrdinals are the commands that a Device refuses to send unless
+// AllowDestructive(true) was called: they clear the owner and everything under
+// it, or reset PCRs that the platform measured into.
+var destructiveOrdinals = map[Ordinal]bool{
+	OrdOwnerClear: true,
+	OrdForceClear: true,
+	OrdPcrReset:   true,
+}
+
+// readOnlyOrdinals are the commands that change nothing in the TPM, so the
+// Device can send them again when reading their response fails with EIO.
+var readOnlyOrdinals = map[Ordinal]bool{
+	OrdPCRRead:       true,
+	OrdDirRead:       true,
+	OrdGetRandom:     true,
+	OrdGetCapability: true,
+	OrdReadPubEK:     true,
+}
+
+// NewDevice returns a Device that sends commands to rwc, which is usually the
+// result of OpenTPM. The Device takes ownership of rwc.
+func NewDevice(rwc io.ReadWriteCloser) *Device {
+	return &Device{lock: make(chan struct{}, 1), rwc: rwc}
+}
+
+// Write sends a command to the TPM.
+func (d *Device) Write(p []byte) (int, error) {
+	if d.closed {
+		return 0, errors.New("tpm: write to closed Device")
+	}
+	d.lastOrd = 0
+	if len(p) >= commandHeaderSize {
+		d.lastOrd = Ordinal(binary.BigEndian.Uint32(p[6:commandHeaderSize]))
+	}
+	if destructiveOrdinals[d.lastOrd] && !d.allowDestructive {
+		d.sent = time.Now()
+		err := fmt.Errorf("%w: refusing to run %v: call Device.AllowDestructive(true) first", ErrDestructive, d.lastOrd)
+		d.commandDone(err)
+		return 0, err
+	}
+	d.parseCommand(p)
+	if d.desynced {
+		if d.Reopen == nil {
+			return 0, fmt.Errorf("%w: reopen the TPM to send more commands", ErrDesync)
+		}
+		if err := d.reopen(); err != nil {
+			return 0, err
+		}
+		d.desynced = false
+	}
+	d.sent = time.Now()
+	d.reopened = false
+	d.resp = d.resp[:0]
+	if d.Reopen != nil {
+		d.cmd = append(d.cmd[:0], p...)
+	}
+	n, err := d.writeAll(p)
+	if d.shouldReopen(err) {
+		if err = d.reopen(); err == nil {
+			n, err = d.writeAll(p)
+		}
+	}
+	d.pending = err == nil
+	if err != nil {
+		d.commandDone(err)
+	}
+	return n, err
+}
+
+// parseCommand records the session handles of the auth sections of a command,
+// and the handle that a FlushSpecific flushes.
+func (d *Device) parseCommand(p []byte) {
+	d.cmdAuths = d.cmdAuths[:0]
+	d.flushed, d.flushedType = 0, 0
+	if len(p) < commandHeaderSize {
+		return
+	}
+	numAuths := 0
+	switch binary.BigEndian.Uint16(p) {
+	case TagRQUAuth1Command:
+		numAuths = 1
+	case TagRQUAuth2Command:
+		numAuths = 2
+	}
+	if len(p) >= commandHeaderSize+numAuths*commandAuthSize {
+		for i := numAuths; i > 0; i-- {
+			d.cmdAuths = append(d.cmdAuths, tpmutil.Handle(binary.BigEndian.Uint32(p[len(p)-i*commandAuthSize:])))
+		}
+	}
+	if d.lastOrd == OrdFlushSpecific && len(p) >= commandHeaderSize+8 {
+		d.flushed = tpmutil.Handle(binary.BigEndian.Uint32(p[commandHeaderSize:]))
+		d.flushedType = binary.BigEndian.Uint32(p[commandHeaderSize+4:])
+	}
+}
+
+// trackHandles updates the sessions and keys that Close flushes from a whole
+// response: it adds the sessions that OIAP and OSAP open, and removes the
+// sessions and keys that FlushSpecific flushes and the sessions that the
+// response auth sections close. A TPM ends every session that a failed command
+// used, so an error response removes all of them. TPMs reuse handles, so a
+// handle that is left behind after its session or key is gone could belong to
+// another one by the time Close flushes it.
+func (d *Device) trackHandles(resp []byte) {
+	if len(resp) < commandHeaderSize {
+		return
+	}
+	if binary.BigEndian.Uint32(resp[6:commandHeaderSize]) != uint32(tpmutil.RCSuccess) {
+		for _, h := range d.cmdAuths {
+			delete(d.sessions, h)
+		}
+		return
+	}
+	switch d.lastOrd {
+	case OrdOIAP, OrdOSAP:
+		if len(resp) >= commandHeaderSize+4 {
+			if d.sessions == nil {
+				d.sessions = make(map[tpmutil.Handle]bool)
+			}
+			d.sessions[tpmutil.Handle(binary.BigEndian.Uint32(resp[commandHeaderSize:]))] = true
+		}
+		return
+	case OrdFlushSpecific:
+		switch d.flushedType {
+		case rtAuth:
+			delete(d.sessions, d.flushed)
+		case rtKey:
+			d.forgetKey(d.flushed)
+		}
+		return
+	}
+	// Each response auth section ends with continueAuthSession and the
+	// 20-byte HMAC.
+	if len(d.cmdAuths) == 0 || len(resp) < commandHeaderSize+len(d.cmdAuths)*responseAuthSize {
+		return
+	}
+	if tag := binary.BigEndian.Uint16(resp); tag != TagRSPAuth1Command && tag != TagRSPAuth2Command {
+		return
+	}
+	for i, h := range d.cmdAuths {
+		cont := resp[len(resp)-(len(d.cmdAuths)-i)*responseAuthSize+len(Nonce{})]
+		if cont == 0 {
+			delete(d.sessions, h)
+		}
+	}
+}
+
+// forgetKey stops tracking the key loaded at h, which is no longer loaded, and
+// marks it closed.
+func (d *Device) forgetKey(h tpmutil.Handle) {
+	d.keys = slices.DeleteFunc(d.keys, func(lk *LoadedKey) bool {
+		if lk.Handle != h {
+			return false
+		}
+		lk.closed = true
+		zeroBytes(lk.auth)
+		return true
+	})
+}
+
+// writeAll writes all of a command here, so that a transport that takes it in
+// pieces doesn't make the rest of it look like another command.
+func (d *Device) writeAll(p []byte) (int, error) {
+	n := 0
+	var err error
+	for n < len(p) && err == nil {
+		var m int
+		m, err = d.rwc.Write(p[n:])
+		n += m
+		if m == 0 && err == nil {
+			err = io.ErrShortWrite
+		}
+	}
+	return n, err
+}
+
+// shouldReopen reports whether err leaves the TPM wedged until it's reopened,
+// and the Device can still reopen it for the current command.
+func (d *Device) shouldReopen(err error) bool {
+	return d.Reopen != nil && !d.reopened && errors.Is(err, syscall.EIO)
+}
+
+// reopen closes the TPM and opens it again with Reopen.
+func (d *Device) reopen() error {
+	d.reopened = true
+	d.rwc.Close()
+	rwc, err := d.Reopen()
+	if err != nil {
+		return fmt.Errorf("couldn't reopen the TPM: %w", err)
+	}
+	d.rwc = rwc
+	return nil
+}
+
+// Read reads a response from the TPM. It keeps track of the OIAP and OSAP
+// sessions that the TPM opens and closes, so that Close can flush the ones
+// that are still open.
+func (d *Device) Read(p []byte) (int, error) {
+	if d.closed {
+		return 0, errors.New("tpm: read from closed Device")
+	}
+	n, err := d.rwc.Read(p)
+	if d.pending && len(d.resp) == 0 && readOnlyOrdinals[d.lastOrd] && d.shouldReopen(err) {
+		if err = d.reopen(); err == nil {
+			if _, err = d.writeAll(d.cmd); err == nil {
+				n, err = d.rwc.Read(p)
+			}
+		}
+	}
+	if d.pending && errors.Is(err, syscall.EIO) {
+		// The TPM may or may not have run the command, and it won't answer
+		// until it's reopened.
+		d.desynced = true
+	}
+	if !d.pending {
+		return n, err
+	}
+	if err != nil {
+		d.pending = false
+		d.commandDone(err)
+		return n, err
+	}
+	d.resp = append(d.resp, p[:n]...)
+	if len(d.resp) < commandHeaderSize {
+		return n, err
+	}
+	size := int(binary.BigEndian.Uint32(d.resp[2:6]))
+	if len(d.resp) < size {
+		return n, err
+	}
+	resp := d.resp
+	if size >= commandHeaderSize {
+		resp = resp[:size]
+	}
+	d.pending = false
+	var rerr error
+	if rc := binary.BigEndian.Uint32(resp[6:commandHeaderSize]); rc != uint32(tpmutil.RCSuccess) {
+		rerr = tpmError(rc)
+	}
+	d.commandDone(rerr)
+	d.trackHandles(resp)
+	return n, err
+}
+
+// AllowDestructive sets whether the Device sends the commands that clear the
+// TPM or reset its PCRs: TPM_OwnerClear, TPM_ForceClear and TPM_PCR_Reset.
+// Until it's called with true, the Device refuses to send them, and they fail
+// with ErrDestructive, so that a script or a test can't wipe a TPM by accident.
+// It must not be called while a command runs through the Device.
+func (d *Device) AllowDestructive(allow bool) {
+	d.allowDestructive = allow
+}
+
+// sealParent returns the OSAP entity type and handle of the key that data is
+// sealed under when it's sealed through rw: the DefaultParent of a Device, or
+// the SRK.
+func sealParent(rw io.ReadWriter) (uint16, tpmutil.Handle) {
+	if d, ok := rw.(*Device); ok && d.DefaultParent != 0 && d.DefaultParent != khSRK {
+		return etKeyHandle, d.DefaultParent
+	}
+	return etSRK, khSRK
+}
+
+// commandDone reports the command that was sent last to OnCommand.
+func (d *Device) commandDone(err error) {
+	if d.OnCommand != nil {
+		d.OnCommand(d.lastOrd, time.Since(d.sent), err)
+	}
+}
+
+// LoadKey loads a key blob into the TPM like LoadKey and remembers the
+// returned LoadedKey, so that Close flushes it and zeroes its auth value.
+func (d *Device) LoadKey(keyBlob []byte, srkAuth []byte, keyAuth []byte) (*LoadedKey, error) {
+	lk, err := LoadKey(d, keyBlob, srkAuth, keyAuth)
+	if err != nil {
+		return nil, err
+	}
+	// A key that was flushed without going through the Device may have left
+	// its handle to this one.
+	d.forgetKey(lk.Handle)
+	d.keys = append(d.keys, lk)
+	return lk, nil
+}
+
+// Close flushes the keys loaded with LoadKey and zeroes their auth values,
+// flushes any auth sessions opened through the Device that are still open, and
+// then closes the TPM. Every step runs even if an earlier one fails, and all the
+// errors are returned together. Close waits for any command that is running
+// through Run to finish, even one that was abandoned. Calling Close more than
+// once is a no-op.
+func (d *Device) Close() error {
+	d.lock <- struct{}{}
+	defer func() { <-d.lock }()
+	if d.closed {
+		return nil
+	}
+
+	var errs []error
+	for _, lk := range d.keys {
+		if err := lk.Close(d.rwc); err != nil {
+			errs = append(errs, fmt.Errorf("couldn't flush key handle 0x%x: %v", lk.Handle, err))
+		}
+	}
+	d.keys = nil
+
+	// Most sessions are closed by the commands that opened them, so only
+	// flush the ones that the TPM still reports as open.
+	if len(d.sessions) > 0 {
+		open, err := getHandles(d.rwc, rtAuth)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, h := range open {
+			if !d.sessions[h] {
+				continue
+			}
+			if err := flushSpecific(d.rwc, h, rtAuth); err != nil {
+				errs = append(errs, fmt.Errorf("couldn't flush session handle 0x%x: %v", h, err))
+			}
+		}
+	}
+	d.sessions = nil
+
+	d.closed = true
+	if err := d.rwc.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Run calls f with the Device once no other command is running through Run,
+// so that any function in this package can run under a context. If ctx is done
+// while Run waits, it returns ctx.Err() without calling f. If ctx is done while
+// f runs, Run abandons f and returns ctx.Err(): there is no way to interrupt a
+// command that the TPM has already received, so f runs to completion in the
+// background and its result is discarded, and the Device stays busy until it
+// does.
+func (d *Device) Run(ctx context.Context, f func(rw io.ReadWriter) error) error {
+	select {
+	case d.lock <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// Both cases may have been ready, so check ctx again before starting.
+	if err := ctx.Err(); err != nil {
+		<-d.lock
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-d.lock }()
+		done <- f(d)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetRandom gets random bytes from the TPM like GetRandom, under ctx.
+func (d *Device) GetRandom(ctx context.Context, size uint32) ([]byte, error) {
+	var b []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		b, err = GetRandom(rw, size)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReadPCR reads a PCR like ReadPCR, under ctx.
+func (d *Device) ReadPCR(ctx context.Context, pcrIndex uint32) ([]byte, error) {
+	var v []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		v, err = ReadPCR(rw, pcrIndex)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// FetchPCRValues reads a sequence of PCRs like FetchPCRValues, under ctx.
+func (d *Device) FetchPCRValues(ctx context.Context, pcrVals []int) ([]byte, error) {
+	var v []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		v, err = FetchPCRValues(rw, pcrVals)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// PcrExtend extends a PCR like PcrExtend, under ctx. It's safe to retry: an
+// extend can reach the TPM and run even though its response is lost, and
+// extending again would measure the event twice. So PcrExtend reads the PCR
+// before extending it, and if the extend fails without an answer from the TPM,
+// a retry with the same PCR and digest reads the PCR again first. If the PCR
+// already holds the extended value, the retry returns it without extending. If
+// the PCR changed some other way, there's no telling whether the extend
+// landed, and the retry returns an error.
+func (d *Device) PcrExtend(ctx context.Context, pcrIndex uint32, pcr PCRValue) ([]byte, error) {
+	var v []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		v, err = d.extendOnce(rw, pcrIndex, pcr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// WatchPCRs reads the PCRs in pcrs every interval, and calls onChange for each
+// of them whose value has changed since the last reading, with its old and new
+// values. The first reading only records the values. Each PCR is read under
+// the Device's lock like ReadPCR, so other commands can run between the reads.
+// WatchPCRs runs until ctx is done, when it returns ctx.Err(), or until a read
+// fails, when it returns the error.
+func (d *Device) WatchPCRs(ctx context.Context, pcrs []int, interval time.Duration, onChange func(pcr int, old, new []byte)) error {
+	if interval <= 0 {
+		return fmt.Errorf("the interval must be positive, got %v", interval)
+	}
+	if _, err := verify.NewPCRMask(pcrs); err != nil {
+		return err
+	}
+	values := make([][]byte, len(pcrs))
+	for i, pcr := range pcrs {
+		v, err := d.ReadPCR(ctx, uint32(pcr))
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		for i, pcr := range pcrs {
+			v, err := d.ReadPCR(ctx, uint32(pcr))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(v, values[i]) {
+				old := values[i]
+				values[i] = v
+				onChange(pcr, old, v)
+			}
+		}
+	}
+}
+
+// extendOnce extends the PCR at pcrIndex with pcr, unless the lost extend
+// that it retries turns out to have landed.
+func (d *Device) extendOnce(rw io.ReadWriter, pcrIndex uint32, pcr PCRValue) ([]byte, error) {
+	lost := d.lostExtend
+	d.lostExtend = nil
+
+	cur, err := ReadPCR(rw, pcrIndex)
+	if err != nil {
+		d.lostExtend = lost
+		return nil, err
+	}
+	var before PCRValue
+	copy(before[:], cur)
+	if lost != nil && lost.pcrIndex == pcrIndex && lost.digest == pcr && before != lost.before {
+		if landed := sha1.Sum(append(lost.before[:], pcr[:]...)); before == landed {
+			return cur, nil
+		}
+		return nil, fmt.Errorf("PCR %d changed from %x to %x since an extend with %x whose response was lost, so it can't tell whether that extend landed", pcrIndex, lost.before, before, pcr)
+	}
+
+	v, err := PcrExtend(rw, pcrIndex, pcr)
+	var tpmErr tpmError
+	if err != nil && !errors.As(err, &tpmErr) {
+		d.lostExtend = &lostExtend{pcrIndex, pcr, before}
+	}
+	return v, err
+}
+
+// Seal seals data like Seal, under ctx.
+func (d *Device) Seal(ctx context.Context, loc Locality, pcrs []int, data []byte, srkAuth []byte) ([]byte, error) {
+	var sealed []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		sealed, err = Seal(rw, loc, pcrs, data, srkAuth)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// Unseal unseals data like Unseal, under ctx.
+func (d *Device) Unseal(ctx context.Context, sealed []byte, srkAuth []byte) ([]byte, error) {
+	var data []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		data, err = Unseal(rw, sealed, srkAuth)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Quote produces a quote like Quote, under ctx.
+func (d *Device) Quote(ctx context.Context, handle tpmutil.Handle, data []byte, pcrNums []int, aikAuth []byte) ([]byte, []byte, error) {
+	var sig, pcrs []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		sig, pcrs, err = Quote(rw, handle, data, pcrNums, aikAuth)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, pcrs, nil
+}
+
+// Quote2 produces a quote like Quote2, under ctx.
+func (d *Device) Quote2(ctx context.Context, handle tpmutil.Handle, data []byte, pcrVals []int, addVersion bool, aikAuth []byte) ([]byte, error) {
+	var sig []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		sig, err = Quote2(rw, handle, data, pcrVals, addVersion, aikAuth)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// Sign signs a digest like Sign, under ctx.
+func (d *Device) Sign(ctx context.Context, keyAuth []byte, keyHandle tpmutil.Handle, hash crypto.Hash, hashed []byte) ([]byte, error) {
+	var sig []byte
+	err := d.Run(ctx, func(rw io.ReadWriter) (err error) {
+		sig, err = Sign(rw, keyAuth, keyHandle, hash, hashed)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
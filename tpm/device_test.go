@@ -0,0 +1,779 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+func TestDeviceClose(t *testing.T) {
+	f := testtpm.NewFake()
+	d := NewDevice(f)
+
+	keyBlob := testKeyBlob(t, keySigning, authAlways, nil)
+	keyAuth := SHA1Auth([]byte("key auth"))
+	lk, err := d.LoadKey(keyBlob, wellKnownAuth(), keyAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the key:", err)
+	}
+	// Leave a session open, as a command that failed half-way might.
+	if _, err := oiap(d); err != nil {
+		t.Fatal("Couldn't open an OIAP session:", err)
+	}
+
+	keys, err := GetKeys(d)
+	if err != nil {
+		t.Fatal("Couldn't get the loaded keys:", err)
+	}
+	if len(keys) != 1 || keys[0] != lk.Handle {
+		t.Fatalf("GetKeys returned %v, want [%v]", keys, lk.Handle)
+	}
+	sessions, err := getHandles(d, rtAuth)
+	if err != nil {
+		t.Fatal("Couldn't get the open sessions:", err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Got %d open sessions, want 1", len(sessions))
+	}
+
+	// Snapshot the state of the fake just before it's closed.
+	var keysLeft, sessionsLeft []tpmutil.Handle
+	d.rwc = &closeHook{f, func() {
+		keysLeft, _ = getHandles(f, rtKey)
+		sessionsLeft, _ = getHandles(f, rtAuth)
+	}}
+
+	if err := d.Close(); err != nil {
+		t.Fatal("Couldn't close the device:", err)
+	}
+	if len(keysLeft) != 0 || len(sessionsLeft) != 0 {
+		t.Fatalf("Close left keys %v and sessions %v loaded", keysLeft, sessionsLeft)
+	}
+	if !bytes.Equal(lk.auth, make([]byte, len(keyAuth))) {
+		t.Fatal("Close didn't zero the cached key auth")
+	}
+	if _, err := f.Write([]byte{0}); err == nil {
+		t.Fatal("Close didn't close the underlying TPM")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal("Second call to Close failed:", err)
+	}
+	if _, err := GetKeys(d); err == nil {
+		t.Fatal("A closed device accepted a command")
+	}
+}
+
+func TestDeviceCloseReusedHandles(t *testing.T) {
+	f := testtpm.NewFake()
+	f.ReuseHandles = true
+	d := NewDevice(f)
+
+	keyBlob := testKeyBlob(t, keySigning, authAlways, nil)
+	keyAuth := SHA1Auth([]byte("key auth"))
+	lk, err := d.LoadKey(keyBlob, wellKnownAuth(), keyAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the key:", err)
+	}
+	if err := lk.Close(d); err != nil {
+		t.Fatal("Couldn't close the key:", err)
+	}
+	if err := lk.Close(d); err != nil {
+		t.Fatal("Second call to LoadedKey.Close failed:", err)
+	}
+	// Load another key behind the Device's back. It gets the same handle.
+	other, err := LoadKey(f, keyBlob, wellKnownAuth(), keyAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the other key:", err)
+	}
+	if other.Handle != lk.Handle {
+		t.Fatalf("The fake gave the other key handle %v, want the reused handle %v", other.Handle, lk.Handle)
+	}
+
+	// A session flushed through the Device, and one closed by the response
+	// to the command it authorized, are no longer tracked.
+	s, err := oiap(d)
+	if err != nil {
+		t.Fatal("Couldn't open an OIAP session:", err)
+	}
+	if err := s.Close(d); err != nil {
+		t.Fatal("Couldn't flush the OIAP session:", err)
+	}
+	sharedSecret, osapr, err := newOSAPSession(d, etSRK, khSRK, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], []interface{}{OrdGetPubKey})
+	if err != nil {
+		t.Fatal("Couldn't build the command auth:", err)
+	}
+	if _, _, _, err := getPubKey(d, khSRK, ca); err != nil {
+		t.Fatal("Couldn't get the SRK public key:", err)
+	}
+	if len(d.sessions) != 0 {
+		t.Fatalf("The Device still tracks sessions %v", d.sessions)
+	}
+	// Open a session behind the Device's back. It gets the same handle.
+	s2, err := oiap(f)
+	if err != nil {
+		t.Fatal("Couldn't open the other OIAP session:", err)
+	}
+	if s2.AuthHandle != s.AuthHandle {
+		t.Fatalf("The fake gave the other session handle %v, want the reused handle %v", s2.AuthHandle, s.AuthHandle)
+	}
+
+	var keysLeft, sessionsLeft []tpmutil.Handle
+	d.rwc = &closeHook{f, func() {
+		keysLeft, _ = getHandles(f, rtKey)
+		sessionsLeft, _ = getHandles(f, rtAuth)
+	}}
+	if err := d.Close(); err != nil {
+		t.Fatal("Couldn't close the device:", err)
+	}
+	if !slices.Equal(keysLeft, []tpmutil.Handle{other.Handle}) || !slices.Equal(sessionsLeft, []tpmutil.Handle{s2.AuthHandle}) {
+		t.Fatalf("Close left keys %v and sessions %v, want [%v] and [%v]", keysLeft, sessionsLeft, other.Handle, s2.AuthHandle)
+	}
+}
+
+// closeHook is an io.ReadWriteCloser that calls a function before closing.
+type closeHook struct {
+	*testtpm.Fake
+	before func()
+}
+
+func (c *closeHook) Close() error {
+	c.before()
+	return c.Fake.Close()
+}
+
+// slowTPM is an io.ReadWriteCloser that delays every response. It counts the
+// commands written to it.
+type slowTPM struct {
+	*testtpm.Fake
+	delay    time.Duration
+	commands chan struct{}
+}
+
+func (s *slowTPM) Write(p []byte) (int, error) {
+	s.commands <- struct{}{}
+	return s.Fake.Write(p)
+}
+
+func (s *slowTPM) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.Fake.Read(p)
+}
+
+func TestDeviceFailedCommandEndsSessions(t *testing.T) {
+	d := NewDevice(testtpm.NewFake())
+	defer d.Close()
+
+	// A session opened with the wrong SRK auth fails the first command it
+	// authorizes, and the TPM ends it.
+	wrongAuth := SHA1Auth([]byte("not the SRK auth"))
+	s, err := OpenOSAPSession(d, EntitySRK, khSRK, wrongAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+	if !d.sessions[s.Handle] {
+		t.Fatalf("The Device isn't tracking session 0x%x", s.Handle)
+	}
+	if _, err := s.Seal(d, LocZero, nil, []byte("data"), wellKnownAuth()); err == nil {
+		t.Fatal("Seal succeeded in a session with the wrong SRK auth")
+	}
+	if d.sessions[s.Handle] {
+		t.Fatalf("The Device still tracks session 0x%x after a command that used it failed", s.Handle)
+	}
+}
+
+// chunkedTPM is a transport to a fake TPM that returns each response in
+// pieces of at most chunk bytes, as a socket may.
+type chunkedTPM struct {
+	*testtpm.Fake
+	chunk int
+	resp  []byte
+}
+
+func (c *chunkedTPM) Read(p []byte) (int, error) {
+	if len(c.resp) == 0 {
+		buf := make([]byte, 4096)
+		n, err := c.Fake.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		c.resp = buf[:n]
+	}
+	n := copy(p[:min(len(p), c.chunk)], c.resp)
+	c.resp = c.resp[n:]
+	return n, nil
+}
+
+func TestDeviceChunkedResponses(t *testing.T) {
+	d := NewDevice(&chunkedTPM{Fake: testtpm.NewFake(), chunk: commandHeaderSize})
+	defer d.Close()
+	var ords []Ordinal
+	d.OnCommand = func(ord Ordinal, _ time.Duration, _ error) {
+		ords = append(ords, ord)
+	}
+
+	s, err := OpenOSAPSession(d, EntitySRK, khSRK, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+	if _, err := GetRandom(d, 64); err != nil {
+		t.Fatal("GetRandom failed:", err)
+	}
+	if want := []Ordinal{OrdOSAP, OrdGetRandom}; !slices.Equal(ords, want) {
+		t.Fatalf("OnCommand got %v, want %v", ords, want)
+	}
+	if len(d.sessions) != 1 || !d.sessions[s.Handle] {
+		t.Fatalf("The Device tracks sessions %v, want only 0x%x", d.sessions, s.Handle)
+	}
+}
+
+func TestDeviceOnCommand(t *testing.T) {
+	f := testtpm.NewFake()
+	d := NewDevice(f)
+	defer d.Close()
+
+	type call struct {
+		ord Ordinal
+		dur time.Duration
+		err error
+	}
+	var calls []call
+	d.OnCommand = func(ord Ordinal, dur time.Duration, err error) {
+		calls = append(calls, call{ord, dur, err})
+	}
+
+	if _, err := GetRandom(d, 16); err != nil {
+		t.Fatal("GetRandom failed:", err)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("OnCommand was called %d times for one command, want 1", len(calls))
+	}
+	if c := calls[0]; c.ord != OrdGetRandom || c.dur <= 0 || c.dur > time.Minute || c.err != nil {
+		t.Fatalf("OnCommand got (%v, %v, %v), want (%v, a short duration, <nil>)", c.ord, c.dur, c.err, OrdGetRandom)
+	}
+
+	f.DoingSelfTest = true
+	if _, err := GetRandom(d, 16); err == nil {
+		t.Fatal("GetRandom succeeded during a self-test")
+	}
+	if len(calls) != 2 {
+		t.Fatalf("OnCommand was called %d times for two commands, want 2", len(calls))
+	}
+	if c := calls[1]; c.ord != OrdGetRandom || c.err != tpmError(errDoingSelfTest) {
+		t.Fatalf("OnCommand got (%v, %v), want (%v, %v)", c.ord, c.err, OrdGetRandom, tpmError(errDoingSelfTest))
+	}
+}
+
+func TestDeviceContextDeadline(t *testing.T) {
+	slow := &slowTPM{Fake: testtpm.NewFake(), delay: 100 * time.Millisecond, commands: make(chan struct{}, 10)}
+	d := NewDevice(slow)
+	defer d.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := d.ReadPCR(ctx, 17); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadPCR with a 1ms deadline returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(slow.commands) != 1 {
+		t.Fatalf("ReadPCR sent %d commands, want 1", len(slow.commands))
+	}
+
+	// The abandoned ReadPCR still holds the device, so this one must give up
+	// while waiting, without sending a command.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel2()
+	if _, err := d.GetRandom(ctx2, 8); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetRandom with a 1ms deadline returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(slow.commands) != 1 {
+		t.Fatalf("GetRandom sent a command while the device was busy")
+	}
+
+	// Once the abandoned command finishes, the device works again.
+	if _, err := d.ReadPCR(context.Background(), 17); err != nil {
+		t.Fatal("ReadPCR without a deadline failed:", err)
+	}
+}
+
+func TestDeviceContextCanceled(t *testing.T) {
+	slow := &slowTPM{Fake: testtpm.NewFake(), commands: make(chan struct{}, 10)}
+	d := NewDevice(slow)
+	defer d.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.GetRandom(ctx, 8); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetRandom with a canceled context returned %v, want %v", err, context.Canceled)
+	}
+	if len(slow.commands) != 0 {
+		t.Fatalf("GetRandom with a canceled context sent %d commands, want 0", len(slow.commands))
+	}
+}
+
+// osapRecorder is an io.ReadWriteCloser that records the entity type and
+// value of every OSAP command written to it.
+type osapRecorder struct {
+	*testtpm.Fake
+	entities [][2]uint32
+}
+
+func (o *osapRecorder) Write(p []byte) (int, error) {
+	var tag uint16
+	var size uint32
+	var ord Ordinal
+	var et uint16
+	var ev tpmutil.Handle
+	if _, err := tpmutil.Unpack(p, &tag, &size, &ord, &et, &ev); err == nil && ord == OrdOSAP {
+		o.entities = append(o.entities, [2]uint32{uint32(et), uint32(ev)})
+	}
+	return o.Fake.Write(p)
+}
+
+func TestDeviceDefaultParent(t *testing.T) {
+	ctx := context.Background()
+	o := &osapRecorder{Fake: testtpm.NewFake()}
+	d := NewDevice(o)
+	defer d.Close()
+
+	// By default, data is sealed under the SRK.
+	if _, err := d.Seal(ctx, LocZero, []int{17}, []byte("secret"), make([]byte, 20)); err != nil {
+		t.Fatal("Couldn't seal under the SRK:", err)
+	}
+	if want := [][2]uint32{{uint32(etSRK), uint32(khSRK)}}; !slices.Equal(o.entities, want) {
+		t.Fatalf("Seal opened OSAP sessions for %x, want %x", o.entities, want)
+	}
+
+	// The fake can't open OSAP sessions for loaded keys, so the seal fails,
+	// but only after asking for a session for the parent.
+	o.entities = nil
+	d.DefaultParent = 0x01000005
+	if _, err := d.Seal(ctx, LocZero, []int{17}, []byte("secret"), make([]byte, 20)); err == nil {
+		t.Fatal("The fake sealed under a key it doesn't have")
+	}
+	if want := [][2]uint32{{uint32(etKeyHandle), 0x01000005}}; !slices.Equal(o.entities, want) {
+		t.Fatalf("Seal opened OSAP sessions for %x, want %x", o.entities, want)
+	}
+}
+
+// lossyTPM is an io.ReadWriteCloser that can lose TPM_Extend commands, either
+// before they reach the fake or by dropping the response after the fake has
+// run them. It counts the extends that the fake runs.
+type lossyTPM struct {
+	*testtpm.Fake
+	loseCommand  bool
+	loseResponse bool
+	extends      int
+	lost         bool
+}
+
+func (l *lossyTPM) Write(p []byte) (int, error) {
+	var tag uint16
+	var size uint32
+	var ord Ordinal
+	if _, err := tpmutil.Unpack(p, &tag, &size, &ord); err == nil && ord == OrdExtend {
+		if l.loseCommand {
+			l.loseCommand = false
+			return 0, errors.New("the command was lost")
+		}
+		l.extends++
+		if l.loseResponse {
+			l.loseResponse = false
+			l.lost = true
+		}
+	}
+	return l.Fake.Write(p)
+}
+
+func (l *lossyTPM) Read(p []byte) (int, error) {
+	n, err := l.Fake.Read(p)
+	if l.lost {
+		l.lost = false
+		return 0, errors.New("the response was lost")
+	}
+	return n, err
+}
+
+func TestDevicePcrExtendRetry(t *testing.T) {
+	ctx := context.Background()
+	digest := PCRValue{1, 2, 3}
+	once := sha1.Sum(append(make([]byte, PCRSize), digest[:]...))
+
+	// The extend runs, but its response is lost. The retry finds the PCR
+	// already extended and doesn't extend it again.
+	l := &lossyTPM{Fake: testtpm.NewFake(), loseResponse: true}
+	d := NewDevice(l)
+	if _, err := d.PcrExtend(ctx, 16, digest); err == nil {
+		t.Fatal("PcrExtend succeeded without a response")
+	}
+	v, err := d.PcrExtend(ctx, 16, digest)
+	if err != nil {
+		t.Fatal("Couldn't retry the extend:", err)
+	}
+	if !bytes.Equal(v, once[:]) || l.extends != 1 {
+		t.Fatalf("after a retry of an extend that landed, got PCR value %x after %d extends, want %x after 1", v, l.extends, once)
+	}
+	d.Close()
+
+	// The extend never reaches the TPM, so the retry extends the PCR.
+	l = &lossyTPM{Fake: testtpm.NewFake(), loseCommand: true}
+	d = NewDevice(l)
+	if _, err := d.PcrExtend(ctx, 16, digest); err == nil {
+		t.Fatal("PcrExtend succeeded without sending the command")
+	}
+	v, err = d.PcrExtend(ctx, 16, digest)
+	if err != nil {
+		t.Fatal("Couldn't retry the extend:", err)
+	}
+	if !bytes.Equal(v, once[:]) || l.extends != 1 {
+		t.Fatalf("after a retry of an extend that was lost, got PCR value %x after %d extends, want %x after 1", v, l.extends, once)
+	}
+	d.Close()
+
+	// Something else extends the PCR before the retry, so the retry can't
+	// tell whether the lost extend landed.
+	l = &lossyTPM{Fake: testtpm.NewFake(), loseResponse: true}
+	d = NewDevice(l)
+	defer d.Close()
+	if _, err := d.PcrExtend(ctx, 16, digest); err == nil {
+		t.Fatal("PcrExtend succeeded without a response")
+	}
+	if _, err := PcrExtend(l.Fake, 16, PCRValue{9}); err != nil {
+		t.Fatal("Couldn't extend the PCR:", err)
+	}
+	if _, err := d.PcrExtend(ctx, 16, digest); err == nil {
+		t.Fatal("PcrExtend retried an extend that may have landed before the PCR changed")
+	}
+}
+
+// wedgedTPM is a transport to a fake TPM that fails its reads and writes with
+// EIO while it's wedged, as a TPM device does after a command times out in
+// firmware. Reads still consume the response, since the command ran. If
+// wedgeOrd is set, only the read of the response to that command fails. The
+// ordinals of the commands that reach the TPM are kept in sent.
+type wedgedTPM struct {
+	f           *testtpm.Fake
+	wedgeWrites bool
+	wedgeReads  bool
+	wedgeOrd    Ordinal
+	sent        []Ordinal
+}
+
+func (w *wedgedTPM) Write(p []byte) (int, error) {
+	if w.wedgeWrites {
+		return 0, syscall.EIO
+	}
+	if len(p) >= commandHeaderSize {
+		w.sent = append(w.sent, Ordinal(binary.BigEndian.Uint32(p[6:commandHeaderSize])))
+	}
+	return w.f.Write(p)
+}
+
+func (w *wedgedTPM) Read(p []byte) (int, error) {
+	n, err := w.f.Read(p)
+	if w.wedgeReads || (w.wedgeOrd != 0 && len(w.sent) > 0 && w.sent[len(w.sent)-1] == w.wedgeOrd) {
+		return 0, syscall.EIO
+	}
+	return n, err
+}
+
+func (w *wedgedTPM) Close() error { return nil }
+
+func TestDeviceReopenOnEIO(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name            string
+		wedgeWrites     bool
+		wedgeReads      bool
+		staysWedged     bool
+		noReopen        bool
+		wantErr         bool
+		wantReopenCount int
+	}{
+		{name: "EIO on write", wedgeWrites: true, wantReopenCount: 1},
+		{name: "EIO on read", wedgeReads: true, wantReopenCount: 1},
+		{name: "still wedged after reopening", wedgeReads: true, staysWedged: true, wantErr: true, wantReopenCount: 1},
+		{name: "no Reopen", wedgeReads: true, noReopen: true, wantErr: true},
+	} {
+		f := testtpm.NewFake()
+		d := NewDevice(&wedgedTPM{f: f, wedgeWrites: tt.wedgeWrites, wedgeReads: tt.wedgeReads})
+		reopens := 0
+		if !tt.noReopen {
+			d.Reopen = func() (io.ReadWriteCloser, error) {
+				reopens++
+				return &wedgedTPM{f: f, wedgeReads: tt.staysWedged}, nil
+			}
+		}
+		_, err := d.GetRandom(ctx, 16)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: GetRandom returned error %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr && !errors.Is(err, syscall.EIO) {
+			t.Errorf("%s: GetRandom returned %v, want EIO", tt.name, err)
+		}
+		if reopens != tt.wantReopenCount {
+			t.Errorf("%s: the TPM was reopened %d times, want %d", tt.name, reopens, tt.wantReopenCount)
+		}
+	}
+
+	// Errors other than EIO don't reopen the TPM.
+	d := NewDevice(&lossyTPM{Fake: testtpm.NewFake(), loseResponse: true})
+	d.Reopen = func() (io.ReadWriteCloser, error) {
+		t.Fatal("The Device reopened the TPM after an error other than EIO")
+		return nil, nil
+	}
+	if _, err := d.PcrExtend(ctx, 16, PCRValue{1}); err == nil {
+		t.Fatal("PcrExtend succeeded without a response")
+	}
+}
+
+func TestDeviceNoResendAfterEIO(t *testing.T) {
+	ctx := context.Background()
+	digest := PCRValue{1, 2, 3}
+	once := sha1.Sum(append(make([]byte, PCRSize), digest[:]...))
+
+	// The extend reaches the TPM and runs, but reading its response fails
+	// with EIO, so the Device can't send it again.
+	f := testtpm.NewFake()
+	d := NewDevice(&wedgedTPM{f: f, wedgeOrd: OrdExtend})
+	defer d.Close()
+	reopens := 0
+	d.Reopen = func() (io.ReadWriteCloser, error) {
+		reopens++
+		return &wedgedTPM{f: f}, nil
+	}
+	if _, err := d.PcrExtend(ctx, 17, digest); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("PcrExtend returned %v, want EIO", err)
+	}
+	if reopens != 0 {
+		t.Fatalf("The TPM was reopened %d times before the extend returned, want 0", reopens)
+	}
+	v, err := ReadPCR(f, 17)
+	if err != nil {
+		t.Fatal("Couldn't read PCR 17:", err)
+	}
+	if !bytes.Equal(v, once[:]) {
+		t.Fatalf("PCR 17 is %x, want %x from exactly one extend", v, once)
+	}
+
+	// The next command reopens the TPM, and the retry finds that the extend
+	// landed.
+	v, err = d.PcrExtend(ctx, 17, digest)
+	if err != nil {
+		t.Fatal("Couldn't retry the extend:", err)
+	}
+	if !bytes.Equal(v, once[:]) || reopens != 1 {
+		t.Fatalf("after retrying the extend, got PCR value %x after %d reopens, want %x after 1", v, reopens, once)
+	}
+}
+
+func TestDeviceAllowDestructive(t *testing.T) {
+	w := &wedgedTPM{f: testtpm.NewFake()}
+	d := NewDevice(w)
+	defer d.Close()
+	var refused []Ordinal
+	d.OnCommand = func(ord Ordinal, _ time.Duration, err error) {
+		if errors.Is(err, ErrDestructive) {
+			refused = append(refused, ord)
+		}
+	}
+
+	if err := OwnerClear(d, Digest{}); !errors.Is(err, ErrDestructive) {
+		t.Fatalf("OwnerClear returned %v, want %v", err, ErrDestructive)
+	}
+	if slices.Contains(w.sent, OrdOwnerClear) {
+		t.Fatal("The Device sent TPM_OwnerClear before AllowDestructive(true)")
+	}
+	if !slices.Equal(refused, []Ordinal{OrdOwnerClear}) {
+		t.Fatalf("OnCommand saw refusals of %v, want [%v]", refused, OrdOwnerClear)
+	}
+
+	d.AllowDestructive(true)
+	if err := OwnerClear(d, Digest{}); errors.Is(err, ErrDestructive) {
+		t.Fatal("OwnerClear was refused after AllowDestructive(true):", err)
+	}
+	if !slices.Contains(w.sent, OrdOwnerClear) {
+		t.Fatal("The Device didn't send TPM_OwnerClear after AllowDestructive(true)")
+	}
+}
+
+func TestDeviceWatchPCRs(t *testing.T) {
+	d := NewDevice(testtpm.NewFake())
+	defer d.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Extend a PCR only after the first reading, so that it's a change.
+	firstRead := make(chan struct{})
+	reads := 0
+	d.OnCommand = func(ord Ordinal, _ time.Duration, _ error) {
+		if ord == OrdPCRRead {
+			reads++
+			if reads == 2 {
+				close(firstRead)
+			}
+		}
+	}
+
+	type change struct {
+		pcr      int
+		old, new []byte
+	}
+	changes := make(chan change, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- d.WatchPCRs(ctx, []int{16, 23}, time.Millisecond, func(pcr int, old, new []byte) {
+			changes <- change{pcr, old, new}
+		})
+	}()
+
+	<-firstRead
+	digest := PCRValue{1, 2, 3}
+	want, err := d.PcrExtend(ctx, 23, digest)
+	if err != nil {
+		t.Fatal("Couldn't extend the PCR:", err)
+	}
+	select {
+	case c := <-changes:
+		if c.pcr != 23 || !bytes.Equal(c.old, make([]byte, PCRSize)) || !bytes.Equal(c.new, want) {
+			t.Fatalf("got a change of PCR %d from %x to %x, want PCR 23 from zeros to %x", c.pcr, c.old, c.new, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchPCRs didn't report the change")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("WatchPCRs returned %v, want %v", err, context.Canceled)
+	}
+	select {
+	case c := <-changes:
+		t.Fatalf("WatchPCRs reported an unexpected change of PCR %d", c.pcr)
+	default:
+	}
+}
+
+// staleTPM is a transport to a fake TPM that answers the next command with a
+// stale response, as if it were left over from an earlier command, and leaves
+// the real response unread.
+type staleTPM struct {
+	*testtpm.Fake
+	stale []byte
+}
+
+func (s *staleTPM) Read(p []byte) (int, error) {
+	if s.stale != nil {
+		n := copy(p, s.stale)
+		s.stale = nil
+		return n, nil
+	}
+	return s.Fake.Read(p)
+}
+
+func (s *staleTPM) Close() error { return nil }
+
+func TestDeviceDesync(t *testing.T) {
+	ctx := context.Background()
+	pack := func(tag uint16, body []byte) []byte {
+		t.Helper()
+		b, err := tpmutil.Pack(responseHeader{tag, uint32(commandHeaderSize + len(body)), 0})
+		if err != nil {
+			t.Fatal("Couldn't pack the response header:", err)
+		}
+		return append(b, body...)
+	}
+	for _, tt := range []struct {
+		name  string
+		stale []byte
+	}{
+		{"response with auth", pack(TagRSPAuth1Command, make([]byte, 41))},
+		{"two responses in one read", append(pack(TagRSPCommand, []byte{0, 0, 0, 0}), make([]byte, PCRSize)...)},
+	} {
+		f := testtpm.NewFake()
+		d := NewDevice(&staleTPM{Fake: f, stale: tt.stale})
+		if _, err := d.GetRandom(ctx, 16); !errors.Is(err, ErrDesync) {
+			t.Fatalf("%s: GetRandom returned %v, want %v", tt.name, err, ErrDesync)
+		}
+		// Without Reopen, the Device refuses to send anything more.
+		if _, err := d.GetRandom(ctx, 16); !errors.Is(err, ErrDesync) {
+			t.Fatalf("%s: GetRandom after a desync returned %v, want %v", tt.name, err, ErrDesync)
+		}
+
+		// Reopening the TPM discards the response that was never read.
+		reopens := 0
+		d.Reopen = func() (io.ReadWriteCloser, error) {
+			reopens++
+			f.Read(make([]byte, 4096))
+			return &staleTPM{Fake: f}, nil
+		}
+		b, err := d.GetRandom(ctx, 16)
+		if err != nil {
+			t.Fatalf("%s: GetRandom after reopening failed: %v", tt.name, err)
+		}
+		if len(b) != 16 || reopens != 1 {
+			t.Fatalf("%s: got %d random bytes after %d reopens, want 16 after 1", tt.name, len(b), reopens)
+		}
+	}
+
+	// A complete response whose body doesn't fit the command is an ordinary
+	// error, and doesn't stop the Device.
+	f := testtpm.NewFake()
+	d := NewDevice(&staleTPM{Fake: f, stale: pack(TagRSPCommand, []byte{0, 0, 0, 16})})
+	if _, err := d.GetRandom(ctx, 16); err == nil || errors.Is(err, ErrDesync) {
+		t.Fatalf("GetRandom with a short body returned %v, want an error other than %v", err, ErrDesync)
+	}
+	f.Read(make([]byte, 4096))
+	if _, err := d.GetRandom(ctx, 16); err != nil {
+		t.Fatal("GetRandom after a malformed response failed:", err)
+	}
+}
+
+func TestDeviceNVOwnerAuth(t *testing.T) {
+	const index = 0x00011000
+	f := testtpm.NewFake()
+	f.NV = map[uint32][]byte{index: make([]byte, 8)}
+	d := NewDevice(f)
+	defer d.Close()
+
+	ownAuth := wellKnownAuth()
+	if err := NVWriteValue(d, index, 2, []byte("nvram"), ownAuth); err != nil {
+		t.Fatal("Couldn't write to NVRAM with owner auth:", err)
+	}
+	got, err := NVReadValue(d, index, 0, 8, ownAuth)
+	if err != nil {
+		t.Fatal("Couldn't read from NVRAM with owner auth:", err)
+	}
+	if want := []byte("\x00\x00nvram\x00"); !bytes.Equal(got, want) {
+		t.Fatalf("NVReadValue returned %q, want %q", got, want)
+	}
+	// The Device must still be usable.
+	if _, err := GetRandom(d, 16); err != nil {
+		t.Fatal("GetRandom after the NVRAM commands failed:", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+const (
+	envelopeVersion uint16 = 1
+	envelopeKeySize        = 32
+)
+
+// An envelopeHeader starts a blob from SealEnvelope. The rest of the blob is
+// the data, encrypted with AES-256-GCM under the sealed key with the sealed
+// key as additional data, so that it only decrypts with the key blob it was
+// packaged with. The ciphertext has no length prefix, since a tpmutil.U32Bytes
+// can't hold more than a megabyte.
+type envelopeHeader struct {
+	Version   uint16
+	SealedKey tpmutil.U32Bytes
+	Nonce     tpmutil.U16Bytes
+}
+
+// SealEnvelope seals data of any size to the given locality and PCRs, which
+// Seal can't do for more than MaxSealSize bytes. It generates a random AES-256
+// key, seals the key like Seal, and encrypts the data with it in AES-GCM off
+// the TPM. The returned blob holds both, and only UnsealEnvelope reads it.
+func SealEnvelope(rw io.ReadWriter, loc Locality, pcrs []int, plaintext, srkAuth []byte) ([]byte, error) {
+	key := make([]byte, envelopeKeySize)
+	defer zeroBytes(key)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	sealedKey, err := Seal(rw, loc, pcrs, key, srkAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newEnvelopeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header, err := tpmutil.Pack(envelopeHeader{envelopeVersion, sealedKey, nonce})
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, plaintext, sealedKey), nil
+}
+
+// UnsealEnvelope unseals the key of a blob from SealEnvelope like Unseal, and
+// decrypts the data with it.
+func UnsealEnvelope(rw io.ReadWriter, env, srkAuth []byte) ([]byte, error) {
+	var e envelopeHeader
+	n, err := tpmutil.Unpack(env, &e)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the envelope: %v", err)
+	}
+	if e.Version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", e.Version)
+	}
+
+	key, err := Unseal(rw, e.SealedKey, srkAuth)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(key)
+	if len(key) != envelopeKeySize {
+		return nil, fmt.Errorf("the envelope's sealed key is %d bytes long, want %d", len(key), envelopeKeySize)
+	}
+	aead, err := newEnvelopeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("the envelope's nonce is %d bytes long, want %d", len(e.Nonce), aead.NonceSize())
+	}
+	plaintext, err := aead.Open(nil, e.Nonce, env[n:], e.SealedKey)
+	if err != nil {
+		return nil, errors.New("couldn't decrypt the envelope: its data or sealed key was modified")
+	}
+	return plaintext, nil
+}
+
+// newEnvelopeAEAD returns the AES-GCM cipher of an envelope with the given key.
+func newEnvelopeAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
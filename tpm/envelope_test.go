@@ -0,0 +1,56 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+)
+
+func TestSealEnvelope(t *testing.T) {
+	f := testtpm.NewFake()
+	plaintext := make([]byte, 1<<20)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal("Couldn't generate the payload:", err)
+	}
+
+	env, err := SealEnvelope(f, LocZero, []int{17}, plaintext, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't seal the envelope:", err)
+	}
+	got, err := UnsealEnvelope(f, env, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't unseal the envelope:", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatal("UnsealEnvelope returned different data than was sealed")
+	}
+
+	tampered := append([]byte(nil), env...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := UnsealEnvelope(f, tampered, wellKnownAuth()); err == nil {
+		t.Fatal("UnsealEnvelope accepted a modified envelope")
+	}
+
+	if _, err := PcrExtend(f, 17, PCRValue{1}); err != nil {
+		t.Fatal("Couldn't extend PCR 17:", err)
+	}
+	if _, err := UnsealEnvelope(f, env, wellKnownAuth()); err == nil {
+		t.Fatal("UnsealEnvelope succeeded after PCR 17 changed")
+	}
+}
@@ -15,7 +15,12 @@
 package tpm
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"strconv"
+
+	"github.com/google/go-tpm/tpmutil"
 )
 
 // A tpmError is an error value from the TPM.
@@ -30,6 +35,14 @@ func (o tpmError) Error() string {
 	return "tpm: unknown error code " + strconv.Itoa(int(o))
 }
 
+// Is reports whether target is the exported error for the state of the TPM
+// that o reports, so that errors.Is(err, ErrDeactivated) holds for a command
+// that failed with TPM_DEACTIVATED.
+func (o tpmError) Is(target error) bool {
+	e, ok := tpmStateErrs[o]
+	return ok && e == target
+}
+
 // These are the TPM error codes from the spec.
 const (
 	_                    = iota
@@ -131,7 +144,11 @@ const (
 )
 
 // Extra messages the TPM might return.
-const errDefendLockRunning tpmError = 2051
+const (
+	errNeedsSelfTest     tpmError = 2049
+	errDoingSelfTest     tpmError = 2050
+	errDefendLockRunning tpmError = 2051
+)
 
 // tpmErrMsgs maps tpmError codes to their associated error strings.
 var tpmErrMsgs = map[tpmError]string{
@@ -230,5 +247,84 @@ var tpmErrMsgs = map[tpmError]string{
 	errMADestination:         "migration destination not authenticated",
 	errMASource:              "migration source incorrect",
 	errMAAuthority:           "incorrect migration authority",
+	errNeedsSelfTest:         "the TPM needs to test the capability the command uses",
+	errDoingSelfTest:         "the TPM is doing a self-test",
 	errDefendLockRunning:     "the TPM is defending against dictionary attacks and is in some time-out period",
 }
+
+// Errors returned by Ready for the states in which a TPM can't be used.
+var (
+	ErrSelfTest       = errors.New("tpm: the TPM hasn't completed its self-test")
+	ErrSelfTestFailed = errors.New("tpm: the TPM failed its self-test")
+	ErrDisabled       = errors.New("tpm: the TPM is disabled")
+	ErrDeactivated    = errors.New("tpm: the TPM is deactivated")
+	ErrLockedOut      = errors.New("tpm: the TPM is locked out after too many authorization failures")
+)
+
+// ErrResetLockBackoff is returned, wrapped with the time left, by
+// ResetLockValue while it backs off after a failed attempt. It comes from this
+// package, not from the TPM, which isn't sent anything. It matches
+// ErrLockedOut, since the caller has to wait either way.
+var ErrResetLockBackoff = fmt.Errorf("tpm: ResetLockValue is backing off after a failed attempt (%w)", ErrLockedOut)
+
+// ErrOSAPEntity is returned, wrapped with the underlying error, when the first
+// command in an OSAP session fails authorization. The shared secret of the
+// session then doesn't match the TPM's, which happens if the entity auth is
+// wrong or if the session is bound to a different entity than the one it was
+// opened for, as with a tampered OSAP response.
+var ErrOSAPEntity = errors.New("tpm: the OSAP session may be bound to the wrong entity")
+
+// ErrKeyNotLoaded is returned, wrapped with the underlying error, when a command
+// names a key handle that the TPM doesn't have loaded. Key handles come from
+// LoadKey2 and don't persist: they're gone after a reboot or a FlushSpecific.
+var ErrKeyNotLoaded = errors.New("tpm: the key is not loaded")
+
+// keyHandleError wraps a TPM_INVALID_KEYHANDLE from a command that uses the key
+// at h with ErrKeyNotLoaded. Other errors are returned as they are.
+func keyHandleError(h tpmutil.Handle, err error) error {
+	if err != tpmError(errInvalidKeyHandle) {
+		return err
+	}
+	return fmt.Errorf("%w: key handle 0x%x is not loaded; call LoadKey2 first (handles don't survive reboots or FlushSpecific) (%w)", ErrKeyNotLoaded, uint32(h), err)
+}
+
+// ErrDesync is returned, wrapped with the details, when a response can't be
+// the response to the command that was sent, as happens when a response that
+// was never read, like that of an abandoned command, is read for the next one.
+// A Device that returns it reopens the TPM before its next command if its
+// Reopen is set, and refuses to send any more commands otherwise.
+var ErrDesync = errors.New("tpm: response does not correspond to the issued command; device framing may be out of sync")
+
+// desyncError wraps err with ErrDesync and, if rw is a Device, marks it as
+// needing to be reopened.
+func desyncError(rw io.ReadWriter, err error) error {
+	if d, ok := rw.(*Device); ok {
+		d.desynced = true
+	}
+	return fmt.Errorf("%w: %v", ErrDesync, err)
+}
+
+// ErrDestructive is returned, wrapped with the name of the command, when a
+// command that clears the TPM or its state is sent through a Device that
+// doesn't allow destructive commands.
+var ErrDestructive = errors.New("tpm: the command is destructive")
+
+// ErrNonceMismatch is returned by QuoteBundle.VerifyFresh when the quote was
+// made over a different nonce than the one the verifier chose, as happens when
+// an old quote is replayed.
+var ErrNonceMismatch = errors.New("tpm: the quote's nonce doesn't match the expected nonce")
+
+// ErrSealTooLarge is returned, wrapped with the sizes, when the data passed to
+// Seal is larger than MaxSealSize.
+var ErrSealTooLarge = errors.New("tpm: the data is too large to seal")
+
+// tpmStateErrs maps the tpmError codes for the states in which a TPM can't be
+// used to the corresponding exported errors.
+var tpmStateErrs = map[tpmError]error{
+	errNeedsSelfTest:     ErrSelfTest,
+	errDoingSelfTest:     ErrSelfTest,
+	errFailedSelfTest:    ErrSelfTestFailed,
+	errDisabled:          ErrDisabled,
+	errDeactivated:       ErrDeactivated,
+	errDefendLockRunning: ErrLockedOut,
+}
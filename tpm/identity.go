@@ -0,0 +1,114 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// vendorNames maps the TCG vendor IDs of TPM manufacturers, as
+// TPM_CAP_PROP_MANUFACTURER reports them without padding, to their names.
+var vendorNames = map[string]string{
+	"AMD":  "AMD",
+	"ATML": "Atmel",
+	"BRCM": "Broadcom",
+	"CSCO": "Cisco",
+	"GOOG": "Google",
+	"HPE":  "HPE",
+	"IBM":  "IBM",
+	"IFX":  "Infineon",
+	"INTC": "Intel",
+	"LEN":  "Lenovo",
+	"MSFT": "Microsoft",
+	"NSM":  "National Semiconductor",
+	"NTC":  "Nuvoton",
+	"NTZ":  "Nationz",
+	"QCOM": "Qualcomm",
+	"ROCC": "Fuzhou Rockchip",
+	"SMSC": "SMSC",
+	"SMSN": "Samsung",
+	"SNS":  "Sinosun",
+	"STM":  "STMicroelectronics",
+	"TXN":  "Texas Instruments",
+	"WEC":  "Winbond",
+}
+
+// decodeVendorID trims the padding from a 4-byte TCG vendor ID, which is
+// either NUL or space bytes, and looks up the name of the vendor. The name is
+// empty for an unknown vendor.
+func decodeVendorID(id []byte) (code, name string) {
+	code = strings.TrimRight(string(id), "\x00 ")
+	return code, vendorNames[code]
+}
+
+// A TPMIdentity describes a TPM for diagnostics.
+type TPMIdentity struct {
+	// VendorID is the TCG vendor ID of the manufacturer, like "IFX", and
+	// Vendor is its name, like "Infineon", or empty if it isn't known.
+	VendorID string
+	Vendor   string
+
+	// Major and Minor are the version of the TPM specification, and RevMajor
+	// and RevMinor the revision of the TPM's firmware.
+	Major, Minor       int
+	RevMajor, RevMinor int
+
+	// SpecLevel and ErrataRev are the level of the specification and the
+	// revision of its errata that the TPM implements. A TPM 1.1b doesn't
+	// report them, and they're zero for one.
+	SpecLevel int
+	ErrataRev int
+}
+
+// Identify reads the manufacturer and the version of the TPM.
+func Identify(rw io.ReadWriter) (*TPMIdentity, error) {
+	vendorID, err := GetManufacturer(rw)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readVersionInfo(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &TPMIdentity{
+		Major:     int(info.Version.Major),
+		Minor:     int(info.Version.Minor),
+		RevMajor:  int(info.Version.RevMajor),
+		RevMinor:  int(info.Version.RevMinor),
+		SpecLevel: int(info.SpecLevel),
+		ErrataRev: int(info.ErrataRev),
+	}
+	id.VendorID, id.Vendor = decodeVendorID(vendorID)
+	return id, nil
+}
+
+// String returns a one-line description of the TPM, like "Infineon (IFX) TPM
+// 1.2, firmware 3.19, spec level 2 errata 3".
+func (id *TPMIdentity) String() string {
+	var sb strings.Builder
+	if id.Vendor != "" {
+		fmt.Fprintf(&sb, "%s (%s)", id.Vendor, id.VendorID)
+	} else {
+		fmt.Fprintf(&sb, "vendor %q", id.VendorID)
+	}
+	fmt.Fprintf(&sb, " TPM %d.%d, firmware %d.%d", id.Major, id.Minor, id.RevMajor, id.RevMinor)
+	if id.SpecLevel != 0 || id.ErrataRev != 0 {
+		fmt.Fprintf(&sb, ", spec level %d errata %d", id.SpecLevel, id.ErrataRev)
+	}
+	return sb.String()
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"testing"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+)
+
+func TestDecodeVendorID(t *testing.T) {
+	for _, tt := range []struct {
+		id         string
+		code, name string
+	}{
+		{"IFX\x00", "IFX", "Infineon"},
+		{"STM ", "STM", "STMicroelectronics"},
+		{"IBM\x00", "IBM", "IBM"},
+		{"ATML", "ATML", "Atmel"},
+		{"WEC\x00", "WEC", "Winbond"},
+		{"NTC\x00", "NTC", "Nuvoton"},
+		{"INTC", "INTC", "Intel"},
+		{"ABCD", "ABCD", ""},
+	} {
+		code, name := decodeVendorID([]byte(tt.id))
+		if code != tt.code || name != tt.name {
+			t.Errorf("decodeVendorID(%q) = (%q, %q), want (%q, %q)", tt.id, code, name, tt.code, tt.name)
+		}
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	f := testtpm.NewFake()
+	id, err := Identify(f)
+	if err != nil {
+		t.Fatal("Couldn't identify the TPM:", err)
+	}
+	want := TPMIdentity{VendorID: "FAKE", Major: 1, Minor: 2, RevMajor: 1, SpecLevel: 2, ErrataRev: 3}
+	if *id != want {
+		t.Fatalf("Identify returned %+v, want %+v", *id, want)
+	}
+	if got, want := id.String(), `vendor "FAKE" TPM 1.2, firmware 1.0, spec level 2 errata 3`; got != want {
+		t.Fatalf("String returned %q, want %q", got, want)
+	}
+
+	f.Version11 = true
+	id, err = Identify(f)
+	if err != nil {
+		t.Fatal("Couldn't identify a TPM 1.1b:", err)
+	}
+	if id.Major != 1 || id.Minor != 1 || id.SpecLevel != 0 || id.ErrataRev != 0 {
+		t.Fatalf("Identify on a TPM 1.1b returned %+v", *id)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// KeyDetails describes the public parts of a key blob, as returned by
+// CreateWrapKey, MakeIdentity and the like. It's the read-only counterpart of
+// the options that CreateWrapKeyWithSchemes takes.
+type KeyDetails struct {
+	// Version is the TPM_STRUCT_VER of a TPM_KEY, or the tag and fill bytes
+	// of a TPM_KEY12.
+	Version uint32
+
+	// Key12 is true if the blob is a TPM_KEY12, whose PCR info is a
+	// TPM_PCR_INFO_LONG rather than a TPM_PCR_INFO.
+	Key12 bool
+
+	KeyUsage      KeyUsage
+	KeyFlags      KeyFlags
+	AuthDataUsage AuthDataUsage
+
+	// Migratable, Redirection, Volatile, PCRIgnoredOnRead and
+	// MigrateAuthority are decoded from KeyFlags.
+	Migratable       bool
+	Redirection      bool
+	Volatile         bool
+	PCRIgnoredOnRead bool
+	MigrateAuthority bool
+
+	AlgID     Algorithm
+	EncScheme EncScheme
+	SigScheme SigScheme
+
+	// KeyLength and NumPrimes are only set for RSA keys.
+	KeyLength uint32
+	NumPrimes uint32
+
+	// PCRBinding is the PCR binding of the key, or nil if the key isn't
+	// bound to any PCRs.
+	PCRBinding *PCRBinding
+
+	// PublicKey is only set for RSA keys.
+	PublicKey *rsa.PublicKey
+}
+
+// InspectKeyBlob parses a TPM_KEY or TPM_KEY12 blob without a TPM. It helps to
+// debug why a key won't load, sign or quote.
+func InspectKeyBlob(blob []byte) (*KeyDetails, error) {
+	// A TPM_KEY12 has the same layout as a TPM_KEY, with its tag and fill
+	// bytes in place of the version.
+	var k key
+	if _, err := tpmutil.Unpack(blob, &k); err != nil {
+		return nil, errors.New("couldn't convert the key blob into a key struct")
+	}
+
+	flags := KeyFlags(k.KeyFlags)
+	kd := &KeyDetails{
+		Version:          k.Version,
+		Key12:            uint16(k.Version>>16) == tagKey12,
+		KeyUsage:         KeyUsage(k.KeyUsage),
+		KeyFlags:         flags,
+		AuthDataUsage:    AuthDataUsage(k.AuthDataUsage),
+		Migratable:       flags.Has(KeyFlagMigratable),
+		Redirection:      flags.Has(KeyFlagRedirection),
+		Volatile:         flags.Has(KeyFlagVolatile),
+		PCRIgnoredOnRead: flags.Has(KeyFlagPCRIgnoredOnRead),
+		MigrateAuthority: flags.Has(KeyFlagMigrateAuthority),
+		AlgID:            Algorithm(k.AlgorithmParams.AlgID),
+		EncScheme:        EncScheme(k.AlgorithmParams.EncScheme),
+		SigScheme:        SigScheme(k.AlgorithmParams.SigScheme),
+	}
+
+	if len(k.PCRInfo) != 0 {
+		b, err := parsePCRBinding(k.PCRInfo, kd.Key12)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the PCR info of the key: %v", err)
+		}
+		kd.PCRBinding = b
+	}
+
+	if kd.AlgID == AlgRSA {
+		var rsakp rsaKeyParams
+		if _, err := tpmutil.Unpack(k.AlgorithmParams.Params, &rsakp); err != nil {
+			return nil, fmt.Errorf("couldn't parse the RSA key params: %v", err)
+		}
+		kd.KeyLength = rsakp.KeyLength
+		kd.NumPrimes = rsakp.NumPrimes
+
+		pub, err := k.RSAPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the RSA public key: %v", err)
+		}
+		kd.PublicKey = pub
+	}
+	return kd, nil
+}
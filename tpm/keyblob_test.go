@@ -0,0 +1,138 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+func TestInspectKeyBlob(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate a key:", err)
+	}
+	pcrInfo, err := newPCRInfoLongWithHashes(LocZero, map[int][]byte{17: make([]byte, PCRSize)})
+	if err != nil {
+		t.Fatal("Couldn't create a TPM_PCR_INFO_LONG:", err)
+	}
+	info, err := tpmutil.Pack(*pcrInfo)
+	if err != nil {
+		t.Fatal("Couldn't pack the TPM_PCR_INFO_LONG:", err)
+	}
+	k := testKey(t, keySigning, authAlways, &priv.PublicKey)
+	k.Version = uint32(tagKey12) << 16
+	k.KeyFlags = uint32(KeyFlagMigratable | KeyFlagVolatile)
+	k.PCRInfo = info
+	blob, err := tpmutil.Pack(k)
+	if err != nil {
+		t.Fatal("Couldn't pack the key:", err)
+	}
+
+	kd, err := InspectKeyBlob(blob)
+	if err != nil {
+		t.Fatal("Couldn't inspect the key blob:", err)
+	}
+	if !kd.Key12 || kd.KeyUsage != KeyUsageSigning || kd.AuthDataUsage != AuthAlways {
+		t.Errorf("got Key12 %t, usage %v and auth %v, want true, %v and %v", kd.Key12, kd.KeyUsage, kd.AuthDataUsage, KeyUsageSigning, AuthAlways)
+	}
+	if !kd.Migratable || !kd.Volatile || kd.Redirection {
+		t.Errorf("got key flags %v, want migratable|isVolatile", kd.KeyFlags)
+	}
+	if kd.AlgID != AlgRSA || kd.EncScheme != EncSchemeNone || kd.SigScheme != SigSchemeRSASSAPKCS1v15DER {
+		t.Errorf("got %v, %v and %v, want RSA, %v and %v", kd.AlgID, kd.EncScheme, kd.SigScheme, EncSchemeNone, SigSchemeRSASSAPKCS1v15DER)
+	}
+	if kd.KeyLength != 2048 || kd.NumPrimes != 2 {
+		t.Errorf("got key length %d and %d primes, want 2048 and 2", kd.KeyLength, kd.NumPrimes)
+	}
+	if kd.PCRBinding == nil {
+		t.Fatal("InspectKeyBlob returned no PCR binding")
+	}
+	if !slices.Equal(kd.PCRBinding.PCRsAtRelease, []int{17}) || kd.PCRBinding.LocAtRelease != LocZero {
+		t.Errorf("got PCRs %v at %v, want [17] at %v", kd.PCRBinding.PCRsAtRelease, kd.PCRBinding.LocAtRelease, LocZero)
+	}
+	if kd.PublicKey == nil || kd.PublicKey.N.Cmp(priv.N) != 0 {
+		t.Error("The public key doesn't match the key in the blob")
+	}
+}
+
+func TestInspectKeyBlobTruncated(t *testing.T) {
+	if _, err := InspectKeyBlob([]byte{0x01, 0x01, 0x00}); err == nil {
+		t.Fatal("InspectKeyBlob returned no error for a truncated blob")
+	}
+}
+
+func TestInspectKeyBlobAIK(t *testing.T) {
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+	kd, err := InspectKeyBlob(blob)
+	if err != nil {
+		t.Fatal("Couldn't inspect the AIK blob:", err)
+	}
+	t.Logf("AIK blob: %+v", kd)
+	if kd.KeyUsage != KeyUsageIdentity {
+		t.Fatalf("got key usage %v, want %v", kd.KeyUsage, KeyUsageIdentity)
+	}
+}
+
+func TestKeyFlags(t *testing.T) {
+	f := testtpm.NewFake()
+	usageAuth := SHA1Auth([]byte("usage auth"))
+	fixed, err := CreateWrapKey(f, wellKnownAuth(), usageAuth, Digest{}, nil)
+	if err != nil {
+		t.Fatal("Couldn't create a non-migratable key:", err)
+	}
+	migratable, _, err := CreateMigratableWrapKey(f, wellKnownAuth(), usageAuth, SHA1Auth([]byte("migration auth")), nil)
+	if err != nil {
+		t.Fatal("Couldn't create a migratable key:", err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		blob       []byte
+		migratable bool
+		str        string
+	}{
+		{"CreateWrapKey", fixed, false, "0"},
+		{"CreateMigratableWrapKey", migratable, true, "migratable"},
+	} {
+		kd, err := InspectKeyBlob(tt.blob)
+		if err != nil {
+			t.Fatalf("%s: couldn't inspect the key blob: %v", tt.name, err)
+		}
+		if kd.Migratable != tt.migratable || kd.KeyFlags.Has(KeyFlagMigratable) != tt.migratable {
+			t.Errorf("%s: got a key with Migratable %t and flags %v, want migratable %t", tt.name, kd.Migratable, kd.KeyFlags, tt.migratable)
+		}
+		if kd.Redirection || kd.Volatile || kd.PCRIgnoredOnRead || kd.MigrateAuthority {
+			t.Errorf("%s: got a key with flags %v, want no flags but migratable", tt.name, kd.KeyFlags)
+		}
+		if got := kd.KeyFlags.String(); got != tt.str {
+			t.Errorf("%s: got key flags %q, want %q", tt.name, got, tt.str)
+		}
+	}
+
+	flags := KeyFlagMigratable | KeyFlagVolatile
+	if !flags.Has(KeyFlagVolatile) || !flags.Has(KeyFlagMigratable|KeyFlagVolatile) || flags.Has(KeyFlagMigratable|KeyFlagRedirection) {
+		t.Errorf("Has gave the wrong answer for flags %v", flags)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ResetLockBackoff is how long ResetLockValue refuses to send another
+// TPM_ResetLockValue to a TPM after an attempt fails with an authorization
+// failure or with the TPM in lockout. The wait doubles with each consecutive
+// failure, up to MaxResetLockBackoff.
+var (
+	ResetLockBackoff    = 10 * time.Second
+	MaxResetLockBackoff = 10 * time.Minute
+)
+
+// A lockoutTracker remembers the recent ResetLockValue failures for each TPM,
+// keyed on the io.ReadWriter that the commands were sent to. The failures of a
+// TPM are consecutive as long as each attempt is made within
+// MaxResetLockBackoff of the end of the last backoff.
+type lockoutTracker struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	failures map[io.ReadWriter]lockoutFailure
+}
+
+type lockoutFailure struct {
+	count int
+	until time.Time
+}
+
+var resetLockTracker = &lockoutTracker{now: time.Now}
+
+// trackable reports whether rw can be used as a map key. Only comparable
+// types, such as the pointers that every TPM implementation in this package
+// uses, can.
+func trackable(rw io.ReadWriter) bool {
+	return rw != nil && reflect.TypeOf(rw).Comparable()
+}
+
+// check returns ErrResetLockBackoff if a recent attempt on rw failed and its
+// backoff hasn't passed yet. It also forgets the failures whose backoff ended
+// more than MaxResetLockBackoff ago, for every TPM, so that TPMs that are no
+// longer used don't stay in the tracker.
+func (l *lockoutTracker) check(rw io.ReadWriter) error {
+	if !trackable(rw) {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for k, f := range l.failures {
+		if now.Sub(f.until) > MaxResetLockBackoff {
+			delete(l.failures, k)
+		}
+	}
+	if f, ok := l.failures[rw]; ok && now.Before(f.until) {
+		return fmt.Errorf("%w: retry in %v", ErrResetLockBackoff, f.until.Sub(now).Round(time.Second))
+	}
+	return nil
+}
+
+// record updates the backoff for rw with the result of an attempt. A success
+// clears it, and an authorization failure or a lockout extends it. Other
+// errors, such as I/O errors, leave it as it is.
+func (l *lockoutTracker) record(rw io.ReadWriter, err error) {
+	if !trackable(rw) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil {
+		delete(l.failures, rw)
+		return
+	}
+	if !errors.Is(err, tpmError(errAuthFail)) && !errors.Is(err, ErrLockedOut) {
+		return
+	}
+
+	if l.failures == nil {
+		l.failures = make(map[io.ReadWriter]lockoutFailure)
+	}
+	f := l.failures[rw]
+	f.count++
+	wait := ResetLockBackoff
+	for i := 1; i < f.count && wait < MaxResetLockBackoff; i++ {
+		wait *= 2
+	}
+	if wait > MaxResetLockBackoff {
+		wait = MaxResetLockBackoff
+	}
+	f.until = l.now().Add(wait)
+	l.failures[rw] = f
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+)
+
+// fakeClock replaces the clock of resetLockTracker with one that only moves
+// when it's advanced, and restores the tracker when the test ends.
+func fakeClock(t *testing.T) *time.Time {
+	t.Helper()
+	now := time.Unix(0, 0)
+	old := resetLockTracker
+	resetLockTracker = &lockoutTracker{now: func() time.Time { return now }}
+	t.Cleanup(func() { resetLockTracker = old })
+	return &now
+}
+
+// lockedOutTPM is a fake TPM that counts the commands written to it and
+// answers every one of them with TPM_DEFEND_LOCK_RUNNING.
+type lockedOutTPM struct {
+	*cannedTPM
+	commands int
+}
+
+func (l *lockedOutTPM) Write(p []byte) (int, error) {
+	l.commands++
+	return l.cannedTPM.Write(p)
+}
+
+func TestResetLockValueBackoff(t *testing.T) {
+	now := fakeClock(t)
+	rw := &lockedOutTPM{cannedTPM: newCannedTPM(t, TagRSPCommand, uint32(errDefendLockRunning), nil)}
+
+	if err := ResetLockValue(rw, Digest{}); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("ResetLockValue returned %v, want %v", err, ErrLockedOut)
+	}
+	sent := rw.commands
+	if sent == 0 {
+		t.Fatal("ResetLockValue sent nothing to the TPM on its first attempt")
+	}
+
+	// Consecutive attempts inside the backoff mustn't reach the TPM.
+	for i := 0; i < 3; i++ {
+		if err := ResetLockValue(rw, Digest{}); !errors.Is(err, ErrLockedOut) {
+			t.Fatalf("attempt %d: ResetLockValue returned %v, want %v", i, err, ErrLockedOut)
+		}
+	}
+	if rw.commands != sent {
+		t.Fatalf("ResetLockValue sent %d commands during its backoff, want 0", rw.commands-sent)
+	}
+
+	// Once the backoff has passed, the next attempt is sent, and its failure
+	// doubles the backoff.
+	*now = now.Add(ResetLockBackoff)
+	if err := ResetLockValue(rw, Digest{}); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("ResetLockValue returned %v, want %v", err, ErrLockedOut)
+	}
+	if rw.commands == sent {
+		t.Fatal("ResetLockValue sent nothing to the TPM after its backoff")
+	}
+	sent = rw.commands
+	*now = now.Add(ResetLockBackoff)
+	ResetLockValue(rw, Digest{})
+	if rw.commands != sent {
+		t.Fatal("ResetLockValue didn't double its backoff after a second failure")
+	}
+}
+
+func TestResetLockValueBackoffAuthFail(t *testing.T) {
+	now := fakeClock(t)
+	f := testtpm.NewFake()
+	ownerAuth := Digest{1}
+	f.OwnerAuth = ownerAuth
+
+	if err := ResetLockValue(f, Digest{2}); err != tpmError(errAuthFail) {
+		t.Fatalf("ResetLockValue with the wrong owner auth returned %v, want %v", err, tpmError(errAuthFail))
+	}
+	// Even the right owner auth must wait out the backoff, and the error
+	// tells the backoff apart from a lockout reported by the TPM.
+	err := ResetLockValue(f, ownerAuth)
+	if !errors.Is(err, ErrResetLockBackoff) || !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("ResetLockValue during its backoff returned %v, want %v", err, ErrResetLockBackoff)
+	}
+	if errors.Is(err, tpmError(errDefendLockRunning)) {
+		t.Fatal("ResetLockValue during its backoff returned a TPM error, but the TPM wasn't sent anything")
+	}
+	if f.LockValueResets != 0 {
+		t.Fatal("ResetLockValue reset the lock value during its backoff")
+	}
+
+	// Other TPMs aren't affected.
+	other := testtpm.NewFake()
+	other.OwnerAuth = ownerAuth
+	if err := ResetLockValue(other, ownerAuth); err != nil {
+		t.Fatal("ResetLockValue failed on another TPM:", err)
+	}
+
+	*now = now.Add(ResetLockBackoff)
+	if err := ResetLockValue(f, ownerAuth); err != nil {
+		t.Fatal("ResetLockValue failed after its backoff:", err)
+	}
+	if f.LockValueResets != 1 {
+		t.Fatalf("got %d lock value resets, want 1", f.LockValueResets)
+	}
+}
+
+func TestResetLockValueBackoffExpires(t *testing.T) {
+	now := fakeClock(t)
+	f := testtpm.NewFake()
+	if err := ResetLockValue(f, Digest{2}); err != tpmError(errAuthFail) {
+		t.Fatalf("ResetLockValue with the wrong owner auth returned %v, want %v", err, tpmError(errAuthFail))
+	}
+	if len(resetLockTracker.failures) != 1 {
+		t.Fatalf("got %d tracked TPMs, want 1", len(resetLockTracker.failures))
+	}
+
+	// A TPM that is never used again is forgotten once its backoff is long
+	// over.
+	*now = now.Add(ResetLockBackoff + MaxResetLockBackoff + time.Second)
+	if err := ResetLockValue(testtpm.NewFake(), Digest{}); err != nil {
+		t.Fatal("ResetLockValue failed on another TPM:", err)
+	}
+	if len(resetLockTracker.failures) != 0 {
+		t.Fatalf("got %d tracked TPMs, want 0", len(resetLockTracker.failures))
+	}
+}
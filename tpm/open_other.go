@@ -17,8 +17,12 @@
 package tpm
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"syscall"
 
 	"github.com/google/go-tpm/tpmutil"
 )
@@ -26,16 +30,82 @@ import (
 // OpenTPM opens a channel to the TPM at the given path. If the file is a
 // device, then it treats it like a normal TPM device, and if the file is a
 // Unix domain socket, then it opens a connection to the socket.
+//
+// If the device can't be opened for the most common reasons, because it
+// doesn't exist, the caller lacks permission or another process holds it, the
+// error says so. It still wraps the underlying error, so errors.Is works with
+// fs.ErrNotExist, fs.ErrPermission and syscall.EBUSY.
 func OpenTPM(path string) (io.ReadWriteCloser, error) {
 	return openAndStartupTPM(path, false)
 }
 
+// Paths of the TPM device nodes. Newer kernels also provide tpmrmPath, which
+// goes through the kernel's resource manager; the kernel may then hold
+// defaultTPMPath exclusively.
+const (
+	defaultTPMPath = "/dev/tpm0"
+	tpmrmPath      = "/dev/tpmrm0"
+)
+
+// Open opens the TPM at /dev/tpm0 and returns it wrapped in a Device. If that
+// fails and /dev/tpmrm0 exists, Open tries that instead.
+func Open() (*Device, error) {
+	return openDevice(defaultTPMPath, tpmrmPath)
+}
+
+// OpenPath opens the TPM at the given path like OpenTPM and returns it wrapped
+// in a Device.
+func OpenPath(path string) (*Device, error) {
+	rwc, err := OpenTPM(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewDevice(rwc), nil
+}
+
+// openDevice opens the first of paths that it can. The paths after the first
+// are fallbacks, which are only tried if they exist. If no path can be opened,
+// it returns the error for the first one.
+func openDevice(paths ...string) (*Device, error) {
+	var firstErr error
+	for i, path := range paths {
+		if i > 0 {
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+		}
+		d, err := OpenPath(path)
+		if err == nil {
+			return d, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// openError explains the common reasons that a TPM device can't be opened,
+// wrapping err.
+func openError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("no TPM device found: %w", err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("insufficient permission; need root or tss group membership: %w", err)
+	case errors.Is(err, syscall.EBUSY):
+		return fmt.Errorf("device busy; another process holds the TPM, try %s: %w", tpmrmPath, err)
+	default:
+		return err
+	}
+}
+
 // openAndStartupTPM opens the TPM and optionally runs TPM_Startup if needed.
 // This feature is implemented only for testing.
 func openAndStartupTPM(path string, doStartup bool) (io.ReadWriteCloser, error) {
 	rwc, err := tpmutil.OpenTPM(path)
 	if err != nil {
-		return nil, err
+		return nil, openError(err)
 	}
 
 	// Make sure this is a TPM 1.2
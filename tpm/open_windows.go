@@ -35,3 +35,12 @@ func OpenTPM() (io.ReadWriteCloser, error) {
 
 	return tpmutil.OpenTPM()
 }
+
+// Open opens the TPM like OpenTPM and returns it wrapped in a Device.
+func Open() (*Device, error) {
+	rwc, err := OpenTPM()
+	if err != nil {
+		return nil, err
+	}
+	return NewDevice(rwc), nil
+}
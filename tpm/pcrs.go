@@ -16,32 +16,45 @@ package tpm
 
 import (
 	"crypto/sha1"
-	"errors"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
+	"strings"
 
-	"github.com/google/go-tpm/tpmutil"
+	"github.com/google/go-tpm/tpm/verify"
 )
 
-// setPCR sets a PCR value as selected in a given mask.
-func (pm *pcrMask) setPCR(i int) error {
-	if i >= 24 || i < 0 {
-		return errors.New("can't set PCR " + strconv.Itoa(i))
-	}
+// numPCRs is the number of PCRs that a pcrMask can select. TPM 1.2 PC Client
+// TPMs have exactly this many PCRs.
+const numPCRs = 24
 
-	(*pm)[i/8] |= 1 << uint(i%8)
-	return nil
+// describePCRs formats a list of PCRs for people, such as "PCRs 0,2,4,17".
+func describePCRs(pcrs []int) string {
+	if len(pcrs) == 0 {
+		return "no PCRs"
+	}
+	s := make([]string, len(pcrs))
+	for i, p := range pcrs {
+		s[i] = strconv.Itoa(p)
+	}
+	if len(pcrs) == 1 {
+		return "PCR " + s[0]
+	}
+	return "PCRs " + strings.Join(s, ",")
 }
 
-// isPCRSet checks to see if a given PCR is included in this mask.
-func (pm pcrMask) isPCRSet(i int) (bool, error) {
-	if i >= 24 || i < 0 {
-		return false, errors.New("can't check PCR " + strconv.Itoa(i))
+// DescribeQuoteCoverage returns a description of the PCRs that a quote with
+// the signature sig over pcrs covers, for UIs and logs, such as "quote over
+// PCRs 0,2,4,17 (256-byte signature)". The PCRs are listed the way the TPM
+// selects them: in increasing order, each once.
+func DescribeQuoteCoverage(sig []byte, pcrs []int) string {
+	mask, err := verify.NewPCRMask(pcrs)
+	if err != nil {
+		return fmt.Sprintf("quote over invalid PCRs: %v", err)
 	}
-
-	n := byte(1 << uint(i%8))
-	return pm[i/8]&n == n, nil
+	return fmt.Sprintf("quote over %s (%d-byte signature)", describePCRs(mask.PCRs()), len(sig))
 }
 
 // String returns a string representation of a pcrSelection
@@ -51,34 +64,150 @@ func (p pcrSelection) String() string {
 
 // newPCRSelection creates a new pcrSelection for the given set of PCRs.
 func newPCRSelection(pcrVals []int) (*pcrSelection, error) {
-	pcrs := &pcrSelection{Size: 3}
-	for _, v := range pcrVals {
-		if err := pcrs.Mask.setPCR(v); err != nil {
-			return nil, err
-		}
+	mask, err := verify.NewPCRMask(pcrVals)
+	if err != nil {
+		return nil, err
 	}
 
-	return pcrs, nil
+	return &pcrSelection{Size: 3, Mask: mask}, nil
 }
 
 // createPCRComposite composes a set of PCRs by prepending a pcrSelection and a
 // length, then computing the SHA1 hash and returning its output.
 func createPCRComposite(mask pcrMask, pcrs []byte) ([]byte, error) {
-	if len(pcrs)%PCRSize != 0 {
-		return nil, errors.New("pcrs must be a multiple of " + strconv.Itoa(PCRSize))
+	d, err := verify.PCRCompositeDigest(mask, pcrs)
+	if err != nil {
+		return nil, err
 	}
+	return d[:], nil
+}
 
-	pcrc := pcrComposite{
-		Selection: pcrSelection{3, mask},
-		Values:    pcrs,
+// ReadPCRComposite reads the given PCRs and returns their values along with
+// the serialized TPM_PCR_COMPOSITE that a quote over those PCRs hashes. The
+// values are in the order the TPM uses: sorted by PCR index, with each PCR
+// included once, whatever the order of pcrNums.
+func ReadPCRComposite(rw io.ReadWriter, pcrNums []int) ([]byte, []byte, error) {
+	sel, err := newPCRSelection(pcrNums)
+	if err != nil {
+		return nil, nil, err
 	}
-	b, err := tpmutil.Pack(pcrc)
+
+	values, err := FetchPCRValues(rw, sel.Mask.PCRs())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	composite, err := verify.PackPCRComposite(sel.Mask, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	return values, composite, nil
+}
+
+// String returns the value as hex.
+func (v PCRValue) String() string {
+	return hex.EncodeToString(v[:])
+}
+
+// A PCRBank holds the values of a set of PCRs, keyed by PCR index.
+type PCRBank map[int]PCRValue
+
+// FetchPCRValuesMap reads the given PCRs into a PCRBank.
+func FetchPCRValuesMap(rw io.ReadWriter, pcrNums []int) (PCRBank, error) {
+	if _, err := verify.NewPCRMask(pcrNums); err != nil {
+		return nil, err
+	}
+	bank := make(PCRBank, len(pcrNums))
+	for _, i := range pcrNums {
+		v, err := ReadPCR(rw, uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		bank[i] = PCRValue(v)
+	}
+	return bank, nil
+}
+
+// PCRs returns the indices of the PCRs in the bank, in increasing order.
+func (b PCRBank) PCRs() []int {
+	pcrs := make([]int, 0, len(b))
+	for i := range b {
+		pcrs = append(pcrs, i)
+	}
+	sort.Ints(pcrs)
+	return pcrs
+}
+
+// Composite returns the serialized TPM_PCR_COMPOSITE of the PCRs in the bank,
+// which is what a quote over those PCRs hashes.
+func (b PCRBank) Composite() ([]byte, error) {
+	pcrs := b.PCRs()
+	mask, err := verify.NewPCRMask(pcrs)
 	if err != nil {
 		return nil, err
 	}
+	values := make([]byte, 0, len(pcrs)*PCRSize)
+	for _, i := range pcrs {
+		v := b[i]
+		values = append(values, v[:]...)
+	}
+	return verify.PackPCRComposite(mask, values)
+}
+
+// Digest returns the SHA-1 digest of the composite of the PCRs in the bank,
+// which is the digest that a quote, or a blob sealed to those PCRs, expects.
+func (b PCRBank) Digest() (Digest, error) {
+	composite, err := b.Composite()
+	if err != nil {
+		return Digest{}, err
+	}
+	return sha1.Sum(composite), nil
+}
+
+// String returns a string representation of a PCRBank, with the value of each
+// PCR in hex, in order of PCR index.
+func (b PCRBank) String() string {
+	var sb strings.Builder
+	sb.WriteString("PCRBank{")
+	for n, i := range b.PCRs() {
+		if n > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%d: %s", i, b[i])
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
 
-	h := sha1.Sum(b)
-	return h[:], nil
+// PCRInfoDigest computes the digestAtRelease of the TPM_PCR_INFO_LONG that Seal
+// binds data to, for the PCRs in pcrs with the values in values, so that a
+// sealed blob's binding can be checked without a TPM. values[i] is the value of
+// pcrs[i], and the PCRs may be listed in any order. The locality selection is
+// checked, but it doesn't change the digest: the TPM stores it in the
+// localityAtRelease of the TPM_PCR_INFO_LONG, and only hashes the
+// TPM_PCR_COMPOSITE of the selected PCRs.
+func PCRInfoDigest(loc Locality, pcrs []int, values [][]byte) (Digest, error) {
+	if loc == 0 || loc&^(LocZero|LocOne|LocTwo|LocThree|LocFour) != 0 {
+		return Digest{}, fmt.Errorf("invalid locality selection 0x%02x", byte(loc))
+	}
+	if len(values) != len(pcrs) {
+		return Digest{}, fmt.Errorf("got %d PCR values for %d PCRs", len(values), len(pcrs))
+	}
+	if _, err := verify.NewPCRMask(pcrs); err != nil {
+		return Digest{}, err
+	}
+	bank := make(PCRBank, len(pcrs))
+	for i, pcr := range pcrs {
+		if len(values[i]) != PCRSize {
+			return Digest{}, fmt.Errorf("the value of PCR %d is %d bytes long, want %d", pcr, len(values[i]), PCRSize)
+		}
+		v := PCRValue(values[i])
+		if old, ok := bank[pcr]; ok && old != v {
+			return Digest{}, fmt.Errorf("PCR %d is listed twice with different values", pcr)
+		}
+		bank[pcr] = v
+	}
+	return bank.Digest()
 }
 
 // String returns a string representation of a pcrInfoLong.
@@ -133,14 +262,12 @@ func createPCRInfoShort(loc Locality, mask pcrMask, pcrVals []byte) (*pcrInfoSho
 // newPCRInfoLong creates and returns a pcrInfoLong structure for the given PCR
 // values.
 func newPCRInfoLong(rw io.ReadWriter, loc Locality, pcrNums []int) (*pcrInfoLong, error) {
-	var mask pcrMask
-	for _, pcr := range pcrNums {
-		if err := mask.setPCR(pcr); err != nil {
-			return nil, err
-		}
+	mask, err := verify.NewPCRMask(pcrNums)
+	if err != nil {
+		return nil, err
 	}
 
-	pcrVals, err := FetchPCRValues(rw, pcrNums)
+	pcrVals, err := FetchPCRValues(rw, mask.PCRs())
 	if err != nil {
 		return nil, err
 	}
@@ -149,13 +276,11 @@ func newPCRInfoLong(rw io.ReadWriter, loc Locality, pcrNums []int) (*pcrInfoLong
 }
 
 func newPCRInfoShort(rw io.ReadWriter, loc Locality, pcrNums []int) (*pcrInfoShort, error) {
-	var mask pcrMask
-	for _, pcr := range pcrNums {
-		if err := mask.setPCR(pcr); err != nil {
-			return nil, err
-		}
+	mask, err := verify.NewPCRMask(pcrNums)
+	if err != nil {
+		return nil, err
 	}
-	pcrVals, err := FetchPCRValues(rw, pcrNums)
+	pcrVals, err := FetchPCRValues(rw, mask.PCRs())
 	if err != nil {
 		return nil, err
 	}
@@ -163,14 +288,12 @@ func newPCRInfoShort(rw io.ReadWriter, loc Locality, pcrNums []int) (*pcrInfoSho
 }
 
 func newPCRInfo(rw io.ReadWriter, pcrNums []int) (*pcrInfo, error) {
-	var mask pcrMask
-	for _, pcr := range pcrNums {
-		if err := mask.setPCR(pcr); err != nil {
-			return nil, err
-		}
+	mask, err := verify.NewPCRMask(pcrNums)
+	if err != nil {
+		return nil, err
 	}
 
-	pcrVals, err := FetchPCRValues(rw, pcrNums)
+	pcrVals, err := FetchPCRValues(rw, mask.PCRs())
 	if err != nil {
 		return nil, err
 	}
@@ -190,13 +313,20 @@ func newPCRInfo(rw io.ReadWriter, pcrNums []int) (*pcrInfo, error) {
 // newPCRInfoLongWithHashes creates and returns a pcrInfoLong structure for the
 // given PCRs and hashes.
 func newPCRInfoLongWithHashes(loc Locality, pcrs map[int][]byte) (*pcrInfoLong, error) {
-	var mask pcrMask
+	pcrNums := make([]int, 0, len(pcrs))
+	for index := range pcrs {
+		pcrNums = append(pcrNums, index)
+	}
+	sort.Ints(pcrNums)
+	mask, err := verify.NewPCRMask(pcrNums)
+	if err != nil {
+		return nil, err
+	}
+
+	// The hashes must be in the order of the mask, not of the map.
 	var hashes []byte
-	for index, hash := range pcrs {
-		if err := mask.setPCR(index); err != nil {
-			return nil, err
-		}
-		hashes = append(hashes, hash...)
+	for _, index := range mask.PCRs() {
+		hashes = append(hashes, pcrs[index]...)
 	}
 
 	return createPCRInfoLong(loc, mask, hashes)
@@ -15,24 +15,34 @@
 package tpm
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+	"github.com/google/go-tpm/tpmutil"
 )
 
 func TestPCRMask(t *testing.T) {
 	var mask pcrMask
-	if err := mask.setPCR(-1); err == nil {
+	if err := mask.Set(-1); err == nil {
 		t.Fatal("Incorrectly allowed non-existent PCR -1 to be set")
 	}
 
-	if err := mask.setPCR(24); err == nil {
+	if err := mask.Set(24); err == nil {
 		t.Fatal("Incorrectly allowed non-existent PCR 24 to be set")
 	}
 
-	if err := mask.setPCR(0); err != nil {
+	if err := mask.Set(0); err != nil {
 		t.Fatal("Couldn't set PCR 0 in the mask:", err)
 	}
 
-	set, err := mask.isPCRSet(0)
+	set, err := mask.IsSet(0)
 	if err != nil {
 		t.Fatal("Couldn't check to see if PCR 0 was set:", err)
 	}
@@ -41,11 +51,11 @@ func TestPCRMask(t *testing.T) {
 		t.Fatal("Incorrectly said PCR wasn't set when it should have been")
 	}
 
-	if err := mask.setPCR(18); err != nil {
+	if err := mask.Set(18); err != nil {
 		t.Fatal("Couldn't set PCR 18 in the mask:", err)
 	}
 
-	set, err = mask.isPCRSet(18)
+	set, err = mask.IsSet(18)
 	if err != nil {
 		t.Fatal("Couldn't check to see if PCR 18 was set:", err)
 	}
@@ -54,11 +64,11 @@ func TestPCRMask(t *testing.T) {
 		t.Fatal("Incorrectly said PCR wasn't set when it should have been")
 	}
 
-	if _, err := mask.isPCRSet(-1); err == nil {
+	if _, err := mask.IsSet(-1); err == nil {
 		t.Fatal("Incorrectly permitted a check for PCR -1")
 	}
 
-	if _, err := mask.isPCRSet(400); err == nil {
+	if _, err := mask.IsSet(400); err == nil {
 		t.Fatal("Incorrectly permitted a check for PCR 400")
 	}
 }
@@ -73,7 +83,7 @@ func TestNewPCRSelection(t *testing.T) {
 		t.Fatal("Incorrectly size in a PCR selection")
 	}
 
-	set, err := pcrs.Mask.isPCRSet(17)
+	set, err := pcrs.Mask.IsSet(17)
 	if err != nil {
 		t.Fatal("Couldn't check a PCR on a mask in a PCR selection")
 	}
@@ -82,7 +92,7 @@ func TestNewPCRSelection(t *testing.T) {
 		t.Fatal("PCR 17 wasn't set in a PCR selection after setting it")
 	}
 
-	set, err = pcrs.Mask.isPCRSet(20)
+	set, err = pcrs.Mask.IsSet(20)
 	if err != nil {
 		t.Fatal("Couldn't check an unset PCR on a mask in a PCR selection")
 	}
@@ -92,6 +102,22 @@ func TestNewPCRSelection(t *testing.T) {
 	}
 }
 
+func TestNewPCRSelectionOutOfRange(t *testing.T) {
+	for _, pcrs := range [][]int{{-1}, {99}, {17, -1, 18, 99}} {
+		_, err := newPCRSelection(pcrs)
+		if err == nil {
+			t.Fatalf("Incorrectly created a PCR selection with PCRs %v", pcrs)
+		}
+		for _, bad := range []int{-1, 99} {
+			for _, p := range pcrs {
+				if p == bad && !strings.Contains(err.Error(), strconv.Itoa(bad)) {
+					t.Errorf("newPCRSelection(%v) returned %q, which doesn't mention PCR %d", pcrs, err, bad)
+				}
+			}
+		}
+	}
+}
+
 func TestIncorrectCreatePCRComposite(t *testing.T) {
 	pcrs, err := newPCRSelection([]int{17, 18})
 	if err != nil {
@@ -143,3 +169,283 @@ func TestNewPCRInfoLongWithHashes(t *testing.T) {
 		t.Fatal("Couldn't create pcrInfoLong structure")
 	}
 }
+
+func TestNewPCRInfoLongWithHashesOrder(t *testing.T) {
+	h16 := PCRValue(sha1.Sum([]byte("16")))
+	h23 := PCRValue(sha1.Sum([]byte("23")))
+	want, err := createPCRInfoLong(LocZero, pcrMask{0x00, 0x00, 0x81}, append(h16[:], h23[:]...))
+	if err != nil {
+		t.Fatal("Couldn't create pcrInfoLong structure:", err)
+	}
+
+	// Map iteration order is random, so try a few times.
+	for i := 0; i < 10; i++ {
+		got, err := newPCRInfoLongWithHashes(LocZero, map[int][]byte{23: h23[:], 16: h16[:]})
+		if err != nil {
+			t.Fatal("Couldn't create pcrInfoLong structure:", err)
+		}
+		if got.DigestAtRelease != want.DigestAtRelease {
+			t.Fatalf("DigestAtRelease is % x, want % x", got.DigestAtRelease, want.DigestAtRelease)
+		}
+	}
+}
+
+func TestNewPCRInfoLongWithHashesOutOfRange(t *testing.T) {
+	if _, err := newPCRInfoLongWithHashes(LocZero, map[int][]byte{-1: make([]byte, 20), 99: make([]byte, 20)}); err == nil {
+		t.Fatal("Incorrectly created a pcrInfoLong for PCRs -1 and 99")
+	}
+}
+
+func TestReadPCRComposite(t *testing.T) {
+	f := testtpm.NewFake()
+	if _, err := PcrExtend(f, 17, PCRValue(sha1.Sum([]byte("17")))); err != nil {
+		t.Fatal("Couldn't extend PCR 17:", err)
+	}
+	if _, err := PcrExtend(f, 18, PCRValue(sha1.Sum([]byte("18")))); err != nil {
+		t.Fatal("Couldn't extend PCR 18:", err)
+	}
+
+	// Out of order and with a duplicate, to check the canonical encoding.
+	values, composite, err := ReadPCRComposite(f, []int{18, 17, 18})
+	if err != nil {
+		t.Fatal("Couldn't read the PCR composite:", err)
+	}
+	want, err := FetchPCRValues(f, []int{17, 18})
+	if err != nil {
+		t.Fatal("Couldn't read PCRs 17 and 18:", err)
+	}
+	if !bytes.Equal(values, want) {
+		t.Fatalf("ReadPCRComposite returned values % x, want % x", values, want)
+	}
+
+	wantPrefix := []byte{0x00, 0x03, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x28}
+	if !bytes.HasPrefix(composite, wantPrefix) || !bytes.Equal(composite[len(wantPrefix):], want) {
+		t.Fatalf("ReadPCRComposite returned composite % x, want % x followed by the values", composite, wantPrefix)
+	}
+
+	sel, err := newPCRSelection([]int{17, 18})
+	if err != nil {
+		t.Fatal("Couldn't create a PCR selection:", err)
+	}
+	digest, err := createPCRComposite(sel.Mask, want)
+	if err != nil {
+		t.Fatal("Couldn't create the PCR composite digest:", err)
+	}
+	if got := sha1.Sum(composite); !bytes.Equal(got[:], digest) {
+		t.Fatalf("SHA1 of the composite is % x, want % x", got, digest)
+	}
+}
+
+func TestPCRBank(t *testing.T) {
+	f := testtpm.NewFake()
+	if _, err := PcrExtend(f, 17, PCRValue(sha1.Sum([]byte("17")))); err != nil {
+		t.Fatal("Couldn't extend PCR 17:", err)
+	}
+
+	bank, err := FetchPCRValuesMap(f, []int{18, 17})
+	if err != nil {
+		t.Fatal("Couldn't read PCRs 17 and 18:", err)
+	}
+	if got := bank.PCRs(); len(got) != 2 || got[0] != 17 || got[1] != 18 {
+		t.Fatalf("PCRBank.PCRs returned %v, want [17 18]", got)
+	}
+
+	composite, err := bank.Composite()
+	if err != nil {
+		t.Fatal("Couldn't create the PCR bank composite:", err)
+	}
+	_, want, err := ReadPCRComposite(f, []int{17, 18})
+	if err != nil {
+		t.Fatal("Couldn't read the PCR composite:", err)
+	}
+	if !bytes.Equal(composite, want) {
+		t.Fatalf("PCRBank.Composite returned % x, want % x", composite, want)
+	}
+
+	sel, err := newPCRSelection([]int{17, 18})
+	if err != nil {
+		t.Fatal("Couldn't create a PCR selection:", err)
+	}
+	v17, v18 := bank[17], bank[18]
+	wantDigest, err := createPCRComposite(sel.Mask, append(v17[:], v18[:]...))
+	if err != nil {
+		t.Fatal("Couldn't create the PCR composite digest:", err)
+	}
+	digest, err := bank.Digest()
+	if err != nil {
+		t.Fatal("Couldn't compute the PCR bank digest:", err)
+	}
+	if !bytes.Equal(digest[:], wantDigest) {
+		t.Fatalf("PCRBank.Digest returned % x, want % x", digest, wantDigest)
+	}
+
+	wantString := "PCRBank{17: " + bank[17].String() + ", 18: " + strings.Repeat("00", 20) + "}"
+	if s := bank.String(); s != wantString {
+		t.Fatalf("PCRBank.String returned %q, want %q", s, wantString)
+	}
+}
+
+func TestPCRBankOutOfRange(t *testing.T) {
+	if _, err := (PCRBank{99: PCRValue{}}).Composite(); err == nil {
+		t.Fatal("Incorrectly created a composite for PCR 99")
+	}
+	if _, err := FetchPCRValuesMap(testtpm.NewFake(), []int{-1}); err == nil {
+		t.Fatal("Incorrectly read PCR -1")
+	}
+}
+
+func TestCoveredPCRs(t *testing.T) {
+	for _, pcrs := range [][]int{
+		nil,
+		{0},
+		{23},
+		{0, 2, 4, 17},
+		{7, 8, 15, 16, 23},
+		{23, 0, 17, 17},
+	} {
+		sel, err := newPCRSelection(pcrs)
+		if err != nil {
+			t.Fatalf("newPCRSelection(%v) failed: %v", pcrs, err)
+		}
+		info, err := tpmutil.Pack(pcrInfoLong{
+			Tag:            tagPCRInfoLong,
+			LocAtCreation:  LocZero,
+			LocAtRelease:   LocZero,
+			PCRsAtCreation: *sel,
+			PCRsAtRelease:  *sel,
+		})
+		if err != nil {
+			t.Fatal("Couldn't pack the TPM_PCR_INFO_LONG:", err)
+		}
+		b, err := parsePCRBinding(info, true)
+		if err != nil {
+			t.Fatalf("Couldn't parse the TPM_PCR_INFO_LONG for %v: %v", pcrs, err)
+		}
+
+		want := slices.Clone(pcrs)
+		slices.Sort(want)
+		want = slices.Compact(want)
+		if got := b.CoveredPCRs(); !slices.Equal(got, want) {
+			t.Errorf("CoveredPCRs() for %v = %v, want %v", pcrs, got, want)
+		}
+	}
+}
+
+func TestDescribeQuoteCoverage(t *testing.T) {
+	sig := make([]byte, 256)
+	for _, tt := range []struct {
+		pcrs []int
+		want string
+	}{
+		{nil, "quote over no PCRs (256-byte signature)"},
+		{[]int{23}, "quote over PCR 23 (256-byte signature)"},
+		{[]int{17, 4, 0, 2, 4}, "quote over PCRs 0,2,4,17 (256-byte signature)"},
+	} {
+		if got := DescribeQuoteCoverage(sig, tt.pcrs); got != tt.want {
+			t.Errorf("DescribeQuoteCoverage(sig, %v) = %q, want %q", tt.pcrs, got, tt.want)
+		}
+	}
+	if got := DescribeQuoteCoverage(sig, []int{24}); !strings.Contains(got, "invalid") {
+		t.Errorf("DescribeQuoteCoverage(sig, [24]) = %q, want a description of invalid PCRs", got)
+	}
+}
+
+func TestPCROrderInsensitive(t *testing.T) {
+	f := testtpm.NewFake()
+	if _, err := PcrExtend(f, 17, PCRValue{17}); err != nil {
+		t.Fatal("Couldn't extend PCR 17:", err)
+	}
+	if _, err := PcrExtend(f, 18, PCRValue{18}); err != nil {
+		t.Fatal("Couldn't extend PCR 18:", err)
+	}
+
+	// The PCRs are listed out of order and with a repeat, but are sealed to
+	// in increasing order, as the TPM checks them.
+	data := []byte("sealed to PCRs 17 and 18")
+	sealed, err := Seal(f, LocZero, []int{18, 17, 17}, data, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't seal:", err)
+	}
+	got, err := Unseal(f, sealed, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't unseal data sealed to PCRs listed out of order:", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Unseal returned %q, want %q", got, data)
+	}
+
+	// A verifier may list the PCRs in any order too, as long as the values
+	// are in increasing PCR order, as the TPM returns them.
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	values, err := FetchPCRValues(f, []int{17, 18})
+	if err != nil {
+		t.Fatal("Couldn't read the PCRs:", err)
+	}
+	nonce := Nonce{1}
+	_, sig := signComposite(t, k, nonce, []int{17, 18}, values)
+	for _, pcrNums := range [][]int{{17, 18}, {18, 17}, {18, 17, 18}} {
+		if err := VerifyQuoteExternalData(&k.PublicKey, nonce, sig, pcrNums, values); err != nil {
+			t.Errorf("VerifyQuoteExternalData with PCRs %v failed: %v", pcrNums, err)
+		}
+	}
+	if err := VerifyQuoteExternalData(&k.PublicKey, nonce, sig, []int{18, 17}, append(values, values[:PCRSize]...)); err == nil {
+		t.Error("VerifyQuoteExternalData accepted three PCR values for two PCRs")
+	}
+}
+
+func TestPCRInfoDigest(t *testing.T) {
+	f := testtpm.NewFake()
+	if _, err := PcrExtend(f, 17, PCRValue{1}); err != nil {
+		t.Fatal("Couldn't extend PCR 17:", err)
+	}
+	pcrs := []int{18, 17}
+	var values [][]byte
+	for _, i := range pcrs {
+		v, err := ReadPCR(f, uint32(i))
+		if err != nil {
+			t.Fatal("Couldn't read the PCR:", err)
+		}
+		values = append(values, v)
+	}
+
+	for _, loc := range []Locality{LocZero, LocThree | LocFour} {
+		sealed, err := Seal(f, loc, pcrs, []byte("secret"), wellKnownAuth())
+		if err != nil {
+			t.Fatal("Couldn't seal the data:", err)
+		}
+		var sd tpmStoredData
+		if _, err := tpmutil.Unpack(sealed, &sd); err != nil {
+			t.Fatal("Couldn't unpack the sealed blob:", err)
+		}
+		var info pcrInfoLong
+		if _, err := tpmutil.Unpack(sd.Info, &info); err != nil {
+			t.Fatal("Couldn't unpack the PCR info of the sealed blob:", err)
+		}
+		if info.LocAtRelease != loc {
+			t.Fatalf("the sealed blob has locality %v, want %v", info.LocAtRelease, loc)
+		}
+
+		d, err := PCRInfoDigest(loc, pcrs, values)
+		if err != nil {
+			t.Fatalf("PCRInfoDigest with %v failed: %v", loc, err)
+		}
+		if d != info.DigestAtRelease {
+			t.Fatalf("PCRInfoDigest with %v returned %x, want the digestAtRelease %x of the sealed blob", loc, d, info.DigestAtRelease)
+		}
+	}
+
+	for _, loc := range []Locality{0, 0x20} {
+		if _, err := PCRInfoDigest(loc, pcrs, values); err == nil {
+			t.Errorf("PCRInfoDigest accepted locality selection 0x%02x", byte(loc))
+		}
+	}
+	if _, err := PCRInfoDigest(LocZero, []int{17, 17}, [][]byte{values[1], values[0]}); err == nil {
+		t.Error("PCRInfoDigest accepted two different values for PCR 17")
+	}
+	if _, err := PCRInfoDigest(LocZero, pcrs, values[:1]); err == nil {
+		t.Error("PCRInfoDigest accepted one value for two PCRs")
+	}
+}
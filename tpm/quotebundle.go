@@ -0,0 +1,269 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm/verify"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// quoteBundleVersion is the version written by QuoteBundle.MarshalBinary.
+const quoteBundleVersion uint16 = 1
+
+// A QuoteBundle holds a quote together with everything needed to verify it,
+// so that it can be sent to a verifier as a single value.
+type QuoteBundle struct {
+	// Nonce is the externalData of the quote.
+	Nonce Nonce
+
+	// PCRs are the indices of the quoted PCRs, in increasing order.
+	PCRs []int
+
+	// Values are the values of the PCRs, in the same order.
+	Values []byte
+
+	// Signature is the quote signature.
+	Signature []byte
+}
+
+// QuoteBundled quotes the given PCRs with the key at handle, using nonce as
+// the externalData, and returns the result as a QuoteBundle. The bundle
+// records the PCR selection the TPM actually signed.
+func QuoteBundled(rw io.ReadWriter, handle tpmutil.Handle, nonce Nonce, pcrNums []int, keyAuth []byte) (*QuoteBundle, error) {
+	sig, composite, err := QuoteComposite(rw, handle, nonce, pcrNums, keyAuth)
+	if err != nil {
+		return nil, err
+	}
+	var pcrc pcrComposite
+	if _, err := tpmutil.Unpack(composite, &pcrc); err != nil {
+		return nil, err
+	}
+	return &QuoteBundle{
+		Nonce:     nonce,
+		PCRs:      pcrc.Selection.Mask.PCRs(),
+		Values:    pcrc.Values,
+		Signature: sig,
+	}, nil
+}
+
+// QuoteMulti quotes each set of PCRs in pcrSets with the key at handle, using
+// nonce as the externalData of every quote, and returns a QuoteBundle for each
+// set, in order. The quotes run in a single OSAP session, which is kept open
+// between them, rather than one session per quote as with QuoteBundled. Each
+// bundle can be verified on its own.
+func QuoteMulti(rw io.ReadWriter, handle tpmutil.Handle, nonce Nonce, pcrSets [][]int, keyAuth []byte) ([]*QuoteBundle, error) {
+	if len(pcrSets) == 0 {
+		return nil, nil
+	}
+	sels := make([]*pcrSelection, len(pcrSets))
+	for i, pcrs := range pcrSets {
+		sel, err := newPCRSelection(pcrs)
+		if err != nil {
+			return nil, fmt.Errorf("PCR set %d: %v", i, err)
+		}
+		sels[i] = sel
+	}
+
+	s, err := OpenOSAPSession(rw, EntityKeyHandle, handle, keyAuth)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close(rw)
+
+	bundles := make([]*QuoteBundle, len(sels))
+	for i, sel := range sels {
+		// Keep the session open for all but the last quote.
+		authIn := []interface{}{OrdQuote, nonce, sel}
+		ca, err := s.newCommandAuth(authIn, i < len(sels)-1)
+		if err != nil {
+			return nil, err
+		}
+
+		pcrc, sig, ra, ret, err := quote(rw, handle, nonce, sel, ca)
+		if err != nil {
+			if err == tpmError(errAuthFail) {
+				err = s.entityError(err)
+			}
+			err = keyHandleError(handle, err)
+			return nil, fmt.Errorf("PCR set %d: %w", i, err)
+		}
+
+		// Check response authentication, which also rolls the session
+		// over to the NonceEven for the next quote.
+		raIn := []interface{}{ret, OrdQuote, pcrc, tpmutil.U32Bytes(sig)}
+		if err := s.verify(ca, ra, raIn); err != nil {
+			return nil, fmt.Errorf("PCR set %d: %w", i, err)
+		}
+
+		bundles[i] = &QuoteBundle{
+			Nonce:     nonce,
+			PCRs:      pcrc.Selection.Mask.PCRs(),
+			Values:    pcrc.Values,
+			Signature: sig,
+		}
+	}
+	return bundles, nil
+}
+
+// Verify checks that the bundle's signature is a quote by pub over its nonce
+// and PCR values.
+func (b *QuoteBundle) Verify(pub *rsa.PublicKey) error {
+	sel, err := newPCRSelection(b.PCRs)
+	if err != nil {
+		return err
+	}
+	composite, err := verify.PackPCRComposite(sel.Mask, b.Values)
+	if err != nil {
+		return err
+	}
+	return VerifyQuoteComposite(pub, b.Nonce, b.Signature, b.PCRs, composite)
+}
+
+// VerifyFresh is like Verify, but also checks that the quote was made over
+// expectedNonce, the challenge the verifier sent, so that a quote made for an
+// earlier challenge can't be replayed. It returns ErrNonceMismatch if the
+// nonces differ.
+func (b *QuoteBundle) VerifyFresh(pub *rsa.PublicKey, expectedNonce Nonce) error {
+	if subtle.ConstantTimeCompare(b.Nonce[:], expectedNonce[:]) != 1 {
+		return ErrNonceMismatch
+	}
+	return b.Verify(pub)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding starts with
+// a version number so that fields can be added later.
+func (b *QuoteBundle) MarshalBinary() ([]byte, error) {
+	sel, err := newPCRSelection(b.PCRs)
+	if err != nil {
+		return nil, err
+	}
+	return tpmutil.Pack(quoteBundleVersion, b.Nonce, sel, tpmutil.U32Bytes(b.Values), tpmutil.U32Bytes(b.Signature))
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (b *QuoteBundle) UnmarshalBinary(data []byte) error {
+	var version uint16
+	n, err := tpmutil.Unpack(data, &version)
+	if err != nil {
+		return err
+	}
+	if version != quoteBundleVersion {
+		return fmt.Errorf("unsupported QuoteBundle version %d", version)
+	}
+
+	var nonce Nonce
+	var sel pcrSelection
+	var values, sig tpmutil.U32Bytes
+	m, err := tpmutil.Unpack(data[n:], &nonce, &sel, &values, &sig)
+	if err != nil {
+		return err
+	}
+	if n+m != len(data) {
+		return fmt.Errorf("got %d trailing bytes after the QuoteBundle", len(data)-n-m)
+	}
+	if sel.Size != 3 {
+		return fmt.Errorf("unsupported PCR selection size %d", sel.Size)
+	}
+
+	*b = QuoteBundle{
+		Nonce:     nonce,
+		PCRs:      sel.Mask.PCRs(),
+		Values:    values,
+		Signature: sig,
+	}
+	return nil
+}
+
+// quoteBundleJSON is the JSON encoding of a QuoteBundle. encoding/json
+// encodes the byte slices in base64, so that they survive transit exactly.
+type quoteBundleJSON struct {
+	Version   uint16 `json:"version"`
+	Nonce     []byte `json:"nonce"`
+	PCRs      []int  `json:"pcrs"`
+	Values    []byte `json:"values"`
+	Signature []byte `json:"signature"`
+}
+
+// MarshalJSON implements json.Marshaler. The nonce, the PCR values and the
+// signature are encoded in base64, and the PCR indices as a list of numbers.
+// Like the binary encoding, the JSON has a version number.
+func (b *QuoteBundle) MarshalJSON() ([]byte, error) {
+	if err := checkPCRValues(b.PCRs, b.Values); err != nil {
+		return nil, err
+	}
+	return json.Marshal(quoteBundleJSON{
+		Version:   quoteBundleVersion,
+		Nonce:     b.Nonce[:],
+		PCRs:      b.PCRs,
+		Values:    b.Values,
+		Signature: b.Signature,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *QuoteBundle) UnmarshalJSON(data []byte) error {
+	var j quoteBundleJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.Version != quoteBundleVersion {
+		return fmt.Errorf("unsupported QuoteBundle version %d", j.Version)
+	}
+	var nonce Nonce
+	if len(j.Nonce) != len(nonce) {
+		return fmt.Errorf("the nonce is %d bytes long, want %d", len(j.Nonce), len(nonce))
+	}
+	copy(nonce[:], j.Nonce)
+	if err := checkPCRValues(j.PCRs, j.Values); err != nil {
+		return err
+	}
+
+	*b = QuoteBundle{
+		Nonce:     nonce,
+		PCRs:      j.PCRs,
+		Values:    j.Values,
+		Signature: j.Signature,
+	}
+	return nil
+}
+
+// checkPCRValues checks that pcrs is a valid list of PCR indices, in the
+// increasing order of their values and without duplicates, and that values
+// holds one value for each of them.
+func checkPCRValues(pcrs []int, values []byte) error {
+	sel, err := newPCRSelection(pcrs)
+	if err != nil {
+		return err
+	}
+	sorted := sel.Mask.PCRs()
+	if len(sorted) != len(pcrs) {
+		return fmt.Errorf("the PCR list %v has duplicates", pcrs)
+	}
+	for i := range sorted {
+		if sorted[i] != pcrs[i] {
+			return fmt.Errorf("the PCR list %v isn't in increasing order", pcrs)
+		}
+	}
+	if len(values) != len(pcrs)*PCRSize {
+		return fmt.Errorf("got %d bytes of PCR values for %d PCRs, want %d", len(values), len(pcrs), len(pcrs)*PCRSize)
+	}
+	return nil
+}
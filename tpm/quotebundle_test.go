@@ -0,0 +1,171 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQuoteBundleRoundTrip(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	var nonce Nonce
+	copy(nonce[:], "01234567890123456789")
+	pcrNums := []int{17, 18}
+	values := bytes.Repeat([]byte{0x42}, 2*PCRSize)
+	_, sig := signComposite(t, k, nonce, pcrNums, values)
+
+	b := &QuoteBundle{Nonce: nonce, PCRs: pcrNums, Values: values, Signature: sig}
+	if err := b.Verify(&k.PublicKey); err != nil {
+		t.Fatal("Couldn't verify the quote bundle:", err)
+	}
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal("Couldn't marshal the quote bundle:", err)
+	}
+	var got QuoteBundle
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal("Couldn't unmarshal the quote bundle:", err)
+	}
+	if got.Nonce != b.Nonce || !bytes.Equal(got.Values, b.Values) || !bytes.Equal(got.Signature, b.Signature) || len(got.PCRs) != 2 || got.PCRs[0] != 17 || got.PCRs[1] != 18 {
+		t.Fatalf("UnmarshalBinary returned %+v, want %+v", got, b)
+	}
+	if err := got.Verify(&k.PublicKey); err != nil {
+		t.Fatal("Couldn't verify the unmarshaled quote bundle:", err)
+	}
+
+	got.Values[0] ^= 0xff
+	if err := got.Verify(&k.PublicKey); err == nil {
+		t.Fatal("Verify accepted a quote bundle with modified PCR values")
+	}
+}
+
+func TestQuoteBundleVerifyFresh(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	var nonceA, nonceB Nonce
+	copy(nonceA[:], "AAAAAAAAAAAAAAAAAAAA")
+	copy(nonceB[:], "BBBBBBBBBBBBBBBBBBBB")
+	pcrNums := []int{17, 18}
+	values := bytes.Repeat([]byte{0x42}, 2*PCRSize)
+	_, sig := signComposite(t, k, nonceA, pcrNums, values)
+
+	b := &QuoteBundle{Nonce: nonceA, PCRs: pcrNums, Values: values, Signature: sig}
+	if err := b.VerifyFresh(&k.PublicKey, nonceA); err != nil {
+		t.Fatal("Couldn't verify the quote bundle against its own nonce:", err)
+	}
+	if err := b.VerifyFresh(&k.PublicKey, nonceB); !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("VerifyFresh with a different expected nonce returned %v, want ErrNonceMismatch", err)
+	}
+
+	// A bundle whose nonce was rewritten to the expected one must still fail,
+	// since the signature covers the original nonce.
+	b.Nonce = nonceB
+	if err := b.VerifyFresh(&k.PublicKey, nonceB); err == nil {
+		t.Fatal("VerifyFresh accepted a quote bundle whose nonce was replaced")
+	}
+}
+
+func TestQuoteBundleUnmarshalErrors(t *testing.T) {
+	b := &QuoteBundle{PCRs: []int{17}, Values: make([]byte, PCRSize), Signature: []byte{1, 2, 3}}
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal("Couldn't marshal the quote bundle:", err)
+	}
+
+	badVersion := append([]byte(nil), data...)
+	badVersion[1] = 99
+	trailing := append(append([]byte(nil), data...), 0)
+	for _, d := range [][]byte{nil, badVersion, trailing, data[:len(data)-1]} {
+		var got QuoteBundle
+		if err := got.UnmarshalBinary(d); err == nil {
+			t.Errorf("UnmarshalBinary(% x) succeeded, want an error", d)
+		}
+	}
+}
+
+func TestQuoteBundleJSON(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	var nonce Nonce
+	copy(nonce[:], "01234567890123456789")
+	pcrNums := []int{0, 7, 17}
+	values := make([]byte, len(pcrNums)*PCRSize)
+	if _, err := rand.Read(values); err != nil {
+		t.Fatal("Couldn't make PCR values:", err)
+	}
+	_, sig := signComposite(t, k, nonce, pcrNums, values)
+
+	data, err := json.Marshal(&QuoteBundle{Nonce: nonce, PCRs: pcrNums, Values: values, Signature: sig})
+	if err != nil {
+		t.Fatal("Couldn't marshal the quote bundle to JSON:", err)
+	}
+	if !strings.Contains(string(data), `"pcrs":[0,7,17]`) {
+		t.Fatalf("The JSON %s doesn't list the PCRs", data)
+	}
+	var got QuoteBundle
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal("Couldn't unmarshal the quote bundle from JSON:", err)
+	}
+	if got.Nonce != nonce || !bytes.Equal(got.Values, values) || !bytes.Equal(got.Signature, sig) {
+		t.Fatalf("The JSON round trip returned %+v", got)
+	}
+	if err := got.Verify(&k.PublicKey); err != nil {
+		t.Fatal("Couldn't verify the quote bundle after the JSON round trip:", err)
+	}
+
+	zeros := func(n int) string { return base64.StdEncoding.EncodeToString(make([]byte, n)) }
+	good := `{"version":1,"nonce":"` + zeros(20) + `","pcrs":[17],"values":"` + zeros(20) + `"}`
+	if err := json.Unmarshal([]byte(good), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed: %v", good, err)
+	}
+	for _, bad := range []string{
+		`{"version":2,"nonce":"` + zeros(20) + `","pcrs":[17],"values":"` + zeros(20) + `"}`,
+		`{"version":1,"nonce":"` + zeros(3) + `","pcrs":[17],"values":"` + zeros(20) + `"}`,
+		`{"version":1,"nonce":"` + zeros(20) + `","pcrs":[18,17],"values":"` + zeros(40) + `"}`,
+		`{"version":1,"nonce":"` + zeros(20) + `","pcrs":[17,17],"values":"` + zeros(40) + `"}`,
+		`{"version":1,"nonce":"` + zeros(20) + `","pcrs":[17,24],"values":"` + zeros(40) + `"}`,
+		`{"version":1,"nonce":"` + zeros(20) + `","pcrs":[17],"values":"` + zeros(3) + `"}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("json.Unmarshal(%s) succeeded, want an error", bad)
+		}
+	}
+	// MarshalJSON refuses what UnmarshalJSON would, so that a bundle can
+	// always read back its own encoding.
+	for _, bad := range []*QuoteBundle{
+		{PCRs: []int{18, 17}, Values: make([]byte, 2*PCRSize)},
+		{PCRs: []int{17, 17}, Values: make([]byte, 2*PCRSize)},
+		{PCRs: []int{17}, Values: make([]byte, 3)},
+	} {
+		if data, err := json.Marshal(bad); err == nil {
+			t.Errorf("json.Marshal(%+v) = %s, want an error", bad, data)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultRandChunkSize is the number of bytes that a RandReader gets from the
+// TPM at a time if no chunk size is given.
+const DefaultRandChunkSize = 256
+
+// A RandReader is an io.Reader of random bytes from the TPM. It gets them a
+// chunk at a time with GetRandom and serves smaller reads from a buffer, so
+// that many small reads need few round trips to the TPM. Like
+// crypto/rand.Reader, a read always fills the whole slice unless there is an
+// error, and a RandReader is safe for concurrent use. Bytes are zeroed in the
+// buffer once they have been read, and Close zeroes the rest.
+type RandReader struct {
+	mu        sync.Mutex
+	rw        io.ReadWriter
+	chunkSize int
+	buf       []byte
+	closed    bool
+}
+
+// NewRandReader returns a RandReader that gets chunkSize bytes from the TPM at
+// a time, or DefaultRandChunkSize bytes if chunkSize is 0 or less.
+func NewRandReader(rw io.ReadWriter, chunkSize int) *RandReader {
+	if chunkSize <= 0 {
+		chunkSize = DefaultRandChunkSize
+	}
+	return &RandReader{rw: rw, chunkSize: chunkSize}
+}
+
+// Read fills p with random bytes from the TPM.
+func (r *RandReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, errors.New("tpm: read from closed RandReader")
+	}
+
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			b, err := GetRandom(r.rw, uint32(r.chunkSize))
+			if err != nil {
+				return n, err
+			}
+			// The TPM may return fewer bytes than asked for, but it must
+			// return some.
+			if len(b) == 0 {
+				return n, tpmError(errShortRandom)
+			}
+			r.buf = b
+		}
+		c := copy(p[n:], r.buf)
+		zeroBytes(r.buf[:c])
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close zeroes the random bytes left in the buffer. The TPM is not closed.
+func (r *RandReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	zeroBytes(r.buf)
+	r.buf = nil
+	r.closed = true
+	return nil
+}
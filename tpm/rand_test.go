@@ -0,0 +1,101 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+)
+
+// countingTPM is a fake TPM that counts the commands written to it.
+type countingTPM struct {
+	*testtpm.Fake
+	commands int
+}
+
+func (c *countingTPM) Write(p []byte) (int, error) {
+	c.commands++
+	return c.Fake.Write(p)
+}
+
+func TestRandReader(t *testing.T) {
+	c := &countingTPM{Fake: testtpm.NewFake()}
+	r := NewRandReader(c, 64)
+
+	// The bytes must be the same as those of GetRandom, in order.
+	want, err := GetRandom(testtpm.NewFake(), 64)
+	if err != nil {
+		t.Fatal("GetRandom failed:", err)
+	}
+	var got []byte
+	for i := 0; i < 4; i++ {
+		b := make([]byte, 16)
+		if n, err := r.Read(b); err != nil || n != len(b) {
+			t.Fatalf("Read %d returned (%d, %v), want (%d, <nil>)", i, n, err, len(b))
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("RandReader returned % x, want % x", got, want)
+	}
+	if c.commands != 1 {
+		t.Fatalf("RandReader sent %d commands for 64 bytes in 64-byte chunks, want 1", c.commands)
+	}
+
+	// A read larger than a chunk needs several.
+	if n, err := r.Read(make([]byte, 100)); err != nil || n != 100 {
+		t.Fatalf("Read of 100 bytes returned (%d, %v), want (100, <nil>)", n, err)
+	}
+	if c.commands != 3 {
+		t.Fatalf("RandReader sent %d commands, want 3", c.commands)
+	}
+
+	buf := r.buf
+	if err := r.Close(); err != nil {
+		t.Fatal("Close failed:", err)
+	}
+	if !bytes.Equal(buf, make([]byte, len(buf))) {
+		t.Fatal("Close didn't zero the buffer")
+	}
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Read incorrectly succeeded after Close")
+	}
+}
+
+func BenchmarkGetRandom16(b *testing.B) {
+	f := testtpm.NewFake()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			if _, err := GetRandom(f, 16); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRandReader16(b *testing.B) {
+	r := NewRandReader(testtpm.NewFake(), DefaultRandChunkSize)
+	defer r.Close()
+	buf := make([]byte, 16)
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			if _, err := r.Read(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// A StoredDataLayout is the layout of a sealed blob, which depends on the
+// version of the TPM that sealed it and on the kind of PCR info it was sealed
+// with.
+type StoredDataLayout int
+
+const (
+	// StoredData11 is the TPM 1.1 TPM_STORED_DATA layout. Its seal info is
+	// a TPM_PCR_INFO, which has no localities.
+	StoredData11 StoredDataLayout = iota + 1
+
+	// StoredData12 is the TPM 1.2 TPM_STORED_DATA12 layout. Its seal info
+	// is a TPM_PCR_INFO_LONG.
+	StoredData12
+)
+
+// String returns the name of the structure for the layout.
+func (l StoredDataLayout) String() string {
+	switch l {
+	case StoredData11:
+		return "TPM_STORED_DATA"
+	case StoredData12:
+		return "TPM_STORED_DATA12"
+	default:
+		return fmt.Sprintf("StoredDataLayout(%d)", int(l))
+	}
+}
+
+// allLocalities is the set of every locality.
+const allLocalities = LocZero | LocOne | LocTwo | LocThree | LocFour
+
+// A PCRBinding is the PCR and locality binding of sealed data or a key, from
+// its TPM_PCR_INFO or TPM_PCR_INFO_LONG. A TPM_PCR_INFO has no localities, so
+// both locality fields allow every locality for it.
+type PCRBinding struct {
+	// PCRsAtCreation and DigestAtCreation are the PCRs and their composite
+	// digest at the time the data was sealed or the key was created.
+	PCRsAtCreation   []int
+	DigestAtCreation Digest
+
+	// PCRsAtRelease and DigestAtRelease are the PCRs and the composite
+	// digest of the values they must hold to unseal the data or use the key.
+	PCRsAtRelease   []int
+	DigestAtRelease Digest
+
+	// LocAtCreation is the locality that sealed the data or created the key,
+	// and LocAtRelease the localities that may unseal or use it.
+	LocAtCreation Locality
+	LocAtRelease  Locality
+
+	// releaseSelection is the serialized TPM_PCR_SELECTION of the release
+	// PCRs, whose size may differ from the one this package uses.
+	releaseSelection []byte
+}
+
+// CoveredPCRs returns the PCRs that the data or key is bound to, the PCRs
+// whose values must match DigestAtRelease to unseal or use it, in increasing
+// order.
+func (b *PCRBinding) CoveredPCRs() []int {
+	return append([]int(nil), b.PCRsAtRelease...)
+}
+
+// SealedData describes the PCR and locality binding of a sealed blob, as
+// returned by Seal or Reseal. A blob that isn't bound to any PCRs has an empty
+// binding that allows every locality.
+type SealedData struct {
+	// Layout is the layout that the blob was parsed as.
+	Layout StoredDataLayout
+
+	PCRBinding
+}
+
+// ParseSealedData parses the PCR and locality binding of a sealed blob in
+// either the TPM_STORED_DATA or the TPM_STORED_DATA12 layout. The layouts
+// start with a structure version and a structure tag, respectively. Unseal
+// sends a blob back to the TPM as it is, so it handles both.
+func ParseSealedData(sealed []byte) (*SealedData, error) {
+	var tsd tpmStoredData
+	if _, err := tpmutil.Unpack(sealed, &tsd); err != nil {
+		return nil, errors.New("couldn't convert the sealed data into a tpmStoredData struct")
+	}
+
+	sd := &SealedData{}
+	switch {
+	case uint16(tsd.Version>>16) == tagStoredData12:
+		sd.Layout = StoredData12
+	case tsd.Version == storedDataVersion:
+		sd.Layout = StoredData11
+	default:
+		return nil, fmt.Errorf("unknown sealed data version or tag 0x%08x", tsd.Version)
+	}
+
+	b, err := parsePCRBinding(tsd.Info, sd.Layout == StoredData12)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the seal info: %v", err)
+	}
+	sd.PCRBinding = *b
+	return sd, nil
+}
+
+// parsePCRBinding parses a serialized TPM_PCR_INFO_LONG if long is true, and a
+// TPM_PCR_INFO otherwise. An empty info gives an empty binding.
+func parsePCRBinding(info []byte, long bool) (*PCRBinding, error) {
+	b := &PCRBinding{
+		LocAtCreation: allLocalities,
+		LocAtRelease:  allLocalities,
+	}
+	if len(info) == 0 {
+		return b, nil
+	}
+
+	buf := bytes.NewBuffer(info)
+	var err error
+	if long {
+		var tag uint16
+		if err := tpmutil.UnpackBuf(buf, &tag, &b.LocAtCreation, &b.LocAtRelease); err != nil {
+			return nil, fmt.Errorf("couldn't parse the TPM_PCR_INFO_LONG: %v", err)
+		}
+		if tag != tagPCRInfoLong {
+			return nil, fmt.Errorf("got tag 0x%04x, want a TPM_PCR_INFO_LONG", tag)
+		}
+		if b.PCRsAtCreation, _, err = parsePCRSelection(buf); err != nil {
+			return nil, err
+		}
+		if b.PCRsAtRelease, b.releaseSelection, err = parsePCRSelection(buf); err != nil {
+			return nil, err
+		}
+	} else {
+		// A TPM_PCR_INFO has a single selection for creation and release.
+		if b.PCRsAtRelease, b.releaseSelection, err = parsePCRSelection(buf); err != nil {
+			return nil, err
+		}
+		b.PCRsAtCreation = b.PCRsAtRelease
+	}
+
+	// The two structures order their digests differently.
+	digests := []interface{}{&b.DigestAtCreation, &b.DigestAtRelease}
+	if !long {
+		digests = []interface{}{&b.DigestAtRelease, &b.DigestAtCreation}
+	}
+	if err := tpmutil.UnpackBuf(buf, digests...); err != nil {
+		return nil, fmt.Errorf("couldn't parse the PCR digests: %v", err)
+	}
+	if buf.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after the PCR info", buf.Len())
+	}
+	return b, nil
+}
+
+// checkSealedData checks that sealed data returned by TPM_Seal is bound to the
+// release PCRs, digest and localities in the TPM_PCR_INFO_LONG that it was
+// sealed with, so that a blob that Unseal would reject is caught when it's
+// made rather than when it's needed.
+func checkSealedData(sealed []byte, pcrInfo *pcrInfoLong) error {
+	sd, err := ParseSealedData(sealed)
+	if err != nil {
+		return fmt.Errorf("the TPM returned sealed data that can't be parsed: %v", err)
+	}
+	if sd.Layout != StoredData12 {
+		return fmt.Errorf("the TPM returned sealed data as a %v, want a %v", sd.Layout, StoredData12)
+	}
+	if want := pcrInfo.PCRsAtRelease.Mask.PCRs(); !slices.Equal(sd.PCRsAtRelease, want) {
+		return fmt.Errorf("the TPM returned sealed data bound to PCRs %v, want %v", sd.PCRsAtRelease, want)
+	}
+	if sd.DigestAtRelease != pcrInfo.DigestAtRelease {
+		return fmt.Errorf("the TPM returned sealed data bound to PCR digest % x, want % x", sd.DigestAtRelease, pcrInfo.DigestAtRelease)
+	}
+	if sd.LocAtRelease != pcrInfo.LocAtRelease {
+		return fmt.Errorf("the TPM returned sealed data that can be unsealed at %v, want %v", sd.LocAtRelease, pcrInfo.LocAtRelease)
+	}
+	return nil
+}
+
+// parsePCRSelection reads a TPM_PCR_SELECTION of any size up to that of a
+// pcrMask from buf. It returns the selected PCRs along with the serialized
+// selection.
+func parsePCRSelection(buf *bytes.Buffer) ([]int, []byte, error) {
+	raw := buf.Bytes()
+	var size uint16
+	if err := tpmutil.UnpackBuf(buf, &size); err != nil {
+		return nil, nil, fmt.Errorf("couldn't parse a PCR selection: %v", err)
+	}
+	if int(size) > len(pcrMask{}) {
+		return nil, nil, fmt.Errorf("PCR selections of %d bytes aren't supported", size)
+	}
+	mask := buf.Next(int(size))
+	if len(mask) != int(size) {
+		return nil, nil, errors.New("the PCR selection is truncated")
+	}
+
+	var pcrs []int
+	for i := 0; i < 8*len(mask); i++ {
+		if mask[i/8]&(1<<uint(i%8)) != 0 {
+			pcrs = append(pcrs, i)
+		}
+	}
+	return pcrs, raw[:2+len(mask)], nil
+}
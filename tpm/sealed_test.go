@@ -0,0 +1,202 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"crypto/sha1"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-tpm/tpm/testtpm"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+func TestParseSealedData12(t *testing.T) {
+	f := testtpm.NewFake()
+	loc := LocZero | LocThree
+	sealed, err := Seal(f, loc, []int{18, 17}, []byte("data"), wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't seal the data:", err)
+	}
+	_, composite, err := ReadPCRComposite(f, []int{17, 18})
+	if err != nil {
+		t.Fatal("Couldn't read the PCR composite:", err)
+	}
+	digest := Digest(sha1.Sum(composite))
+
+	sd, err := ParseSealedData(sealed)
+	if err != nil {
+		t.Fatal("Couldn't parse the sealed data:", err)
+	}
+	want := &SealedData{
+		Layout: StoredData12,
+		PCRBinding: PCRBinding{
+			PCRsAtCreation:   []int{17, 18},
+			DigestAtCreation: digest,
+			PCRsAtRelease:    []int{17, 18},
+			DigestAtRelease:  digest,
+			LocAtCreation:    loc,
+			LocAtRelease:     loc,
+		},
+	}
+	sd.releaseSelection = nil
+	if !reflect.DeepEqual(sd, want) {
+		t.Fatalf("ParseSealedData returned %+v, want %+v", sd, want)
+	}
+
+	future, err := SealToFutureState(f, LocZero, []int{17}, [][]byte{make([]byte, PCRSize)}, []byte("data"), wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't seal to a future PCR state:", err)
+	}
+	sd, err = ParseSealedData(future)
+	if err != nil {
+		t.Fatal("Couldn't parse the sealed data:", err)
+	}
+	if len(sd.PCRsAtCreation) != 0 || !reflect.DeepEqual(sd.PCRsAtRelease, []int{17}) {
+		t.Fatalf("Got PCRs %v at creation and %v at release, want none and [17]", sd.PCRsAtCreation, sd.PCRsAtRelease)
+	}
+}
+
+// packStoredData11 builds a TPM 1.1 TPM_STORED_DATA whose TPM_PCR_INFO selects
+// the PCRs in the two-byte mask with the given release digest.
+func packStoredData11(t *testing.T, mask [2]byte, release, creation Digest) []byte {
+	t.Helper()
+	info, err := tpmutil.Pack(uint16(len(mask)), mask, release, creation)
+	if err != nil {
+		t.Fatal("Couldn't pack the TPM_PCR_INFO:", err)
+	}
+	b, err := tpmutil.Pack(storedDataVersion, tpmutil.U32Bytes(info), tpmutil.U32Bytes([]byte("encrypted")))
+	if err != nil {
+		t.Fatal("Couldn't pack the TPM_STORED_DATA:", err)
+	}
+	return b
+}
+
+func TestParseSealedData11(t *testing.T) {
+	f := testtpm.NewFake()
+	// A TPM 1.1 selection of PCR 8 only has two bytes, so its composite
+	// differs from the one for the three-byte selection this package makes.
+	mask := [2]byte{0x00, 0x01}
+	pcr8, err := ReadPCR(f, 8)
+	if err != nil {
+		t.Fatal("Couldn't read PCR 8:", err)
+	}
+	composite, err := tpmutil.Pack(uint16(len(mask)), mask, tpmutil.U32Bytes(pcr8))
+	if err != nil {
+		t.Fatal("Couldn't pack the PCR composite:", err)
+	}
+	release := Digest(sha1.Sum(composite))
+	creation := Digest(sha1.Sum([]byte("creation")))
+	sealed := packStoredData11(t, mask, release, creation)
+
+	sd, err := ParseSealedData(sealed)
+	if err != nil {
+		t.Fatal("Couldn't parse the sealed data:", err)
+	}
+	if sd.Layout != StoredData11 {
+		t.Fatalf("Parsed the blob as %v, want %v", sd.Layout, StoredData11)
+	}
+	if !reflect.DeepEqual(sd.PCRsAtRelease, []int{8}) || !reflect.DeepEqual(sd.PCRsAtCreation, []int{8}) {
+		t.Fatalf("Got PCRs %v at creation and %v at release, want [8] for both", sd.PCRsAtCreation, sd.PCRsAtRelease)
+	}
+	if sd.DigestAtRelease != release || sd.DigestAtCreation != creation {
+		t.Fatalf("Got digests % x at release and % x at creation, want % x and % x", sd.DigestAtRelease, sd.DigestAtCreation, release, creation)
+	}
+	if sd.LocAtRelease != allLocalities {
+		t.Fatalf("A TPM 1.1 blob can be unsealed at %v, want every locality", sd.LocAtRelease)
+	}
+
+	if ok, err := CanUnseal(f, sealed); err != nil || !ok {
+		t.Fatalf("CanUnseal returned (%t, %v), want (true, <nil>)", ok, err)
+	}
+	if _, err := PcrExtend(f, 8, PCRValue(sha1.Sum([]byte("8")))); err != nil {
+		t.Fatal("Couldn't extend PCR 8:", err)
+	}
+	if ok, err := CanUnseal(f, sealed); err != nil || ok {
+		t.Fatalf("CanUnseal after the PCR changed returned (%t, %v), want (false, <nil>)", ok, err)
+	}
+}
+
+func TestParseSealedDataErrors(t *testing.T) {
+	good := packStoredData11(t, [2]byte{0x01, 0x00}, Digest{}, Digest{})
+	unknown := append([]byte{0x02}, good[1:]...)
+
+	info, err := tpmutil.Pack(uint16(4), [4]byte{}, Digest{}, Digest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wide, err := tpmutil.Pack(storedDataVersion, tpmutil.U32Bytes(info), tpmutil.U32Bytes(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = tpmutil.Pack(tagPCRInfoLong, LocZero, LocZero, pcrSelection{Size: 3}, pcrSelection{Size: 3}, Digest{}, Digest{}, byte(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailing, err := tpmutil.Pack(tagStoredData12, uint16(0), tpmutil.U32Bytes(info), tpmutil.U32Bytes(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		sealed []byte
+	}{
+		{"truncated", good[:len(good)-1]},
+		{"unknown version", unknown},
+		{"wide selection", wide},
+		{"trailing bytes", trailing},
+	} {
+		if _, err := ParseSealedData(tc.sealed); err == nil {
+			t.Errorf("%s: ParseSealedData returned no error", tc.name)
+		}
+	}
+}
+
+func TestCheckSealedData(t *testing.T) {
+	f := testtpm.NewFake()
+	pcrInfo, err := newPCRInfoLong(f, LocZero, []int{17})
+	if err != nil {
+		t.Fatal("Couldn't make the PCR info:", err)
+	}
+	sealed, err := Seal(f, LocZero, []int{17}, []byte("data"), wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't seal the data:", err)
+	}
+	if err := checkSealedData(sealed, pcrInfo); err != nil {
+		t.Fatal("checkSealedData rejected the output of Seal:", err)
+	}
+
+	// The seal info starts after the 4-byte tag and entity type and its
+	// 4-byte size, with a 2-byte tag, the locality at creation and the
+	// locality at release, and then the selections and digests.
+	const infoStart = 8
+	for _, tc := range []struct {
+		name   string
+		offset int
+	}{
+		{"layout", 1},
+		{"locality at release", infoStart + 3},
+		{"PCRs at release", infoStart + 4 + 5 + 2 + 2},
+		{"digest at release", infoStart + 4 + 5 + 5 + 20 + 7},
+	} {
+		corrupt := append([]byte{}, sealed...)
+		corrupt[tc.offset] ^= 0x01
+		if err := checkSealedData(corrupt, pcrInfo); err == nil {
+			t.Errorf("checkSealedData accepted sealed data with a corrupted %s", tc.name)
+		}
+	}
+}
@@ -18,24 +18,26 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/rsa"
+	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
 
+	"github.com/google/go-tpm/tpm/verify"
 	"github.com/google/go-tpm/tpmutil"
 )
 
-// A pcrValue is the fixed-size value of a PCR.
-type pcrValue [20]byte
+// A PCRValue is the fixed-size value of a PCR.
+type PCRValue [20]byte
 
 // PCRSize gives the fixed size (20 bytes) of a PCR.
-const PCRSize int = 20
+const PCRSize = verify.PCRSize
 
 // A pcrMask represents a set of PCR choices, one bit per PCR out of the 24
 // possible PCR values.
-type pcrMask [3]byte
+type pcrMask = verify.PCRMask
 
 // A pcrSelection is the first element in the input a PCR composition, which is
 // A pcrSelection, followed by the combined length of the PCR values,
@@ -147,6 +149,34 @@ func (c *CapVersionInfo) Decode(data []byte) error {
 
 }
 
+// DAInfo describes the state of the dictionary-attack mitigation of the TPM,
+// from TPM_DA_INFO or TPM_DA_INFO_LIMITED.
+type DAInfo struct {
+	// Limited is true if the TPM only reported TPM_DA_INFO_LIMITED, in
+	// which case CurrentCount, ThresholdCount and ActionDependValue are zero.
+	Limited bool
+
+	// Active is true if the TPM is currently locked out.
+	Active bool
+
+	// CurrentCount is the number of authorization failures counted.
+	CurrentCount uint16
+
+	// ThresholdCount is the number of failures at which the TPM acts.
+	ThresholdCount uint16
+
+	// ActionAtThreshold is the TPM_DA_ACTION_TYPE bit mask of actions
+	// taken when the threshold is reached.
+	ActionAtThreshold uint32
+
+	// ActionDependValue is action-dependent, for example the number of
+	// seconds the TPM stays locked out.
+	ActionDependValue uint32
+
+	// VendorData is vendor-specific data.
+	VendorData []byte
+}
+
 // PermanentFlags contains persistent TPM properties
 type PermanentFlags struct {
 	Tag                          uint16
@@ -199,7 +229,7 @@ func CloseKey(rw io.ReadWriter, h tpmutil.Handle) error {
 }
 
 // A Nonce is a 20-byte value.
-type Nonce [20]byte
+type Nonce = verify.Nonce
 
 // An oiapResponse is a response to an OIAP command.
 type oiapResponse struct {
@@ -247,7 +277,23 @@ func (opr *osapResponse) Close(rw io.ReadWriter) error {
 }
 
 // A Digest is a 20-byte SHA1 value.
-type Digest [20]byte
+type Digest = verify.Digest
+
+// WellKnownAuth returns the well-known auth value of 20 bytes of zeros. Most
+// TPM provisioning tools use it as the SRK auth, and it is the TSS well-known
+// secret. Each call returns a fresh value, so callers can zero or modify it
+// without affecting anyone else.
+func WellKnownAuth() Digest {
+	return Digest{}
+}
+
+// SHA1Auth derives a TPM auth value from a secret by hashing it with SHA-1.
+// This is the convention the TSS uses for plain-text secrets, so it must be
+// used for any auth value that was set up from a password by TSS-based tools
+// such as tpm_takeownership.
+func SHA1Auth(secret []byte) Digest {
+	return sha1.Sum(secret)
+}
 
 // An AuthValue is a 20-byte value used for authentication.
 type authValue [20]byte
@@ -266,8 +312,8 @@ func (sc sealCommand) String() string {
 }
 
 // commandAuth stores the auth information sent with a command. Commands with
-// tagRQUAuth1Command tags use one of these auth structures, and commands with
-// tagRQUAuth2Command use two.
+// TagRQUAuth1Command tags use one of these auth structures, and commands with
+// TagRQUAuth2Command use two.
 type commandAuth struct {
 	AuthHandle  tpmutil.Handle
 	NonceOdd    Nonce
@@ -292,22 +338,14 @@ func (ra responseAuth) String() string {
 	return fmt.Sprintf("responseAuth{NonceEven: % x, ContSession: %x, Auth: % x}", ra.NonceEven, ra.ContSession, ra.Auth)
 }
 
-// These are the parameters of a TPM key.
-type keyParams struct {
-	AlgID     Algorithm
-	EncScheme uint16
-	SigScheme uint16
-	Params    tpmutil.U32Bytes // Serialized rsaKeyParams or symmetricKeyParams.
-}
+// These are the parameters of a TPM key. Params holds a serialized
+// rsaKeyParams or symmetricKeyParams.
+type keyParams = verify.KeyParams
 
 // An rsaKeyParams encodes the length of the RSA prime in bits, the number of
 // primes in its factored form, and the exponent used for public-key
 // encryption.
-type rsaKeyParams struct {
-	KeyLength uint32
-	NumPrimes uint32
-	Exponent  tpmutil.U32Bytes
-}
+type rsaKeyParams = verify.RSAKeyParams
 
 type symmetricKeyParams struct {
 	KeyLength uint32
@@ -316,16 +354,7 @@ type symmetricKeyParams struct {
 }
 
 // A key is a TPM representation of a key.
-type key struct {
-	Version         uint32
-	KeyUsage        uint16
-	KeyFlags        KeyFlags
-	AuthDataUsage   byte
-	AlgorithmParams keyParams
-	PCRInfo         tpmutil.U32Bytes
-	PubKey          tpmutil.U32Bytes
-	EncData         tpmutil.U32Bytes
-}
+type key = verify.Key
 
 // A key12 is a newer TPM representation of a key.
 type key12 struct {
@@ -340,12 +369,25 @@ type key12 struct {
 	EncData         tpmutil.U32Bytes
 }
 
-// A pubKey represents a public key known to the TPM.
-type pubKey struct {
-	AlgorithmParams keyParams
-	Key             tpmutil.U32Bytes
+// A boundData is the TPM_BOUND_DATA that Bind encrypts for UnBind.
+type boundData struct {
+	Version     uint32
+	Payload     byte
+	PayloadData []byte
 }
 
+// An identityContents is the TPM_IDENTITY_CONTENTS that MakeIdentity signs
+// with the new AIK.
+type identityContents struct {
+	Version           uint32
+	Ordinal           Ordinal
+	LabelPrivCADigest Digest
+	IdentityPubKey    pubKey
+}
+
+// A pubKey represents a public key known to the TPM.
+type pubKey = verify.PubKey
+
 // A migrationKeyAuth represents the target of a migration.
 type migrationKeyAuth struct {
 	MigrationKey    pubKey
@@ -414,7 +456,7 @@ func convertPubKey(pk crypto.PublicKey) (*pubKey, error) {
 		return nil, err
 	}
 	kp := keyParams{
-		AlgID:     AlgRSA,
+		AlgID:     uint32(AlgRSA),
 		EncScheme: esNone,
 		SigScheme: ssRSASaPKCS1v15SHA1,
 		Params:    rsakpb,
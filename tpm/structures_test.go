@@ -0,0 +1,111 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// packedStructs are the structures that are sent to or received from the TPM
+// with tpmutil.Pack and tpmutil.Unpack. Structures without a length for every
+// variable-sized field, like boundData and CapVersionInfo, can't round-trip
+// and aren't listed.
+var packedStructs = []interface{}{
+	&pcrSelection{},
+	&pcrInfoLong{},
+	&pcrInfoShort{},
+	&pcrInfo{},
+	&PermanentFlags{},
+	&nvAttributes{},
+	&NVDataPublic{},
+	&oiapResponse{},
+	&osapCommand{},
+	&osapResponse{},
+	&sealCommand{},
+	&commandAuth{},
+	&responseAuth{},
+	&keyParams{},
+	&rsaKeyParams{},
+	&symmetricKeyParams{},
+	&key{},
+	&key12{},
+	&identityContents{},
+	&pubKey{},
+	&migrationKeyAuth{},
+	&symKey{},
+	&tpmStoredData{},
+	&quoteInfo{},
+	&pcrComposite{},
+}
+
+func TestPackUnpackRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, s := range packedStructs {
+		typ := reflect.TypeOf(s).Elem()
+		t.Run(typ.Name(), func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				v, ok := quick.Value(typ, r)
+				if !ok {
+					t.Fatalf("Couldn't generate a random %v", typ)
+				}
+				in := v.Addr().Interface()
+				b, err := tpmutil.Pack(in)
+				if err != nil {
+					t.Fatalf("Couldn't pack %+v: %v", in, err)
+				}
+
+				out := reflect.New(typ).Interface()
+				n, err := tpmutil.Unpack(b, out)
+				if err != nil {
+					t.Fatalf("Couldn't unpack % x: %v", b, err)
+				}
+				if n != len(b) {
+					t.Fatalf("Unpack read %d bytes of %d", n, len(b))
+				}
+				if diff := cmp.Diff(in, out, cmpopts.EquateEmpty()); diff != "" {
+					t.Fatalf("Round trip of %v changed it (-in +out):\n%s", typ, diff)
+				}
+			}
+		})
+	}
+}
+
+func FuzzUnpack(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x10, 0x01})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	for _, s := range packedStructs {
+		b, err := tpmutil.Pack(s)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Unpack may fail on arbitrary data, but it must never panic.
+		for _, s := range packedStructs {
+			out := reflect.New(reflect.TypeOf(s).Elem()).Interface()
+			tpmutil.Unpack(data, out)
+		}
+	})
+}
@@ -0,0 +1,1540 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testtpm provides an in-memory fake TPM 1.2 for unit tests.
+//
+// The fake understands a small subset of the TPM 1.2 command set: GetRandom,
+// PCRRead, Extend, DirRead, DirWriteAuth, OIAP, OSAP, Seal, Unseal, LoadKey2,
+// CreateWrapKey, CreateMigrationBlob, GetPubKey, ReadPubEK, TakeOwnership,
+// OwnerReadInternalPub, Reset, ResetLockValue, NV_ReadValue, NV_WriteValue,
+// FlushSpecific, Startup, SetTempDeactivated, OwnerSetDisable,
+// TSC_PhysicalPresence and the handle, manufacturer, resource count, permanent
+// flag, volatile flag and version capabilities of GetCapability. Its auth sessions perform the same HMAC computations as a real
+// TPM, so the auth code in package tpm runs unchanged against it. Nothing else
+// about it is cryptographically real: random values are deterministic, sealed
+// data and the auth values of wrapped keys are kept in memory rather than
+// encrypted, the public keys of the SRK and of wrapped keys have no private
+// keys, the EK is whatever key the test supplies, and loaded keys can't be
+// used.
+package testtpm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Command and response tags.
+const (
+	tagRQUCommand      uint16 = 0x00C1
+	tagRQUAuth1Command uint16 = 0x00C2
+	tagRQUAuth2Command uint16 = 0x00C3
+	tagRSPCommand      uint16 = 0x00C4
+	tagRSPAuth1Command uint16 = 0x00C5
+	tagRSPAuth2Command uint16 = 0x00C6
+)
+
+// Supported ordinals.
+const (
+	ordOIAP                 uint32 = 0x0000000A
+	ordOSAP                 uint32 = 0x0000000B
+	ordTakeOwnership        uint32 = 0x0000000D
+	ordExtend               uint32 = 0x00000014
+	ordPCRRead              uint32 = 0x00000015
+	ordSeal                 uint32 = 0x00000017
+	ordUnseal               uint32 = 0x00000018
+	ordDirWriteAuth         uint32 = 0x00000019
+	ordDirRead              uint32 = 0x0000001A
+	ordCreateWrapKey        uint32 = 0x0000001F
+	ordGetPubKey            uint32 = 0x00000021
+	ordCreateMigrationBlob  uint32 = 0x00000028
+	ordResetLockValue       uint32 = 0x00000040
+	ordLoadKey2             uint32 = 0x00000041
+	ordGetRandom            uint32 = 0x00000046
+	ordReset                uint32 = 0x0000005A
+	ordGetCapability        uint32 = 0x00000065
+	ordOwnerSetDisable      uint32 = 0x0000006E
+	ordSetTempDeactivated   uint32 = 0x00000073
+	ordReadPubEK            uint32 = 0x0000007C
+	ordOwnerReadInternalPub uint32 = 0x00000081
+	ordStartup              uint32 = 0x00000099
+	ordFlushSpecific        uint32 = 0x000000BA
+	ordNVWriteValue         uint32 = 0x000000CD
+	ordNVReadValue          uint32 = 0x000000CF
+
+	// TSC_PhysicalPresence is a TPM Software Connection command.
+	ordPhysicalPresence uint32 = 0x4000000A
+)
+
+// Return codes.
+const (
+	rcSuccess           uint32 = 0
+	rcAuthFail          uint32 = 1
+	rcBadIndex          uint32 = 2
+	rcBadParameter      uint32 = 3
+	rcDeactivated       uint32 = 6
+	rcDisabled          uint32 = 7
+	rcDisabledCmd       uint32 = 8
+	rcBadOrdinal        uint32 = 10
+	rcInvalidKeyHandle  uint32 = 12
+	rcNoSpace           uint32 = 17
+	rcNotSealedBlob     uint32 = 19
+	rcOwnerSet          uint32 = 20
+	rcResources         uint32 = 21
+	rcWrongPCRVal       uint32 = 24
+	rcBadParamSize      uint32 = 25
+	rcAuth2Fail         uint32 = 29
+	rcBadTag            uint32 = 30
+	rcDecryptError      uint32 = 33
+	rcInvalidAuthHandle uint32 = 34
+	rcNoEndorsement     uint32 = 35
+	rcWrongEntityType   uint32 = 37
+	rcBadMode           uint32 = 44
+	rcBadPresence       uint32 = 45
+	rcBadLocality       uint32 = 61
+	rcNoOperator        uint32 = 73
+	rcDoingSelfTest     uint32 = 2050
+)
+
+// Entity types, capabilities, resource types and reserved handles.
+const (
+	etKeyHandle uint16 = 0x0001
+	etOwner     uint16 = 0x0002
+	etSRK       uint16 = 0x0004
+
+	capFlag                uint32 = 0x00000004
+	capProperty            uint32 = 0x00000005
+	capHandle              uint32 = 0x00000014
+	capVersion11           uint32 = 0x00000006
+	capVersionVal          uint32 = 0x0000001A
+	subCapPropManufacturer uint32 = 0x00000103
+	subCapPropKeys         uint32 = 0x00000104
+	subCapPropAuthSess     uint32 = 0x0000010A
+	subCapPropMaxAuthSess  uint32 = 0x0000010D
+	subCapPropMaxTranSess  uint32 = 0x0000010E
+	subCapPropMaxKeys      uint32 = 0x00000110
+	subCapPropContext      uint32 = 0x00000112
+	subCapPropMaxContext   uint32 = 0x00000113
+	subCapFlagPermanent    uint32 = 0x00000108
+	subCapFlagVolatile     uint32 = 0x00000109
+
+	msMigrate uint16 = 0x0001
+	msRewrap  uint16 = 0x0002
+
+	rtKey  uint32 = 0x00000001
+	rtAuth uint32 = 0x00000002
+
+	khSRK      tpmutil.Handle = 0x40000000
+	khOwner    tpmutil.Handle = 0x40000001
+	khEK       tpmutil.Handle = 0x40000006
+	khOperator tpmutil.Handle = 0x40000008
+)
+
+// The algorithm and schemes of the SRK.
+const (
+	algRSA              uint32 = 0x00000001
+	esRSAEsOAEPSHA1MGF1 uint16 = 0x0003
+	ssNone              uint16 = 0x0001
+)
+
+// pidOwner is the TPM_PID_OWNER protocol of TakeOwnership.
+const pidOwner uint16 = 0x0005
+
+// oaepLabel is the label of the OAEP encryption of the auth values in
+// TakeOwnership.
+var oaepLabel = []byte("TCPA")
+
+// Startup types.
+const (
+	stClear       uint16 = 0x0001
+	stDeactivated uint16 = 0x0003
+)
+
+// deactivatedOrdinals are the supported commands that a deactivated TPM
+// refuses.
+var deactivatedOrdinals = map[uint32]bool{
+	ordSeal:                true,
+	ordUnseal:              true,
+	ordDirWriteAuth:        true,
+	ordDirRead:             true,
+	ordResetLockValue:      true,
+	ordLoadKey2:            true,
+	ordCreateWrapKey:       true,
+	ordCreateMigrationBlob: true,
+}
+
+// disabledOrdinals are the supported commands that a disabled TPM refuses.
+var disabledOrdinals = map[uint32]bool{
+	ordSeal:                true,
+	ordUnseal:              true,
+	ordDirWriteAuth:        true,
+	ordDirRead:             true,
+	ordResetLockValue:      true,
+	ordLoadKey2:            true,
+	ordCreateWrapKey:       true,
+	ordGetRandom:           true,
+	ordCreateMigrationBlob: true,
+}
+
+const (
+	// numPCRs is the number of PCRs in the fake's PCR bank.
+	numPCRs = 24
+
+	// numDIRs is the number of DIRs in the fake, the minimum that TPM 1.2
+	// allows.
+	numDIRs = 1
+
+	// headerSize is the size of the tag, size and ordinal (or return code)
+	// at the start of every command and response.
+	headerSize = 10
+
+	// authSize is the size of a single auth section at the end of a command.
+	authSize = 45
+
+	// firstSessionHandle is the handle given to the first auth session.
+	firstSessionHandle tpmutil.Handle = 0x02000000
+
+	// firstKeyHandle is the handle given to the first loaded key.
+	firstKeyHandle tpmutil.Handle = 0x01000000
+
+	// storedData12Tag is the tag of a TPM_STORED_DATA12 structure, which
+	// Seal returns for a TPM_PCR_INFO_LONG.
+	storedData12Tag uint16 = 0x0016
+)
+
+// Physical presence bits for TSC_PhysicalPresence.
+const (
+	ppLock         uint16 = 0x0004
+	ppPresent      uint16 = 0x0008
+	ppNotPresent   uint16 = 0x0010
+	ppCMDEnable    uint16 = 0x0020
+	ppHWEnable     uint16 = 0x0040
+	ppLifetimeLock uint16 = 0x0080
+	ppCMDDisable   uint16 = 0x0100
+	ppHWDisable    uint16 = 0x0200
+
+	ppEnableBits   = ppCMDEnable | ppHWEnable | ppCMDDisable | ppHWDisable
+	ppPresenceBits = ppLock | ppPresent | ppNotPresent
+)
+
+// TPM_AUTH_DATA_USAGE values. A key with TPM_AUTH_PRIV_USE_ONLY, which is also
+// TPM_NO_READ_PUBKEY_AUTH, needs no auth to read its public key.
+const (
+	authNever       byte = 0x00
+	authPrivUseOnly byte = 0x03
+)
+
+// Tags of the TPM_PERMANENT_FLAGS, TPM_STCLEAR_FLAGS and TPM_CAP_VERSION_INFO
+// structures.
+const (
+	permanentFlagsTag uint16 = 0x001F
+	stClearFlagsTag   uint16 = 0x0020
+	capVersionInfoTag uint16 = 0x0030
+)
+
+// manufacturer is the value the fake reports for TPM_CAP_PROP_MANUFACTURER.
+var manufacturer = [4]byte{'F', 'A', 'K', 'E'}
+
+// The firmware revision that the fake reports in its version.
+const (
+	fakeRevMajor = 1
+	fakeRevMinor = 0
+)
+
+// A session is an open OIAP or OSAP session.
+type session struct {
+	nonceEven [20]byte
+
+	// secret is the OSAP shared secret. It is nil for OIAP sessions, which
+	// use the auth value of whatever entity they authorize instead.
+	secret []byte
+
+	// entity is the handle an OSAP session is bound to.
+	entity tpmutil.Handle
+}
+
+// A commandAuth is an auth section sent at the end of a command.
+type commandAuth struct {
+	AuthHandle  tpmutil.Handle
+	NonceOdd    [20]byte
+	ContSession byte
+	Auth        [20]byte
+}
+
+// A command is a parsed TPM command.
+type command struct {
+	ord    uint32
+	params []byte
+	auths  []commandAuth
+}
+
+// The auth values of a key made by CreateWrapKey.
+type wrappedKey struct {
+	usageAuth     [20]byte
+	migrationAuth [20]byte
+}
+
+// A sealedBlob is data stored by Seal.
+type sealedBlob struct {
+	pcrInfo []byte
+	auth    [20]byte
+	data    []byte
+}
+
+// Fake is an in-memory TPM 1.2. It implements io.ReadWriteCloser and expects
+// commands to arrive in alternating Write and Read calls, just as a real TPM
+// device does. A Fake is not safe for concurrent use.
+type Fake struct {
+	// SRKAuth is the usage auth value of the SRK. It defaults to the
+	// well-known value of 20 bytes of zeros.
+	SRKAuth [20]byte
+
+	// OwnerAuth is the owner auth value. It defaults to the well-known value
+	// of 20 bytes of zeros.
+	OwnerAuth [20]byte
+
+	// MaxSessions is the number of auth sessions that can be open at once,
+	// or 0 for no limit. OIAP and OSAP fail with TPM_RESOURCES beyond it.
+	// GetCapability only reports auth session counts if it is set.
+	MaxSessions int
+
+	// MaxKeys is the number of keys that can be loaded at once, or 0 for no
+	// limit. LoadKey2 fails with TPM_NOSPACE beyond it. GetCapability only
+	// reports key counts if it is set.
+	MaxKeys int
+
+	// MaxSavedContexts is the number of saved context slots that
+	// GetCapability reports, or 0 for none. The fake doesn't save contexts,
+	// so they're all reported free.
+	MaxSavedContexts int
+
+	// LockValueResets counts the successful ResetLockValue commands.
+	LockValueResets int
+
+	// EK is the endorsement key, or nil if the TPM has none. ReadPubEK and
+	// TakeOwnership fail with TPM_NO_ENDORSEMENT without it.
+	EK *rsa.PrivateKey
+
+	// Unowned makes the fake a TPM without an owner. ReadPubEK only works
+	// while it is set, and TakeOwnership clears it, replacing the owner and
+	// SRK auth values and the SRK.
+	Unowned bool
+
+	// OperatorAuth is the operator auth value, or nil if none is set.
+	OperatorAuth []byte
+
+	// Deactivated sets the deactivated permanent flag.
+	Deactivated bool
+
+	// Disabled sets the disable permanent flag, which OwnerSetDisable
+	// changes.
+	Disabled bool
+
+	// Version11 makes the fake a TPM 1.1b, which reports its version through
+	// TPM_CAP_VERSION and doesn't support TPM_CAP_VERSION_VAL.
+	Version11 bool
+
+	// ReuseHandles makes the fake give each new session and key the lowest
+	// free handle, as real TPMs do, instead of one that was never used.
+	ReuseHandles bool
+
+	// NV holds the contents of the defined NV indices. NVReadValue and
+	// NVWriteValue work with or without owner auth, as on a TPM whose NV
+	// storage isn't locked, but only within the indices defined here.
+	NV map[uint32][]byte
+
+	// DoingSelfTest makes every command but GetCapability fail with
+	// TPM_DOING_SELFTEST, as a TPM does until its self-test finishes.
+	DoingSelfTest bool
+
+	pcrs           [numPCRs][20]byte
+	dirs           [numDIRs][20]byte
+	sessions       map[tpmutil.Handle]*session
+	nextHandle     tpmutil.Handle
+	keys           map[tpmutil.Handle]*tpmKey
+	nextKey        tpmutil.Handle
+	blobs          map[[20]byte]*sealedBlob
+	wrapped        map[[20]byte]*wrappedKey
+	srkPub         []byte
+	ppHWEnable     bool
+	ppCMDEnable    bool
+	ppLifetimeLock bool
+
+	// Volatile flags, which Startup clears.
+	tempDeactivated bool
+	ppAsserted      bool
+	ppLocked        bool
+
+	counter uint64
+	resp    []byte
+	closed  bool
+}
+
+// NewFake creates a new Fake with all PCRs set to zero and the well-known
+// SRK and owner auth values.
+func NewFake() *Fake {
+	return &Fake{
+		sessions:   make(map[tpmutil.Handle]*session),
+		nextHandle: firstSessionHandle,
+		keys:       make(map[tpmutil.Handle]*tpmKey),
+		nextKey:    firstKeyHandle,
+		blobs:      make(map[[20]byte]*sealedBlob),
+		wrapped:    make(map[[20]byte]*wrappedKey),
+	}
+}
+
+// Write implements io.Writer by executing a single TPM command. The response
+// must be read with Read before the next command is written.
+func (f *Fake) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, errors.New("testtpm: write to closed fake TPM")
+	}
+	if f.resp != nil {
+		return 0, errors.New("testtpm: must call Write then Read in an alternating sequence")
+	}
+	f.resp = f.execute(p)
+	return len(p), nil
+}
+
+// Read implements io.Reader by returning the response to the last command.
+func (f *Fake) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errors.New("testtpm: read from closed fake TPM")
+	}
+	if f.resp == nil {
+		return 0, errors.New("testtpm: must call Write then Read in an alternating sequence")
+	}
+	if len(p) < len(f.resp) {
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(p, f.resp)
+	f.resp = nil
+	return n, nil
+}
+
+// Close implements io.Closer. A closed Fake rejects all further commands.
+func (f *Fake) Close() error {
+	if f.closed {
+		return errors.New("testtpm: fake TPM is already closed")
+	}
+	f.closed = true
+	return nil
+}
+
+// random fills b with deterministic pseudo-random bytes.
+func (f *Fake) random(b []byte) {
+	for len(b) > 0 {
+		var ctr [8]byte
+		binary.BigEndian.PutUint64(ctr[:], f.counter)
+		f.counter++
+		h := sha1.Sum(append([]byte("testtpm"), ctr[:]...))
+		b = b[copy(b, h[:]):]
+	}
+}
+
+// execute runs a single command and returns the serialized response.
+func (f *Fake) execute(cmd []byte) []byte {
+	var tag uint16
+	var size, ord uint32
+	if _, err := tpmutil.Unpack(cmd, &tag, &size, &ord); err != nil || int(size) != len(cmd) {
+		return errorResponse(rcBadParamSize)
+	}
+
+	var numAuths int
+	switch tag {
+	case tagRQUCommand:
+	case tagRQUAuth1Command:
+		numAuths = 1
+	case tagRQUAuth2Command:
+		numAuths = 2
+	default:
+		return errorResponse(rcBadTag)
+	}
+	if len(cmd) < headerSize+numAuths*authSize {
+		return errorResponse(rcBadParamSize)
+	}
+
+	c := &command{
+		ord:    ord,
+		params: cmd[headerSize : len(cmd)-numAuths*authSize],
+		auths:  make([]commandAuth, numAuths),
+	}
+	authBuf := bytes.NewBuffer(cmd[len(cmd)-numAuths*authSize:])
+	for i := range c.auths {
+		if err := tpmutil.UnpackBuf(authBuf, &c.auths[i]); err != nil {
+			return errorResponse(rcBadParamSize)
+		}
+	}
+
+	if f.DoingSelfTest && ord != ordGetCapability {
+		return errorResponse(rcDoingSelfTest)
+	}
+	if f.Disabled && disabledOrdinals[ord] {
+		return errorResponse(rcDisabled)
+	}
+	if (f.Deactivated || f.tempDeactivated) && deactivatedOrdinals[ord] {
+		return errorResponse(rcDeactivated)
+	}
+
+	switch ord {
+	case ordGetRandom:
+		return f.getRandom(c)
+	case ordPCRRead:
+		return f.pcrRead(c)
+	case ordExtend:
+		return f.extend(c)
+	case ordDirWriteAuth:
+		return f.dirWriteAuth(c)
+	case ordDirRead:
+		return f.dirRead(c)
+	case ordOIAP:
+		return f.oiap(c)
+	case ordOSAP:
+		return f.osap(c)
+	case ordSeal:
+		return f.seal(c)
+	case ordUnseal:
+		return f.unseal(c)
+	case ordReset:
+		return f.reset(c)
+	case ordResetLockValue:
+		return f.resetLockValue(c)
+	case ordLoadKey2:
+		return f.loadKey2(c)
+	case ordCreateWrapKey:
+		return f.createWrapKey(c)
+	case ordCreateMigrationBlob:
+		return f.createMigrationBlob(c)
+	case ordGetPubKey:
+		return f.getPubKey(c)
+	case ordReadPubEK:
+		return f.readPubEK(c)
+	case ordTakeOwnership:
+		return f.takeOwnership(c)
+	case ordOwnerReadInternalPub:
+		return f.ownerReadInternalPub(c)
+	case ordGetCapability:
+		return f.getCapability(c)
+	case ordNVReadValue:
+		return f.nvReadValue(c)
+	case ordNVWriteValue:
+		return f.nvWriteValue(c)
+	case ordFlushSpecific:
+		return f.flushSpecific(c)
+	case ordStartup:
+		return f.startup(c)
+	case ordSetTempDeactivated:
+		return f.setTempDeactivated(c)
+	case ordOwnerSetDisable:
+		return f.ownerSetDisable(c)
+	case ordPhysicalPresence:
+		return f.physicalPresence(c)
+	default:
+		return errorResponse(rcBadOrdinal)
+	}
+}
+
+// errorResponse builds a response that carries only a return code.
+func errorResponse(rc uint32) []byte {
+	resp, _ := tpmutil.Pack(tagRSPCommand, uint32(headerSize), rc)
+	return resp
+}
+
+// response builds a successful response to an unauthorized command.
+func response(out ...interface{}) []byte {
+	body, err := tpmutil.Pack(out...)
+	if err != nil {
+		return errorResponse(rcBadParameter)
+	}
+	header, _ := tpmutil.Pack(tagRSPCommand, uint32(headerSize+len(body)), rcSuccess)
+	return append(header, body...)
+}
+
+// authResponse builds a successful response to an authorized command, with
+// one response auth section for each command auth section, each computed with
+// the corresponding key in keys. Sessions that the caller didn't ask to keep
+// open are closed.
+func (f *Fake) authResponse(c *command, keys [][]byte, out ...interface{}) []byte {
+	return f.authResponseHandles(c, keys, nil, out...)
+}
+
+// authResponseHandles is like authResponse, but the response parameters start
+// with the given handles, which aren't covered by the response auth.
+func (f *Fake) authResponseHandles(c *command, keys [][]byte, handles []tpmutil.Handle, out ...interface{}) []byte {
+	params, err := tpmutil.Pack(out...)
+	if err != nil {
+		return errorResponse(rcBadParameter)
+	}
+	digestIn, _ := tpmutil.Pack(rcSuccess, c.ord)
+	digest := sha1.Sum(append(digestIn, params...))
+
+	var body []byte
+	for _, h := range handles {
+		hb, _ := tpmutil.Pack(h)
+		body = append(body, hb...)
+	}
+	body = append(body, params...)
+
+	for i, ca := range c.auths {
+		s := f.sessions[ca.AuthHandle]
+		f.random(s.nonceEven[:])
+		auth := hmacSHA1(keys[i], digest[:], s.nonceEven[:], ca.NonceOdd[:], []byte{ca.ContSession})
+		body = append(body, s.nonceEven[:]...)
+		body = append(body, ca.ContSession)
+		body = append(body, auth...)
+		if ca.ContSession == 0 {
+			delete(f.sessions, ca.AuthHandle)
+		}
+	}
+
+	tag := tagRSPAuth1Command
+	if len(c.auths) == 2 {
+		tag = tagRSPAuth2Command
+	}
+	header, _ := tpmutil.Pack(tag, uint32(headerSize+len(body)), rcSuccess)
+	return append(header, body...)
+}
+
+// checkAuth verifies the i-th auth section of c over the command parameters
+// that follow the first numHandles handles. OSAP sessions are checked with
+// their shared secret and OIAP sessions with entityAuth. It returns the key
+// that must be used for the response auth.
+func (f *Fake) checkAuth(c *command, i int, numHandles int, entity tpmutil.Handle, entityAuth []byte) ([]byte, uint32) {
+	failure := rcAuthFail
+	if i == 1 {
+		failure = rcAuth2Fail
+	}
+
+	ca := c.auths[i]
+	s, ok := f.sessions[ca.AuthHandle]
+	if !ok {
+		return nil, rcInvalidAuthHandle
+	}
+
+	key := entityAuth
+	if s.secret != nil {
+		if s.entity != entity {
+			delete(f.sessions, ca.AuthHandle)
+			return nil, failure
+		}
+		key = s.secret
+	}
+
+	ordBytes, _ := tpmutil.Pack(c.ord)
+	digest := sha1.Sum(append(ordBytes, c.params[4*numHandles:]...))
+	auth := hmacSHA1(key, digest[:], s.nonceEven[:], ca.NonceOdd[:], []byte{ca.ContSession})
+	if !hmac.Equal(auth, ca.Auth[:]) {
+		// A real TPM terminates a session after an auth failure.
+		delete(f.sessions, ca.AuthHandle)
+		return nil, failure
+	}
+	return key, rcSuccess
+}
+
+// hmacSHA1 computes HMAC-SHA1 over the concatenation of data.
+func hmacSHA1(key []byte, data ...[]byte) []byte {
+	hm := hmac.New(sha1.New, key)
+	for _, d := range data {
+		hm.Write(d)
+	}
+	return hm.Sum(nil)
+}
+
+func (f *Fake) getRandom(c *command) []byte {
+	var size uint32
+	if _, err := tpmutil.Unpack(c.params, &size); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	b := make([]byte, size)
+	f.random(b)
+	return response(tpmutil.U32Bytes(b))
+}
+
+func (f *Fake) pcrRead(c *command) []byte {
+	var index uint32
+	if _, err := tpmutil.Unpack(c.params, &index); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if index >= numPCRs {
+		return errorResponse(rcBadIndex)
+	}
+	return response(f.pcrs[index])
+}
+
+func (f *Fake) extend(c *command) []byte {
+	var index uint32
+	var digest [20]byte
+	if _, err := tpmutil.Unpack(c.params, &index, &digest); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if index >= numPCRs {
+		return errorResponse(rcBadIndex)
+	}
+	f.pcrs[index] = sha1.Sum(append(f.pcrs[index][:], digest[:]...))
+	return response(f.pcrs[index])
+}
+
+func (f *Fake) dirWriteAuth(c *command) []byte {
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	var index uint32
+	var contents [20]byte
+	if _, err := tpmutil.Unpack(c.params, &index, &contents); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if index >= numDIRs {
+		return errorResponse(rcBadIndex)
+	}
+	key, rc := f.checkAuth(c, 0, 0, khOwner, f.OwnerAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	f.dirs[index] = contents
+	return f.authResponse(c, [][]byte{key})
+}
+
+func (f *Fake) dirRead(c *command) []byte {
+	var index uint32
+	if _, err := tpmutil.Unpack(c.params, &index); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if index >= numDIRs {
+		return errorResponse(rcBadIndex)
+	}
+	return response(f.dirs[index])
+}
+
+// newSession opens a new auth session and returns its handle. It returns
+// false if the fake already has MaxSessions open sessions.
+func (f *Fake) newSession(s *session) (tpmutil.Handle, bool) {
+	if f.MaxSessions > 0 && len(f.sessions) >= f.MaxSessions {
+		return 0, false
+	}
+	h := f.newHandle(firstSessionHandle, &f.nextHandle, func(h tpmutil.Handle) bool { return f.sessions[h] != nil })
+	f.random(s.nonceEven[:])
+	f.sessions[h] = s
+	return h, true
+}
+
+// newHandle returns the handle for a new session or key, starting from first.
+// next is the lowest handle that was never used, and used reports whether a
+// handle is in use.
+func (f *Fake) newHandle(first tpmutil.Handle, next *tpmutil.Handle, used func(tpmutil.Handle) bool) tpmutil.Handle {
+	h := *next
+	if f.ReuseHandles {
+		for h = first; used(h); h++ {
+		}
+	}
+	if h >= *next {
+		*next = h + 1
+	}
+	return h
+}
+
+func (f *Fake) oiap(c *command) []byte {
+	s := &session{}
+	h, ok := f.newSession(s)
+	if !ok {
+		return errorResponse(rcResources)
+	}
+	return response(h, s.nonceEven)
+}
+
+func (f *Fake) osap(c *command) []byte {
+	var entityType uint16
+	var entity tpmutil.Handle
+	var oddOSAP [20]byte
+	if _, err := tpmutil.Unpack(c.params, &entityType, &entity, &oddOSAP); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+
+	var auth [20]byte
+	switch {
+	case entityType == etSRK && entity == khSRK:
+		auth = f.SRKAuth
+	case entityType == etKeyHandle && entity == khSRK:
+		auth = f.SRKAuth
+	case entityType == etOwner && entity == khOwner:
+		auth = f.OwnerAuth
+	case entityType == etKeyHandle:
+		return errorResponse(rcInvalidKeyHandle)
+	default:
+		return errorResponse(rcWrongEntityType)
+	}
+
+	var evenOSAP [20]byte
+	f.random(evenOSAP[:])
+	s := &session{
+		secret: hmacSHA1(auth[:], evenOSAP[:], oddOSAP[:]),
+		entity: entity,
+	}
+	h, ok := f.newSession(s)
+	if !ok {
+		return errorResponse(rcResources)
+	}
+	return response(h, s.nonceEven, evenOSAP)
+}
+
+func (f *Fake) seal(c *command) []byte {
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	var keyHandle tpmutil.Handle
+	var encAuth [20]byte
+	var pcrInfo, data tpmutil.U32Bytes
+	if _, err := tpmutil.Unpack(c.params, &keyHandle, &encAuth, &pcrInfo, &data); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if keyHandle != khSRK {
+		return errorResponse(rcInvalidKeyHandle)
+	}
+	if len(pcrInfo) > 0 {
+		if _, err := parsePCRInfoLong(pcrInfo); err != nil {
+			return errorResponse(rcBadParameter)
+		}
+	}
+
+	// The data auth is encrypted with the session's shared secret and the
+	// nonceEven it had when the command was sent, so it has to be recovered
+	// before the response rolls the nonce.
+	s := f.sessions[c.auths[0].AuthHandle]
+	if s == nil || s.secret == nil {
+		return errorResponse(rcInvalidAuthHandle)
+	}
+	xorKey := sha1.Sum(append(append([]byte{}, s.secret...), s.nonceEven[:]...))
+
+	key, rc := f.checkAuth(c, 0, 1, keyHandle, f.SRKAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+
+	blob := &sealedBlob{
+		pcrInfo: append([]byte{}, pcrInfo...),
+		data:    append([]byte{}, data...),
+	}
+	for i := range blob.auth {
+		blob.auth[i] = encAuth[i] ^ xorKey[i]
+	}
+	var id [20]byte
+	f.random(id[:])
+	f.blobs[id] = blob
+
+	// TPM_Seal leaves the entity type of the stored data empty.
+	return f.authResponse(c, [][]byte{key}, storedData12Tag, uint16(0), tpmutil.U32Bytes(pcrInfo), tpmutil.U32Bytes(id[:]))
+}
+
+func (f *Fake) unseal(c *command) []byte {
+	if len(c.auths) != 2 {
+		return errorResponse(rcBadTag)
+	}
+	var keyHandle tpmutil.Handle
+	var version uint32
+	var info, enc tpmutil.U32Bytes
+	if _, err := tpmutil.Unpack(c.params, &keyHandle, &version, &info, &enc); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if keyHandle != khSRK {
+		return errorResponse(rcInvalidKeyHandle)
+	}
+
+	var id [20]byte
+	if len(enc) != len(id) {
+		return errorResponse(rcNotSealedBlob)
+	}
+	copy(id[:], enc)
+	blob, ok := f.blobs[id]
+	if !ok || !bytes.Equal(blob.pcrInfo, info) {
+		return errorResponse(rcNotSealedBlob)
+	}
+
+	key1, rc := f.checkAuth(c, 0, 1, keyHandle, f.SRKAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	key2, rc := f.checkAuth(c, 1, 1, 0, blob.auth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+
+	if len(blob.pcrInfo) > 0 {
+		pcri, err := parsePCRInfoLong(blob.pcrInfo)
+		if err != nil {
+			return errorResponse(rcNotSealedBlob)
+		}
+		// The fake always runs commands at locality 0.
+		if pcri.LocAtRelease&1 == 0 {
+			return errorResponse(rcBadLocality)
+		}
+		if f.composite(pcri.PCRsAtRelease) != pcri.DigestAtRelease {
+			return errorResponse(rcWrongPCRVal)
+		}
+	}
+
+	return f.authResponse(c, [][]byte{key1, key2}, tpmutil.U32Bytes(blob.data))
+}
+
+// A tpmKey holds the fields of a TPM_KEY that the fake needs to parse past.
+type tpmKey struct {
+	Version       uint32
+	KeyUsage      uint16
+	KeyFlags      uint32
+	AuthDataUsage byte
+	AlgID         uint32
+	EncScheme     uint16
+	SigScheme     uint16
+	Params        tpmutil.U32Bytes
+	PCRInfo       tpmutil.U32Bytes
+	PubKey        tpmutil.U32Bytes
+	EncData       tpmutil.U32Bytes
+}
+
+func (f *Fake) loadKey2(c *command) []byte {
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	var parent tpmutil.Handle
+	var k tpmKey
+	if _, err := tpmutil.Unpack(c.params, &parent, &k); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if parent != khSRK {
+		return errorResponse(rcInvalidKeyHandle)
+	}
+
+	key, rc := f.checkAuth(c, 0, 1, parent, f.SRKAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+
+	if f.MaxKeys > 0 && len(f.keys) >= f.MaxKeys {
+		return errorResponse(rcNoSpace)
+	}
+	h := f.newHandle(firstKeyHandle, &f.nextKey, func(h tpmutil.Handle) bool { return f.keys[h] != nil })
+	f.keys[h] = &k
+	return f.authResponseHandles(c, [][]byte{key}, []tpmutil.Handle{h})
+}
+
+// createWrapKey handles TPM_CreateWrapKey under the SRK. Like sealed data, the
+// new key's auth values are kept in memory, and its EncData only names them.
+// Its public key is random and has no private key.
+func (f *Fake) createWrapKey(c *command) []byte {
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	var parent tpmutil.Handle
+	var encUsageAuth, encMigrationAuth [20]byte
+	var k tpmKey
+	if _, err := tpmutil.Unpack(c.params, &parent, &encUsageAuth, &encMigrationAuth, &k); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if parent != khSRK {
+		return errorResponse(rcInvalidKeyHandle)
+	}
+
+	// ADIP pads the usage auth with the session's nonceEven and the
+	// migration auth with the command's nonceOdd, so both have to be
+	// recovered before the response rolls the nonce.
+	s := f.sessions[c.auths[0].AuthHandle]
+	if s == nil || s.secret == nil {
+		return errorResponse(rcInvalidAuthHandle)
+	}
+	usagePad := sha1.Sum(append(append([]byte{}, s.secret...), s.nonceEven[:]...))
+	migrationPad := sha1.Sum(append(append([]byte{}, s.secret...), c.auths[0].NonceOdd[:]...))
+
+	key, rc := f.checkAuth(c, 0, 1, parent, f.SRKAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+
+	var w wrappedKey
+	for i := range w.usageAuth {
+		w.usageAuth[i] = encUsageAuth[i] ^ usagePad[i]
+		w.migrationAuth[i] = encMigrationAuth[i] ^ migrationPad[i]
+	}
+	var id [20]byte
+	f.random(id[:])
+	f.wrapped[id] = &w
+
+	k.PubKey = make([]byte, 256)
+	f.random(k.PubKey)
+	k.PubKey[0] |= 0x80
+	k.EncData = id[:]
+	return f.authResponse(c, [][]byte{key}, k)
+}
+
+// KeyAuths returns the usage and migration auth values of the key loaded at h,
+// if it was made by CreateWrapKey.
+func (f *Fake) KeyAuths(h tpmutil.Handle) (usageAuth, migrationAuth [20]byte, ok bool) {
+	k, ok := f.keys[h]
+	if !ok || len(k.EncData) != 20 {
+		return usageAuth, migrationAuth, false
+	}
+	w, ok := f.wrapped[[20]byte(k.EncData)]
+	if !ok {
+		return usageAuth, migrationAuth, false
+	}
+	return w.usageAuth, w.migrationAuth, true
+}
+
+// createMigrationBlob handles TPM_CreateMigrationBlob under the SRK for the
+// REWRAP and MIGRATE schemes. encData must be the EncData of a key made by
+// CreateWrapKey, which the fake can "decrypt" by looking it up; anything else,
+// such as a whole key blob, fails with TPM_DECRYPT_ERROR as it would on a real
+// TPM. The migration auth is checked with the second auth section, but the
+// migration key's authorization digest isn't checked, and the migrated data is
+// random.
+func (f *Fake) createMigrationBlob(c *command) []byte {
+	if len(c.auths) != 2 {
+		return errorResponse(rcBadTag)
+	}
+	var parent tpmutil.Handle
+	var migrationType, scheme uint16
+	var migrationKey tpmPubKey
+	var digest [20]byte
+	var encData tpmutil.U32Bytes
+	if _, err := tpmutil.Unpack(c.params, &parent, &migrationType, &migrationKey, &scheme, &digest, &encData); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if parent != khSRK {
+		return errorResponse(rcInvalidKeyHandle)
+	}
+	if migrationType != scheme || (scheme != msRewrap && scheme != msMigrate) {
+		return errorResponse(rcBadMode)
+	}
+	if len(encData) != 20 {
+		return errorResponse(rcDecryptError)
+	}
+	w, ok := f.wrapped[[20]byte(encData)]
+	if !ok {
+		return errorResponse(rcDecryptError)
+	}
+
+	key1, rc := f.checkAuth(c, 0, 1, parent, f.SRKAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	key2, rc := f.checkAuth(c, 1, 1, parent, w.migrationAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+
+	var random []byte
+	if scheme == msMigrate {
+		random = make([]byte, len(migrationKey.Key))
+		f.random(random)
+	}
+	outData := make([]byte, len(migrationKey.Key))
+	f.random(outData)
+	return f.authResponse(c, [][]byte{key1, key2}, tpmutil.U32Bytes(random), tpmutil.U32Bytes(outData))
+}
+
+// A tpmPubKey is a TPM_PUBKEY for a 2048-bit RSA key.
+type tpmPubKey struct {
+	AlgID     uint32
+	EncScheme uint16
+	SigScheme uint16
+	Params    tpmutil.U32Bytes
+	Key       tpmutil.U32Bytes
+}
+
+// getPubKey handles TPM_GetPubKey. With authorization, the fake only supports
+// it for the SRK, whose public key is random, and made on first use. Without
+// authorization, it returns the public key of a loaded key whose public key can
+// be read without its usage auth, and fails with TPM_AUTHFAIL for any other.
+func (f *Fake) getPubKey(c *command) []byte {
+	var keyHandle tpmutil.Handle
+	if _, err := tpmutil.Unpack(c.params, &keyHandle); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if len(c.auths) == 0 {
+		if keyHandle == khSRK {
+			return errorResponse(rcAuthFail)
+		}
+		k, ok := f.keys[keyHandle]
+		if !ok {
+			return errorResponse(rcInvalidKeyHandle)
+		}
+		if k.AuthDataUsage != authNever && k.AuthDataUsage != authPrivUseOnly {
+			return errorResponse(rcAuthFail)
+		}
+		return response(tpmPubKey{k.AlgID, k.EncScheme, k.SigScheme, k.Params, k.PubKey})
+	}
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	if keyHandle != khSRK {
+		return errorResponse(rcInvalidKeyHandle)
+	}
+	key, rc := f.checkAuth(c, 0, 1, keyHandle, f.SRKAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+
+	return f.authResponse(c, [][]byte{key}, f.srkPublicKey())
+}
+
+// srkPublicKey returns the TPM_PUBKEY of the SRK, making a random one on
+// first use.
+func (f *Fake) srkPublicKey() tpmPubKey {
+	if f.srkPub == nil {
+		f.srkPub = make([]byte, 256)
+		f.random(f.srkPub)
+		f.srkPub[0] |= 0x80
+	}
+	return tpmPubKey{
+		AlgID:     algRSA,
+		EncScheme: esRSAEsOAEPSHA1MGF1,
+		SigScheme: ssNone,
+		Params:    rsaParams2048(),
+		Key:       f.srkPub,
+	}
+}
+
+// ekPublicKey returns the TPM_PUBKEY of the EK.
+func (f *Fake) ekPublicKey() tpmPubKey {
+	return tpmPubKey{
+		AlgID:     algRSA,
+		EncScheme: esRSAEsOAEPSHA1MGF1,
+		SigScheme: ssNone,
+		Params:    rsaParams2048(),
+		Key:       f.EK.N.Bytes(),
+	}
+}
+
+// rsaParams2048 returns a TPM_RSA_KEY_PARMS for a 2048-bit key with two primes
+// and the default exponent.
+func rsaParams2048() []byte {
+	params, _ := tpmutil.Pack(uint32(2048), uint32(2), tpmutil.U32Bytes(nil))
+	return params
+}
+
+// readPubEK handles TPM_ReadPubek, which a TPM only allows until it has an
+// owner.
+func (f *Fake) readPubEK(c *command) []byte {
+	var nonce [20]byte
+	if _, err := tpmutil.Unpack(c.params, &nonce); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if f.EK == nil {
+		return errorResponse(rcNoEndorsement)
+	}
+	if !f.Unowned {
+		return errorResponse(rcDisabledCmd)
+	}
+	pub := f.ekPublicKey()
+	b, _ := tpmutil.Pack(pub, nonce)
+	return response(pub, sha1.Sum(b))
+}
+
+// takeOwnership handles TPM_TakeOwnership. The new owner auth authorizes the
+// command in an OIAP session, so it has to be decrypted before the auth can be
+// checked.
+func (f *Fake) takeOwnership(c *command) []byte {
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	var pid uint16
+	var encOwnerAuth, encSRKAuth tpmutil.U32Bytes
+	var srk tpmKey
+	if _, err := tpmutil.Unpack(c.params, &pid, &encOwnerAuth, &encSRKAuth, &srk); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if pid != pidOwner {
+		return errorResponse(rcBadParameter)
+	}
+	if !f.Unowned {
+		return errorResponse(rcOwnerSet)
+	}
+	if f.EK == nil {
+		return errorResponse(rcNoEndorsement)
+	}
+	if srk.AlgID != algRSA || srk.EncScheme != esRSAEsOAEPSHA1MGF1 || srk.SigScheme != ssNone {
+		return errorResponse(rcBadParameter)
+	}
+
+	ownerAuth, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, f.EK, encOwnerAuth, oaepLabel)
+	if err != nil || len(ownerAuth) != 20 {
+		return errorResponse(rcBadParameter)
+	}
+	srkAuth, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, f.EK, encSRKAuth, oaepLabel)
+	if err != nil || len(srkAuth) != 20 {
+		return errorResponse(rcBadParameter)
+	}
+	if s := f.sessions[c.auths[0].AuthHandle]; s != nil && s.secret != nil {
+		return errorResponse(rcBadMode)
+	}
+	key, rc := f.checkAuth(c, 0, 0, khOwner, ownerAuth)
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+
+	f.Unowned = false
+	copy(f.OwnerAuth[:], ownerAuth)
+	copy(f.SRKAuth[:], srkAuth)
+	f.srkPub = nil
+	pub := f.srkPublicKey()
+	srk.Params = pub.Params
+	srk.PubKey = pub.Key
+	srk.EncData = nil
+	return f.authResponse(c, [][]byte{key}, srk)
+}
+
+// ownerReadInternalPub handles TPM_OwnerReadInternalPub, which reads the
+// public part of the EK or the SRK with owner auth.
+func (f *Fake) ownerReadInternalPub(c *command) []byte {
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	var keyHandle tpmutil.Handle
+	if _, err := tpmutil.Unpack(c.params, &keyHandle); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	var pub tpmPubKey
+	switch {
+	case keyHandle == khSRK && !f.Unowned:
+		pub = f.srkPublicKey()
+	case keyHandle == khEK && f.EK != nil:
+		pub = f.ekPublicKey()
+	default:
+		return errorResponse(rcBadParameter)
+	}
+	// The key handle is part of the authorized parameters.
+	key, rc := f.checkAuth(c, 0, 0, khOwner, f.OwnerAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	return f.authResponse(c, [][]byte{key}, pub)
+}
+
+func (f *Fake) reset(c *command) []byte {
+	f.sessions = make(map[tpmutil.Handle]*session)
+	return response()
+}
+
+func (f *Fake) resetLockValue(c *command) []byte {
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	key, rc := f.checkAuth(c, 0, 0, khOwner, f.OwnerAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	f.LockValueResets++
+	return f.authResponse(c, [][]byte{key})
+}
+
+// nvArea returns the part of the NV index that a command reads or writes, or a
+// return code if it isn't defined.
+func (f *Fake) nvArea(index, offset, size uint32) ([]byte, uint32) {
+	data, ok := f.NV[index]
+	if !ok {
+		return nil, rcBadIndex
+	}
+	if uint64(offset)+uint64(size) > uint64(len(data)) {
+		return nil, rcNoSpace
+	}
+	return data[offset : offset+size], rcSuccess
+}
+
+// nvReadValue handles TPM_NV_ReadValue, which reads an NV index with owner auth
+// or, as the NV storage isn't locked, without any.
+func (f *Fake) nvReadValue(c *command) []byte {
+	if len(c.auths) > 1 {
+		return errorResponse(rcBadTag)
+	}
+	var index, offset, size uint32
+	if _, err := tpmutil.Unpack(c.params, &index, &offset, &size); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	data, rc := f.nvArea(index, offset, size)
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	if len(c.auths) == 0 {
+		return response(tpmutil.U32Bytes(data))
+	}
+	key, rc := f.checkAuth(c, 0, 0, khOwner, f.OwnerAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	return f.authResponse(c, [][]byte{key}, tpmutil.U32Bytes(data))
+}
+
+// nvWriteValue handles TPM_NV_WriteValue, which writes an NV index with owner
+// auth or, as the NV storage isn't locked, without any. Its response has no
+// parameters.
+func (f *Fake) nvWriteValue(c *command) []byte {
+	if len(c.auths) > 1 {
+		return errorResponse(rcBadTag)
+	}
+	var index, offset, size uint32
+	n, err := tpmutil.Unpack(c.params, &index, &offset, &size)
+	if err != nil || len(c.params)-n != int(size) {
+		return errorResponse(rcBadParamSize)
+	}
+	area, rc := f.nvArea(index, offset, size)
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	if len(c.auths) == 0 {
+		copy(area, c.params[n:])
+		return response()
+	}
+	key, rc := f.checkAuth(c, 0, 0, khOwner, f.OwnerAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	copy(area, c.params[n:])
+	return f.authResponse(c, [][]byte{key})
+}
+
+func (f *Fake) getCapability(c *command) []byte {
+	var capArea uint32
+	var subCap tpmutil.U32Bytes
+	if _, err := tpmutil.Unpack(c.params, &capArea, &subCap); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	// The version capabilities ignore their subCap.
+	switch {
+	case capArea == capVersion11 && f.Version11:
+		return response(tpmutil.U32Bytes{1, 1, fakeRevMajor, fakeRevMinor})
+	case capArea == capVersion11:
+		return response(tpmutil.U32Bytes{1, 1, 0, 0})
+	case capArea == capVersionVal && !f.Version11:
+		// A TPM_CAP_VERSION_INFO for a TPM 1.2 at spec level 2, errata
+		// revision 3, with no vendor-specific data.
+		b, _ := tpmutil.Pack(capVersionInfoTag, [4]byte{1, 2, fakeRevMajor, fakeRevMinor}, uint16(2), byte(3), manufacturer, uint16(0))
+		return response(tpmutil.U32Bytes(b))
+	}
+	if len(subCap) != 4 {
+		return errorResponse(rcBadMode)
+	}
+	sub := binary.BigEndian.Uint32(subCap)
+
+	switch {
+	case capArea == capProperty && sub == subCapPropManufacturer:
+		return response(tpmutil.U32Bytes(manufacturer[:]))
+	case capArea == capProperty && sub == subCapPropKeys && f.MaxKeys > 0:
+		return propertyResponse(f.MaxKeys - len(f.keys))
+	case capArea == capProperty && (sub == subCapPropContext || sub == subCapPropMaxContext) && f.MaxSavedContexts > 0:
+		return propertyResponse(f.MaxSavedContexts)
+	case capArea == capProperty && sub == subCapPropMaxKeys && f.MaxKeys > 0:
+		return propertyResponse(f.MaxKeys)
+	case capArea == capProperty && sub == subCapPropAuthSess && f.MaxSessions > 0:
+		return propertyResponse(f.MaxSessions - len(f.sessions))
+	case capArea == capProperty && sub == subCapPropMaxAuthSess && f.MaxSessions > 0:
+		return propertyResponse(f.MaxSessions)
+	case capArea == capProperty && sub == subCapPropMaxTranSess:
+		// The fake has no transport sessions, and like some real TPMs it
+		// only reports the maximum.
+		return propertyResponse(0)
+	case capArea == capFlag && sub == subCapFlagPermanent:
+		return f.permanentFlags()
+	case capArea == capFlag && sub == subCapFlagVolatile:
+		// Only the deactivated and physical presence flags are ever set.
+		var flags [5]bool
+		flags[0] = f.tempDeactivated
+		flags[2] = f.ppAsserted
+		flags[3] = f.ppLocked
+		b, _ := tpmutil.Pack(stClearFlagsTag, flags)
+		return response(tpmutil.U32Bytes(b))
+	case capArea == capHandle && sub == rtKey:
+		b, _ := tpmutil.Pack(uint16(len(f.keys)))
+		for h := firstKeyHandle; h < f.nextKey; h++ {
+			if _, ok := f.keys[h]; ok {
+				hb, _ := tpmutil.Pack(h)
+				b = append(b, hb...)
+			}
+		}
+		return response(tpmutil.U32Bytes(b))
+	case capArea == capHandle && sub == rtAuth:
+		b, _ := tpmutil.Pack(uint16(len(f.sessions)))
+		for h := firstSessionHandle; h < f.nextHandle; h++ {
+			if _, ok := f.sessions[h]; ok {
+				hb, _ := tpmutil.Pack(h)
+				b = append(b, hb...)
+			}
+		}
+		return response(tpmutil.U32Bytes(b))
+	default:
+		return errorResponse(rcBadMode)
+	}
+}
+
+// permanentFlags builds the response to GetCapability for the
+// TPM_PERMANENT_FLAGS. Only the deactivated and physical presence flags are
+// ever set.
+func (f *Fake) permanentFlags() []byte {
+	var flags [20]bool
+	flags[0] = f.Disabled
+	flags[2] = f.Deactivated
+	flags[6] = f.ppLifetimeLock
+	flags[7] = f.ppHWEnable
+	flags[8] = f.ppCMDEnable
+	b, _ := tpmutil.Pack(permanentFlagsTag, flags)
+	return response(tpmutil.U32Bytes(b))
+}
+
+// propertyResponse builds the response to GetCapability for a numeric
+// TPM_CAP_PROPERTY.
+func propertyResponse(v int) []byte {
+	b, _ := tpmutil.Pack(uint32(v))
+	return response(tpmutil.U32Bytes(b))
+}
+
+func (f *Fake) flushSpecific(c *command) []byte {
+	var h tpmutil.Handle
+	var resourceType uint32
+	if _, err := tpmutil.Unpack(c.params, &h, &resourceType); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	switch resourceType {
+	case rtAuth:
+		if _, ok := f.sessions[h]; !ok {
+			return errorResponse(rcInvalidAuthHandle)
+		}
+		delete(f.sessions, h)
+		return response()
+	case rtKey:
+		if _, ok := f.keys[h]; !ok {
+			return errorResponse(rcInvalidKeyHandle)
+		}
+		delete(f.keys, h)
+		return response()
+	default:
+		return errorResponse(rcBadParameter)
+	}
+}
+
+func (f *Fake) physicalPresence(c *command) []byte {
+	var pp uint16
+	if _, err := tpmutil.Unpack(c.params, &pp); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+
+	// Each command may only use the bits of one group.
+	switch {
+	case pp == ppLifetimeLock:
+		if f.ppLifetimeLock {
+			return errorResponse(rcBadParameter)
+		}
+		f.ppLifetimeLock = true
+	case pp != 0 && pp&^ppEnableBits == 0:
+		if f.ppLifetimeLock || pp&ppHWEnable != 0 && pp&ppHWDisable != 0 || pp&ppCMDEnable != 0 && pp&ppCMDDisable != 0 {
+			return errorResponse(rcBadParameter)
+		}
+		if pp&ppHWEnable != 0 {
+			f.ppHWEnable = true
+		}
+		if pp&ppHWDisable != 0 {
+			f.ppHWEnable = false
+		}
+		if pp&ppCMDEnable != 0 {
+			f.ppCMDEnable = true
+		}
+		if pp&ppCMDDisable != 0 {
+			f.ppCMDEnable = false
+		}
+	case pp != 0 && pp&^ppPresenceBits == 0:
+		if !f.ppCMDEnable || f.ppLocked || pp&ppPresent != 0 && pp&ppNotPresent != 0 {
+			return errorResponse(rcBadParameter)
+		}
+		if pp&ppPresent != 0 {
+			f.ppAsserted = true
+		}
+		if pp&ppNotPresent != 0 {
+			f.ppAsserted = false
+		}
+		if pp&ppLock != 0 {
+			f.ppLocked = true
+		}
+	default:
+		return errorResponse(rcBadParameter)
+	}
+	return response()
+}
+
+// startup handles TPM_Startup as if the machine had just been rebooted: it
+// resets the PCRs and the volatile flags, closes every session and unloads
+// every key. Unlike a real TPM, the fake accepts Startup at any time, and it
+// never saves state, so only TPM_ST_CLEAR and TPM_ST_DEACTIVATED are
+// supported.
+func (f *Fake) startup(c *command) []byte {
+	var typ uint16
+	if _, err := tpmutil.Unpack(c.params, &typ); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	if typ != stClear && typ != stDeactivated {
+		return errorResponse(rcBadParameter)
+	}
+
+	f.pcrs = [numPCRs][20]byte{}
+	f.sessions = make(map[tpmutil.Handle]*session)
+	f.keys = make(map[tpmutil.Handle]*tpmKey)
+	f.tempDeactivated = typ == stDeactivated
+	f.ppAsserted = false
+	f.ppLocked = false
+	return response()
+}
+
+// setTempDeactivated handles TPM_SetTempDeactivated, which needs either
+// physical presence or operator auth in an OIAP session.
+func (f *Fake) setTempDeactivated(c *command) []byte {
+	if len(c.auths) == 0 {
+		if !f.ppAsserted {
+			return errorResponse(rcBadPresence)
+		}
+		f.tempDeactivated = true
+		return response()
+	}
+
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	if f.OperatorAuth == nil {
+		return errorResponse(rcNoOperator)
+	}
+	key, rc := f.checkAuth(c, 0, 0, khOperator, f.OperatorAuth)
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	f.tempDeactivated = true
+	return f.authResponse(c, [][]byte{key})
+}
+
+// ownerSetDisable handles TPM_OwnerSetDisable, which sets or clears the
+// disable permanent flag with owner auth.
+func (f *Fake) ownerSetDisable(c *command) []byte {
+	if len(c.auths) != 1 {
+		return errorResponse(rcBadTag)
+	}
+	var disable byte
+	if _, err := tpmutil.Unpack(c.params, &disable); err != nil {
+		return errorResponse(rcBadParamSize)
+	}
+	key, rc := f.checkAuth(c, 0, 0, khOwner, f.OwnerAuth[:])
+	if rc != rcSuccess {
+		return errorResponse(rc)
+	}
+	f.Disabled = disable != 0
+	return f.authResponse(c, [][]byte{key})
+}
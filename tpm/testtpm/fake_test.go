@@ -0,0 +1,112 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testtpm_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/google/go-tpm/tpm"
+	"github.com/google/go-tpm/tpm/testtpm"
+)
+
+func TestGetRandom(t *testing.T) {
+	b1, err := tpm.GetRandom(testtpm.NewFake(), 64)
+	if err != nil {
+		t.Fatal("Couldn't get random bytes from the fake TPM:", err)
+	}
+	b2, err := tpm.GetRandom(testtpm.NewFake(), 64)
+	if err != nil {
+		t.Fatal("Couldn't get random bytes from the fake TPM:", err)
+	}
+	if len(b1) != 64 {
+		t.Fatalf("Got %d random bytes, want 64", len(b1))
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Fatal("Two fresh fake TPMs returned different random bytes")
+	}
+}
+
+func TestPcrExtend(t *testing.T) {
+	f := testtpm.NewFake()
+	old, err := tpm.ReadPCR(f, 12)
+	if err != nil {
+		t.Fatal("Couldn't read PCR 12:", err)
+	}
+
+	var v [20]byte
+	copy(v[:], "FFFFFFFFFFFFFFFFFFFF")
+	extended, err := tpm.PcrExtend(f, 12, v)
+	if err != nil {
+		t.Fatal("Couldn't extend PCR 12:", err)
+	}
+	want := sha1.Sum(append(old, v[:]...))
+	if !bytes.Equal(extended, want[:]) {
+		t.Fatalf("PcrExtend returned % x, want % x", extended, want)
+	}
+
+	got, err := tpm.ReadPCR(f, 12)
+	if err != nil {
+		t.Fatal("Couldn't read PCR 12:", err)
+	}
+	if !bytes.Equal(got, want[:]) {
+		t.Fatalf("ReadPCR returned % x after extend, want % x", got, want)
+	}
+
+	if _, err := tpm.ReadPCR(f, 24); err == nil {
+		t.Fatal("ReadPCR succeeded on PCR 24")
+	}
+}
+
+func TestSealUnseal(t *testing.T) {
+	f := testtpm.NewFake()
+	data := []byte("a secret sealed to PCR 17")
+	srkAuth := tpm.WellKnownAuth()
+
+	sealed, err := tpm.Seal(f, tpm.LocZero, []int{17}, data, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't seal the data:", err)
+	}
+
+	unsealed, err := tpm.Unseal(f, sealed, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't unseal the data:", err)
+	}
+	if !bytes.Equal(unsealed, data) {
+		t.Fatalf("Unseal returned %q, want %q", unsealed, data)
+	}
+
+	// Changing PCR 17 must make the data impossible to unseal.
+	if _, err := tpm.PcrExtend(f, 17, [20]byte{1}); err != nil {
+		t.Fatal("Couldn't extend PCR 17:", err)
+	}
+	if _, err := tpm.Unseal(f, sealed, srkAuth[:]); err == nil {
+		t.Fatal("Unseal succeeded after PCR 17 changed")
+	}
+}
+
+func TestSealWrongAuth(t *testing.T) {
+	f := testtpm.NewFake()
+	f.SRKAuth = tpm.SHA1Auth([]byte("srk"))
+
+	wrongAuth := tpm.WellKnownAuth()
+	if _, err := tpm.Seal(f, tpm.LocZero, []int{17}, []byte("data"), wrongAuth[:]); err == nil {
+		t.Fatal("Seal succeeded with the wrong SRK auth")
+	}
+	if _, err := tpm.Seal(f, tpm.LocZero, []int{17}, []byte("data"), f.SRKAuth[:]); err != nil {
+		t.Fatal("Couldn't seal with the right SRK auth:", err)
+	}
+}
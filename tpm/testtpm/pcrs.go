@@ -0,0 +1,74 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testtpm
+
+import (
+	"crypto/sha1"
+	"errors"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// tagPCRInfoLong is the structure tag of a TPM_PCR_INFO_LONG.
+const tagPCRInfoLong uint16 = 0x0006
+
+// A pcrSelection is a TPM_PCR_SELECTION with a 3-byte mask.
+type pcrSelection struct {
+	Size uint16
+	Mask [3]byte
+}
+
+// A pcrInfoLong is a TPM_PCR_INFO_LONG.
+type pcrInfoLong struct {
+	Tag              uint16
+	LocAtCreation    byte
+	LocAtRelease     byte
+	PCRsAtCreation   pcrSelection
+	PCRsAtRelease    pcrSelection
+	DigestAtCreation [20]byte
+	DigestAtRelease  [20]byte
+}
+
+// parsePCRInfoLong parses a serialized TPM_PCR_INFO_LONG.
+func parsePCRInfoLong(b []byte) (*pcrInfoLong, error) {
+	var pcri pcrInfoLong
+	read, err := tpmutil.Unpack(b, &pcri)
+	if err != nil {
+		return nil, err
+	}
+	if read != len(b) {
+		return nil, errors.New("trailing bytes after TPM_PCR_INFO_LONG")
+	}
+	if pcri.Tag != tagPCRInfoLong {
+		return nil, errors.New("wrong tag for TPM_PCR_INFO_LONG")
+	}
+	if pcri.PCRsAtCreation.Size != 3 || pcri.PCRsAtRelease.Size != 3 {
+		return nil, errors.New("unsupported PCR selection size")
+	}
+	return &pcri, nil
+}
+
+// composite computes the TPM_COMPOSITE_HASH of the current values of the
+// selected PCRs.
+func (f *Fake) composite(sel pcrSelection) [20]byte {
+	var vals []byte
+	for i := 0; i < numPCRs; i++ {
+		if sel.Mask[i/8]&(1<<uint(i%8)) != 0 {
+			vals = append(vals, f.pcrs[i][:]...)
+		}
+	}
+	b, _ := tpmutil.Pack(sel, tpmutil.U32Bytes(vals))
+	return sha1.Sum(b)
+}
@@ -13,6 +13,15 @@
 // limitations under the License.
 
 // Package tpm supports direct communication with a tpm device under Linux.
+//
+// Every auth parameter in this package (srkAuth, ownerAuth, aikAuth, keyAuth
+// and so on) is a 20-byte TPM auth value, not a passphrase, and is used as-is
+// as an HMAC key. The SRK auth is used by Seal, Reseal, Unseal, LoadKey2,
+// MakeIdentity and the CreateWrapKey family. The owner auth is used by
+// MakeIdentity, ActivateIdentity, ResetLockValue, OwnerClear, the OwnerRead
+// functions and the owner-authorized NV functions. The usage auth of a loaded
+// key is used by Quote, Quote2, Sign and GetPubKey. WellKnownAuth and SHA1Auth
+// make auth values.
 package tpm
 
 import (
@@ -24,17 +33,27 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	_ "crypto/sha256" // Registers the SHA-256 OAEP hash of BindWithHash.
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 
+	"github.com/google/go-tpm/tpm/verify"
 	"github.com/google/go-tpm/tpmutil"
 )
 
 // GetKeys gets the list of handles for currently-loaded TPM keys.
 func GetKeys(rw io.ReadWriter) ([]tpmutil.Handle, error) {
-	b, err := getCapability(rw, CapHandle, rtKey)
+	return getHandles(rw, rtKey)
+}
+
+// getHandles gets the list of handles for currently-loaded resources of the
+// given resource type. The TPM returns these as a TPM_KEY_HANDLE_LIST, which
+// is a 16-bit count followed by that many 32-bit handles.
+func getHandles(rw io.ReadWriter, resourceType uint32) ([]tpmutil.Handle, error) {
+	b, err := getCapability(rw, CapHandle, resourceType)
 	if err != nil {
 		return nil, err
 	}
@@ -45,12 +64,52 @@ func GetKeys(rw io.ReadWriter) ([]tpmutil.Handle, error) {
 	return handles, err
 }
 
+// FlushAll flushes every loaded key and every open auth session from the TPM.
+// This is useful for test teardown and for recovering a TPM that has run out
+// of resources. The SRK and EK are permanent and are never flushed.
+func FlushAll(rw io.ReadWriter) error {
+	for _, rt := range []uint32{rtKey, rtAuth} {
+		handles, err := getHandles(rw, rt)
+		if err != nil {
+			return err
+		}
+		for _, h := range handles {
+			if h == khSRK || h == khEK {
+				continue
+			}
+			if err := flushSpecific(rw, h, rt); err != nil {
+				return fmt.Errorf("couldn't flush handle 0x%x: %v", h, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Reset brings the TPM back to a clean transient state, for use between the
+// cases of a test suite: it flushes every loaded key and auth session with
+// FlushAll, then resets the dictionary-attack lock with ResetLockValue. The
+// lock is only reset if ownerAuth is WellKnownAuth, since test TPMs are owned
+// with the well-known value; a failed reset with the wrong owner auth would
+// itself count as a dictionary-attack failure.
+func Reset(rw io.ReadWriter, ownerAuth Digest) error {
+	if err := FlushAll(rw); err != nil {
+		return err
+	}
+	if ownerAuth != WellKnownAuth() {
+		return nil
+	}
+	if err := ResetLockValue(rw, ownerAuth); err != nil {
+		return fmt.Errorf("couldn't reset the lock value: %v", err)
+	}
+	return nil
+}
+
 // PcrExtend extends a value into the right PCR by index.
-func PcrExtend(rw io.ReadWriter, pcrIndex uint32, pcr pcrValue) ([]byte, error) {
+func PcrExtend(rw io.ReadWriter, pcrIndex uint32, pcr PCRValue) ([]byte, error) {
 	in := []interface{}{pcrIndex, pcr}
-	var d pcrValue
+	var d PCRValue
 	out := []interface{}{&d}
-	if _, err := submitTPMRequest(rw, tagRQUCommand, ordExtend, in, out); err != nil {
+	if _, err := submitTPMRequest(rw, TagRQUCommand, OrdExtend, in, out); err != nil {
 		return nil, err
 	}
 
@@ -60,11 +119,11 @@ func PcrExtend(rw io.ReadWriter, pcrIndex uint32, pcr pcrValue) ([]byte, error)
 // ReadPCR reads a PCR value from the TPM.
 func ReadPCR(rw io.ReadWriter, pcrIndex uint32) ([]byte, error) {
 	in := []interface{}{pcrIndex}
-	var v pcrValue
+	var v PCRValue
 	out := []interface{}{&v}
 	// There's no need to check the ret value here, since the err value contains
 	// all the necessary information.
-	if _, err := submitTPMRequest(rw, tagRQUCommand, ordPCRRead, in, out); err != nil {
+	if _, err := submitTPMRequest(rw, TagRQUCommand, OrdPCRRead, in, out); err != nil {
 		return nil, err
 	}
 
@@ -93,7 +152,7 @@ func GetRandom(rw io.ReadWriter, size uint32) ([]byte, error) {
 	out := []interface{}{&b}
 	// There's no need to check the ret value here, since the err value
 	// contains all the necessary information.
-	if _, err := submitTPMRequest(rw, tagRQUCommand, ordGetRandom, in, out); err != nil {
+	if _, err := submitTPMRequest(rw, TagRQUCommand, OrdGetRandom, in, out); err != nil {
 		return nil, err
 	}
 
@@ -109,6 +168,11 @@ func LoadKey2(rw io.ReadWriter, keyBlob []byte, srkAuth []byte) (tpmutil.Handle,
 		return 0, err
 	}
 
+	return loadKey2Helper(rw, &k, srkAuth)
+}
+
+// loadKey2Helper loads a deserialized key into the TPM under the SRK.
+func loadKey2Helper(rw io.ReadWriter, k *key, srkAuth []byte) (tpmutil.Handle, error) {
 	// Run OSAP for the SRK, reading a random OddOSAP for our initial
 	// command and getting back a secret and a handle. LoadKey2 needs an
 	// OSAP session for the SRK because the private part of a TPM_KEY or
@@ -120,19 +184,19 @@ func LoadKey2(rw io.ReadWriter, keyBlob []byte, srkAuth []byte) (tpmutil.Handle,
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
 
-	authIn := []interface{}{ordLoadKey2, k}
+	authIn := []interface{}{OrdLoadKey2, k}
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
 		return 0, err
 	}
 
-	handle, ra, ret, err := loadKey2(rw, &k, ca)
+	handle, ra, ret, err := loadKey2(rw, k, ca)
 	if err != nil {
 		return 0, err
 	}
 
 	// Check the response authentication.
-	raIn := []interface{}{ret, ordLoadKey2}
+	raIn := []interface{}{ret, OrdLoadKey2}
 	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
 		return 0, err
 	}
@@ -140,59 +204,211 @@ func LoadKey2(rw io.ReadWriter, keyBlob []byte, srkAuth []byte) (tpmutil.Handle,
 	return handle, nil
 }
 
+// A LoadedKey is a key that has been loaded into the TPM, along with the
+// usage auth value for the key and the public parameters parsed from its key
+// blob. Its methods pass the right handle and auth value to each command, so
+// the two can't be mixed up between keys.
+type LoadedKey struct {
+	// Handle is the TPM handle of the loaded key.
+	Handle tpmutil.Handle
+
+	key    key
+	auth   []byte
+	closed bool
+}
+
+// LoadKey loads a key blob into the TPM like LoadKey2 and returns a LoadedKey
+// that remembers keyAuth, the usage auth value of the key.
+func LoadKey(rw io.ReadWriter, keyBlob []byte, srkAuth []byte, keyAuth []byte) (*LoadedKey, error) {
+	lk := &LoadedKey{auth: append([]byte(nil), keyAuth...)}
+	if _, err := tpmutil.Unpack(keyBlob, &lk.key); err != nil {
+		return nil, err
+	}
+
+	handle, err := loadKey2Helper(rw, &lk.key, srkAuth)
+	if err != nil {
+		return nil, err
+	}
+	lk.Handle = handle
+	return lk, nil
+}
+
+// PublicKey returns the RSA public key from the key blob the key was loaded
+// from. It doesn't send any command to the TPM.
+func (lk *LoadedKey) PublicKey() (*rsa.PublicKey, error) {
+	return lk.key.RSAPublicKey()
+}
+
+// UsesAuth reports whether the key needs its usage auth, from the
+// TPM_AUTH_DATA_USAGE of the key blob it was loaded from: it's false only for a
+// TPM_AUTH_NEVER key. It doesn't send any command to the TPM.
+func (lk *LoadedKey) UsesAuth() bool {
+	return lk.key.AuthDataUsage != authNever
+}
+
+// Quote produces a TPM quote for the given data with the loaded key. See
+// Quote.
+func (lk *LoadedKey) Quote(rw io.ReadWriter, data []byte, pcrNums []int) ([]byte, []byte, error) {
+	return Quote(rw, lk.Handle, data, pcrNums, lk.auth)
+}
+
+// Quote2 performs a quote operation with the loaded key. See Quote2.
+func (lk *LoadedKey) Quote2(rw io.ReadWriter, data []byte, pcrVals []int, addVersion bool) ([]byte, error) {
+	return Quote2(rw, lk.Handle, data, pcrVals, addVersion, lk.auth)
+}
+
+// Sign signs a digest with the loaded key. See Sign.
+func (lk *LoadedKey) Sign(rw io.ReadWriter, hash crypto.Hash, hashed []byte) ([]byte, error) {
+	return Sign(rw, lk.auth, lk.Handle, hash, hashed)
+}
+
+// UnBind decrypts data bound to the loaded key. See UnBind.
+func (lk *LoadedKey) UnBind(rw io.ReadWriter, encData []byte) ([]byte, error) {
+	return UnBind(rw, lk.auth, lk.Handle, encData)
+}
+
+// GetPubKey retrieves the public key of the loaded key from the TPM. See
+// GetPubKey.
+func (lk *LoadedKey) GetPubKey(rw io.ReadWriter) ([]byte, error) {
+	return GetPubKey(rw, lk.Handle, lk.auth)
+}
+
+// Close flushes the key from the TPM and zeroes the cached auth value. Only the
+// first call flushes the key, since the TPM may have given its handle to
+// another key by the time of a later one.
+func (lk *LoadedKey) Close(rw io.ReadWriter) error {
+	if lk.closed {
+		return nil
+	}
+	lk.closed = true
+	zeroBytes(lk.auth)
+	return CloseKey(rw, lk.Handle)
+}
+
 // Quote2 performs a quote operation on the TPM for the given data,
 // under the key associated with the handle and for the pcr values
-// specified in the call.
-func Quote2(rw io.ReadWriter, handle tpmutil.Handle, data []byte, pcrVals []int, addVersion byte, aikAuth []byte) ([]byte, error) {
+// specified in the call. The data is hashed with SHA-1 and the digest is used
+// as the externalData of the quote; use Quote2ExternalData to supply the
+// externalData directly. If addVersion is true, the TPM appends its
+// TPM_CAP_VERSION_INFO to the TPM_QUOTE_INFO2 that it signs. aikAuth is the
+// usage auth of the key at handle, not the SRK auth.
+func Quote2(rw io.ReadWriter, handle tpmutil.Handle, data []byte, pcrVals []int, addVersion bool, aikAuth []byte) ([]byte, error) {
+	return Quote2ExternalData(rw, handle, sha1.Sum(data), pcrVals, addVersion, aikAuth)
+}
+
+// Quote2ExternalData performs a quote operation on the TPM like Quote2, but
+// passes externalData to the TPM as-is instead of hashing caller data first.
+// This is the form to use when the verifier hands out a 20-byte nonce.
+func Quote2ExternalData(rw io.ReadWriter, handle tpmutil.Handle, externalData Nonce, pcrVals []int, addVersion bool, aikAuth []byte) ([]byte, error) {
+	sig, _, _, err := quote2Helper(rw, handle, externalData, pcrVals, addVersion, aikAuth)
+	return sig, err
+}
+
+// Quote2Values performs a quote like Quote2ExternalData, but also returns the
+// values of the quoted PCRs, sorted by PCR index, and the TPM_CAP_VERSION_INFO
+// that the TPM added to the signed data if addVersion is set; pass both to
+// VerifyQuote2. The TPM doesn't return PCR values from a Quote2, so
+// Quote2Values reads them after the quote and checks them against the PCR
+// digest that the TPM signed. If a PCR was extended in between, it returns an
+// error, and the quote can be retried.
+func Quote2Values(rw io.ReadWriter, handle tpmutil.Handle, externalData Nonce, pcrNums []int, addVersion bool, aikAuth []byte) ([]byte, []byte, []byte, error) {
+	sig, pcrShort, versionInfo, err := quote2Helper(rw, handle, externalData, pcrNums, addVersion, aikAuth)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	values, composite, err := ReadPCRComposite(rw, pcrNums)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if sha1.Sum(composite) != pcrShort.DigestAtRelease {
+		return nil, nil, nil, errors.New("the PCRs changed after the quote")
+	}
+	return sig, values, versionInfo, nil
+}
+
+// quote2Helper runs the Quote2 command and returns the signature along with the
+// TPM_PCR_INFO_SHORT and the serialized TPM_CAP_VERSION_INFO, if any, that the
+// TPM signed.
+func quote2Helper(rw io.ReadWriter, handle tpmutil.Handle, externalData Nonce, pcrVals []int, addVersion bool, aikAuth []byte) ([]byte, *pcrInfoShort, []byte, error) {
 	// Run OSAP for the handle, reading a random OddOSAP for our initial
 	// command and getting back a secret and a response.
 	sharedSecret, osapr, err := newOSAPSession(rw, etKeyHandle, handle, aikAuth)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
 
-	// Hash the data to get the value to pass to quote2.
-	hash := sha1.Sum(data)
 	pcrSel, err := newPCRSelection(pcrVals)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	// addVersion is a TPM BOOL, which is a single byte.
+	var av byte
+	if addVersion {
+		av = 1
 	}
-	authIn := []interface{}{ordQuote2, hash, pcrSel, addVersion}
+	authIn := []interface{}{OrdQuote2, externalData, pcrSel, av}
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	// TODO(tmroeder): use the returned CapVersion.
-	pcrShort, _, capBytes, sig, ra, ret, err := quote2(rw, handle, hash, pcrSel, addVersion, ca)
+	pcrShort, _, capBytes, sig, ra, ret, err := quote2(rw, handle, externalData, pcrSel, av, ca)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, keyHandleError(handle, err)
 	}
 
 	// Check response authentication.
-	raIn := []interface{}{ret, ordQuote2, pcrShort, tpmutil.U32Bytes(capBytes), tpmutil.U32Bytes(sig)}
+	raIn := []interface{}{ret, OrdQuote2, pcrShort, tpmutil.U32Bytes(capBytes), tpmutil.U32Bytes(sig)}
 	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	if err := checkQuote2VersionInfo(addVersion, capBytes); err != nil {
+		return nil, nil, nil, err
 	}
 
-	return sig, nil
+	return sig, pcrShort, capBytes, nil
+}
+
+// checkQuote2VersionInfo checks that the TPM returned a TPM_CAP_VERSION_INFO
+// from Quote2 exactly when it was asked to add one. Without it, the response
+// just has an empty versionInfo, and the signed TPM_QUOTE_INFO2 has nothing
+// after it.
+func checkQuote2VersionInfo(addVersion bool, versionInfo []byte) error {
+	if addVersion && len(versionInfo) == 0 {
+		return errors.New("the TPM didn't add its version info to the quote")
+	}
+	if !addVersion && len(versionInfo) != 0 {
+		return errors.New("the TPM added version info to the quote without being asked")
+	}
+	return nil
 }
 
 // GetPubKey retrieves an opaque blob containing a public key corresponding to
-// a handle from the TPM.
-func GetPubKey(rw io.ReadWriter, keyHandle tpmutil.Handle, srkAuth []byte) ([]byte, error) {
+// a handle from the TPM. keyAuth is the usage auth of the key at keyHandle,
+// which is the SRK auth if keyHandle is the SRK. The TPM doesn't reveal the
+// EK through TPM_GetPubKey; use OwnerReadPubEK or ReadPubEK to read it.
+func GetPubKey(rw io.ReadWriter, keyHandle tpmutil.Handle, keyAuth []byte) ([]byte, error) {
+	entityType := etKeyHandle
+	switch keyHandle {
+	case khSRK:
+		entityType = etSRK
+	case khEK:
+		return nil, errors.New("the TPM doesn't reveal the EK through TPM_GetPubKey; read it with OwnerReadPubEK, or with ReadPubEK if the TPM has no owner")
+	}
+
 	// Run OSAP for the handle, reading a random OddOSAP for our initial
 	// command and getting back a secret and a response.
-	sharedSecret, osapr, err := newOSAPSession(rw, etKeyHandle, keyHandle, srkAuth)
+	sharedSecret, osapr, err := newOSAPSession(rw, entityType, keyHandle, keyAuth)
 	if err != nil {
 		return nil, err
 	}
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
 
-	authIn := []interface{}{ordGetPubKey}
+	authIn := []interface{}{OrdGetPubKey}
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
 		return nil, err
@@ -200,11 +416,11 @@ func GetPubKey(rw io.ReadWriter, keyHandle tpmutil.Handle, srkAuth []byte) ([]by
 
 	pk, ra, ret, err := getPubKey(rw, keyHandle, ca)
 	if err != nil {
-		return nil, err
+		return nil, keyHandleError(keyHandle, err)
 	}
 
 	// Check response authentication for TPM_GetPubKey.
-	raIn := []interface{}{ret, ordGetPubKey, pk}
+	raIn := []interface{}{ret, OrdGetPubKey, pk}
 	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
 		return nil, err
 	}
@@ -216,26 +432,64 @@ func GetPubKey(rw io.ReadWriter, keyHandle tpmutil.Handle, srkAuth []byte) ([]by
 	return b, err
 }
 
+// KeyRequiresAuth reports whether the key loaded at keyHandle needs its usage
+// auth, so that generic code can tell whether to open a session for it. The TPM
+// doesn't reveal the TPM_AUTH_DATA_USAGE of a loaded key, so KeyRequiresAuth
+// asks for its public key without authorization, which the TPM refuses with
+// TPM_AUTHFAIL for a TPM_AUTH_ALWAYS key. A TPM_AUTH_PRIV_USE_ONLY key, which
+// needs its auth for everything but reading its public key, can't be told from
+// a TPM_AUTH_NEVER key this way, and is reported as not needing auth. Use
+// LoadedKey.UsesAuth if the key blob is at hand.
+func KeyRequiresAuth(rw io.ReadWriter, keyHandle tpmutil.Handle) (bool, error) {
+	_, err := getPubKeyNoAuth(rw, keyHandle)
+	switch {
+	case err == nil:
+		return false, nil
+	case err == tpmError(errAuthFail):
+		return true, nil
+	default:
+		return false, keyHandleError(keyHandle, err)
+	}
+}
+
+// GetSRKPubKey retrieves the public key of the SRK from the TPM, for example
+// to wrap keys or migration blobs for it, using the SRK auth rather than the
+// owner auth that OwnerReadInternalPub needs. Not every TPM allows it: the
+// owner can make the SRK's public key readable only with owner auth.
+func GetSRKPubKey(rw io.ReadWriter, srkAuth []byte) ([]byte, error) {
+	return GetPubKey(rw, khSRK, srkAuth)
+}
+
 // newOSAPSession starts a new OSAP session and derives a shared key from it.
-func newOSAPSession(rw io.ReadWriter, entityType uint16, entityValue tpmutil.Handle, srkAuth []byte) ([20]byte, *osapResponse, error) {
+// entityAuth is the auth value of the entity the session is for: the usage
+// auth of the key for etKeyHandle, the SRK auth for etSRK and the owner auth
+// for etOwner.
+func newOSAPSession(rw io.ReadWriter, entityType uint16, entityValue tpmutil.Handle, entityAuth []byte) ([20]byte, *osapResponse, error) {
+	var sharedSecret [20]byte
+	if err := checkOSAPEntity(entityType, entityValue); err != nil {
+		return sharedSecret, nil, err
+	}
+
 	osapc := &osapCommand{
 		EntityType:  entityType,
 		EntityValue: entityValue,
 	}
 
-	var sharedSecret [20]byte
 	if _, err := rand.Read(osapc.OddOSAP[:]); err != nil {
 		return sharedSecret, nil, err
 	}
 
 	osapr, err := osap(rw, osapc)
 	if err != nil {
+		if entityType == etKeyHandle {
+			err = keyHandleError(entityValue, err)
+		}
 		return sharedSecret, nil, err
 	}
 
 	// A shared secret is computed as
 	//
-	// sharedSecret = HMAC-SHA1(srkAuth, evenosap||oddosap)
+	// sharedSecret = HMAC-SHA1(entityAuth, evenosap||oddosap)
 	//
 	// where srkAuth is the hash of the SRK authentication (which hash is all 0s
 	// for the well-known SRK auth value) and even and odd OSAP are the
@@ -245,7 +499,7 @@ func newOSAPSession(rw io.ReadWriter, entityType uint16, entityValue tpmutil.Han
 		return sharedSecret, nil, err
 	}
 
-	hm := hmac.New(sha1.New, srkAuth)
+	hm := hmac.New(sha1.New, entityAuth)
 	hm.Write(osapData)
 	// Note that crypto/hash.Sum returns a slice rather than an array, so we
 	// have to copy this into an array to make sure that serialization doesn't
@@ -255,10 +509,292 @@ func newOSAPSession(rw io.ReadWriter, entityType uint16, entityValue tpmutil.Han
 	return sharedSecret, osapr, nil
 }
 
+// checkOSAPEntity checks that entityValue is a handle that can be used with
+// entityType, so that mismatched pairs fail with a clear error instead of an
+// obscure one from the TPM.
+func checkOSAPEntity(entityType uint16, entityValue tpmutil.Handle) error {
+	switch entityType {
+	case etSRK:
+		if entityValue != khSRK {
+			return fmt.Errorf("entity type SRK requires handle 0x%x, got 0x%x", khSRK, entityValue)
+		}
+	case etOwner:
+		if entityValue != khOwner {
+			return fmt.Errorf("entity type owner requires handle 0x%x, got 0x%x", khOwner, entityValue)
+		}
+	case etKeyHandle:
+		// The only reserved handle that refers to a key usable with OSAP is
+		// the SRK.
+		if entityValue&0xff000000 == khSRK&0xff000000 && entityValue != khSRK {
+			return fmt.Errorf("entity type key handle can't be used with reserved handle 0x%x", entityValue)
+		}
+	default:
+		return fmt.Errorf("unsupported OSAP entity type 0x%x", entityType)
+	}
+	return nil
+}
+
+// An OSAPSession is an open OSAP session, for callers who build and send their
+// own authorized commands.
+type OSAPSession struct {
+	// Handle is the auth handle of the session.
+	Handle tpmutil.Handle
+
+	// NonceEven is the nonce to use in the auth of the next command sent in
+	// the session. Each response carries the nonce for the command after it;
+	// the methods of OSAPSession update NonceEven from every response they
+	// verify, and callers who send their own commands must do the same.
+	NonceEven Nonce
+
+	// SharedSecret is the HMAC key for commands in the session.
+	SharedSecret Digest
+
+	entity tpmutil.Handle
+	closed bool
+
+	// verified is set once a response in the session has been verified,
+	// which shows that the session is bound to the right entity.
+	verified bool
+
+	// tpmClosed is set if the TPM closed the session in a response, rather
+	// than the caller with Close.
+	tpmClosed bool
+}
+
+// OpenOSAPSession opens an OSAP session for the given entity, after checking
+// locally that entityType and entityValue go together: EntitySRK needs the SRK
+// handle, EntityOwner needs the owner handle and EntityKeyHandle needs the
+// handle of a loaded key or the SRK. entityAuth is the usage auth value of the
+// entity. The session must be closed with Close.
+func OpenOSAPSession(rw io.ReadWriter, entityType EntityType, entityValue tpmutil.Handle, entityAuth []byte) (*OSAPSession, error) {
+	sharedSecret, osapr, err := newOSAPSession(rw, uint16(entityType), entityValue, entityAuth)
+	if err != nil {
+		return nil, err
+	}
+	return &OSAPSession{
+		Handle:       osapr.AuthHandle,
+		NonceEven:    osapr.NonceEven,
+		SharedSecret: sharedSecret,
+		entity:       entityValue,
+	}, nil
+}
+
+// Close zeroes the shared secret of the session and flushes it from the TPM
+// if the TPM hasn't already closed it.
+func (s *OSAPSession) Close(rw io.ReadWriter) error {
+	zeroBytes(s.SharedSecret[:])
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return flushSpecific(rw, s.Handle, rtAuth)
+}
+
+// Seal seals data like Seal, but in the session, which must be for the SRK or
+// another loaded storage key, which the data is sealed under. It keeps the
+// session open so that it can be used for further commands.
+// The sealed data gets dataAuth as its auth value; pass the SRK auth value to
+// be able to unseal it with Unseal.
+func (s *OSAPSession) Seal(rw io.ReadWriter, loc Locality, pcrs []int, data []byte, dataAuth []byte) ([]byte, error) {
+	if err := checkSealSize(data); err != nil {
+		return nil, err
+	}
+	pcrInfo, err := newPCRInfoLong(rw, loc, pcrs)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(rw, pcrInfo, data, dataAuth, true)
+}
+
+// newCommandAuth computes the auth for the next command in the session, with
+// the session's current NonceEven and a fresh NonceOdd.
+func (s *OSAPSession) newCommandAuth(params []interface{}, cont bool) (*commandAuth, error) {
+	if s.closed {
+		return nil, sessionClosedError("OSAP", s.Handle, s.tpmClosed)
+	}
+	return newContinuedCommandAuth(s.Handle, s.NonceEven, nil, cont, s.SharedSecret[:], params)
+}
+
+// verify checks the response auth of a command sent with ca and rolls the
+// session over to the NonceEven in the response, which the next command must
+// use. It also records whether the TPM closed the session.
+func (s *OSAPSession) verify(ca *commandAuth, ra *responseAuth, params []interface{}) error {
+	if err := ra.verify(ca.NonceOdd, s.SharedSecret[:], params); err != nil {
+		return s.entityError(err)
+	}
+	s.verified = true
+	s.NonceEven = ra.NonceEven
+	if closedByTPM(s.Handle, ca, ra) {
+		s.closed, s.tpmClosed = true, true
+	}
+	return nil
+}
+
+// entityError wraps err, an auth failure of a command in the session, with
+// ErrOSAPEntity if it's the first command, whether the TPM rejected its auth or
+// its response auth didn't verify. The OSAP response has no auth of its own,
+// so that's the first point at which a session bound to the wrong entity
+// shows.
+func (s *OSAPSession) entityError(err error) error {
+	if s.verified {
+		return err
+	}
+	return fmt.Errorf("%w: the first command in the session failed authorization, so check the entity auth (%w)", ErrOSAPEntity, err)
+}
+
+// closedByTPM reports whether the TPM closed the session with the given handle
+// in the response auth ra to a command sent with ca. The TPM may close a
+// session even if the command asked to keep it open.
+func closedByTPM(h tpmutil.Handle, ca *commandAuth, ra *responseAuth) bool {
+	if ra.ContSession != 0 {
+		return false
+	}
+	if ca.ContSession != 0 {
+		Logger.Debug("tpm: the TPM closed a session that the command asked to keep open", "handle", h)
+	}
+	return true
+}
+
+// sessionClosedError returns the error for an attempt to use a closed session
+// of the given kind.
+func sessionClosedError(kind string, h tpmutil.Handle, tpmClosed bool) error {
+	if tpmClosed {
+		return fmt.Errorf("the TPM closed the %s session 0x%x in its last response, so it can't be reused; open a new one", kind, h)
+	}
+	return fmt.Errorf("the %s session is closed", kind)
+}
+
+// osapSessionExportVersion is the version written by OSAPSession.Export.
+const osapSessionExportVersion uint16 = 1
+
+// Export serializes the session so that another process can compute auths in
+// it: see ImportOSAPSession.
+//
+// WARNING: the serialization contains the shared secret of the session in the
+// clear. Anyone who reads it can authorize any command on the session's entity
+// for as long as the session stays open, exactly as if they knew the entity's
+// auth value. Only send it over a channel that is private to the two
+// processes, never write it to disk or logs, and zero it once it has been
+// sent. The caller should also zero the shared secret in s, which Close does,
+// and must not send any further commands in s: the two copies of the session
+// would disagree about NonceEven, and the TPM would reject the commands of
+// one of them.
+func (s *OSAPSession) Export() ([]byte, error) {
+	if s.closed {
+		return nil, sessionClosedError("OSAP", s.Handle, s.tpmClosed)
+	}
+	return tpmutil.Pack(osapSessionExportVersion, s.Handle, s.NonceEven, s.SharedSecret, s.entity)
+}
+
+// ImportOSAPSession reconstructs a session serialized with
+// OSAPSession.Export. The same warnings about the shared secret apply: b
+// should be zeroed as soon as ImportOSAPSession returns, and the returned
+// session closed with Close, which zeroes its copy.
+func ImportOSAPSession(b []byte) (*OSAPSession, error) {
+	var version uint16
+	n, err := tpmutil.Unpack(b, &version)
+	if err != nil {
+		return nil, err
+	}
+	if version != osapSessionExportVersion {
+		return nil, fmt.Errorf("unsupported OSAP session export version %d", version)
+	}
+
+	var s OSAPSession
+	m, err := tpmutil.Unpack(b[n:], &s.Handle, &s.NonceEven, &s.SharedSecret, &s.entity)
+	if err != nil {
+		return nil, err
+	}
+	if n+m != len(b) {
+		return nil, fmt.Errorf("got %d trailing bytes after the OSAP session", len(b)-n-m)
+	}
+	return &s, nil
+}
+
+// CommandAuth computes the auth for a command sent in the session by the
+// caller. params are the parameters that the auth covers: the ordinal of the
+// command followed by its input parameters, without the handles. If cont is
+// true, the command asks the TPM to keep the session open; the caller must then
+// set NonceEven to the nonce in the response before computing the next auth.
+// CommandAuth returns the NonceOdd to send with the command, which the caller
+// needs to check the response auth, and the auth itself.
+func (s *OSAPSession) CommandAuth(params []interface{}, cont bool) (Nonce, [20]byte, error) {
+	ca, err := s.newCommandAuth(params, cont)
+	if err != nil {
+		return Nonce{}, [20]byte{}, err
+	}
+	return ca.NonceOdd, ca.Auth, nil
+}
+
+// An OIAPSession is an open OIAP session. Unlike an OSAP session, it isn't
+// bound to an entity: the auth of each command is keyed with the usage auth of
+// whatever entity the command uses, so one session can authorize commands on
+// different entities, like the data auth of many sealed blobs.
+type OIAPSession struct {
+	// Handle is the auth handle of the session.
+	Handle tpmutil.Handle
+
+	// NonceEven is the nonce to use in the auth of the next command sent in
+	// the session. The methods that use an OIAPSession update it from every
+	// response they verify.
+	NonceEven Nonce
+
+	closed    bool
+	tpmClosed bool
+}
+
+// OpenOIAPSession opens an OIAP session. The session must be closed with
+// Close.
+func OpenOIAPSession(rw io.ReadWriter) (*OIAPSession, error) {
+	oiapr, err := oiap(rw)
+	if err != nil {
+		return nil, err
+	}
+	return &OIAPSession{Handle: oiapr.AuthHandle, NonceEven: oiapr.NonceEven}, nil
+}
+
+// Close flushes the session from the TPM if the TPM hasn't already closed it.
+func (s *OIAPSession) Close(rw io.ReadWriter) error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return flushSpecific(rw, s.Handle, rtAuth)
+}
+
+// newCommandAuth computes the auth for the next command in the session, keyed
+// with entityAuth, with the session's current NonceEven and a fresh NonceOdd.
+func (s *OIAPSession) newCommandAuth(entityAuth []byte, params []interface{}, cont bool) (*commandAuth, error) {
+	if s.closed {
+		return nil, sessionClosedError("OIAP", s.Handle, s.tpmClosed)
+	}
+	return newContinuedCommandAuth(s.Handle, s.NonceEven, nil, cont, entityAuth, params)
+}
+
+// verify checks the response auth of a command sent with ca and rolls the
+// session over to the NonceEven in the response, which the next command must
+// use. It also records whether the TPM closed the session.
+func (s *OIAPSession) verify(ca *commandAuth, ra *responseAuth, entityAuth []byte, params []interface{}) error {
+	if err := ra.verify(ca.NonceOdd, entityAuth, params); err != nil {
+		return err
+	}
+	s.NonceEven = ra.NonceEven
+	if closedByTPM(s.Handle, ca, ra) {
+		s.closed, s.tpmClosed = true, true
+	}
+	return nil
+}
+
 // newCommandAuth creates a new commandAuth structure over the given
 // parameters, using the given secret and the given odd nonce, if provided,
 // for the HMAC. If no odd nonce is provided, one is randomly generated.
 func newCommandAuth(authHandle tpmutil.Handle, nonceEven Nonce, nonceOdd *Nonce, key []byte, params []interface{}) (*commandAuth, error) {
+	return newContinuedCommandAuth(authHandle, nonceEven, nonceOdd, false, key, params)
+}
+
+// newContinuedCommandAuth is like newCommandAuth, but sets ContSession if cont
+// is true, asking the TPM to keep the session open after the command.
+func newContinuedCommandAuth(authHandle tpmutil.Handle, nonceEven Nonce, nonceOdd *Nonce, cont bool, key []byte, params []interface{}) (*commandAuth, error) {
 	// Auth = HMAC-SHA1(key, SHA1(params) || NonceEven || NonceOdd || ContSession)
 	digestBytes, err := tpmutil.Pack(params...)
 	if err != nil {
@@ -280,6 +816,9 @@ func newCommandAuth(authHandle tpmutil.Handle, nonceEven Nonce, nonceOdd *Nonce,
 		AuthHandle: authHandle,
 		NonceOdd:   odd,
 	}
+	if cont {
+		ca.ContSession = 1
+	}
 
 	authBytes, err := tpmutil.Pack(digest, nonceEven, ca.NonceOdd, ca.ContSession)
 	if err != nil {
@@ -320,6 +859,70 @@ func (ra *responseAuth) verify(nonceOdd Nonce, key []byte, params []interface{})
 	return nil
 }
 
+// An authPad holds the intermediate values of encrypting an auth value for an
+// OSAP session, so that they can be zeroed once the encAuth is computed.
+type authPad struct {
+	xorData []byte
+	pad     Digest
+}
+
+// encrypt computes auth XOR SHA1(sharedSecret || nonceEven), the encAuth that
+// carries a new auth value to the TPM, and zeroes the intermediate values.
+func (p *authPad) encrypt(sharedSecret Digest, nonceEven Nonce, auth []byte) (Digest, error) {
+	defer p.zero()
+	var encAuth Digest
+	if len(auth) != len(encAuth) {
+		return encAuth, fmt.Errorf("got a %d-byte auth value, want %d bytes", len(auth), len(encAuth))
+	}
+
+	var err error
+	if p.xorData, err = tpmutil.Pack(sharedSecret, nonceEven); err != nil {
+		return encAuth, err
+	}
+	p.pad = sha1.Sum(p.xorData)
+	for i := range encAuth {
+		encAuth[i] = auth[i] ^ p.pad[i]
+	}
+	return encAuth, nil
+}
+
+// zero zeroes the intermediate values of the pad.
+func (p *authPad) zero() {
+	zeroBytes(p.xorData)
+	zeroBytes(p.pad[:])
+}
+
+// encryptAuth computes the encAuth for a new auth value sent in an OSAP
+// session with the given shared secret and nonce, which is the session's
+// current NonceEven unless the command sends a second new auth value, as
+// encryptAuthPair does.
+func encryptAuth(sharedSecret Digest, nonceEven Nonce, auth []byte) (Digest, error) {
+	var p authPad
+	return p.encrypt(sharedSecret, nonceEven, auth)
+}
+
+// encryptAuthPair computes the encAuths for the two new auth values of a
+// command that sends them in an OSAP session, like the usage and migration
+// auths of CreateWrapKey. ADIP (Authorization Data Insertion Protocol) pads the
+// first with the session's NonceEven, and the second with the NonceOdd that the
+// command is sent with, so nonceOdd must be chosen before the command's auth is
+// computed. The two keystreams must be independent: otherwise, an eavesdropping
+// attacker could XOR the two encrypted values together to cancel out the pad
+// and learn first XOR second. And the TPM decrypts the second with the NonceOdd
+// pad, so a second encAuth padded with the NonceEven sets a different auth
+// value than the caller asked for.
+func encryptAuthPair(sharedSecret Digest, nonceEven, nonceOdd Nonce, first, second []byte) (Digest, Digest, error) {
+	encFirst, err := encryptAuth(sharedSecret, nonceEven, first)
+	if err != nil {
+		return Digest{}, Digest{}, err
+	}
+	encSecond, err := encryptAuth(sharedSecret, nonceOdd, second)
+	if err != nil {
+		return Digest{}, Digest{}, err
+	}
+	return encFirst, encSecond, nil
+}
+
 // zeroBytes zeroes a byte array.
 func zeroBytes(b []byte) {
 	for i := range b {
@@ -328,51 +931,79 @@ func zeroBytes(b []byte) {
 }
 
 func sealHelper(rw io.ReadWriter, pcrInfo *pcrInfoLong, data []byte, srkAuth []byte) ([]byte, error) {
-	// Run OSAP for the SRK, reading a random OddOSAP for our initial
-	// command and getting back a secret and a handle.
-	sharedSecret, osapr, err := newOSAPSession(rw, etSRK, khSRK, srkAuth)
+	// Run OSAP for the parent key, usually the SRK, reading a random OddOSAP
+	// for our initial command and getting back a secret and a handle.
+	et, parent := sealParent(rw)
+	s, err := OpenOSAPSession(rw, EntityType(et), parent, srkAuth)
 	if err != nil {
 		return nil, err
 	}
-	defer osapr.Close(rw)
-	defer zeroBytes(sharedSecret[:])
+	defer s.Close(rw)
+
+	return s.seal(rw, pcrInfo, data, srkAuth, false)
+}
+
+// MaxSealSize is the largest amount of data that Seal can seal under a 2048-bit
+// key such as the SRK. The TPM encrypts the data in a TPM_SEALED_DATA, which
+// adds 65 bytes to it, with RSAES-OAEP SHA-1, which can encrypt at most 214
+// bytes under a 2048-bit key. The seal functions refuse more than MaxSealSize
+// bytes whatever the parent key, so under a Device.DefaultParent of another
+// size the limit is the TPM's: a larger key could seal more, and a smaller
+// key makes the TPM reject some data that fits in MaxSealSize.
+const MaxSealSize = 149
+
+// checkSealSize checks that data isn't too large to seal. Each exported seal
+// function calls it once, before any command is sent, and the helpers under
+// them don't check again.
+func checkSealSize(data []byte) error {
+	if len(data) > MaxSealSize {
+		return fmt.Errorf("%w: got %d bytes, but at most %d can be sealed; use SealEnvelope for larger data", ErrSealTooLarge, len(data), MaxSealSize)
+	}
+	return nil
+}
+
+// seal runs a seal command in the session, which must be for the SRK or another
+// storage key, which the data is sealed under. The sealed data gets dataAuth as
+// its auth value. If cont is true, the session is kept open for further
+// commands.
+func (s *OSAPSession) seal(rw io.ReadWriter, pcrInfo *pcrInfoLong, data []byte, dataAuth []byte, cont bool) ([]byte, error) {
+	if s.entity == khOwner {
+		return nil, fmt.Errorf("can't seal with a session for handle 0x%x", s.entity)
+	}
 
 	// EncAuth for a seal command is computed as
 	//
-	// encAuth = XOR(srkAuth, SHA1(sharedSecret || <lastEvenNonce>))
+	// encAuth = XOR(dataAuth, SHA1(sharedSecret || <lastEvenNonce>))
 	//
-	// In this case, the last even nonce is NonceEven from OSAP.
-	xorData, err := tpmutil.Pack(sharedSecret, osapr.NonceEven)
+	// where the last even nonce is the session's current NonceEven.
+	encAuth, err := encryptAuth(s.SharedSecret, s.NonceEven, dataAuth)
 	if err != nil {
 		return nil, err
 	}
-	defer zeroBytes(xorData)
-
-	encAuthData := sha1.Sum(xorData)
-	sc := &sealCommand{KeyHandle: khSRK}
-	for i := range sc.EncAuth {
-		sc.EncAuth[i] = srkAuth[i] ^ encAuthData[i]
-	}
+	sc := &sealCommand{KeyHandle: s.entity, EncAuth: authValue(encAuth)}
 
 	// The digest input for seal authentication is
 	//
-	// digest = SHA1(ordSeal || encAuth || binary.Size(pcrInfo) || pcrInfo ||
+	// digest = SHA1(OrdSeal || encAuth || binary.Size(pcrInfo) || pcrInfo ||
 	//               len(data) || data)
 	//
-	authIn := []interface{}{ordSeal, sc.EncAuth, uint32(binary.Size(pcrInfo)), pcrInfo, tpmutil.U32Bytes(data)}
-	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
+	authIn := []interface{}{OrdSeal, sc.EncAuth, uint32(binary.Size(pcrInfo)), pcrInfo, tpmutil.U32Bytes(data)}
+	ca, err := s.newCommandAuth(authIn, cont)
 	if err != nil {
 		return nil, err
 	}
 
 	sealed, ra, ret, err := seal(rw, sc, pcrInfo, data, ca)
 	if err != nil {
+		if err == tpmError(errAuthFail) {
+			err = s.entityError(err)
+		}
 		return nil, err
 	}
 
 	// Check the response authentication.
-	raIn := []interface{}{ret, ordSeal, sealed}
-	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
+	raIn := []interface{}{ret, OrdSeal, sealed}
+	if err := s.verify(ca, ra, raIn); err != nil {
 		return nil, err
 	}
 
@@ -381,11 +1012,20 @@ func sealHelper(rw io.ReadWriter, pcrInfo *pcrInfoLong, data []byte, srkAuth []b
 		return nil, err
 	}
 
+	// An unsealable blob is found out when it's needed most, so make sure
+	// now that it's bound to what was asked for.
+	if err := checkSealedData(sealedBytes, pcrInfo); err != nil {
+		return nil, err
+	}
+
 	return sealedBytes, nil
 }
 
 // Seal encrypts data against a given locality and PCRs and returns the sealed data.
 func Seal(rw io.ReadWriter, loc Locality, pcrs []int, data []byte, srkAuth []byte) ([]byte, error) {
+	if err := checkSealSize(data); err != nil {
+		return nil, err
+	}
 	pcrInfo, err := newPCRInfoLong(rw, loc, pcrs)
 	if err != nil {
 		return nil, err
@@ -398,6 +1038,9 @@ func Seal(rw io.ReadWriter, loc Locality, pcrs []int, data []byte, srkAuth []byt
 // sealing to provide a way of updating software which is part of a measured
 // boot process.
 func Reseal(rw io.ReadWriter, loc Locality, pcrs map[int][]byte, data []byte, srkAuth []byte) ([]byte, error) {
+	if err := checkSealSize(data); err != nil {
+		return nil, err
+	}
 	pcrInfo, err := newPCRInfoLongWithHashes(loc, pcrs)
 	if err != nil {
 		return nil, err
@@ -405,23 +1048,74 @@ func Reseal(rw io.ReadWriter, loc Locality, pcrs map[int][]byte, data []byte, sr
 	return sealHelper(rw, pcrInfo, data, srkAuth)
 }
 
+// SealToFutureState seals data so that it can only be unsealed once each PCR
+// in releasePCRs holds the corresponding value in expectedValues, for example
+// the values that an upgraded boot chain is expected to measure. Unlike Seal,
+// it doesn't read the current PCR values, and the sealed data isn't bound to
+// any PCRs at creation.
+func SealToFutureState(rw io.ReadWriter, loc Locality, releasePCRs []int, expectedValues [][]byte, data []byte, srkAuth []byte) ([]byte, error) {
+	if err := checkSealSize(data); err != nil {
+		return nil, err
+	}
+	if len(releasePCRs) != len(expectedValues) {
+		return nil, fmt.Errorf("got %d expected PCR values for %d PCRs", len(expectedValues), len(releasePCRs))
+	}
+	pcrs := make(map[int][]byte, len(releasePCRs))
+	for i, pcr := range releasePCRs {
+		if len(expectedValues[i]) != PCRSize {
+			return nil, fmt.Errorf("the expected value of PCR %d is %d bytes long, want %d", pcr, len(expectedValues[i]), PCRSize)
+		}
+		if _, ok := pcrs[pcr]; ok {
+			return nil, fmt.Errorf("PCR %d is given more than once", pcr)
+		}
+		pcrs[pcr] = expectedValues[i]
+	}
+	pcrInfo, err := newPCRInfoLongWithHashes(loc, pcrs)
+	if err != nil {
+		return nil, err
+	}
+	// The TPM fills in the digest at creation from the PCRs selected for
+	// creation, so selecting none leaves the creation state unbound.
+	pcrInfo.PCRsAtCreation = pcrSelection{Size: 3}
+	pcrInfo.DigestAtCreation = Digest{}
+	return sealHelper(rw, pcrInfo, data, srkAuth)
+}
+
 // Unseal decrypts data encrypted by the TPM.
 func Unseal(rw io.ReadWriter, sealed []byte, srkAuth []byte) ([]byte, error) {
-	// Run OSAP for the SRK, reading a random OddOSAP for our initial
-	// command and getting back a secret and a handle.
-	sharedSecret, osapr, err := newOSAPSession(rw, etSRK, khSRK, srkAuth)
+	// The unseal command needs an OIAP session in addition to the OSAP session.
+	s, err := OpenOIAPSession(rw)
 	if err != nil {
 		return nil, err
 	}
-	defer osapr.Close(rw)
-	defer zeroBytes(sharedSecret[:])
+	defer s.Close(rw)
 
-	// The unseal command needs an OIAP session in addition to the OSAP session.
-	oiapr, err := oiap(rw)
+	return unsealHelper(rw, sealed, srkAuth, s, false)
+}
+
+// UnsealWith decrypts data encrypted by the TPM like Unseal, but authorizes the
+// sealed data in the given OIAP session and keeps the session open, so that a
+// batch of blobs can be unsealed with one OIAP session instead of one per
+// blob. The data auth of the blobs must be srkAuth, as it is for blobs sealed
+// with Seal. If UnsealWith fails, the TPM may have closed the session; the
+// caller should close it and open a new one.
+func UnsealWith(rw io.ReadWriter, s *OIAPSession, sealed []byte, srkAuth []byte) ([]byte, error) {
+	return unsealHelper(rw, sealed, srkAuth, s, true)
+}
+
+// unsealHelper runs the unseal command in a new OSAP session for the parent key,
+// usually the SRK, and in the OIAP session s. If cont is true, s is kept open
+// for further commands.
+func unsealHelper(rw io.ReadWriter, sealed []byte, srkAuth []byte, s *OIAPSession, cont bool) ([]byte, error) {
+	// Run OSAP for the parent key, reading a random OddOSAP for our initial
+	// command and getting back a secret and a handle.
+	et, parent := sealParent(rw)
+	sharedSecret, osapr, err := newOSAPSession(rw, et, parent, srkAuth)
 	if err != nil {
 		return nil, err
 	}
-	defer oiapr.Close(rw)
+	defer osapr.Close(rw)
+	defer zeroBytes(sharedSecret[:])
 
 	// Convert the sealed value into a tpmStoredData.
 	var tsd tpmStoredData
@@ -430,8 +1124,8 @@ func Unseal(rw io.ReadWriter, sealed []byte, srkAuth []byte) ([]byte, error) {
 	}
 
 	// The digest for auth1 and auth2 for the unseal command is computed as
-	// digest = SHA1(ordUnseal || tsd)
-	authIn := []interface{}{ordUnseal, tsd}
+	// digest = SHA1(OrdUnseal || tsd)
+	authIn := []interface{}{OrdUnseal, tsd}
 
 	// The first commandAuth uses the shared secret as an HMAC key.
 	ca1, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
@@ -441,32 +1135,98 @@ func Unseal(rw io.ReadWriter, sealed []byte, srkAuth []byte) ([]byte, error) {
 
 	// The second commandAuth is based on OIAP instead of OSAP and uses the
 	// SRK auth value as an HMAC key instead of the shared secret.
-	ca2, err := newCommandAuth(oiapr.AuthHandle, oiapr.NonceEven, nil, srkAuth, authIn)
+	ca2, err := s.newCommandAuth(srkAuth, authIn, cont)
 	if err != nil {
 		return nil, err
 	}
 
-	unsealed, ra1, ra2, ret, err := unseal(rw, khSRK, &tsd, ca1, ca2)
+	unsealed, ra1, ra2, ret, err := unseal(rw, parent, &tsd, ca1, ca2)
 	if err != nil {
 		return nil, err
 	}
 
 	// Check the response authentication.
-	raIn := []interface{}{ret, ordUnseal, tpmutil.U32Bytes(unsealed)}
+	raIn := []interface{}{ret, OrdUnseal, tpmutil.U32Bytes(unsealed)}
 	if err := ra1.verify(ca1.NonceOdd, sharedSecret[:], raIn); err != nil {
 		return nil, err
 	}
 
-	if err := ra2.verify(ca2.NonceOdd, srkAuth, raIn); err != nil {
+	if err := s.verify(ca2, ra2, srkAuth, raIn); err != nil {
 		return nil, err
 	}
 
 	return unsealed, nil
 }
 
+// CanUnseal reports whether the PCRs that sealed data is bound to currently
+// hold the values it requires, so that Unseal would pass the PCR check. It
+// only reads PCRs and never sends TPM_Unseal, so it needs no auth and a
+// mismatch doesn't count against the TPM's dictionary-attack protection. The
+// locality at release isn't checked, since the TPM doesn't report the locality
+// of the caller. Sealed data that isn't bound to any PCRs can always be
+// unsealed.
+func CanUnseal(rw io.ReadWriter, sealed []byte) (bool, error) {
+	sd, err := ParseSealedData(sealed)
+	if err != nil {
+		return false, err
+	}
+	if len(sd.PCRsAtRelease) == 0 {
+		return true, nil
+	}
+
+	vals, err := FetchPCRValues(rw, sd.PCRsAtRelease)
+	if err != nil {
+		return false, err
+	}
+	// The composite starts with the selection from the blob, since TPM 1.1
+	// selections may be shorter than the ones this package makes.
+	composite, err := tpmutil.Pack(tpmutil.RawBytes(sd.releaseSelection), tpmutil.U32Bytes(vals))
+	if err != nil {
+		return false, err
+	}
+	return Digest(sha1.Sum(composite)) == sd.DigestAtRelease, nil
+}
+
 // Quote produces a TPM quote for the given data under the given PCRs. It uses
-// AIK auth and a given AIK handle.
+// AIK auth and a given AIK handle. The data is hashed with SHA-1 and the digest
+// is used as the externalData of the quote, so the result must be checked with
+// VerifyQuote. Use QuoteExternalData to supply the externalData directly.
+// aikAuth is the usage auth of the key at handle, not the SRK auth: the quote
+// runs in an OSAP session for the key itself.
 func Quote(rw io.ReadWriter, handle tpmutil.Handle, data []byte, pcrNums []int, aikAuth []byte) ([]byte, []byte, error) {
+	return QuoteExternalData(rw, handle, sha1.Sum(data), pcrNums, aikAuth)
+}
+
+// QuoteExternalData produces a TPM quote like Quote, but passes externalData
+// to the TPM as-is instead of hashing caller data first. The result must be
+// checked with VerifyQuoteExternalData.
+func QuoteExternalData(rw io.ReadWriter, handle tpmutil.Handle, externalData Nonce, pcrNums []int, aikAuth []byte) ([]byte, []byte, error) {
+	sig, pcrc, err := quoteHelper(rw, handle, externalData, pcrNums, aikAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, pcrc.Values, nil
+}
+
+// QuoteComposite performs a quote like QuoteExternalData, but returns the
+// serialized TPM_PCR_COMPOSITE that the TPM signed, including the PCR selection
+// it actually used, instead of just the PCR values. Pass it to
+// VerifyQuoteComposite to check the selection as well as the signature.
+func QuoteComposite(rw io.ReadWriter, handle tpmutil.Handle, externalData Nonce, pcrNums []int, aikAuth []byte) ([]byte, []byte, error) {
+	sig, pcrc, err := quoteHelper(rw, handle, externalData, pcrNums, aikAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	composite, err := tpmutil.Pack(pcrc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, composite, nil
+}
+
+// quoteHelper runs the quote command and returns the signature along with the
+// PCR composite that the TPM signed.
+func quoteHelper(rw io.ReadWriter, handle tpmutil.Handle, externalData Nonce, pcrNums []int, aikAuth []byte) ([]byte, *pcrComposite, error) {
 	// Run OSAP for the handle, reading a random OddOSAP for our initial
 	// command and getting back a secret and a response.
 	sharedSecret, osapr, err := newOSAPSession(rw, etKeyHandle, handle, aikAuth)
@@ -476,30 +1236,28 @@ func Quote(rw io.ReadWriter, handle tpmutil.Handle, data []byte, pcrNums []int,
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
 
-	// Hash the data to get the value to pass to quote2.
-	hash := sha1.Sum(data)
 	pcrSel, err := newPCRSelection(pcrNums)
 	if err != nil {
 		return nil, nil, err
 	}
-	authIn := []interface{}{ordQuote, hash, pcrSel}
+	authIn := []interface{}{OrdQuote, externalData, pcrSel}
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	pcrc, sig, ra, ret, err := quote(rw, handle, hash, pcrSel, ca)
+	pcrc, sig, ra, ret, err := quote(rw, handle, externalData, pcrSel, ca)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, keyHandleError(handle, err)
 	}
 
 	// Check response authentication.
-	raIn := []interface{}{ret, ordQuote, pcrc, tpmutil.U32Bytes(sig)}
+	raIn := []interface{}{ret, OrdQuote, pcrc, tpmutil.U32Bytes(sig)}
 	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
 		return nil, nil, err
 	}
 
-	return sig, pcrc.Values, nil
+	return sig, pcrc, nil
 }
 
 // MakeIdentity creates a new AIK with the given new auth value, and the given
@@ -510,11 +1268,38 @@ func Quote(rw io.ReadWriter, handle tpmutil.Handle, data []byte, pcrNums []int,
 // AIK is sealed against the SRK.
 // TODO(tmroeder): currently, this code can only create 2048-bit RSA keys.
 func MakeIdentity(rw io.ReadWriter, srkAuth []byte, ownerAuth []byte, aikAuth []byte, pk crypto.PublicKey, label []byte) ([]byte, error) {
+	blob, _, err := MakeIdentityWithBinding(rw, srkAuth, ownerAuth, aikAuth, pk, label)
+	return blob, err
+}
+
+// MakeIdentityWithBinding creates an AIK like MakeIdentity, and also returns
+// the identity binding: the AIK's signature over the TPM_IDENTITY_CONTENTS,
+// which a privacy CA checks with VerifyIdentityBinding.
+func MakeIdentityWithBinding(rw io.ReadWriter, srkAuth []byte, ownerAuth []byte, aikAuth []byte, pk crypto.PublicKey, label []byte) ([]byte, []byte, error) {
+	caDigest, err := verify.IdentityCADigest(pk, label)
+	if err != nil {
+		return nil, nil, err
+	}
+	return makeIdentityHelper(rw, srkAuth, ownerAuth, aikAuth, caDigest)
+}
+
+// MakeIdentityWithChosenID creates an AIK like MakeIdentityWithBinding, but
+// takes the labelPrivCADigest (the TPM_CHOSENID_HASH) directly, for privacy
+// CAs that compute it themselves rather than from a label and their public
+// key. chosenID is passed to the TPM as-is. The identity binding can be checked
+// with VerifyIdentityBindingChosenID.
+func MakeIdentityWithChosenID(rw io.ReadWriter, srkAuth []byte, ownerAuth []byte, aikAuth []byte, chosenID Digest) ([]byte, []byte, error) {
+	return makeIdentityHelper(rw, srkAuth, ownerAuth, aikAuth, chosenID)
+}
+
+// makeIdentityHelper runs the MakeIdentity command with the given
+// labelPrivCADigest and returns the AIK blob and the identity binding.
+func makeIdentityHelper(rw io.ReadWriter, srkAuth []byte, ownerAuth []byte, aikAuth []byte, caDigest Digest) ([]byte, []byte, error) {
 	// Run OSAP for the SRK, reading a random OddOSAP for our initial command
 	// and getting back a secret and a handle.
 	sharedSecretSRK, osaprSRK, err := newOSAPSession(rw, etSRK, khSRK, srkAuth)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer osaprSRK.Close(rw)
 	defer zeroBytes(sharedSecretSRK[:])
@@ -523,7 +1308,7 @@ func MakeIdentity(rw io.ReadWriter, srkAuth []byte, ownerAuth []byte, aikAuth []
 	// and getting back a secret and a handle.
 	sharedSecretOwn, osaprOwn, err := newOSAPSession(rw, etOwner, khOwner, ownerAuth)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer osaprOwn.Close(rw)
 	defer zeroBytes(sharedSecretOwn[:])
@@ -533,38 +1318,9 @@ func MakeIdentity(rw io.ReadWriter, srkAuth []byte, ownerAuth []byte, aikAuth []
 	// encAuth = XOR(aikAuth, SHA1(sharedSecretOwn || <lastEvenNonce>))
 	//
 	// In this case, the last even nonce is NonceEven from OSAP for the Owner.
-	xorData, err := tpmutil.Pack(sharedSecretOwn, osaprOwn.NonceEven)
+	encAuth, err := encryptAuth(sharedSecretOwn, osaprOwn.NonceEven, aikAuth)
 	if err != nil {
-		return nil, err
-	}
-	defer zeroBytes(xorData)
-
-	encAuthData := sha1.Sum(xorData)
-	var encAuth Digest
-	for i := range encAuth {
-		encAuth[i] = aikAuth[i] ^ encAuthData[i]
-	}
-
-	var caDigest Digest
-	if (pk != nil) != (label != nil) {
-		return nil, errors.New("inconsistent null values between the pk and the label")
-	}
-
-	if pk != nil {
-		pubKey, err := convertPubKey(pk)
-		if err != nil {
-			return nil, err
-		}
-
-		// We can't pack the pair of values directly, since the label is
-		// included directly as bytes, without any length.
-		fullpkb, err := tpmutil.Pack(pubKey)
-		if err != nil {
-			return nil, err
-		}
-
-		caDigestBytes := append(label, fullpkb...)
-		caDigest = sha1.Sum(caDigestBytes)
+		return nil, nil, err
 	}
 
 	rsaAIKParams := rsaKeyParams{
@@ -574,11 +1330,11 @@ func MakeIdentity(rw io.ReadWriter, srkAuth []byte, ownerAuth []byte, aikAuth []
 	}
 	packedParams, err := tpmutil.Pack(rsaAIKParams)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	aikParams := keyParams{
-		AlgID:     AlgRSA,
+		AlgID:     uint32(AlgRSA),
 		EncScheme: esNone,
 		SigScheme: ssRSASaPKCS1v15SHA1,
 		Params:    packedParams,
@@ -594,41 +1350,40 @@ func MakeIdentity(rw io.ReadWriter, srkAuth []byte, ownerAuth []byte, aikAuth []
 
 	// The digest input for MakeIdentity authentication is
 	//
-	// digest = SHA1(ordMakeIdentity || encAuth || caDigest || aik)
+	// digest = SHA1(OrdMakeIdentity || encAuth || caDigest || aik)
 	//
-	authIn := []interface{}{ordMakeIdentity, encAuth, caDigest, aik}
+	authIn := []interface{}{OrdMakeIdentity, encAuth, caDigest, aik}
 	ca1, err := newCommandAuth(osaprSRK.AuthHandle, osaprSRK.NonceEven, nil, sharedSecretSRK[:], authIn)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	ca2, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	k, sig, ra1, ra2, ret, err := makeIdentity(rw, encAuth, caDigest, aik, ca1, ca2)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Check response authentication.
-	raIn := []interface{}{ret, ordMakeIdentity, k, tpmutil.U32Bytes(sig)}
+	raIn := []interface{}{ret, OrdMakeIdentity, k, tpmutil.U32Bytes(sig)}
 	if err := ra1.verify(ca1.NonceOdd, sharedSecretSRK[:], raIn); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if err := ra2.verify(ca2.NonceOdd, sharedSecretOwn[:], raIn); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// TODO(tmroeder): check the signature against the pubEK.
 	blob, err := tpmutil.Pack(k)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return blob, nil
+	return blob, sig, nil
 }
 
 func unloadTrspiCred(blob []byte) ([]byte, error) {
@@ -685,7 +1440,7 @@ func ActivateIdentity(rw io.ReadWriter, aikAuth []byte, ownerAuth []byte, aik tp
 	defer osaprOwn.Close(rw)
 	defer zeroBytes(sharedSecretOwn[:])
 
-	authIn := []interface{}{ordActivateIdentity, tpmutil.U32Bytes(asym)}
+	authIn := []interface{}{OrdActivateIdentity, tpmutil.U32Bytes(asym)}
 	ca1, err := newCommandAuth(oiaprAIK.AuthHandle, oiaprAIK.NonceEven, nil, aikAuth, authIn)
 	if err != nil {
 		return nil, fmt.Errorf("newCommandAuth failed: %v", err)
@@ -701,7 +1456,7 @@ func ActivateIdentity(rw io.ReadWriter, aikAuth []byte, ownerAuth []byte, aik tp
 	}
 
 	// Check response authentication.
-	raIn := []interface{}{ret, ordActivateIdentity, symkey}
+	raIn := []interface{}{ret, OrdActivateIdentity, symkey}
 	if err := ra1.verify(ca1.NonceOdd, aikAuth, raIn); err != nil {
 		return nil, fmt.Errorf("aik resAuth failed to verify: %v", err)
 	}
@@ -756,7 +1511,26 @@ func ActivateIdentity(rw io.ReadWriter, aikAuth []byte, ownerAuth []byte, aik tp
 // TPM to start working again after authentication errors without waiting for
 // the dictionary-attack defenses to time out. This requires owner
 // authentication.
+//
+// On some TPMs, a ResetLockValue with a bad owner auth while the TPM is in
+// lockout counts as another failure and makes the lockout longer, so calling
+// it in a loop until it succeeds can lock the TPM out for good. To guard
+// against that, once an attempt fails with an authorization failure or with
+// the TPM in lockout, ResetLockValue returns ErrResetLockBackoff, which matches
+// ErrLockedOut, for the same rw without sending anything until ResetLockBackoff
+// has passed.
+// The backoff doubles with each consecutive failure, and a success clears it.
 func ResetLockValue(rw io.ReadWriter, ownerAuth Digest) error {
+	if err := resetLockTracker.check(rw); err != nil {
+		return err
+	}
+	err := resetLockValueOwner(rw, ownerAuth)
+	resetLockTracker.record(rw, err)
+	return err
+}
+
+// resetLockValueOwner sends TPM_ResetLockValue with owner auth.
+func resetLockValueOwner(rw io.ReadWriter, ownerAuth Digest) error {
 	// Run OSAP for the Owner, reading a random OddOSAP for our initial command
 	// and getting back a secret and a handle.
 	sharedSecretOwn, osaprOwn, err := newOSAPSession(rw, etOwner, khOwner, ownerAuth[:])
@@ -768,9 +1542,9 @@ func ResetLockValue(rw io.ReadWriter, ownerAuth Digest) error {
 
 	// The digest input for ResetLockValue auth is
 	//
-	// digest = SHA1(ordResetLockValue)
+	// digest = SHA1(OrdResetLockValue)
 	//
-	authIn := []interface{}{ordResetLockValue}
+	authIn := []interface{}{OrdResetLockValue}
 	ca, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
 	if err != nil {
 		return err
@@ -782,7 +1556,7 @@ func ResetLockValue(rw io.ReadWriter, ownerAuth Digest) error {
 	}
 
 	// Check response authentication.
-	raIn := []interface{}{ret, ordResetLockValue}
+	raIn := []interface{}{ret, OrdResetLockValue}
 	if err := ra.verify(ca.NonceOdd, sharedSecretOwn[:], raIn); err != nil {
 		return err
 	}
@@ -790,6 +1564,49 @@ func ResetLockValue(rw io.ReadWriter, ownerAuth Digest) error {
 	return nil
 }
 
+// DirRead reads the Data Integrity Register (DIR) at dirIndex. TPM 1.2 chips
+// only need to have DIR 0, and some have none at all; reading a DIR that
+// doesn't exist fails with the TPM_BADINDEX error.
+func DirRead(rw io.ReadWriter, dirIndex uint32) ([]byte, error) {
+	contents, err := dirRead(rw, dirIndex)
+	if err != nil {
+		return nil, err
+	}
+	return contents[:], nil
+}
+
+// DirWriteAuth writes data to the Data Integrity Register (DIR) at dirIndex.
+// This requires owner authentication.
+func DirWriteAuth(rw io.ReadWriter, dirIndex uint32, data Digest, ownerAuth Digest) error {
+	// Run OSAP for the Owner, reading a random OddOSAP for our initial command
+	// and getting back a secret and a handle.
+	sharedSecretOwn, osaprOwn, err := newOSAPSession(rw, etOwner, khOwner, ownerAuth[:])
+	if err != nil {
+		return err
+	}
+	defer osaprOwn.Close(rw)
+	defer zeroBytes(sharedSecretOwn[:])
+
+	// The digest input for DirWriteAuth auth is
+	//
+	// digest = SHA1(OrdDirWriteAuth || dirIndex || newContents)
+	//
+	authIn := []interface{}{OrdDirWriteAuth, dirIndex, data}
+	ca, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
+	if err != nil {
+		return err
+	}
+
+	ra, ret, err := dirWriteAuth(rw, dirIndex, data, ca)
+	if err != nil {
+		return err
+	}
+
+	// Check response authentication.
+	raIn := []interface{}{ret, OrdDirWriteAuth}
+	return ra.verify(ca.NonceOdd, sharedSecretOwn[:], raIn)
+}
+
 // ownerReadInternalHelper sets up command auth and checks response auth for
 // OwnerReadInternalPub. It's not exported because OwnerReadInternalPub only
 // supports two fixed key handles: khEK and khSRK.
@@ -805,9 +1622,9 @@ func ownerReadInternalHelper(rw io.ReadWriter, kh tpmutil.Handle, ownerAuth Dige
 
 	// The digest input for OwnerReadInternalPub is
 	//
-	// digest = SHA1(ordOwnerReadInternalPub || kh)
+	// digest = SHA1(OrdOwnerReadInternalPub || kh)
 	//
-	authIn := []interface{}{ordOwnerReadInternalPub, kh}
+	authIn := []interface{}{OrdOwnerReadInternalPub, kh}
 	ca, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
 	if err != nil {
 		return nil, err
@@ -819,7 +1636,7 @@ func ownerReadInternalHelper(rw io.ReadWriter, kh tpmutil.Handle, ownerAuth Dige
 	}
 
 	// Check response authentication.
-	raIn := []interface{}{ret, ordOwnerReadInternalPub, pk}
+	raIn := []interface{}{ret, OrdOwnerReadInternalPub, pk}
 	if err := ra.verify(ca.NonceOdd, sharedSecretOwn[:], raIn); err != nil {
 		return nil, err
 	}
@@ -869,6 +1686,11 @@ func ReadEKCert(rw io.ReadWriter, ownAuth Digest) ([]byte, error) {
 	}
 
 	if header.Tag != certTagPCClientStoredCert {
+		// Some TPMs store the bare DER certificate, without the PC Client
+		// header. Its SEQUENCE header gives its length.
+		if n, ok := derLength(data); ok {
+			return nvReadChunks(rw, certIndex, 0, n, ownAuth)
+		}
 		return nil, fmt.Errorf("invalid certificate")
 	}
 
@@ -897,25 +1719,60 @@ func ReadEKCert(rw io.ReadWriter, ownAuth Digest) ([]byte, error) {
 		return nil, fmt.Errorf("invalid certType: 0x%x", header.CertType)
 	}
 
-	var ekbuf []byte
-	for offset < bufSize {
-		length := bufSize - offset
+	return nvReadChunks(rw, certIndex, offset, bufSize, ownAuth)
+}
+
+// nvReadChunks reads the NV index from offset up to end.
+func nvReadChunks(rw io.ReadWriter, index, offset, end uint32, ownAuth Digest) ([]byte, error) {
+	var buf []byte
+	for offset < end {
+		length := end - offset
 		// TPMs can only read so much memory per command so we read in 128byte chunks.
 		// 128 was taken from go-tspi. The actual max read seems to be platform dependent
 		// but cannot be queried on TPM1.2 (and does not seem to appear in any documentation).
 		if length > 128 {
 			length = 128
 		}
-		data, err = NVReadValue(rw, certIndex, offset, length, []byte(ownAuth[:]))
+		data, err := NVReadValue(rw, index, offset, length, []byte(ownAuth[:]))
 		if err != nil {
 			return nil, err
 		}
 
-		ekbuf = append(ekbuf, data...)
+		buf = append(buf, data...)
 		offset += length
 	}
 
-	return ekbuf, nil
+	return buf, nil
+}
+
+// derLength returns the full length of the DER SEQUENCE that b starts with,
+// if b starts with the header of one that is long enough to be a certificate.
+func derLength(b []byte) (uint32, bool) {
+	if len(b) < 4 || b[0] != 0x30 {
+		return 0, false
+	}
+	switch b[1] {
+	case 0x81:
+		return 3 + uint32(b[2]), true
+	case 0x82:
+		return 4 + uint32(binary.BigEndian.Uint16(b[2:4])), true
+	}
+	return 0, false
+}
+
+// ReadEKCertificate reads the EK certificate from the NVRAM like ReadEKCert
+// and parses it. It also reads certificates that are stored as bare DER,
+// without the TCG PC Client header.
+func ReadEKCertificate(rw io.ReadWriter, ownAuth Digest) (*x509.Certificate, error) {
+	der, err := ReadEKCert(rw, ownAuth)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the EK certificate: %w", err)
+	}
+	return cert, nil
 }
 
 // NVDefineSpace implements the reservation of NVRAM as specified in:
@@ -934,15 +1791,15 @@ func NVDefineSpace(rw io.ReadWriter, nvData NVDataPublic, ownAuth []byte) error
 
 		// encAuth: NV_Define_Space is a special case where no encryption is used.
 		// See spec: TPM-Main-Part-1-Design-Principles_v1.2_rev116_01032011, P. 81
-		xorData, err := tpmutil.Pack(sharedSecretOwn, osaprOwn.NonceEven)
+		// The index gets the well-known auth value of all zeros, so the
+		// encAuth is just the pad.
+		indexAuth := WellKnownAuth()
+		encAuthData, err := encryptAuth(sharedSecretOwn, osaprOwn.NonceEven, indexAuth[:])
 		if err != nil {
 			return err
 		}
-		defer zeroBytes(xorData)
-
-		encAuthData := sha1.Sum(xorData)
 
-		authIn := []interface{}{ordNVDefineSpace, nvData, encAuthData}
+		authIn := []interface{}{OrdNVDefineSpace, nvData, encAuthData}
 		ca, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
 		if err != nil {
 			return err
@@ -951,7 +1808,7 @@ func NVDefineSpace(rw io.ReadWriter, nvData NVDataPublic, ownAuth []byte) error
 		if err != nil {
 			return fmt.Errorf("failed to define space in NVRAM: %v", err)
 		}
-		raIn := []interface{}{ret, ordNVDefineSpace}
+		raIn := []interface{}{ret, OrdNVDefineSpace}
 		if err := ra.verify(ca.NonceOdd, sharedSecretOwn[:], raIn); err != nil {
 			return fmt.Errorf("failed to verify authenticity of response: %v", err)
 		}
@@ -978,7 +1835,7 @@ func NVReadValue(rw io.ReadWriter, index, offset, len uint32, ownAuth []byte) ([
 	}
 	defer osaprOwn.Close(rw)
 	defer zeroBytes(sharedSecretOwn[:])
-	authIn := []interface{}{ordNVReadValue, index, offset, len}
+	authIn := []interface{}{OrdNVReadValue, index, offset, len}
 	ca, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct owner auth fields: %v", err)
@@ -987,7 +1844,7 @@ func NVReadValue(rw io.ReadWriter, index, offset, len uint32, ownAuth []byte) ([
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from NVRAM: %v", err)
 	}
-	raIn := []interface{}{ret, ordNVReadValue, tpmutil.U32Bytes(data)}
+	raIn := []interface{}{ret, OrdNVReadValue, tpmutil.U32Bytes(data)}
 	if err := ra.verify(ca.NonceOdd, sharedSecretOwn[:], raIn); err != nil {
 		return nil, fmt.Errorf("failed to verify authenticity of response: %v", err)
 	}
@@ -1009,7 +1866,7 @@ func NVReadValueAuth(rw io.ReadWriter, index, offset, len uint32, auth []byte) (
 	}
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
-	authIn := []interface{}{ordNVReadValueAuth, index, offset, len}
+	authIn := []interface{}{OrdNVReadValueAuth, index, offset, len}
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct auth fields: %v", err)
@@ -1018,7 +1875,7 @@ func NVReadValueAuth(rw io.ReadWriter, index, offset, len uint32, auth []byte) (
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from NVRAM: %v", err)
 	}
-	raIn := []interface{}{ret, ordNVReadValueAuth, tpmutil.U32Bytes(data)}
+	raIn := []interface{}{ret, OrdNVReadValueAuth, tpmutil.U32Bytes(data)}
 	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
 		return nil, fmt.Errorf("failed to verify authenticity of response: %v", err)
 	}
@@ -1030,7 +1887,7 @@ func NVReadValueAuth(rw io.ReadWriter, index, offset, len uint32, auth []byte) (
 // See TPM-Main-Part-3-Commands_v1.2_rev116_01032011, P216
 func NVWriteValue(rw io.ReadWriter, index, offset uint32, data []byte, ownAuth []byte) error {
 	if ownAuth == nil {
-		if _, _, _, err := nvWriteValue(rw, index, offset, uint32(len(data)), data, nil); err != nil {
+		if _, _, err := nvWriteValue(rw, index, offset, uint32(len(data)), data, nil); err != nil {
 			return fmt.Errorf("failed to write to NVRAM: %v", err)
 		}
 		return nil
@@ -1041,16 +1898,16 @@ func NVWriteValue(rw io.ReadWriter, index, offset uint32, data []byte, ownAuth [
 	}
 	defer osaprOwn.Close(rw)
 	defer zeroBytes(sharedSecretOwn[:])
-	authIn := []interface{}{ordNVWriteValue, index, offset, len(data), data}
+	authIn := []interface{}{OrdNVWriteValue, index, offset, uint32(len(data)), data}
 	ca, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
 	if err != nil {
 		return fmt.Errorf("failed to construct owner auth fields: %v", err)
 	}
-	data, ra, ret, err := nvWriteValue(rw, index, offset, uint32(len(data)), data, ca)
+	ra, ret, err := nvWriteValue(rw, index, offset, uint32(len(data)), data, ca)
 	if err != nil {
 		return fmt.Errorf("failed to write to NVRAM: %v", err)
 	}
-	raIn := []interface{}{ret, ordNVWriteValue, tpmutil.U32Bytes(data)}
+	raIn := []interface{}{ret, OrdNVWriteValue}
 	if err := ra.verify(ca.NonceOdd, sharedSecretOwn[:], raIn); err != nil {
 		return fmt.Errorf("failed to verify authenticity of response: %v", err)
 	}
@@ -1072,79 +1929,387 @@ func NVWriteValueAuth(rw io.ReadWriter, index, offset uint32, data []byte, auth
 	}
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
-	authIn := []interface{}{ordNVWriteValueAuth, index, offset, len(data), data}
+	authIn := []interface{}{OrdNVWriteValueAuth, index, offset, uint32(len(data)), data}
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
 		return fmt.Errorf("failed to construct auth fields: %v", err)
 	}
-	data, ra, ret, err := nvWriteValue(rw, index, offset, uint32(len(data)), data, ca)
+	ra, ret, err := nvWriteValue(rw, index, offset, uint32(len(data)), data, ca)
+	if err != nil {
+		return fmt.Errorf("failed to write to NVRAM: %v", err)
+	}
+	raIn := []interface{}{ret, OrdNVWriteValueAuth}
+	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
+		return fmt.Errorf("failed to verify authenticity of response: %v", err)
+	}
+	return nil
+}
+
+// OwnerReadPubEK uses owner auth to get a blob representing the public part of the
+// endorsement key.
+func OwnerReadPubEK(rw io.ReadWriter, ownerAuth Digest) ([]byte, error) {
+	pk, err := ownerReadInternalHelper(rw, khEK, ownerAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	return tpmutil.Pack(pk)
+}
+
+// ReadPubEK reads the public part of the endorsement key when no owner is
+// established.
+func ReadPubEK(rw io.ReadWriter) ([]byte, error) {
+	var n Nonce
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+
+	pk, d, _, err := readPubEK(rw, n)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recompute the hash of the pk and the nonce to defend against replay
+	// attacks.
+	b, err := tpmutil.Pack(pk, n)
+	if err != nil {
+		return nil, err
+	}
+
+	s := sha1.Sum(b)
+	// There's no need for constant-time comparison of these hash values,
+	// since no secret is involved.
+	if !bytes.Equal(s[:], d[:]) {
+		return nil, errors.New("the ReadPubEK operation failed the replay check")
+	}
+
+	return tpmutil.Pack(pk)
+}
+
+// GetManufacturer returns the manufacturer ID
+func GetManufacturer(rw io.ReadWriter) ([]byte, error) {
+	return getCapability(rw, CapProperty, SubCapPropManufacturer)
+}
+
+// DetectVersion returns the version of the TPM and the revision of its
+// firmware. It reads them from TPM_CAP_VERSION_VAL, and if the TPM doesn't
+// support that, as a TPM 1.1b doesn't, from TPM_CAP_VERSION.
+func DetectVersion(rw io.ReadWriter) (major, minor, revMajor, revMinor int, err error) {
+	info, err := readVersionInfo(rw)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	v := info.Version
+	return int(v.Major), int(v.Minor), int(v.RevMajor), int(v.RevMinor), nil
+}
+
+// readVersionInfo reads the TPM_CAP_VERSION_INFO of TPM_CAP_VERSION_VAL. A TPM
+// 1.1b doesn't support that, so for one it reads TPM_CAP_VERSION instead, and
+// only the Version of the result is set.
+func readVersionInfo(rw io.ReadWriter) (*CapVersionInfo, error) {
+	var info CapVersionInfo
+	b, err := getCapabilityBytes(rw, CapVersion, nil)
+	var tpmErr tpmError
+	switch {
+	case err == nil:
+		if _, err := tpmutil.Unpack(b, &info); err != nil {
+			return nil, err
+		}
+		if uint16(info.Tag) != tagCapVersionInfo {
+			return nil, fmt.Errorf("invalid TPM_CAP_VERSION_INFO tag 0x%x", uint16(info.Tag))
+		}
+	case errors.As(err, &tpmErr):
+		if b, err = getCapabilityBytes(rw, CapVersion11, nil); err != nil {
+			return nil, err
+		}
+		if _, err := tpmutil.Unpack(b, &info.Version); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return &info, nil
+}
+
+// GetResourceCounts returns the number of keys, auth sessions and transport
+// sessions that can still be loaded into the TPM. For any of them that the TPM
+// doesn't report the number available of, it returns the maximum number the TPM
+// supports instead.
+func GetResourceCounts(rw io.ReadWriter) (keySlots, authSessions, transSessions int, err error) {
+	if keySlots, err = getResourceCount(rw, SubCapPropKeys, SubCapPropMaxKeys); err != nil {
+		return 0, 0, 0, err
+	}
+	if authSessions, err = getResourceCount(rw, SubCapPropAuthSess, SubCapPropMaxAuthSess); err != nil {
+		return 0, 0, 0, err
+	}
+	if transSessions, err = getResourceCount(rw, SubCapPropTranSess, SubCapPropMaxTranSess); err != nil {
+		return 0, 0, 0, err
+	}
+	return keySlots, authSessions, transSessions, nil
+}
+
+// GetSavedContextSlots returns the number of saved context slots that are free
+// in the TPM and the number it has in all, so that a manager that swaps keys
+// and sessions out with TPM_SaveContext can tell how many slots are in use
+// before it has to evict one. TPM 1.2 has no command that lists the saved
+// contexts themselves: they are blobs held by the caller, not resources in
+// the TPM.
+func GetSavedContextSlots(rw io.ReadWriter) (free, max int, err error) {
+	if free, err = getProperty(rw, SubCapPropContext); err != nil {
+		return 0, 0, err
+	}
+	if max, err = getProperty(rw, SubCapPropMaxContext); err != nil {
+		return 0, 0, err
+	}
+	return free, max, nil
+}
+
+// getProperty reads a numeric TPM_CAP_PROPERTY.
+func getProperty(rw io.ReadWriter, subCap uint32) (int, error) {
+	raw, err := getCapability(rw, CapProperty, subCap)
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) != 4 {
+		return 0, fmt.Errorf("got a %d-byte property, want 4 bytes", len(raw))
+	}
+	return int(binary.BigEndian.Uint32(raw)), nil
+}
+
+// getResourceCount reads the number of a resource that is available from the
+// available subcap of TPM_CAP_PROPERTY, or from the max subcap if the TPM
+// doesn't support the first one.
+func getResourceCount(rw io.ReadWriter, available, max uint32) (int, error) {
+	n, err := getProperty(rw, available)
+	if err == tpmError(errBadMode) {
+		n, err = getProperty(rw, max)
+	}
+	return n, err
+}
+
+// GetPermanentFlags returns the TPM_PERMANENT_FLAGS structure.
+func GetPermanentFlags(rw io.ReadWriter) (PermanentFlags, error) {
+	var ret PermanentFlags
+
+	raw, err := getCapability(rw, CapFlag, SubCapFlagPermanent)
+	if err != nil {
+		return ret, err
+	}
+
+	_, err = tpmutil.Unpack(raw, &ret)
+	return ret, err
+}
+
+// Ready checks that the TPM responds and can be used, and returns an error
+// that says why if it can't: ErrSelfTest if it hasn't finished its self-test,
+// ErrSelfTestFailed, ErrDisabled, ErrDeactivated, or ErrLockedOut if it is
+// locked out by its dictionary-attack protection. It only uses commands that
+// need no auth. TPMs that don't report their dictionary-attack state are
+// assumed not to be locked out.
+func Ready(rw io.ReadWriter) error {
+	// GetRandom is the cheapest command, and fails if the TPM can't run
+	// commands at all.
+	if _, err := GetRandom(rw, 1); err != nil {
+		return readyError(err)
+	}
+
+	flags, err := GetPermanentFlags(rw)
+	if err != nil {
+		return readyError(err)
+	}
+	if flags.Disable {
+		return ErrDisabled
+	}
+	if flags.Deactivated {
+		return ErrDeactivated
+	}
+
+	// The TPM can also be deactivated until the next startup.
+	raw, err := getCapability(rw, CapFlag, SubCapFlagVolatile)
+	if err != nil {
+		return readyError(err)
+	}
+	var tag uint16
+	var deactivated bool
+	if _, err := tpmutil.Unpack(raw, &tag, &deactivated); err != nil {
+		return err
+	}
+	if deactivated {
+		return ErrDeactivated
+	}
+
+	da, err := GetDAInfo(rw, EntityOwner)
+	if err == tpmError(errBadMode) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to write to NVRAM: %v", err)
+		return readyError(err)
 	}
-	raIn := []interface{}{ret, ordNVWriteValueAuth, tpmutil.U32Bytes(data)}
-	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
-		return fmt.Errorf("failed to verify authenticity of response: %v", err)
+	if da.Active {
+		return ErrLockedOut
 	}
 	return nil
 }
 
-// OwnerReadPubEK uses owner auth to get a blob representing the public part of the
-// endorsement key.
-func OwnerReadPubEK(rw io.ReadWriter, ownerAuth Digest) ([]byte, error) {
-	pk, err := ownerReadInternalHelper(rw, khEK, ownerAuth)
+// readyError converts the errors that the TPM returns for the states that
+// Ready checks into the corresponding errors.
+func readyError(err error) error {
+	te, ok := err.(tpmError)
+	if !ok {
+		return err
+	}
+	want, ok := tpmStateErrs[te]
+	if !ok {
+		return err
+	}
+	return fmt.Errorf("%w (%v)", want, err)
+}
+
+// GetPhysicalPresenceFlags returns the physical presence flags from
+// TPM_PERMANENT_FLAGS: whether physical presence can be asserted with the
+// hardware pin and with TSC_PhysicalPresence, and whether those two settings
+// are locked for the lifetime of the TPM.
+func GetPhysicalPresenceFlags(rw io.ReadWriter) (hwEnable, cmdEnable, lifetimeLock bool, err error) {
+	flags, err := GetPermanentFlags(rw)
 	if err != nil {
-		return nil, err
+		return false, false, false, err
 	}
+	return flags.PhysicalPresenceHWEnable, flags.PhysicalPresenceCMDEnable, flags.PhysicalPresenceLifetimeLock, nil
+}
 
-	return tpmutil.Pack(pk)
+// SetPhysicalPresenceLifetimeLock locks the physical presence hardware and
+// command enable flags at their current values for the lifetime of the TPM.
+// Set them first: once the lock is set, they can never be changed, and if
+// command physical presence is enabled, software can still assert physical
+// presence.
+//
+// WARNING: this can't be undone in any way, not even by clearing the TPM.
+func SetPhysicalPresenceLifetimeLock(rw io.ReadWriter) error {
+	return physicalPresence(rw, ppLifetimeLock)
 }
 
-// ReadPubEK reads the public part of the endorsement key when no owner is
-// established.
-func ReadPubEK(rw io.ReadWriter) ([]byte, error) {
-	var n Nonce
-	if _, err := rand.Read(n[:]); err != nil {
-		return nil, err
+// SetTempDeactivated deactivates the TPM until the next TPM_Startup, usually
+// the next reboot, without changing any persistent flags. Until then, commands
+// that need an active TPM, like Seal and Unseal, fail with an error that
+// matches ErrDeactivated. It needs physical presence; use
+// SetTempDeactivatedWithOperatorAuth on a TPM with an operator auth value set.
+func SetTempDeactivated(rw io.ReadWriter) error {
+	_, _, err := setTempDeactivated(rw, nil)
+	return err
+}
+
+// SetTempDeactivatedWithOperatorAuth is like SetTempDeactivated, but
+// authorizes the command with the operator auth value instead of physical
+// presence.
+func SetTempDeactivatedWithOperatorAuth(rw io.ReadWriter, operatorAuth Digest) error {
+	s, err := OpenOIAPSession(rw)
+	if err != nil {
+		return err
 	}
+	defer s.Close(rw)
 
-	pk, d, _, err := readPubEK(rw, n)
+	// The digest input for SetTempDeactivated auth is
+	//
+	// digest = SHA1(OrdSetTempDeactivated)
+	//
+	authIn := []interface{}{OrdSetTempDeactivated}
+	ca, err := s.newCommandAuth(operatorAuth[:], authIn, false)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Recompute the hash of the pk and the nonce to defend against replay
-	// attacks.
-	b, err := tpmutil.Pack(pk, n)
+	ra, ret, err := setTempDeactivated(rw, ca)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	s := sha1.Sum(b)
-	// There's no need for constant-time comparison of these hash values,
-	// since no secret is involved.
-	if !bytes.Equal(s[:], d[:]) {
-		return nil, errors.New("the ReadPubEK operation failed the replay check")
+	raIn := []interface{}{ret, OrdSetTempDeactivated}
+	return s.verify(ca, ra, operatorAuth[:], raIn)
+}
+
+// OwnerSetDisable disables the TPM if disable is true, or enables it if it's
+// false, with owner auth rather than physical presence. The disable flag is
+// persistent, so the TPM stays disabled across reboots until it's enabled
+// again. While it's disabled, most commands fail with an error that matches
+// ErrDisabled.
+func OwnerSetDisable(rw io.ReadWriter, disable bool, ownerAuth Digest) error {
+	// Run OSAP for the Owner, reading a random OddOSAP for our initial command
+	// and getting back a secret and a handle.
+	sharedSecretOwn, osaprOwn, err := newOSAPSession(rw, etOwner, khOwner, ownerAuth[:])
+	if err != nil {
+		return err
 	}
+	defer osaprOwn.Close(rw)
+	defer zeroBytes(sharedSecretOwn[:])
 
-	return tpmutil.Pack(pk)
+	// disableState is a TPM BOOL, which is a single byte. The digest input
+	// for OwnerSetDisable auth is
+	//
+	// digest = SHA1(OrdOwnerSetDisable || disableState)
+	//
+	var disableState byte
+	if disable {
+		disableState = 1
+	}
+	authIn := []interface{}{OrdOwnerSetDisable, disableState}
+	ca, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
+	if err != nil {
+		return err
+	}
+
+	ra, ret, err := ownerSetDisable(rw, disableState, ca)
+	if err != nil {
+		return err
+	}
+
+	// Check response authentication.
+	raIn := []interface{}{ret, OrdOwnerSetDisable}
+	return ra.verify(ca.NonceOdd, sharedSecretOwn[:], raIn)
 }
 
-// GetManufacturer returns the manufacturer ID
-func GetManufacturer(rw io.ReadWriter) ([]byte, error) {
-	return getCapability(rw, CapProperty, SubCapPropManufacturer)
+// GetDAInfo returns the state of the dictionary-attack mitigation for the
+// given entity type, such as how many more auth failures the TPM will accept
+// before it locks out. TPM 1.2 has no standard command to change the
+// thresholds; they are set by the TPM vendor.
+func GetDAInfo(rw io.ReadWriter, et EntityType) (*DAInfo, error) {
+	subCap, err := tpmutil.Pack(uint16(et))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := getCapabilityBytes(rw, CapDALogic, subCap)
+	if err != nil {
+		return nil, err
+	}
+	return parseDAInfo(raw)
 }
 
-// GetPermanentFlags returns the TPM_PERMANENT_FLAGS structure.
-func GetPermanentFlags(rw io.ReadWriter) (PermanentFlags, error) {
-	var ret PermanentFlags
+// parseDAInfo parses a TPM_DA_INFO or TPM_DA_INFO_LIMITED structure.
+func parseDAInfo(raw []byte) (*DAInfo, error) {
+	var tag uint16
+	if _, err := tpmutil.Unpack(raw, &tag); err != nil {
+		return nil, err
+	}
 
-	raw, err := getCapability(rw, CapFlag, SubCapFlagPermanent)
+	var state byte
+	var actionTag uint16
+	var vendorData tpmutil.U32Bytes
+	info := &DAInfo{}
+	var err error
+	switch tag {
+	case tagDAInfo:
+		_, err = tpmutil.Unpack(raw[2:], &state, &info.CurrentCount, &info.ThresholdCount, &actionTag, &info.ActionAtThreshold, &info.ActionDependValue, &vendorData)
+	case tagDAInfoLimited:
+		info.Limited = true
+		_, err = tpmutil.Unpack(raw[2:], &state, &actionTag, &info.ActionAtThreshold, &vendorData)
+	default:
+		return nil, fmt.Errorf("unexpected tag 0x%x for TPM_DA_INFO", tag)
+	}
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
-
-	_, err = tpmutil.Unpack(raw, &ret)
-	return ret, err
+	info.Active = state != 0
+	info.VendorData = vendorData
+	return info, nil
 }
 
 // GetAlgs returns a list of algorithms supported by the TPM device.
@@ -1192,13 +2357,28 @@ func GetNVList(rw io.ReadWriter) ([]uint32, error) {
 }
 
 // GetNVIndex returns the structure of NVDataPublic which contains
-// information about the requested NV Index.
+// information about the requested NV Index. It is equivalent to
+// GetNVDataPublic.
 // See: TPM-Main-Part-2-TPM-Structures_v1.2_rev116_01032011, P.167
 func GetNVIndex(rw io.ReadWriter, nvIndex uint32) (*NVDataPublic, error) {
+	return GetNVDataPublic(rw, nvIndex)
+}
+
+// GetNVDataPublic reads the TPM_NV_DATA_PUBLIC of an NV index, which gives
+// the size of the index, its attributes and the PCRs it is bound to for
+// reading and writing. Use it to size an NVReadValue before reading.
+// See: TPM-Main-Part-2-TPM-Structures_v1.2_rev116_01032011, P.142
+func GetNVDataPublic(rw io.ReadWriter, nvIndex uint32) (*NVDataPublic, error) {
+	buf, err := getCapability(rw, CapNVIndex, nvIndex)
+	if err != nil {
+		return nil, err
+	}
 	var nvInfo NVDataPublic
-	buf, _ := getCapability(rw, CapNVIndex, nvIndex)
 	if _, err := tpmutil.Unpack(buf, &nvInfo); err != nil {
-		return &nvInfo, err
+		return nil, err
+	}
+	if nvInfo.Tag != tagNVDataPublic {
+		return nil, fmt.Errorf("invalid TPM_NV_DATA_PUBLIC tag 0x%x for NV index 0x%x", nvInfo.Tag, nvIndex)
 	}
 	return &nvInfo, nil
 }
@@ -1224,9 +2404,9 @@ func OwnerClear(rw io.ReadWriter, ownerAuth Digest) error {
 
 	// The digest input for OwnerClear is
 	//
-	// digest = SHA1(ordOwnerClear)
+	// digest = SHA1(OrdOwnerClear)
 	//
-	authIn := []interface{}{ordOwnerClear}
+	authIn := []interface{}{OrdOwnerClear}
 	ca, err := newCommandAuth(osaprOwn.AuthHandle, osaprOwn.NonceEven, nil, sharedSecretOwn[:], authIn)
 	if err != nil {
 		return err
@@ -1238,7 +2418,7 @@ func OwnerClear(rw io.ReadWriter, ownerAuth Digest) error {
 	}
 
 	// Check response authentication.
-	raIn := []interface{}{ret, ordOwnerClear}
+	raIn := []interface{}{ret, OrdOwnerClear}
 	if err := ra.verify(ca.NonceOdd, sharedSecretOwn[:], raIn); err != nil {
 		return err
 	}
@@ -1258,11 +2438,11 @@ func TakeOwnership(rw io.ReadWriter, newOwnerAuth Digest, newSRKAuth Digest, pub
 	if err != nil {
 		return err
 	}
-	encOwnerAuth, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, ek, newOwnerAuth[:], oaepLabel)
+	encOwnerAuth, err := encryptOAEP(ek, crypto.SHA1, newOwnerAuth[:])
 	if err != nil {
 		return err
 	}
-	encSRKAuth, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, ek, newSRKAuth[:], oaepLabel)
+	encSRKAuth, err := encryptOAEP(ek, crypto.SHA1, newSRKAuth[:])
 	if err != nil {
 		return err
 	}
@@ -1283,7 +2463,7 @@ func TakeOwnership(rw io.ReadWriter, newOwnerAuth Digest, newSRKAuth Digest, pub
 		return err
 	}
 	srkParams := keyParams{
-		AlgID:     AlgRSA,
+		AlgID:     uint32(AlgRSA),
 		EncScheme: esRSAEsOAEPSHA1MGF1,
 		SigScheme: ssNone,
 		Params:    srkpb,
@@ -1305,8 +2485,8 @@ func TakeOwnership(rw io.ReadWriter, newOwnerAuth Digest, newSRKAuth Digest, pub
 
 	// The digest for TakeOwnership is
 	//
-	// SHA1(ordTakeOwnership || pidOwner || encOwnerAuth || encSRKAuth || srk)
-	authIn := []interface{}{ordTakeOwnership, pidOwner, tpmutil.U32Bytes(encOwnerAuth), tpmutil.U32Bytes(encSRKAuth), srk}
+	// SHA1(OrdTakeOwnership || pidOwner || encOwnerAuth || encSRKAuth || srk)
+	authIn := []interface{}{OrdTakeOwnership, pidOwner, tpmutil.U32Bytes(encOwnerAuth), tpmutil.U32Bytes(encSRKAuth), srk}
 	ca, err := newCommandAuth(oiapr.AuthHandle, oiapr.NonceEven, nil, newOwnerAuth[:], authIn)
 	if err != nil {
 		return err
@@ -1317,11 +2497,30 @@ func TakeOwnership(rw io.ReadWriter, newOwnerAuth Digest, newSRKAuth Digest, pub
 		return err
 	}
 
-	raIn := []interface{}{ret, ordTakeOwnership, k}
+	raIn := []interface{}{ret, OrdTakeOwnership, k}
 	return ra.verify(ca.NonceOdd, newOwnerAuth[:], raIn)
 }
 
-func createWrapKeyHelper(rw io.ReadWriter, srkAuth []byte, keyFlags KeyFlags, usageAuth Digest, migrationAuth Digest, pcrs []int) (*key, error) {
+// TakeOwnershipReadSRK is TakeOwnership followed by OwnerReadSRK with the new
+// owner auth, for provisioning tools that need the public key of the fresh SRK,
+// say to wrap migration blobs for it or to check sealed data against it. If
+// only the read fails, the TPM is owned all the same, and the error says so.
+func TakeOwnershipReadSRK(rw io.ReadWriter, newOwnerAuth Digest, newSRKAuth Digest, pubEK []byte) (*rsa.PublicKey, error) {
+	if err := TakeOwnership(rw, newOwnerAuth, newSRKAuth, pubEK); err != nil {
+		return nil, err
+	}
+	srk, err := OwnerReadSRK(rw, newOwnerAuth)
+	if err != nil {
+		return nil, fmt.Errorf("took ownership, but couldn't read the SRK public key: %w", err)
+	}
+	return UnmarshalPubRSAPublicKey(srk)
+}
+
+func createWrapKeyHelper(rw io.ReadWriter, srkAuth []byte, keyFlags KeyFlags, usage KeyUsage, es EncScheme, ss SigScheme, usageAuth Digest, migrationAuth Digest, pcrs []int) (*key, error) {
+	if err := checkKeySchemes(usage, es, ss); err != nil {
+		return nil, err
+	}
+
 	// Run OSAP for the SRK, reading a random OddOSAP for our initial
 	// command and getting back a secret and a handle.
 	sharedSecret, osapr, err := newOSAPSession(rw, etSRK, khSRK, srkAuth)
@@ -1331,41 +2530,15 @@ func createWrapKeyHelper(rw io.ReadWriter, srkAuth []byte, keyFlags KeyFlags, us
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
 
-	xorData, err := tpmutil.Pack(sharedSecret, osapr.NonceEven)
-	if err != nil {
-		return nil, err
-	}
-	defer zeroBytes(xorData)
-
 	// We have to come up with NonceOdd early to encrypt the migration auth.
 	var nonceOdd Nonce
 	if _, err := rand.Read(nonceOdd[:]); err != nil {
 		return nil, err
 	}
-
-	// ADIP (Authorization Data Insertion Protocol) is based on NonceEven for the first auth value
-	// encrypted by the protocol, and NonceOdd for the second auth value. This is so that the two
-	// keystreams are independent - otherwise, an eavesdropping attacker could XOR the two encrypted
-	// values together to cancel out the key and calculate (usageAuth ^ migrationAuth).
-	xorData2, err := tpmutil.Pack(sharedSecret, nonceOdd)
+	encUsageAuth, encMigrationAuth, err := encryptAuthPair(sharedSecret, osapr.NonceEven, nonceOdd, usageAuth[:], migrationAuth[:])
 	if err != nil {
 		return nil, err
 	}
-	defer zeroBytes(xorData2)
-
-	encAuthDataKey := sha1.Sum(xorData)
-	defer zeroBytes(encAuthDataKey[:])
-	encAuthDataKey2 := sha1.Sum(xorData2)
-	defer zeroBytes(encAuthDataKey2[:])
-
-	var encUsageAuth Digest
-	for i := range usageAuth {
-		encUsageAuth[i] = encAuthDataKey[i] ^ usageAuth[i]
-	}
-	var encMigrationAuth Digest
-	for i := range migrationAuth {
-		encMigrationAuth[i] = encAuthDataKey2[i] ^ migrationAuth[i]
-	}
 
 	rParams := rsaKeyParams{
 		KeyLength: 2048,
@@ -1390,19 +2563,19 @@ func createWrapKeyHelper(rw io.ReadWriter, srkAuth []byte, keyFlags KeyFlags, us
 
 	keyInfo := &key{
 		Version:       0x01010000,
-		KeyUsage:      keySigning,
-		KeyFlags:      keyFlags,
+		KeyUsage:      uint16(usage),
+		KeyFlags:      uint32(keyFlags),
 		AuthDataUsage: authAlways,
 		AlgorithmParams: keyParams{
-			AlgID:     AlgRSA,
-			EncScheme: esNone,
-			SigScheme: ssRSASaPKCS1v15DER,
+			AlgID:     uint32(AlgRSA),
+			EncScheme: uint16(es),
+			SigScheme: uint16(ss),
 			Params:    rParamsPacked,
 		},
 		PCRInfo: pcrInfoBytes,
 	}
 
-	authIn := []interface{}{ordCreateWrapKey, encUsageAuth, encMigrationAuth, keyInfo}
+	authIn := []interface{}{OrdCreateWrapKey, encUsageAuth, encMigrationAuth, keyInfo}
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, &nonceOdd, sharedSecret[:], authIn)
 	if err != nil {
 		return nil, err
@@ -1413,7 +2586,7 @@ func createWrapKeyHelper(rw io.ReadWriter, srkAuth []byte, keyFlags KeyFlags, us
 		return nil, err
 	}
 
-	raIn := []interface{}{ret, ordCreateWrapKey, k}
+	raIn := []interface{}{ret, OrdCreateWrapKey, k}
 	if err = ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
 		return nil, err
 	}
@@ -1430,7 +2603,22 @@ func createWrapKeyHelper(rw io.ReadWriter, srkAuth []byte, keyFlags KeyFlags, us
 // parameter would be used for authorizing migration of the key (although this
 // code currently disables migration).
 func CreateWrapKey(rw io.ReadWriter, srkAuth []byte, usageAuth Digest, migrationAuth Digest, pcrs []int) ([]byte, error) {
-	k, err := createWrapKeyHelper(rw, srkAuth, 0, usageAuth, migrationAuth, pcrs)
+	return CreateWrapKeyWithSchemes(rw, srkAuth, KeyUsageSigning, EncSchemeNone, SigSchemeRSASSAPKCS1v15DER, usageAuth, migrationAuth, pcrs)
+}
+
+// CreateWrapKeyWithSchemes creates a non-migratable 2048-bit RSA key like
+// CreateWrapKey, but with the given usage and schemes. The schemes must be
+// valid for the usage:
+//
+//   - KeyUsageSigning keys use EncSchemeNone and either PKCS#1 v1.5 signature
+//     scheme.
+//   - KeyUsageStorage keys use EncSchemeRSAESOAEPSHA1MGF1 and SigSchemeNone.
+//   - KeyUsageBind keys use either RSA encryption scheme and SigSchemeNone.
+//     Data for them is encrypted with Bind and decrypted with UnBind.
+//   - KeyUsageLegacy keys use either RSA encryption scheme and either PKCS#1
+//     v1.5 signature scheme.
+func CreateWrapKeyWithSchemes(rw io.ReadWriter, srkAuth []byte, usage KeyUsage, es EncScheme, ss SigScheme, usageAuth Digest, migrationAuth Digest, pcrs []int) ([]byte, error) {
+	k, err := createWrapKeyHelper(rw, srkAuth, 0, usage, es, ss, usageAuth, migrationAuth, pcrs)
 	if err != nil {
 		return nil, err
 	}
@@ -1441,12 +2629,127 @@ func CreateWrapKey(rw io.ReadWriter, srkAuth []byte, usageAuth Digest, migration
 	return keyblob, nil
 }
 
+// checkKeySchemes checks that the encryption and signature schemes are ones
+// the TPM accepts for a key with the given usage.
+func checkKeySchemes(usage KeyUsage, es EncScheme, ss SigScheme) error {
+	rsaEnc := es == EncSchemeRSAESPKCSv15 || es == EncSchemeRSAESOAEPSHA1MGF1
+	pkcs1Sig := ss == SigSchemeRSASSAPKCS1v15SHA1 || ss == SigSchemeRSASSAPKCS1v15DER
+
+	var ok bool
+	switch usage {
+	case KeyUsageSigning:
+		ok = es == EncSchemeNone && pkcs1Sig
+	case KeyUsageStorage:
+		ok = es == EncSchemeRSAESOAEPSHA1MGF1 && ss == SigSchemeNone
+	case KeyUsageBind:
+		ok = rsaEnc && ss == SigSchemeNone
+	case KeyUsageLegacy:
+		ok = rsaEnc && pkcs1Sig
+	default:
+		return fmt.Errorf("unsupported key usage 0x%x", uint16(usage))
+	}
+	if !ok {
+		return fmt.Errorf("encryption scheme 0x%x and signature scheme 0x%x can't be used with key usage 0x%x", uint16(es), uint16(ss), uint16(usage))
+	}
+	return nil
+}
+
+// encryptOAEP encrypts data for pub with RSAES-OAEP, using h for both the
+// label hash and MGF1, and the "TCPA" label of TPM_ES_RSAESOAEP_SHA1_MGF1. A
+// TPM's RSA engine only decrypts with SHA-1, so everything a TPM is meant to
+// decrypt, like the auth values of TakeOwnership, must use crypto.SHA1.
+func encryptOAEP(pub *rsa.PublicKey, h crypto.Hash, data []byte) ([]byte, error) {
+	if h != crypto.SHA1 && h != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported OAEP hash %v; only SHA-1 and SHA-256 are allowed", h)
+	}
+	return rsa.EncryptOAEP(h.New(), rand.Reader, pub, data, oaepLabel)
+}
+
+// Bind encrypts data for the key in keyBlob, which must be a KeyUsageBind key,
+// using the key's encryption scheme. The result can only be decrypted by
+// calling UnBind with that key loaded. Bind doesn't use the TPM.
+func Bind(keyBlob []byte, data []byte) ([]byte, error) {
+	return BindWithHash(keyBlob, data, crypto.SHA1)
+}
+
+// BindWithHash encrypts data like Bind, but uses h as the OAEP hash if the
+// key's encryption scheme is OAEP. h may be crypto.SHA1 or crypto.SHA256.
+// The TPM can only unbind data encrypted with SHA-1, so SHA-256 is only for
+// off-TPM consumers that hold the private key themselves, such as a privacy CA
+// and a client that have agreed on it. Keys with the PKCS#1 v1.5 scheme have
+// no OAEP hash, and only crypto.SHA1 is accepted for them.
+func BindWithHash(keyBlob []byte, data []byte, h crypto.Hash) ([]byte, error) {
+	var k key
+	if _, err := tpmutil.Unpack(keyBlob, &k); err != nil {
+		return nil, err
+	}
+	if k.KeyUsage != keyBind {
+		return nil, fmt.Errorf("key usage 0x%x is not a binding key", k.KeyUsage)
+	}
+	pub, err := k.RSAPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	bd, err := tpmutil.Pack(boundData{
+		Version:     0x01010000,
+		Payload:     ptBind,
+		PayloadData: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch k.AlgorithmParams.EncScheme {
+	case esRSAEsOAEPSHA1MGF1:
+		return encryptOAEP(pub, h, bd)
+	case esRSAEsPKCSv15:
+		if h != crypto.SHA1 {
+			return nil, fmt.Errorf("the PKCS#1 v1.5 encryption scheme has no OAEP hash to set to %v", h)
+		}
+		return rsa.EncryptPKCS1v15(rand.Reader, pub, bd)
+	default:
+		return nil, fmt.Errorf("unsupported encryption scheme 0x%x", k.AlgorithmParams.EncScheme)
+	}
+}
+
+// UnBind decrypts data produced by Bind with the binding key loaded at
+// keyHandle.
+func UnBind(rw io.ReadWriter, keyAuth []byte, keyHandle tpmutil.Handle, encData []byte) ([]byte, error) {
+	// Run OSAP for the key, reading a random OddOSAP for our initial
+	// command and getting back a secret and a handle.
+	sharedSecret, osapr, err := newOSAPSession(rw, etKeyHandle, keyHandle, keyAuth)
+	if err != nil {
+		return nil, err
+	}
+	defer osapr.Close(rw)
+	defer zeroBytes(sharedSecret[:])
+
+	authIn := []interface{}{OrdUnBind, tpmutil.U32Bytes(encData)}
+	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ra, ret, err := unbind(rw, keyHandle, encData, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	raIn := []interface{}{ret, OrdUnBind, tpmutil.U32Bytes(data)}
+	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
 // CreateMigratableWrapKey creates a new RSA key as in CreateWrapKey, but the
 // key is migratable (with the given migration auth).
 // Returns the loadable KeyBlob as well as just the encrypted private part, for
 // migration.
 func CreateMigratableWrapKey(rw io.ReadWriter, srkAuth []byte, usageAuth Digest, migrationAuth Digest, pcrs []int) ([]byte, []byte, error) {
-	k, err := createWrapKeyHelper(rw, srkAuth, keyMigratable, usageAuth, migrationAuth, pcrs)
+	k, err := createWrapKeyHelper(rw, srkAuth, KeyFlagMigratable, KeyUsageSigning, EncSchemeNone, SigSchemeRSASSAPKCS1v15DER, usageAuth, migrationAuth, pcrs)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1460,6 +2763,33 @@ func CreateMigratableWrapKey(rw io.ReadWriter, srkAuth []byte, usageAuth Digest,
 // AuthorizeMigrationKey authorizes a given public key for use in migrating
 // migratable keys. The scheme is REWRAP.
 func AuthorizeMigrationKey(rw io.ReadWriter, ownerAuth Digest, migrationKey crypto.PublicKey) ([]byte, error) {
+	return AuthorizeMigrationKeyScheme(rw, ownerAuth, MSRewrap, migrationKey)
+}
+
+// AuthorizeMigrationKeyScheme authorizes a given public key for use in
+// migrating migratable keys with the given scheme. The returned blob is passed
+// to CreateMigrationBlob or CreateMigrationBlobParent.
+func AuthorizeMigrationKeyScheme(rw io.ReadWriter, ownerAuth Digest, scheme MigrationScheme, migrationKey crypto.PublicKey) ([]byte, error) {
+	if migrationKey == nil {
+		return nil, errors.New("a migration key must be provided")
+	}
+	pub, err := convertPubKey(migrationKey)
+	if err != nil {
+		return nil, err
+	}
+	// convertPubKey is designed for signing keys.
+	pub.AlgorithmParams.EncScheme = esRSAEsOAEPSHA1MGF1
+	pub.AlgorithmParams.SigScheme = ssNone
+	rsaParams := rsaKeyParams{
+		KeyLength: 2048,
+		NumPrimes: 2,
+		//Exponent: default (omit)
+	}
+	pub.AlgorithmParams.Params, err = tpmutil.Pack(rsaParams)
+	if err != nil {
+		return nil, err
+	}
+
 	// Run OSAP for the OwnerAuth, reading a random OddOSAP for our initial
 	// command and getting back a secret and a handle.
 	sharedSecret, osapr, err := newOSAPSession(rw, etOwner, khOwner, ownerAuth[:])
@@ -1469,31 +2799,9 @@ func AuthorizeMigrationKey(rw io.ReadWriter, ownerAuth Digest, migrationKey cryp
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
 
-	var pub *pubKey
-	if migrationKey != nil {
-		pub, err = convertPubKey(migrationKey)
-		if err != nil {
-			return nil, err
-		}
-		// convertPubKey is designed for signing keys.
-		pub.AlgorithmParams.EncScheme = esRSAEsOAEPSHA1MGF1
-		pub.AlgorithmParams.SigScheme = ssNone
-		rsaParams := rsaKeyParams{
-			KeyLength: 2048,
-			NumPrimes: 2,
-			//Exponent: default (omit)
-		}
-		pub.AlgorithmParams.Params, err = tpmutil.Pack(rsaParams)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	scheme := msRewrap
-
 	// The digest for auth for the authorizeMigrationKey command is computed as
-	// SHA1(ordAuthorizeMigrationkey || migrationScheme || migrationKey)
-	authIn := []interface{}{ordAuthorizeMigrationKey, scheme, pub}
+	// SHA1(OrdAuthorizeMigrationKey || migrationScheme || migrationKey)
+	authIn := []interface{}{OrdAuthorizeMigrationKey, scheme, pub}
 
 	// The commandAuth uses the shared secret as an HMAC key.
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
@@ -1501,22 +2809,54 @@ func AuthorizeMigrationKey(rw io.ReadWriter, ownerAuth Digest, migrationKey cryp
 		return nil, err
 	}
 
-	migrationAuth, _, _, err := authorizeMigrationKey(rw, scheme, *pub, ca)
+	migrationAuth, ra, ret, err := authorizeMigrationKey(rw, scheme, *pub, ca)
 	if err != nil {
 		return nil, err
 	}
 
-	// For now, ignore the response authentication.
+	// Check the response authentication.
+	raIn := []interface{}{ret, OrdAuthorizeMigrationKey, migrationAuth}
+	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
+		return nil, err
+	}
+
 	return migrationAuth, nil
 }
 
-// CreateMigrationBlob performs a Rewrap migration of the given key blob.
-func CreateMigrationBlob(rw io.ReadWriter, srkAuth Digest, migrationAuth Digest, keyBlob []byte, migrationKeyBlob []byte) ([]byte, error) {
-	// Run OSAP for the SRK, reading a random OddOSAP for our initial
+// CreateMigrationBlob performs a migration of a key that is a child of the SRK.
+// encData is the encrypted private part of the key, as returned by
+// CreateMigratableWrapKey, not the whole key blob. The scheme is taken from
+// migrationKeyBlob, as returned by AuthorizeMigrationKey or
+// AuthorizeMigrationKeyScheme. For the MIGRATE scheme, use
+// CreateMigrationBlobParent instead, since the random value it returns is
+// needed by ConvertMigrationBlob.
+func CreateMigrationBlob(rw io.ReadWriter, srkAuth Digest, migrationAuth Digest, encData []byte, migrationKeyBlob []byte) ([]byte, error) {
+	_, outData, err := CreateMigrationBlobParent(rw, khSRK, srkAuth[:], migrationAuth, encData, migrationKeyBlob)
+	return outData, err
+}
+
+// CreateMigrationBlobParent performs a migration of the encrypted private part
+// of a key that was wrapped by the key loaded at parentHandle. It returns the
+// random value (empty for the REWRAP scheme) and the migrated data. For the
+// REWRAP scheme, the migrated data is the private part of the key encrypted
+// under the migration key; for the MIGRATE scheme, it must be passed, along
+// with the random value, to ConvertMigrationBlob on the target TPM.
+func CreateMigrationBlobParent(rw io.ReadWriter, parentHandle tpmutil.Handle, parentAuth []byte, migrationAuth Digest, encData []byte, migrationKeyBlob []byte) ([]byte, []byte, error) {
+	var mka migrationKeyAuth
+	if _, err := tpmutil.Unpack(migrationKeyBlob, &mka); err != nil {
+		return nil, nil, fmt.Errorf("couldn't parse the migration key blob: %v", err)
+	}
+	scheme := mka.MigrationScheme
+
+	// Run OSAP for the parent key, reading a random OddOSAP for our initial
 	// command and getting back a secret and a handle.
-	sharedSecret, osapr, err := newOSAPSession(rw, etSRK, khSRK, srkAuth[:])
+	et := etKeyHandle
+	if parentHandle == khSRK {
+		et = etSRK
+	}
+	sharedSecret, osapr, err := newOSAPSession(rw, et, parentHandle, parentAuth)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
@@ -1525,38 +2865,103 @@ func CreateMigrationBlob(rw io.ReadWriter, srkAuth Digest, migrationAuth Digest,
 	// OSAP session.
 	oiapr, err := oiap(rw)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer oiapr.Close(rw)
 
-	encData := tpmutil.U32Bytes(keyBlob)
+	data := tpmutil.U32Bytes(encData)
 
 	// The digest for auth1 and auth2 for the createMigrationBlob command is
-	// SHA1(ordCreateMigrationBlob || migrationScheme || migrationKeyBlob || encData)
-	authIn := []interface{}{ordCreateMigrationBlob, msRewrap, migrationKeyBlob, encData}
+	// SHA1(OrdCreateMigrationBlob || migrationScheme || migrationKeyBlob || encData)
+	authIn := []interface{}{OrdCreateMigrationBlob, scheme, migrationKeyBlob, data}
 
 	// The first commandAuth uses the shared secret as an HMAC key.
 	ca1, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// The second commandAuth is based on OIAP instead of OSAP and uses the
 	// migration auth as the HMAC key.
 	ca2, err := newCommandAuth(oiapr.AuthHandle, oiapr.NonceEven, nil, migrationAuth[:], authIn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	random, outData, ra1, ra2, ret, err := createMigrationBlob(rw, parentHandle, scheme, migrationKeyBlob, data, ca1, ca2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Check the response authentication.
+	raIn := []interface{}{ret, OrdCreateMigrationBlob, tpmutil.U32Bytes(random), tpmutil.U32Bytes(outData)}
+	if err := ra1.verify(ca1.NonceOdd, sharedSecret[:], raIn); err != nil {
+		return nil, nil, err
+	}
+
+	if err := ra2.verify(ca2.NonceOdd, migrationAuth[:], raIn); err != nil {
+		return nil, nil, err
+	}
+
+	return random, outData, nil
+}
+
+// ConvertMigrationBlob takes the migrated data and random value produced by
+// CreateMigrationBlobParent with the MIGRATE scheme and rewraps the key under
+// the storage key loaded at parentHandle, which must be the key that was
+// authorized as the migration key. It returns the new encrypted private part of
+// the key; see ReplaceEncData.
+func ConvertMigrationBlob(rw io.ReadWriter, parentHandle tpmutil.Handle, parentAuth []byte, inData []byte, random []byte) ([]byte, error) {
+	// Run OSAP for the parent key, reading a random OddOSAP for our initial
+	// command and getting back a secret and a handle.
+	et := etKeyHandle
+	if parentHandle == khSRK {
+		et = etSRK
+	}
+	sharedSecret, osapr, err := newOSAPSession(rw, et, parentHandle, parentAuth)
+	if err != nil {
+		return nil, err
+	}
+	defer osapr.Close(rw)
+	defer zeroBytes(sharedSecret[:])
+
+	// The digest for auth for the convertMigrationBlob command is computed as
+	// SHA1(OrdConvertMigrationBlob || inData || random)
+	authIn := []interface{}{OrdConvertMigrationBlob, tpmutil.U32Bytes(inData), tpmutil.U32Bytes(random)}
+
+	// The commandAuth uses the shared secret as an HMAC key.
+	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
 		return nil, err
 	}
 
-	_, outData, _, _, _, err := createMigrationBlob(rw, khSRK, msRewrap, migrationKeyBlob, encData, ca1, ca2)
+	outData, ra, ret, err := convertMigrationBlob(rw, parentHandle, inData, random, ca)
 	if err != nil {
 		return nil, err
 	}
 
-	// For now, ignore the response authenticatino.
+	// Check the response authentication.
+	raIn := []interface{}{ret, OrdConvertMigrationBlob, tpmutil.U32Bytes(outData)}
+	if err := ra.verify(ca.NonceOdd, sharedSecret[:], raIn); err != nil {
+		return nil, err
+	}
+
 	return outData, nil
 }
 
+// ReplaceEncData returns a copy of keyBlob with its encrypted private part
+// replaced by encData. It is used on the target TPM of a migration to turn the
+// output of CreateMigrationBlob or ConvertMigrationBlob back into a loadable key
+// blob.
+func ReplaceEncData(keyBlob []byte, encData []byte) ([]byte, error) {
+	var k key
+	if _, err := tpmutil.Unpack(keyBlob, &k); err != nil {
+		return nil, err
+	}
+	k.EncData = encData
+	return tpmutil.Pack(k)
+}
+
 // https://golang.org/src/crypto/rsa/pkcs1v15.go?s=8762:8862#L204
 var hashPrefixes = map[crypto.Hash][]byte{
 	crypto.MD5:       {0x30, 0x20, 0x30, 0x0c, 0x06, 0x08, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x02, 0x05, 0x05, 0x00, 0x04, 0x10},
@@ -1571,7 +2976,8 @@ var hashPrefixes = map[crypto.Hash][]byte{
 
 // Sign will sign a digest using the supplied key handle. Uses PKCS1v15 signing, which means the hash OID is prefixed to the
 // hash before it is signed. Therefore the hash used needs to be passed as the hash parameter to determine the right
-// prefix.
+// prefix. The hashed value must already be a digest: Sign never hashes it again.
+// keyAuth is the usage auth of the key at keyHandle, not the SRK auth.
 func Sign(rw io.ReadWriter, keyAuth []byte, keyHandle tpmutil.Handle, hash crypto.Hash, hashed []byte) ([]byte, error) {
 	prefix, ok := hashPrefixes[hash]
 	if !ok {
@@ -1588,7 +2994,7 @@ func Sign(rw io.ReadWriter, keyAuth []byte, keyHandle tpmutil.Handle, hash crypt
 	defer osapr.Close(rw)
 	defer zeroBytes(sharedSecret[:])
 
-	authIn := []interface{}{ordSign, tpmutil.U32Bytes(data)}
+	authIn := []interface{}{OrdSign, tpmutil.U32Bytes(data)}
 	ca, err := newCommandAuth(osapr.AuthHandle, osapr.NonceEven, nil, sharedSecret[:], authIn)
 	if err != nil {
 		return nil, err
@@ -1596,10 +3002,10 @@ func Sign(rw io.ReadWriter, keyAuth []byte, keyHandle tpmutil.Handle, hash crypt
 
 	signature, ra, ret, err := sign(rw, keyHandle, data, ca)
 	if err != nil {
-		return nil, err
+		return nil, keyHandleError(keyHandle, err)
 	}
 
-	raIn := []interface{}{ret, ordSign, tpmutil.U32Bytes(signature)}
+	raIn := []interface{}{ret, OrdSign, tpmutil.U32Bytes(signature)}
 	err = ra.verify(ca.NonceOdd, sharedSecret[:], raIn)
 	if err != nil {
 		return nil, err
@@ -1627,8 +3033,17 @@ func PcrReset(rw io.ReadWriter, pcrs []int) error {
 func ForceClear(rw io.ReadWriter) error {
 	in := []interface{}{}
 	out := []interface{}{}
-	_, err := submitTPMRequest(rw, tagRQUCommand, ordForceClear, in, out)
+	_, err := submitTPMRequest(rw, TagRQUCommand, OrdForceClear, in, out)
+
+	return err
+}
 
+// ResetAuthSessions runs TPM_Reset, which closes every open auth session in
+// the TPM at once, including those left behind by processes that died in the
+// middle of a session. It needs no auth. Unlike ResetLockValue and ForceClear,
+// it changes neither the dictionary-attack state nor the ownership of the TPM.
+func ResetAuthSessions(rw io.ReadWriter) error {
+	_, err := submitTPMRequest(rw, TagRQUCommand, OrdReset, nil, nil)
 	return err
 }
 
@@ -1637,7 +3052,7 @@ func startup(rw io.ReadWriter) error {
 	var typ uint16 = 0x0001 // TPM_ST_CLEAR
 	in := []interface{}{typ}
 	out := []interface{}{}
-	_, err := submitTPMRequest(rw, tagRQUCommand, ordStartup, in, out)
+	_, err := submitTPMRequest(rw, TagRQUCommand, OrdStartup, in, out)
 
 	return err
 }
@@ -1656,7 +3071,7 @@ func createEK(rw io.ReadWriter) error {
 	}
 	in := []interface{}{antiReplay, keyInfo}
 	out := []interface{}{}
-	_, err := submitTPMRequest(rw, tagRQUCommand, ordCreateEndorsementKeyPair, in, out)
+	_, err := submitTPMRequest(rw, TagRQUCommand, OrdCreateEndorsementKeyPair, in, out)
 
 	return err
 }
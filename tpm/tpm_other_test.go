@@ -17,8 +17,13 @@
 package tpm
 
 import (
+	"errors"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -36,3 +41,60 @@ func openTPMOrSkip(t *testing.T) io.ReadWriteCloser {
 
 	return rwc
 }
+
+func TestOpenDeviceFallback(t *testing.T) {
+	tpmPath := os.Getenv(tpmPathEnvVar)
+	if tpmPath == "" {
+		tpmPath = defaultTPMPath
+	}
+	if _, err := os.Stat(tpmPath); err != nil {
+		t.Skipf("Skipping test, since there is no TPM at %s", tpmPath)
+	}
+
+	missing := filepath.Join(t.TempDir(), "tpm0")
+	d, err := openDevice(missing, tpmPath)
+	if err != nil {
+		t.Skipf("Skipping test, since we can't open %s for read/write: %s\n", tpmPath, err)
+	}
+	defer d.Close()
+
+	if _, err := GetManufacturer(d); err != nil {
+		t.Fatal("Couldn't get the manufacturer from the fallback device:", err)
+	}
+}
+
+func TestOpenDeviceNoDevice(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "tpm0")
+	if _, err := openDevice(first, filepath.Join(dir, "tpmrm0")); err == nil || !strings.Contains(err.Error(), first) {
+		t.Fatalf("openDevice with no devices returned %v, want an error for %s", err, first)
+	}
+}
+
+func TestOpenError(t *testing.T) {
+	for _, tt := range []struct {
+		errno  syscall.Errno
+		target error
+		want   string
+	}{
+		{syscall.ENOENT, fs.ErrNotExist, "no TPM device found"},
+		{syscall.EACCES, fs.ErrPermission, "insufficient permission"},
+		{syscall.EBUSY, syscall.EBUSY, "device busy"},
+	} {
+		err := openError(&fs.PathError{Op: "open", Path: defaultTPMPath, Err: tt.errno})
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("openError(%v) = %q, want it to contain %q", tt.errno, err, tt.want)
+		}
+		if !errors.Is(err, tt.target) {
+			t.Errorf("openError(%v) = %v, which isn't %v", tt.errno, err, tt.target)
+		}
+	}
+}
+
+func TestOpenTPMNoDevice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tpm0")
+	_, err := OpenTPM(path)
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "no TPM device found") {
+		t.Fatalf("OpenTPM(%s) returned %v, want a wrapped fs.ErrNotExist", path, err)
+	}
+}
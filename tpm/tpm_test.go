@@ -16,14 +16,21 @@ package tpm
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	mathrand "math/rand"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/google/go-tpm/tpm/testtpm"
+	"github.com/google/go-tpm/tpm/verify"
 	"github.com/google/go-tpm/tpmutil"
 )
 
@@ -38,13 +45,56 @@ var (
 // If the environment variable is not present, then getAuth returns the
 // well-known auth value of 20 bytes of zeros.
 func getAuth(name string) Digest {
-	var auth Digest
 	authInput := os.Getenv(name)
-	if authInput != "" {
-		aa := sha1.Sum([]byte(authInput))
-		copy(auth[:], aa[:])
+	if authInput == "" {
+		return WellKnownAuth()
 	}
-	return auth
+	return SHA1Auth([]byte(authInput))
+}
+
+// testKey returns a TPM_KEY for a 2048-bit RSA key with the given usage and
+// auth data usage, and the schemes that the TPM gives keys of that usage. Its
+// public key is pub, or empty if pub is nil.
+func testKey(t *testing.T, usage uint16, authUsage byte, pub *rsa.PublicKey) key {
+	t.Helper()
+	params, err := tpmutil.Pack(rsaKeyParams{KeyLength: 2048, NumPrimes: 2})
+	if err != nil {
+		t.Fatal("Couldn't pack the RSA key params:", err)
+	}
+	es, ss := esNone, ssRSASaPKCS1v15DER
+	switch usage {
+	case keyIdentity:
+		ss = ssRSASaPKCS1v15SHA1
+	case keyBind:
+		es, ss = esRSAEsOAEPSHA1MGF1, ssNone
+	}
+	k := key{
+		Version:         0x01010000,
+		KeyUsage:        usage,
+		AuthDataUsage:   authUsage,
+		AlgorithmParams: keyParams{AlgID: uint32(AlgRSA), EncScheme: es, SigScheme: ss, Params: params},
+	}
+	if pub != nil {
+		k.PubKey = pub.N.Bytes()
+	}
+	return k
+}
+
+// testKeyBlob packs the key that testKey returns.
+func testKeyBlob(t *testing.T, usage uint16, authUsage byte, pub *rsa.PublicKey) []byte {
+	t.Helper()
+	blob, err := tpmutil.Pack(testKey(t, usage, authUsage, pub))
+	if err != nil {
+		t.Fatal("Couldn't pack the key:", err)
+	}
+	return blob
+}
+
+// wellKnownAuth returns a fresh copy of WellKnownAuth as a slice, for the
+// functions that take an auth as []byte.
+func wellKnownAuth() []byte {
+	auth := WellKnownAuth()
+	return auth[:]
 }
 
 func TestGetKeys(t *testing.T) {
@@ -122,6 +172,26 @@ func TestGetNVIndex(t *testing.T) {
 	t.Logf("NVIndices with Attributes:%v", nvInfo)
 }
 
+func TestGetNVDataPublic(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	nvList, err := GetNVList(rwc)
+	if err != nil {
+		t.Fatalf("Couldn't read NVList %v", err)
+	}
+	for _, nvEntry := range nvList {
+		pub, err := GetNVDataPublic(rwc, nvEntry)
+		if err != nil {
+			t.Fatalf("Can't read NVDataPublic of index: %v with: %v", nvEntry, err)
+		}
+		if pub.NVIndex != nvEntry {
+			t.Errorf("GetNVDataPublic(0x%x) returned data for index 0x%x", nvEntry, pub.NVIndex)
+		}
+		t.Logf("NV index 0x%x: size %d, permissions %v", pub.NVIndex, pub.Size, pub.Permission.Attributes)
+	}
+}
+
 func TestPcrExtend(t *testing.T) {
 	rwc := openTPMOrSkip(t)
 	defer rwc.Close()
@@ -167,6 +237,21 @@ func TestReadEKCert(t *testing.T) {
 	}
 }
 
+func TestReadEKCertificate(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// Emulators usually have no EK certificate.
+	if _, err := GetNVIndex(rwc, 0x1000f000); err != nil {
+		t.Skip("No EK certificate in NVRAM:", err)
+	}
+	cert, err := ReadEKCertificate(rwc, getAuth(ownerAuthEnvVar))
+	if err != nil {
+		t.Fatal("Couldn't read the EK certificate:", err)
+	}
+	t.Logf("EK certificate issued by %v", cert.Issuer)
+}
+
 func TestReadPCR(t *testing.T) {
 	rwc := openTPMOrSkip(t)
 	defer rwc.Close()
@@ -184,7 +269,7 @@ func TestFetchPCRValues(t *testing.T) {
 	defer rwc.Close()
 
 	var mask pcrMask
-	if err := mask.setPCR(17); err != nil {
+	if err := mask.Set(17); err != nil {
 		t.Fatal("Couldn't set PCR 17:", err)
 	}
 
@@ -338,6 +423,29 @@ func TestSeal(t *testing.T) {
 	}
 }
 
+func TestSealTooLarge(t *testing.T) {
+	data := make([]byte, MaxSealSize+1)
+	if _, err := Seal(noTPM{t}, LocZero, []int{17}, data, wellKnownAuth()); !errors.Is(err, ErrSealTooLarge) {
+		t.Fatalf("Seal of %d bytes returned %v, want %v", len(data), err, ErrSealTooLarge)
+	}
+	if _, err := Reseal(noTPM{t}, LocZero, map[int][]byte{17: make([]byte, PCRSize)}, data, wellKnownAuth()); !errors.Is(err, ErrSealTooLarge) {
+		t.Fatalf("Reseal of %d bytes returned %v, want %v", len(data), err, ErrSealTooLarge)
+	}
+
+	f := testtpm.NewFake()
+	if _, err := Seal(f, LocZero, []int{17}, data[:MaxSealSize], wellKnownAuth()); err != nil {
+		t.Fatalf("Couldn't seal %d bytes: %v", MaxSealSize, err)
+	}
+	s, err := OpenOSAPSession(f, EntitySRK, khSRK, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session for the SRK:", err)
+	}
+	defer s.Close(f)
+	if _, err := s.Seal(f, LocZero, []int{17}, data, wellKnownAuth()); !errors.Is(err, ErrSealTooLarge) {
+		t.Fatalf("OSAPSession.Seal of %d bytes returned %v, want %v", len(data), err, ErrSealTooLarge)
+	}
+}
+
 func TestReseal(t *testing.T) {
 	rwc := openTPMOrSkip(t)
 	defer rwc.Close()
@@ -388,6 +496,104 @@ func TestLoadKey2(t *testing.T) {
 	}
 }
 
+func TestFlushAll(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// Get the key from aikblob, assuming it exists. Otherwise, skip the test.
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+
+	srkAuth := getAuth(srkAuthEnvVar)
+	for i := 0; i < 3; i++ {
+		if _, err := LoadKey2(rwc, blob, srkAuth[:]); err != nil {
+			t.Fatal("Couldn't load the AIK into the TPM and get a handle for it:", err)
+		}
+	}
+
+	if err := FlushAll(rwc); err != nil {
+		t.Fatal("Couldn't flush all resources from the TPM:", err)
+	}
+
+	handles, err := GetKeys(rwc)
+	if err != nil {
+		t.Fatal("Couldn't enumerate keys in the TPM:", err)
+	}
+	if len(handles) != 0 {
+		t.Fatalf("Got %d loaded keys after FlushAll, want 0: % x", len(handles), handles)
+	}
+}
+
+func TestReset(t *testing.T) {
+	keyBlob := testKeyBlob(t, keySigning, authAlways, nil)
+
+	for _, tt := range []struct {
+		ownerAuth  Digest
+		lockResets int
+	}{
+		{WellKnownAuth(), 1},
+		{SHA1Auth([]byte("owner")), 0},
+	} {
+		f := testtpm.NewFake()
+		f.OwnerAuth = tt.ownerAuth
+		if _, err := LoadKey2(f, keyBlob, wellKnownAuth()); err != nil {
+			t.Fatal("Couldn't load the key:", err)
+		}
+		if _, err := oiap(f); err != nil {
+			t.Fatal("Couldn't open an OIAP session:", err)
+		}
+
+		if err := Reset(f, tt.ownerAuth); err != nil {
+			t.Fatal("Couldn't reset the TPM:", err)
+		}
+		keys, err := getHandles(f, rtKey)
+		if err != nil {
+			t.Fatal("Couldn't get the loaded keys:", err)
+		}
+		sessions, err := getHandles(f, rtAuth)
+		if err != nil {
+			t.Fatal("Couldn't get the open sessions:", err)
+		}
+		if len(keys) != 0 || len(sessions) != 0 {
+			t.Errorf("Reset left keys %v and sessions %v loaded", keys, sessions)
+		}
+		if f.LockValueResets != tt.lockResets {
+			t.Errorf("Reset with owner auth % x reset the lock value %d times, want %d", tt.ownerAuth, f.LockValueResets, tt.lockResets)
+		}
+	}
+}
+
+func TestResetAuthSessions(t *testing.T) {
+	f := testtpm.NewFake()
+	f.MaxSessions = 3
+
+	// Leak every session slot, as crashed processes might.
+	for i := 0; i < f.MaxSessions; i++ {
+		if _, err := oiap(f); err != nil {
+			t.Fatalf("Couldn't open OIAP session %d: %v", i, err)
+		}
+	}
+	if _, err := oiap(f); err != tpmError(errResources) {
+		t.Fatalf("Opening a session beyond the limit returned %v, want %v", err, tpmError(errResources))
+	}
+
+	if err := ResetAuthSessions(f); err != nil {
+		t.Fatal("Couldn't reset the auth sessions:", err)
+	}
+	sessions, err := getHandles(f, rtAuth)
+	if err != nil {
+		t.Fatal("Couldn't get the open sessions:", err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("Got %d open sessions after ResetAuthSessions, want 0", len(sessions))
+	}
+	if _, err := oiap(f); err != nil {
+		t.Fatal("Couldn't open an OIAP session after ResetAuthSessions:", err)
+	}
+}
+
 func TestQuote2(t *testing.T) {
 	rwc := openTPMOrSkip(t)
 	defer rwc.Close()
@@ -410,13 +616,122 @@ func TestQuote2(t *testing.T) {
 	// Data to quote.
 	data := []byte(`The OS says this test is good`)
 	aikAuth := getAuth(aikAuthEnvVar)
-	q, err := Quote2(rwc, handle, data, []int{17, 18}, 1 /* addVersion */, aikAuth[:])
+	pk, err := UnmarshalRSAPublicKey(blob)
 	if err != nil {
-		t.Fatal("Couldn't quote the data:", err)
+		t.Fatal("Couldn't extract an RSA key from the AIK blob:", err)
+	}
+	for _, addVersion := range []bool{false, true} {
+		q, err := Quote2(rwc, handle, data, []int{17, 18}, addVersion, aikAuth[:])
+		if err != nil {
+			t.Fatalf("Couldn't quote the data with addVersion %t: %v", addVersion, err)
+		}
+		if len(q) == 0 {
+			t.Fatal("Couldn't get a quote using an AIK")
+		}
+
+		// Quote2 doesn't return the version info, so the quote can only be
+		// checked without it.
+		if addVersion {
+			continue
+		}
+		values, err := FetchPCRValues(rwc, []int{17, 18})
+		if err != nil {
+			t.Fatal("Couldn't read the quoted PCRs:", err)
+		}
+		if err := VerifyQuote2(pk, sha1.Sum(data), q, []int{17, 18}, values, nil); err != nil {
+			t.Fatal("The quote without version info didn't pass verification:", err)
+		}
+	}
+}
+
+func TestCheckQuote2VersionInfo(t *testing.T) {
+	versionInfo := []byte{0x00, 0x30, 0x01, 0x02}
+	for _, tc := range []struct {
+		addVersion  bool
+		versionInfo []byte
+		ok          bool
+	}{
+		{false, nil, true},
+		{true, versionInfo, true},
+		{false, versionInfo, false},
+		{true, nil, false},
+	} {
+		if err := checkQuote2VersionInfo(tc.addVersion, tc.versionInfo); (err == nil) != tc.ok {
+			t.Errorf("checkQuote2VersionInfo(%t, % x) returned %v, want ok = %t", tc.addVersion, tc.versionInfo, err, tc.ok)
+		}
+	}
+}
+
+func TestQuote2Values(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// Get the key from aikblob, assuming it exists. Otherwise, skip the test.
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+
+	srkAuth := getAuth(srkAuthEnvVar)
+	handle, err := LoadKey2(rwc, blob, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the AIK into the TPM and get a handle for it:", err)
+	}
+	defer CloseKey(rwc, handle)
+	pk, err := UnmarshalRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't extract an RSA key from the AIK blob:", err)
+	}
+
+	nonce := Nonce(sha1.Sum([]byte("Quote2Values nonce")))
+	pcrNums := []int{18, 17}
+	aikAuth := getAuth(aikAuthEnvVar)
+	for _, addVersion := range []bool{false, true} {
+		sig, values, versionInfo, err := Quote2Values(rwc, handle, nonce, pcrNums, addVersion, aikAuth[:])
+		if err != nil {
+			t.Fatalf("Couldn't quote with addVersion %t: %v", addVersion, err)
+		}
+		if addVersion != (len(versionInfo) > 0) {
+			t.Fatalf("Quote2Values with addVersion %t returned version info % x", addVersion, versionInfo)
+		}
+		if err := VerifyQuote2(pk, nonce, sig, pcrNums, values, versionInfo); err != nil {
+			t.Fatalf("The quote with addVersion %t didn't pass verification: %v", addVersion, err)
+		}
+		if addVersion {
+			if err := VerifyQuote2(pk, nonce, sig, pcrNums, values, nil); err == nil {
+				t.Fatal("A quote with version info passed verification without it")
+			}
+		}
+	}
+}
+
+func TestLoadedKeyQuote2(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// Get the key from aikblob, assuming it exists. Otherwise, skip the test.
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+
+	srkAuth := getAuth(srkAuthEnvVar)
+	aikAuth := getAuth(aikAuthEnvVar)
+	aik, err := LoadKey(rwc, blob, srkAuth[:], aikAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the AIK into the TPM:", err)
 	}
+	defer aik.Close(rwc)
 
-	if len(q) == 0 {
-		t.Fatal("Couldn't get a quote using an AIK")
+	for i := 0; i < 3; i++ {
+		data := []byte{byte(i)}
+		q, err := aik.Quote2(rwc, data, []int{17, 18}, false)
+		if err != nil {
+			t.Fatalf("Couldn't produce quote %d with the loaded AIK: %v", i, err)
+		}
+		if len(q) == 0 {
+			t.Fatalf("Got an empty quote %d from the loaded AIK", i)
+		}
 	}
 }
 
@@ -442,7 +757,8 @@ func TestGetPubKey(t *testing.T) {
 	}
 	defer CloseKey(rwc, handle)
 
-	k, err := GetPubKey(rwc, handle, srkAuth[:])
+	aikAuth := getAuth(aikAuthEnvVar)
+	k, err := GetPubKey(rwc, handle, aikAuth[:])
 	if err != nil {
 		t.Fatal("Couldn't get the pub key for the AIK")
 	}
@@ -452,6 +768,84 @@ func TestGetPubKey(t *testing.T) {
 	}
 }
 
+func TestGetSRKPubKey(t *testing.T) {
+	f := testtpm.NewFake()
+	blob, err := GetSRKPubKey(f, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't get the SRK public key:", err)
+	}
+	pk, err := UnmarshalPubRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't parse the SRK public key:", err)
+	}
+	if pk.N.BitLen() != 2048 {
+		t.Fatalf("The SRK public key has %d bits, want 2048", pk.N.BitLen())
+	}
+
+	again, err := GetPubKey(f, khSRK, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't get the SRK public key by handle:", err)
+	}
+	if !bytes.Equal(again, blob) {
+		t.Fatal("GetPubKey for the SRK handle returned a different key than GetSRKPubKey")
+	}
+
+	badAuth := SHA1Auth([]byte("not the SRK auth"))
+	if _, err := GetSRKPubKey(f, badAuth[:]); err != tpmError(errAuthFail) {
+		t.Fatalf("GetSRKPubKey with the wrong auth returned %v, want %v", err, tpmError(errAuthFail))
+	}
+	if _, err := GetPubKey(f, khEK, wellKnownAuth()); err == nil {
+		t.Fatal("GetPubKey for the EK succeeded, want an error pointing to OwnerReadPubEK")
+	}
+}
+
+func TestGetSRKPubKeyHardware(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	srkAuth := getAuth(srkAuthEnvVar)
+	blob, err := GetSRKPubKey(rwc, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't get the SRK public key:", err)
+	}
+	if _, err := UnmarshalPubRSAPublicKey(blob); err != nil {
+		t.Fatal("Couldn't parse the SRK public key:", err)
+	}
+}
+
+func TestKeyNotLoaded(t *testing.T) {
+	f := testtpm.NewFake()
+	const bogus tpmutil.Handle = 0x01000042
+	for name, run := range map[string]func() error{
+		"Quote": func() error {
+			_, _, err := Quote(f, bogus, []byte("data"), []int{17}, wellKnownAuth())
+			return err
+		},
+		"Quote2": func() error {
+			_, err := Quote2(f, bogus, []byte("data"), []int{17}, false, wellKnownAuth())
+			return err
+		},
+		"Sign": func() error {
+			d := sha1.Sum([]byte("data"))
+			_, err := Sign(f, wellKnownAuth(), bogus, crypto.SHA1, d[:])
+			return err
+		},
+		"GetPubKey": func() error {
+			_, err := GetPubKey(f, bogus, wellKnownAuth())
+			return err
+		},
+	} {
+		err := run()
+		if !errors.Is(err, ErrKeyNotLoaded) || !errors.Is(err, tpmError(errInvalidKeyHandle)) {
+			t.Errorf("%s with a bogus handle returned %v, want %v wrapping %v", name, err, ErrKeyNotLoaded, tpmError(errInvalidKeyHandle))
+			continue
+		}
+		if !strings.Contains(err.Error(), "0x1000042") || !strings.Contains(err.Error(), "LoadKey2") {
+			t.Errorf("%s with a bogus handle returned %q, which doesn't name the handle and LoadKey2", name, err)
+		}
+	}
+}
+
 func TestQuote(t *testing.T) {
 	rwc := openTPMOrSkip(t)
 	defer rwc.Close()
@@ -490,6 +884,93 @@ func TestQuote(t *testing.T) {
 	}
 }
 
+func TestKeyAuthNotWellKnown(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// Create a key whose usage auth differs from the SRK auth, so that using
+	// the wrong one for any of the commands below fails.
+	srkAuth := getAuth(srkAuthEnvVar)
+	keyAuth := SHA1Auth([]byte("not the well-known auth"))
+	blob, err := CreateWrapKey(rwc, srkAuth[:], keyAuth, keyAuth, nil)
+	if err != nil {
+		t.Fatal("Couldn't create a key:", err)
+	}
+	handle, err := LoadKey2(rwc, blob, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the key:", err)
+	}
+	defer CloseKey(rwc, handle)
+	pk, err := UnmarshalRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't extract an RSA key from the key blob:", err)
+	}
+
+	data := []byte("quoted with the key's own auth")
+	pcrNums := []int{17, 18}
+	if _, _, err := Quote(rwc, handle, data, pcrNums, srkAuth[:]); err == nil {
+		t.Fatal("Quote with the SRK auth succeeded, want an auth failure")
+	}
+	q, values, err := Quote(rwc, handle, data, pcrNums, keyAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't quote with the key auth:", err)
+	}
+	if err := VerifyQuote(pk, data, q, pcrNums, values); err != nil {
+		t.Fatal("The quote didn't pass verification:", err)
+	}
+
+	if _, err := Quote2(rwc, handle, data, pcrNums, false, keyAuth[:]); err != nil {
+		t.Fatal("Couldn't Quote2 with the key auth:", err)
+	}
+	if _, err := GetPubKey(rwc, handle, keyAuth[:]); err != nil {
+		t.Fatal("Couldn't get the public key with the key auth:", err)
+	}
+	hashed := sha1.Sum(data)
+	if _, err := Sign(rwc, keyAuth[:], handle, crypto.SHA1, hashed[:]); err != nil {
+		t.Fatal("Couldn't sign with the key auth:", err)
+	}
+}
+
+func TestQuoteExternalData(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// Get the key from aikblob, assuming it exists. Otherwise, skip the test.
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+
+	// Load the AIK for the quote.
+	srkAuth := getAuth(srkAuthEnvVar)
+	handle, err := LoadKey2(rwc, blob, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the AIK into the TPM and get a handle for it:", err)
+	}
+	defer CloseKey(rwc, handle)
+
+	// A verifier-chosen nonce to quote over directly.
+	var nonce Nonce
+	if _, err := rand.Read(nonce[:]); err != nil {
+		t.Fatal("Couldn't generate a nonce:", err)
+	}
+	pcrNums := []int{17, 18}
+	aikAuth := getAuth(aikAuthEnvVar)
+	q, values, err := QuoteExternalData(rwc, handle, nonce, pcrNums, aikAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't quote the nonce:", err)
+	}
+
+	pk, err := UnmarshalRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't extract an RSA key from the AIK blob:", err)
+	}
+
+	if err := VerifyQuoteExternalData(pk, nonce, q, pcrNums, values); err != nil {
+		t.Fatal("The quote didn't pass verification:", err)
+	}
+}
+
 func TestUnmarshalRSAPublicKey(t *testing.T) {
 	// Get the key from aikblob, assuming it exists. Otherwise, skip the test.
 	blob, err := os.ReadFile("./aikblob")
@@ -542,19 +1023,105 @@ func TestMakeIdentity(t *testing.T) {
 	}
 }
 
-func TestResetLockValue(t *testing.T) {
+func TestMakeIdentityWithBinding(t *testing.T) {
 	rwc := openTPMOrSkip(t)
 	defer rwc.Close()
 
-	// This test code assumes that the owner auth is the well-known value.
+	srkAuth := getAuth(srkAuthEnvVar)
 	ownerAuth := getAuth(ownerAuthEnvVar)
-	if err := ResetLockValue(rwc, ownerAuth); err != nil {
-		t.Fatal("Couldn't reset the lock value:", err)
+	aikAuth := getAuth(aikAuthEnvVar)
+
+	ca, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate a privacy CA key:", err)
 	}
-}
+	label := []byte("privacy CA label")
 
-func TestOwnerReadSRK(t *testing.T) {
-	rwc := openTPMOrSkip(t)
+	blob, binding, err := MakeIdentityWithBinding(rwc, srkAuth[:], ownerAuth[:], aikAuth[:], &ca.PublicKey, label)
+	if err != nil {
+		t.Fatal("Couldn't make a new AIK in the TPM:", err)
+	}
+	if err := VerifyIdentityBinding(blob, &ca.PublicKey, label, binding); err != nil {
+		t.Fatal("The identity binding didn't pass verification:", err)
+	}
+}
+
+func TestMakeIdentityWithChosenID(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	srkAuth := getAuth(srkAuthEnvVar)
+	ownerAuth := getAuth(ownerAuthEnvVar)
+	aikAuth := getAuth(aikAuthEnvVar)
+
+	chosenID := Digest(sha1.Sum([]byte("chosen by the privacy CA")))
+	blob, binding, err := MakeIdentityWithChosenID(rwc, srkAuth[:], ownerAuth[:], aikAuth[:], chosenID)
+	if err != nil {
+		t.Fatal("Couldn't make a new AIK in the TPM:", err)
+	}
+	handle, err := LoadKey2(rwc, blob, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the AIK:", err)
+	}
+	defer CloseKey(rwc, handle)
+
+	if err := VerifyIdentityBindingChosenID(blob, chosenID, binding); err != nil {
+		t.Fatal("The identity binding didn't pass verification:", err)
+	}
+	if err := VerifyIdentityBindingChosenID(blob, Digest{}, binding); err == nil {
+		t.Fatal("The identity binding passed verification for another chosen ID")
+	}
+}
+
+func TestResetLockValue(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// This test code assumes that the owner auth is the well-known value.
+	ownerAuth := getAuth(ownerAuthEnvVar)
+	if err := ResetLockValue(rwc, ownerAuth); err != nil {
+		t.Fatal("Couldn't reset the lock value:", err)
+	}
+}
+
+func TestDirRead(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	dir, err := DirRead(rwc, 0)
+	if err == tpmError(errBadIndex) {
+		t.Skip("The TPM has no DIRs; skipping test")
+	}
+	if err != nil {
+		t.Fatal("Couldn't read DIR 0:", err)
+	}
+	t.Logf("Got DIR 0 value % x\n", dir)
+}
+
+func TestDirWriteAuth(t *testing.T) {
+	f := testtpm.NewFake()
+	data := Digest(sha1.Sum([]byte("policy digest")))
+	if err := DirWriteAuth(f, 0, data, WellKnownAuth()); err != nil {
+		t.Fatal("Couldn't write DIR 0:", err)
+	}
+	dir, err := DirRead(f, 0)
+	if err != nil {
+		t.Fatal("Couldn't read DIR 0:", err)
+	}
+	if !bytes.Equal(dir, data[:]) {
+		t.Fatalf("DIR 0 is % x, want % x", dir, data)
+	}
+
+	if err := DirWriteAuth(f, 0, Digest{}, SHA1Auth([]byte("not the owner"))); err != tpmError(errAuthFail) {
+		t.Fatalf("DirWriteAuth with the wrong owner auth returned %v, want %v", err, tpmError(errAuthFail))
+	}
+	if _, err := DirRead(f, 1); err != tpmError(errBadIndex) {
+		t.Fatalf("DirRead of a missing DIR returned %v, want %v", err, tpmError(errBadIndex))
+	}
+}
+
+func TestOwnerReadSRK(t *testing.T) {
+	rwc := openTPMOrSkip(t)
 	defer rwc.Close()
 
 	// This test code assumes that the owner auth is the well-known value.
@@ -629,6 +1196,48 @@ func TestTakeOwnership(t *testing.T) {
 	}
 }
 
+func TestTakeOwnershipReadSRK(t *testing.T) {
+	ek, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an EK:", err)
+	}
+	f := testtpm.NewFake()
+	f.EK = ek
+	f.Unowned = true
+
+	pubEK, err := ReadPubEK(f)
+	if err != nil {
+		t.Fatal("Couldn't read the public EK:", err)
+	}
+	ownerAuth := SHA1Auth([]byte("owner"))
+	srkAuth := SHA1Auth([]byte("srk"))
+	srk, err := TakeOwnershipReadSRK(f, ownerAuth, srkAuth, pubEK)
+	if err != nil {
+		t.Fatal("Couldn't take ownership of the TPM:", err)
+	}
+	if srk.N.BitLen() != 2048 || srk.E != 65537 {
+		t.Fatalf("got a %d-bit SRK with exponent %d, want a 2048-bit key with exponent 65537", srk.N.BitLen(), srk.E)
+	}
+
+	// The SRK has the new SRK auth, and its public key is the one that came
+	// back.
+	blob, err := GetPubKey(f, khSRK, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't read the SRK with the new SRK auth:", err)
+	}
+	pub, err := UnmarshalPubRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't parse the SRK public key:", err)
+	}
+	if !pub.Equal(srk) {
+		t.Fatal("TakeOwnershipReadSRK returned a different key from GetPubKey")
+	}
+
+	if _, err := TakeOwnershipReadSRK(f, ownerAuth, srkAuth, pubEK); err != tpmError(errOwnerSet) {
+		t.Fatalf("taking ownership twice returned %v, want %v", err, tpmError(errOwnerSet))
+	}
+}
+
 func TestForceClear(t *testing.T) {
 	// Only enable this if you know what you're doing.
 	// TPM force clear clears the ownership of the TPM.
@@ -744,3 +1353,1046 @@ func TestKeyMigration(t *testing.T) {
 		t.Errorf("Error decrypting migrated key blob: %v", err)
 	}
 }
+
+func TestKeyMigrationMigrateScheme(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+	ownerAuth := getAuth(ownerAuthEnvVar)
+	srkAuth := getAuth(srkAuthEnvVar)
+	migrationAuth := Digest{}
+	usageAuth := Digest{}
+	rand.Read(migrationAuth[:])
+	rand.Read(usageAuth[:])
+
+	mk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating migration key: %v", err)
+	}
+
+	mb, err := AuthorizeMigrationKeyScheme(rwc, ownerAuth, MSMigrate, mk.Public())
+	if err != nil {
+		t.Fatalf("error authorizing migration key: %v", err)
+	}
+
+	keyblob, privkey, err := CreateMigratableWrapKey(rwc, srkAuth[:], usageAuth, migrationAuth, []int{})
+	if err != nil {
+		t.Fatalf("error creating key: %v", err)
+	}
+
+	random, encPriv, err := CreateMigrationBlobParent(rwc, khSRK, srkAuth[:], migrationAuth, privkey, mb)
+	if err != nil {
+		t.Fatalf("error migrating created key: %v", err)
+	}
+	if len(random) == 0 {
+		t.Error("CreateMigrationBlobParent returned no random value for the MIGRATE scheme")
+	}
+	if _, err := rsa.DecryptOAEP(sha1.New(), nil, mk, encPriv, oaepLabel); err != nil {
+		t.Errorf("error decrypting migrated key blob: %v", err)
+	}
+
+	replaced, err := ReplaceEncData(keyblob, encPriv)
+	if err != nil {
+		t.Fatalf("ReplaceEncData failed: %v", err)
+	}
+	var k key
+	if _, err := tpmutil.Unpack(replaced, &k); err != nil {
+		t.Fatalf("couldn't unpack replaced key blob: %v", err)
+	}
+	if !bytes.Equal(k.EncData, encPriv) {
+		t.Error("ReplaceEncData didn't replace the encrypted private part")
+	}
+}
+
+func TestCreateMigrationBlobFake(t *testing.T) {
+	f := testtpm.NewFake()
+	usageAuth := SHA1Auth([]byte("usage auth"))
+	migrationAuth := SHA1Auth([]byte("migration auth"))
+
+	mk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating migration key: %v", err)
+	}
+	pub, err := convertPubKey(mk.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := tpmutil.Pack(migrationKeyAuth{MigrationKey: *pub, MigrationScheme: MSRewrap})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyblob, encData, err := CreateMigratableWrapKey(f, wellKnownAuth(), usageAuth, migrationAuth, nil)
+	if err != nil {
+		t.Fatal("Couldn't create a migratable key:", err)
+	}
+
+	// The fake, like a real TPM, can only decrypt the key's EncData, not a
+	// whole key blob.
+	if _, err := CreateMigrationBlob(f, WellKnownAuth(), migrationAuth, keyblob, mb); err != tpmError(errDecryptError) {
+		t.Fatalf("CreateMigrationBlob with a whole key blob returned %v, want %v", err, tpmError(errDecryptError))
+	}
+	if _, _, err := CreateMigrationBlobParent(f, khSRK, wellKnownAuth(), migrationAuth, encData, mb); err != nil {
+		t.Fatal("CreateMigrationBlobParent failed:", err)
+	}
+
+	outData, err := CreateMigrationBlob(f, WellKnownAuth(), migrationAuth, encData, mb)
+	if err != nil {
+		t.Fatal("CreateMigrationBlob failed:", err)
+	}
+	if len(outData) != len(pub.Key) {
+		t.Errorf("CreateMigrationBlob returned %d bytes, want %d", len(outData), len(pub.Key))
+	}
+
+	badAuth := SHA1Auth([]byte("not the migration auth"))
+	if _, err := CreateMigrationBlob(f, WellKnownAuth(), badAuth, encData, mb); err != tpmError(errAuth2Fail) {
+		t.Fatalf("CreateMigrationBlob with the wrong migration auth returned %v, want %v", err, tpmError(errAuth2Fail))
+	}
+}
+
+func TestCheckKeySchemes(t *testing.T) {
+	tests := []struct {
+		usage KeyUsage
+		es    EncScheme
+		ss    SigScheme
+		ok    bool
+	}{
+		{KeyUsageSigning, EncSchemeNone, SigSchemeRSASSAPKCS1v15DER, true},
+		{KeyUsageSigning, EncSchemeRSAESOAEPSHA1MGF1, SigSchemeRSASSAPKCS1v15DER, false},
+		{KeyUsageStorage, EncSchemeRSAESOAEPSHA1MGF1, SigSchemeNone, true},
+		{KeyUsageStorage, EncSchemeNone, SigSchemeNone, false},
+		{KeyUsageBind, EncSchemeRSAESOAEPSHA1MGF1, SigSchemeNone, true},
+		{KeyUsageBind, EncSchemeRSAESPKCSv15, SigSchemeNone, true},
+		{KeyUsageBind, EncSchemeNone, SigSchemeNone, false},
+		{KeyUsageBind, EncSchemeRSAESOAEPSHA1MGF1, SigSchemeRSASSAPKCS1v15SHA1, false},
+		{KeyUsageLegacy, EncSchemeRSAESPKCSv15, SigSchemeRSASSAPKCS1v15SHA1, true},
+		{KeyUsage(keyIdentity), EncSchemeNone, SigSchemeRSASSAPKCS1v15SHA1, false},
+	}
+	for _, tt := range tests {
+		err := checkKeySchemes(tt.usage, tt.es, tt.ss)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkKeySchemes(0x%x, 0x%x, 0x%x) returned %v, want ok = %v", tt.usage, tt.es, tt.ss, err, tt.ok)
+		}
+	}
+}
+
+func TestBindOAEP(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	keyBlob := testKeyBlob(t, keyBind, authAlways, &pk.PublicKey)
+
+	data := []byte("some data to bind")
+	want := append([]byte{0x01, 0x01, 0x00, 0x00, ptBind}, data...)
+	for _, h := range []crypto.Hash{crypto.SHA1, crypto.SHA256} {
+		enc, err := BindWithHash(keyBlob, data, h)
+		if err != nil {
+			t.Fatalf("Couldn't bind the data with %v: %v", h, err)
+		}
+		dec, err := rsa.DecryptOAEP(h.New(), nil, pk, enc, oaepLabel)
+		if err != nil {
+			t.Fatalf("Couldn't decrypt the data bound with %v: %v", h, err)
+		}
+		if !bytes.Equal(dec, want) {
+			t.Fatalf("BindWithHash(%v) encrypted % x, want % x", h, dec, want)
+		}
+	}
+
+	// Bind is BindWithHash with SHA-1, which the TPM needs.
+	enc, err := Bind(keyBlob, data)
+	if err != nil {
+		t.Fatal("Couldn't bind the data:", err)
+	}
+	if _, err := rsa.DecryptOAEP(sha1.New(), nil, pk, enc, oaepLabel); err != nil {
+		t.Fatal("Couldn't decrypt the bound data with SHA-1:", err)
+	}
+	if _, err := BindWithHash(keyBlob, data, crypto.MD5); err == nil {
+		t.Fatal("BindWithHash accepted MD5 as the OAEP hash")
+	}
+}
+
+func TestBindUnBind(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+	srkAuth := getAuth(srkAuthEnvVar)
+	usageAuth := SHA1Auth([]byte("bind key auth"))
+
+	keyBlob, err := CreateWrapKeyWithSchemes(rwc, srkAuth[:], KeyUsageBind, EncSchemeRSAESOAEPSHA1MGF1, SigSchemeNone, usageAuth, WellKnownAuth(), nil)
+	if err != nil {
+		t.Fatal("Couldn't create a binding key:", err)
+	}
+	lk, err := LoadKey(rwc, keyBlob, srkAuth[:], usageAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the binding key:", err)
+	}
+	defer lk.Close(rwc)
+
+	data := []byte("some data to bind")
+	enc, err := Bind(keyBlob, data)
+	if err != nil {
+		t.Fatal("Couldn't bind the data:", err)
+	}
+	dec, err := lk.UnBind(rwc, enc)
+	if err != nil {
+		t.Fatal("Couldn't unbind the data:", err)
+	}
+	if !bytes.Equal(dec, data) {
+		t.Fatalf("UnBind returned %q, want %q", dec, data)
+	}
+}
+
+// noTPM is an io.ReadWriter that fails the test if any command is sent.
+type noTPM struct{ t *testing.T }
+
+func (n noTPM) Write(p []byte) (int, error) {
+	n.t.Fatalf("unexpected command sent to the TPM: % x", p)
+	return 0, nil
+}
+
+func (n noTPM) Read(p []byte) (int, error) {
+	n.t.Fatal("unexpected read from the TPM")
+	return 0, nil
+}
+
+func TestOpenOSAPSessionMismatchedEntity(t *testing.T) {
+	tests := []struct {
+		et EntityType
+		h  tpmutil.Handle
+	}{
+		{EntitySRK, khOwner},
+		{EntitySRK, 0x01000000},
+		{EntityOwner, khSRK},
+		{EntityKeyHandle, khOwner},
+		{EntityKeyHandle, khEK},
+		{EntityType(etData), 0x01000000},
+	}
+	for _, tt := range tests {
+		if _, err := OpenOSAPSession(noTPM{t}, tt.et, tt.h, wellKnownAuth()); err == nil {
+			t.Errorf("OpenOSAPSession(0x%x, 0x%x) succeeded, want an error", tt.et, tt.h)
+		}
+	}
+}
+
+func TestOpenOSAPSession(t *testing.T) {
+	f := testtpm.NewFake()
+	for _, tt := range []struct {
+		et EntityType
+		h  tpmutil.Handle
+	}{
+		{EntitySRK, khSRK},
+		{EntityKeyHandle, khSRK},
+		{EntityOwner, khOwner},
+	} {
+		s, err := OpenOSAPSession(f, tt.et, tt.h, wellKnownAuth())
+		if err != nil {
+			t.Fatalf("OpenOSAPSession(0x%x, 0x%x) failed: %v", tt.et, tt.h, err)
+		}
+		if s.SharedSecret == (Digest{}) {
+			t.Errorf("OpenOSAPSession(0x%x, 0x%x) returned an empty shared secret", tt.et, tt.h)
+		}
+		if err := s.Close(f); err != nil {
+			t.Errorf("Couldn't close the session: %v", err)
+		}
+		if s.SharedSecret != (Digest{}) {
+			t.Error("Close didn't zero the shared secret")
+		}
+	}
+}
+
+func TestOSAPSessionNonceRollover(t *testing.T) {
+	f := testtpm.NewFake()
+	s, err := OpenOSAPSession(f, EntitySRK, khSRK, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+	defer s.Close(f)
+
+	// Each command must use the NonceEven from the previous response; with
+	// the nonce from the OSAP response, the second command would fail.
+	nonces := map[Nonce]bool{s.NonceEven: true}
+	for i := 0; i < 4; i++ {
+		data := []byte{byte(i)}
+		sealed, err := s.Seal(f, LocZero, nil, data, wellKnownAuth())
+		if err != nil {
+			t.Fatalf("Seal %d in the continued session failed: %v", i, err)
+		}
+		if nonces[s.NonceEven] {
+			t.Fatalf("Seal %d didn't roll the session over to a new NonceEven", i)
+		}
+		nonces[s.NonceEven] = true
+
+		unsealed, err := Unseal(f, sealed, wellKnownAuth())
+		if err != nil {
+			t.Fatalf("Couldn't unseal the data from Seal %d: %v", i, err)
+		}
+		if !bytes.Equal(unsealed, data) {
+			t.Fatalf("Unseal returned % x, want % x", unsealed, data)
+		}
+	}
+}
+
+func TestCanUnseal(t *testing.T) {
+	f := testtpm.NewFake()
+	data := []byte("sealed to PCR 17")
+	sealed, err := Seal(f, LocZero, []int{17}, data, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't seal the data:", err)
+	}
+	ok, err := CanUnseal(f, sealed)
+	if err != nil {
+		t.Fatal("CanUnseal failed:", err)
+	}
+	if !ok {
+		t.Fatal("CanUnseal returned false before the PCR changed")
+	}
+
+	if _, err := PcrExtend(f, 17, PCRValue(sha1.Sum([]byte("17")))); err != nil {
+		t.Fatal("Couldn't extend PCR 17:", err)
+	}
+	ok, err = CanUnseal(f, sealed)
+	if err != nil {
+		t.Fatal("CanUnseal failed:", err)
+	}
+	if ok {
+		t.Fatal("CanUnseal returned true after the PCR changed")
+	}
+	if _, err := Unseal(f, sealed, wellKnownAuth()); err != tpmError(errWrongPCRVal) {
+		t.Fatalf("Unseal after the PCR changed returned %v, want %v", err, tpmError(errWrongPCRVal))
+	}
+
+	unbound, err := Seal(f, LocZero, nil, data, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't seal the data without PCRs:", err)
+	}
+	if ok, err := CanUnseal(f, unbound); err != nil || !ok {
+		t.Fatalf("CanUnseal for data not bound to PCRs returned (%t, %v), want (true, <nil>)", ok, err)
+	}
+
+	if _, err := CanUnseal(f, []byte{0x01}); err == nil {
+		t.Fatal("CanUnseal incorrectly accepted a truncated blob")
+	}
+}
+
+func TestSealToFutureState(t *testing.T) {
+	f := testtpm.NewFake()
+	current, err := ReadPCR(f, 17)
+	if err != nil {
+		t.Fatal("Couldn't read PCR 17:", err)
+	}
+	// Work out offline the value that PCR 17 will hold after the next
+	// measurement.
+	measurement := sha1.Sum([]byte("upgraded boot loader"))
+	future := sha1.Sum(append(current, measurement[:]...))
+
+	data := []byte("sealed to the future")
+	sealed, err := SealToFutureState(f, LocZero, []int{17}, [][]byte{future[:]}, data, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't seal to the future PCR state:", err)
+	}
+
+	var tsd tpmStoredData
+	if _, err := tpmutil.Unpack(sealed, &tsd); err != nil {
+		t.Fatal("Couldn't unpack the sealed data:", err)
+	}
+	var pcrInfo pcrInfoLong
+	if _, err := tpmutil.Unpack(tsd.Info, &pcrInfo); err != nil {
+		t.Fatal("Couldn't unpack the PCR info of the sealed data:", err)
+	}
+	mask, err := verify.NewPCRMask([]int{17})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := createPCRComposite(mask, future[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pcrInfo.DigestAtRelease[:], want) {
+		t.Fatalf("DigestAtRelease is % x, want % x", pcrInfo.DigestAtRelease, want)
+	}
+	if pcrInfo.PCRsAtCreation.Mask != (pcrMask{}) {
+		t.Fatalf("PCRsAtCreation is %v, want no PCRs", pcrInfo.PCRsAtCreation)
+	}
+
+	if _, err := Unseal(f, sealed, wellKnownAuth()); err != tpmError(errWrongPCRVal) {
+		t.Fatalf("Unseal before the PCR reached the future state returned %v, want %v", err, tpmError(errWrongPCRVal))
+	}
+	if _, err := PcrExtend(f, 17, measurement); err != nil {
+		t.Fatal("Couldn't extend PCR 17:", err)
+	}
+	got, err := Unseal(f, sealed, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't unseal once the PCR reached the future state:", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Unsealed %q, want %q", got, data)
+	}
+
+	if _, err := SealToFutureState(f, LocZero, []int{17, 18}, [][]byte{future[:]}, data, wellKnownAuth()); err == nil {
+		t.Fatal("SealToFutureState accepted fewer values than PCRs")
+	}
+	if _, err := SealToFutureState(f, LocZero, []int{17}, [][]byte{future[:10]}, data, wellKnownAuth()); err == nil {
+		t.Fatal("SealToFutureState accepted a short PCR value")
+	}
+	if _, err := SealToFutureState(f, LocZero, []int{17, 17}, [][]byte{future[:], future[:]}, data, wellKnownAuth()); err == nil {
+		t.Fatal("SealToFutureState accepted a repeated PCR")
+	}
+}
+
+func TestUnsealWith(t *testing.T) {
+	f := testtpm.NewFake()
+	var blobs [][]byte
+	for i := 0; i < 3; i++ {
+		sealed, err := Seal(f, LocZero, []int{17}, []byte{byte(i)}, wellKnownAuth())
+		if err != nil {
+			t.Fatalf("Couldn't seal blob %d: %v", i, err)
+		}
+		blobs = append(blobs, sealed)
+	}
+
+	s, err := OpenOIAPSession(f)
+	if err != nil {
+		t.Fatal("Couldn't open an OIAP session:", err)
+	}
+	handle := s.Handle
+
+	// Each unseal must use the NonceEven from the previous response; with
+	// the nonce from the OIAP response, the second unseal would fail.
+	nonces := map[Nonce]bool{s.NonceEven: true}
+	for i, sealed := range blobs {
+		unsealed, err := UnsealWith(f, s, sealed, wellKnownAuth())
+		if err != nil {
+			t.Fatalf("Unseal %d in the reused OIAP session failed: %v", i, err)
+		}
+		if !bytes.Equal(unsealed, []byte{byte(i)}) {
+			t.Fatalf("Unseal %d returned % x, want % x", i, unsealed, []byte{byte(i)})
+		}
+		if s.Handle != handle {
+			t.Fatalf("Unseal %d changed the session handle from 0x%x to 0x%x", i, handle, s.Handle)
+		}
+		if nonces[s.NonceEven] {
+			t.Fatalf("Unseal %d didn't roll the session over to a new NonceEven", i)
+		}
+		nonces[s.NonceEven] = true
+	}
+
+	// The session must still be open on the TPM.
+	if err := s.Close(f); err != nil {
+		t.Fatal("Couldn't close the OIAP session:", err)
+	}
+	if _, err := UnsealWith(f, s, blobs[0], wellKnownAuth()); err == nil {
+		t.Fatal("UnsealWith incorrectly succeeded in a closed session")
+	}
+}
+
+func TestOSAPSessionClosedByTPM(t *testing.T) {
+	f := testtpm.NewFake()
+	s, err := OpenOSAPSession(f, EntitySRK, khSRK, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+
+	// Simulate a response that closes the session although the command asked
+	// to keep it open. The response auth has the same form as a command auth.
+	ca, err := s.newCommandAuth([]interface{}{OrdSeal}, true)
+	if err != nil {
+		t.Fatal("Couldn't compute the command auth:", err)
+	}
+	raIn := []interface{}{uint32(0), OrdSeal}
+	resp, err := newContinuedCommandAuth(s.Handle, Nonce{1}, &ca.NonceOdd, false, s.SharedSecret[:], raIn)
+	if err != nil {
+		t.Fatal("Couldn't compute the response auth:", err)
+	}
+	ra := &responseAuth{NonceEven: Nonce{1}, ContSession: resp.ContSession, Auth: resp.Auth}
+	if err := s.verify(ca, ra, raIn); err != nil {
+		t.Fatal("Couldn't verify the response auth:", err)
+	}
+	if !s.closed || !s.tpmClosed {
+		t.Fatal("The session wasn't flagged as closed by the TPM")
+	}
+
+	_, err = s.Seal(f, LocZero, nil, []byte("data"), wellKnownAuth())
+	if err == nil || !strings.Contains(err.Error(), "the TPM closed the OSAP session") {
+		t.Fatalf("Seal in a session closed by the TPM returned %v, want an error saying the TPM closed it", err)
+	}
+	if _, err := s.Export(); err == nil {
+		t.Fatal("Export incorrectly succeeded for a session closed by the TPM")
+	}
+	// The session is still open in the fake, which didn't send the response,
+	// but Close must not try to flush a session that the TPM closed.
+	if err := s.Close(f); err != nil {
+		t.Fatal("Close of a session closed by the TPM failed:", err)
+	}
+}
+
+func TestOSAPSessionStaleNonce(t *testing.T) {
+	f := testtpm.NewFake()
+	s, err := OpenOSAPSession(f, EntitySRK, khSRK, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+	stale := *s
+	if _, err := s.Seal(f, LocZero, nil, []byte("first"), wellKnownAuth()); err != nil {
+		t.Fatal("Seal in the session failed:", err)
+	}
+	// The stale copy hasn't verified a response, so its auth failure is also
+	// reported as a possible wrong entity.
+	if _, err := stale.Seal(f, LocZero, nil, []byte("second"), wellKnownAuth()); !errors.Is(err, tpmError(errAuthFail)) {
+		t.Fatalf("Seal with a stale NonceEven returned %v, want %v", err, tpmError(errAuthFail))
+	}
+}
+
+func TestExportImportOSAPSession(t *testing.T) {
+	f := testtpm.NewFake()
+	s, err := OpenOSAPSession(f, EntitySRK, khSRK, wellKnownAuth())
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+	b, err := s.Export()
+	if err != nil {
+		t.Fatal("Couldn't export the session:", err)
+	}
+	zeroBytes(s.SharedSecret[:])
+
+	imported, err := ImportOSAPSession(b)
+	if err != nil {
+		t.Fatal("Couldn't import the session:", err)
+	}
+	zeroBytes(b)
+	defer imported.Close(f)
+	if imported.Handle != s.Handle || imported.NonceEven != s.NonceEven {
+		t.Fatalf("ImportOSAPSession returned handle 0x%x and NonceEven % x, want 0x%x and % x", imported.Handle, imported.NonceEven, s.Handle, s.NonceEven)
+	}
+
+	// The imported session must be usable for further commands.
+	data := []byte("imported")
+	for i := 0; i < 2; i++ {
+		sealed, err := imported.Seal(f, LocZero, nil, data, wellKnownAuth())
+		if err != nil {
+			t.Fatalf("Seal %d in the imported session failed: %v", i, err)
+		}
+		unsealed, err := Unseal(f, sealed, wellKnownAuth())
+		if err != nil {
+			t.Fatalf("Couldn't unseal the data from Seal %d: %v", i, err)
+		}
+		if !bytes.Equal(unsealed, data) {
+			t.Fatalf("Unseal returned % x, want % x", unsealed, data)
+		}
+	}
+}
+
+func TestImportOSAPSessionErrors(t *testing.T) {
+	s := &OSAPSession{Handle: 0x02000000, entity: khSRK}
+	b, err := s.Export()
+	if err != nil {
+		t.Fatal("Couldn't export the session:", err)
+	}
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"truncated", b[:len(b)-1]},
+		{"trailing bytes", append(append([]byte(nil), b...), 0)},
+		{"bad version", append([]byte{0, 2}, b[2:]...)},
+	} {
+		if _, err := ImportOSAPSession(tt.b); err == nil {
+			t.Errorf("ImportOSAPSession(%s) succeeded, want an error", tt.name)
+		}
+	}
+
+	s.closed = true
+	if _, err := s.Export(); err == nil {
+		t.Error("Export of a closed session succeeded, want an error")
+	}
+}
+
+func TestQuoteBundled(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// Get the key from aikblob, assuming it exists. Otherwise, skip the test.
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+
+	srkAuth := getAuth(srkAuthEnvVar)
+	handle, err := LoadKey2(rwc, blob, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the AIK into the TPM and get a handle for it:", err)
+	}
+	defer CloseKey(rwc, handle)
+
+	var nonce Nonce
+	if _, err := rand.Read(nonce[:]); err != nil {
+		t.Fatal("Couldn't generate a nonce:", err)
+	}
+	aikAuth := getAuth(aikAuthEnvVar)
+	b, err := QuoteBundled(rwc, handle, nonce, []int{18, 17}, aikAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't quote the nonce:", err)
+	}
+
+	pk, err := UnmarshalRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't extract an RSA key from the AIK blob:", err)
+	}
+	if err := b.Verify(pk); err != nil {
+		t.Fatal("The quote bundle didn't pass verification:", err)
+	}
+}
+
+func TestQuoteMulti(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	// Get the key from aikblob, assuming it exists. Otherwise, skip the test.
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+
+	srkAuth := getAuth(srkAuthEnvVar)
+	handle, err := LoadKey2(rwc, blob, srkAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the AIK into the TPM and get a handle for it:", err)
+	}
+	defer CloseKey(rwc, handle)
+
+	var nonce Nonce
+	if _, err := rand.Read(nonce[:]); err != nil {
+		t.Fatal("Couldn't generate a nonce:", err)
+	}
+	aikAuth := getAuth(aikAuthEnvVar)
+	bundles, err := QuoteMulti(rwc, handle, nonce, [][]int{{17}, {18}}, aikAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't quote the PCR sets:", err)
+	}
+	if len(bundles) != 2 {
+		t.Fatalf("QuoteMulti returned %d bundles for 2 PCR sets", len(bundles))
+	}
+
+	pk, err := UnmarshalRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't extract an RSA key from the AIK blob:", err)
+	}
+	for i, want := range []int{17, 18} {
+		if len(bundles[i].PCRs) != 1 || bundles[i].PCRs[0] != want {
+			t.Errorf("bundle %d covers PCRs %v, want [%d]", i, bundles[i].PCRs, want)
+		}
+		if err := bundles[i].Verify(pk); err != nil {
+			t.Errorf("bundle %d didn't pass verification: %v", i, err)
+		}
+	}
+}
+
+func TestQuoteMultiBadPCRs(t *testing.T) {
+	if _, err := QuoteMulti(noTPM{t}, 0x01000001, Nonce{}, [][]int{{17}, {24}}, nil); err == nil {
+		t.Fatal("QuoteMulti accepted an out-of-range PCR")
+	}
+}
+
+func TestParseDAInfo(t *testing.T) {
+	full, err := tpmutil.Pack(tagDAInfo, byte(1), uint16(3), uint16(10), uint16(0x0039), uint32(0x04), uint32(600), tpmutil.U32Bytes{0xAA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseDAInfo(full)
+	if err != nil {
+		t.Fatal("Couldn't parse TPM_DA_INFO:", err)
+	}
+	want := DAInfo{Active: true, CurrentCount: 3, ThresholdCount: 10, ActionAtThreshold: 0x04, ActionDependValue: 600, VendorData: []byte{0xAA}}
+	if info.Limited != want.Limited || info.Active != want.Active || info.CurrentCount != want.CurrentCount || info.ThresholdCount != want.ThresholdCount || info.ActionAtThreshold != want.ActionAtThreshold || info.ActionDependValue != want.ActionDependValue || !bytes.Equal(info.VendorData, want.VendorData) {
+		t.Fatalf("parseDAInfo returned %+v, want %+v", info, want)
+	}
+
+	limited, err := tpmutil.Pack(tagDAInfoLimited, byte(0), uint16(0x0039), uint32(0x04), tpmutil.U32Bytes{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = parseDAInfo(limited)
+	if err != nil {
+		t.Fatal("Couldn't parse TPM_DA_INFO_LIMITED:", err)
+	}
+	if !info.Limited || info.Active || info.ActionAtThreshold != 0x04 {
+		t.Fatalf("parseDAInfo returned %+v for TPM_DA_INFO_LIMITED", info)
+	}
+
+	if _, err := parseDAInfo([]byte{0x00, 0x18}); err == nil {
+		t.Fatal("parseDAInfo accepted a structure with the wrong tag")
+	}
+}
+
+func TestGetDAInfo(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	info, err := GetDAInfo(rwc, EntityOwner)
+	if err != nil {
+		t.Fatal("Couldn't get the dictionary-attack info:", err)
+	}
+	t.Logf("dictionary-attack info: %+v", info)
+}
+
+func TestGetResourceCounts(t *testing.T) {
+	f := testtpm.NewFake()
+	f.MaxKeys = 4
+	f.MaxSessions = 3
+	keyBlob := testKeyBlob(t, keySigning, authAlways, nil)
+	if _, err := LoadKey2(f, keyBlob, wellKnownAuth()); err != nil {
+		t.Fatal("Couldn't load the key:", err)
+	}
+	if _, err := oiap(f); err != nil {
+		t.Fatal("Couldn't open an OIAP session:", err)
+	}
+
+	// The fake only reports the maximum number of transport sessions, so
+	// that count comes from the fallback.
+	keySlots, authSessions, transSessions, err := GetResourceCounts(f)
+	if err != nil {
+		t.Fatal("Couldn't get the resource counts:", err)
+	}
+	if keySlots != 3 || authSessions != 2 || transSessions != 0 {
+		t.Fatalf("GetResourceCounts returned (%d, %d, %d), want (3, 2, 0)", keySlots, authSessions, transSessions)
+	}
+}
+
+func TestGetSavedContextSlots(t *testing.T) {
+	f := testtpm.NewFake()
+	if _, _, err := GetSavedContextSlots(f); err != tpmError(errBadMode) {
+		t.Fatalf("GetSavedContextSlots on a TPM that doesn't report them returned %v, want %v", err, tpmError(errBadMode))
+	}
+
+	f.MaxSavedContexts = 8
+	free, max, err := GetSavedContextSlots(f)
+	if err != nil {
+		t.Fatal("Couldn't get the saved context slots:", err)
+	}
+	if free != 8 || max != 8 {
+		t.Fatalf("GetSavedContextSlots returned (%d, %d), want (8, 8)", free, max)
+	}
+}
+
+func TestDetectVersion(t *testing.T) {
+	f := testtpm.NewFake()
+	major, minor, _, _, err := DetectVersion(f)
+	if err != nil {
+		t.Fatal("Couldn't detect the version of a TPM 1.2:", err)
+	}
+	if major != 1 || minor != 2 {
+		t.Fatalf("DetectVersion on a TPM 1.2 returned version %d.%d", major, minor)
+	}
+
+	f.Version11 = true
+	major, minor, _, _, err = DetectVersion(f)
+	if err != nil {
+		t.Fatal("Couldn't detect the version of a TPM 1.1b:", err)
+	}
+	if major != 1 || minor != 1 {
+		t.Fatalf("DetectVersion on a TPM 1.1b returned version %d.%d", major, minor)
+	}
+}
+
+func TestKeyRequiresAuth(t *testing.T) {
+	f := testtpm.NewFake()
+	for _, tt := range []struct {
+		usage byte
+		want  bool
+	}{
+		{authAlways, true},
+		{authNever, false},
+	} {
+		keyBlob := testKeyBlob(t, keySigning, tt.usage, nil)
+		lk, err := LoadKey(f, keyBlob, wellKnownAuth(), nil)
+		if err != nil {
+			t.Fatal("Couldn't load the key:", err)
+		}
+		if got := lk.UsesAuth(); got != tt.want {
+			t.Errorf("UsesAuth of a key with auth data usage %v returned %t, want %t", AuthDataUsage(tt.usage), got, tt.want)
+		}
+		got, err := KeyRequiresAuth(f, lk.Handle)
+		if err != nil {
+			t.Fatal("KeyRequiresAuth failed:", err)
+		}
+		if got != tt.want {
+			t.Errorf("KeyRequiresAuth of a key with auth data usage %v returned %t, want %t", AuthDataUsage(tt.usage), got, tt.want)
+		}
+		if err := lk.Close(f); err != nil {
+			t.Fatal("Couldn't flush the key:", err)
+		}
+		if _, err := KeyRequiresAuth(f, lk.Handle); !errors.Is(err, ErrKeyNotLoaded) {
+			t.Fatalf("KeyRequiresAuth of a flushed key returned %v, want %v", err, ErrKeyNotLoaded)
+		}
+	}
+}
+
+func TestCreateMigratableWrapKeyAuths(t *testing.T) {
+	f := testtpm.NewFake()
+	usageAuth := SHA1Auth([]byte("usage auth"))
+	migrationAuth := SHA1Auth([]byte("migration auth"))
+	keyBlob, _, err := CreateMigratableWrapKey(f, wellKnownAuth(), usageAuth, migrationAuth, nil)
+	if err != nil {
+		t.Fatal("Couldn't create a migratable key:", err)
+	}
+	kd, err := InspectKeyBlob(keyBlob)
+	if err != nil {
+		t.Fatal("Couldn't inspect the key blob:", err)
+	}
+	if !kd.Migratable {
+		t.Fatal("CreateMigratableWrapKey created a non-migratable key")
+	}
+
+	lk, err := LoadKey(f, keyBlob, wellKnownAuth(), usageAuth[:])
+	if err != nil {
+		t.Fatal("Couldn't load the migratable key:", err)
+	}
+	defer lk.Close(f)
+	gotUsage, gotMigration, ok := f.KeyAuths(lk.Handle)
+	if !ok {
+		t.Fatal("The fake doesn't know the auth values of the key")
+	}
+	if gotUsage != usageAuth || gotMigration != migrationAuth {
+		t.Fatalf("the TPM decrypted usage auth %x and migration auth %x, want %x and %x", gotUsage, gotMigration, usageAuth, migrationAuth)
+	}
+}
+
+func TestAuthPadZeroed(t *testing.T) {
+	secret := Digest(sha1.Sum([]byte("shared secret")))
+	nonce := Nonce(sha1.Sum([]byte("nonce even")))
+	auth := SHA1Auth([]byte("new auth"))
+
+	var p authPad
+	encAuth, err := p.encrypt(secret, nonce, auth[:])
+	if err != nil {
+		t.Fatal("Couldn't encrypt the auth value:", err)
+	}
+	pad := sha1.Sum(append(secret[:], nonce[:]...))
+	for i := range encAuth {
+		if encAuth[i]^pad[i] != auth[i] {
+			t.Fatalf("encAuth is % x, want % x XOR % x", encAuth, auth, pad)
+		}
+	}
+	if len(p.xorData) == 0 {
+		t.Fatal("encrypt didn't record the XOR input")
+	}
+	if !bytes.Equal(p.xorData, make([]byte, len(p.xorData))) || p.pad != (Digest{}) {
+		t.Fatalf("encrypt left the intermediates % x and % x unzeroed", p.xorData, p.pad)
+	}
+
+	if _, err := p.encrypt(secret, nonce, auth[:10]); err == nil {
+		t.Fatal("encrypt accepted a short auth value")
+	}
+}
+
+func TestEncryptAuth(t *testing.T) {
+	var secret Digest
+	copy(secret[:], bytes.Repeat([]byte{0x01}, len(secret)))
+	auth := bytes.Repeat([]byte{0x03}, len(secret))
+	for _, tc := range []struct {
+		nonce byte
+		want  string
+	}{
+		{0x02, "b16b46953f2816c8392c94b98d855f5389b15598"},
+		{0x04, "eafb538504e3bb853d0aae692ba7d087211e6231"},
+	} {
+		var nonce Nonce
+		copy(nonce[:], bytes.Repeat([]byte{tc.nonce}, len(nonce)))
+		got, err := encryptAuth(secret, nonce, auth)
+		if err != nil {
+			t.Fatal("Couldn't encrypt the auth value:", err)
+		}
+		if h := hex.EncodeToString(got[:]); h != tc.want {
+			t.Errorf("encryptAuth with nonce %#02x = %s, want %s", tc.nonce, h, tc.want)
+		}
+	}
+}
+
+func TestPhysicalPresenceFlags(t *testing.T) {
+	f := testtpm.NewFake()
+	if err := physicalPresence(f, ppCMDEnable); err != nil {
+		t.Fatal("Couldn't enable command physical presence:", err)
+	}
+	hwEnable, cmdEnable, lifetimeLock, err := GetPhysicalPresenceFlags(f)
+	if err != nil {
+		t.Fatal("Couldn't get the physical presence flags:", err)
+	}
+	if hwEnable || !cmdEnable || lifetimeLock {
+		t.Fatalf("GetPhysicalPresenceFlags returned (%t, %t, %t), want (false, true, false)", hwEnable, cmdEnable, lifetimeLock)
+	}
+
+	if err := SetPhysicalPresenceLifetimeLock(f); err != nil {
+		t.Fatal("Couldn't set the physical presence lifetime lock:", err)
+	}
+	if _, _, lifetimeLock, err := GetPhysicalPresenceFlags(f); err != nil || !lifetimeLock {
+		t.Fatalf("GetPhysicalPresenceFlags returned lifetimeLock %t and error %v after the lock, want true and <nil>", lifetimeLock, err)
+	}
+	if err := physicalPresence(f, ppCMDDisable); err != tpmError(errBadParameter) {
+		t.Fatalf("Disabling command physical presence after the lock returned %v, want %v", err, tpmError(errBadParameter))
+	}
+}
+
+func TestReady(t *testing.T) {
+	f := testtpm.NewFake()
+	if err := Ready(f); err != nil {
+		t.Fatal("Ready failed for a working TPM:", err)
+	}
+
+	f.Deactivated = true
+	if err := Ready(f); err != ErrDeactivated {
+		t.Fatalf("Ready for a deactivated TPM returned %v, want %v", err, ErrDeactivated)
+	}
+
+	f.Deactivated = false
+	f.DoingSelfTest = true
+	if err := Ready(f); !errors.Is(err, ErrSelfTest) {
+		t.Fatalf("Ready for a TPM doing its self-test returned %v, want %v", err, ErrSelfTest)
+	}
+}
+
+func TestSetTempDeactivated(t *testing.T) {
+	f := testtpm.NewFake()
+	data := []byte("sealed while active")
+	if err := SetTempDeactivated(f); err != tpmError(errBadPresence) {
+		t.Fatalf("SetTempDeactivated without physical presence returned %v, want %v", err, tpmError(errBadPresence))
+	}
+
+	if err := physicalPresence(f, ppCMDEnable); err != nil {
+		t.Fatal("Couldn't enable command physical presence:", err)
+	}
+	if err := physicalPresence(f, ppPresent); err != nil {
+		t.Fatal("Couldn't assert physical presence:", err)
+	}
+	if err := SetTempDeactivated(f); err != nil {
+		t.Fatal("SetTempDeactivated failed:", err)
+	}
+	_, err := Seal(f, LocZero, []int{17}, data, wellKnownAuth())
+	if err != tpmError(errDeactivated) {
+		t.Fatalf("Seal on a deactivated TPM returned %v, want %v", err, tpmError(errDeactivated))
+	}
+	if !errors.Is(err, ErrDeactivated) {
+		t.Fatalf("errors.Is(%v, ErrDeactivated) = false, want true", err)
+	}
+	if err := Ready(f); err != ErrDeactivated {
+		t.Fatalf("Ready on a deactivated TPM returned %v, want %v", err, ErrDeactivated)
+	}
+
+	// A reboot reactivates the TPM.
+	if err := startup(f); err != nil {
+		t.Fatal("Couldn't start the TPM up again:", err)
+	}
+	if _, err := Seal(f, LocZero, []int{17}, data, wellKnownAuth()); err != nil {
+		t.Fatal("Seal failed after a reboot:", err)
+	}
+
+	operatorAuth := Digest(sha1.Sum([]byte("operator")))
+	if err := SetTempDeactivatedWithOperatorAuth(f, operatorAuth); err != tpmError(errNoOperator) {
+		t.Fatalf("SetTempDeactivatedWithOperatorAuth without an operator auth value returned %v, want %v", err, tpmError(errNoOperator))
+	}
+	f.OperatorAuth = operatorAuth[:]
+	if err := SetTempDeactivatedWithOperatorAuth(f, Digest{}); err != tpmError(errAuthFail) {
+		t.Fatalf("SetTempDeactivatedWithOperatorAuth with the wrong auth returned %v, want %v", err, tpmError(errAuthFail))
+	}
+	if err := SetTempDeactivatedWithOperatorAuth(f, operatorAuth); err != nil {
+		t.Fatal("SetTempDeactivatedWithOperatorAuth failed:", err)
+	}
+	if _, err := Seal(f, LocZero, []int{17}, data, wellKnownAuth()); !errors.Is(err, ErrDeactivated) {
+		t.Fatalf("Seal on a deactivated TPM returned %v, want %v", err, ErrDeactivated)
+	}
+}
+
+func TestOwnerSetDisable(t *testing.T) {
+	f := testtpm.NewFake()
+	ownerAuth := Digest(sha1.Sum([]byte("owner")))
+	f.OwnerAuth = ownerAuth
+
+	if err := OwnerSetDisable(f, true, Digest{}); err != tpmError(errAuthFail) {
+		t.Fatalf("OwnerSetDisable with the wrong owner auth returned %v, want %v", err, tpmError(errAuthFail))
+	}
+	if err := OwnerSetDisable(f, true, ownerAuth); err != nil {
+		t.Fatal("Couldn't disable the TPM:", err)
+	}
+	if _, err := GetRandom(f, 16); err != tpmError(errDisabled) || !errors.Is(err, ErrDisabled) {
+		t.Fatalf("GetRandom on a disabled TPM returned %v, want %v", err, tpmError(errDisabled))
+	}
+	if err := Ready(f); !errors.Is(err, ErrDisabled) {
+		t.Fatalf("Ready on a disabled TPM returned %v, want %v", err, ErrDisabled)
+	}
+
+	if err := OwnerSetDisable(f, false, ownerAuth); err != nil {
+		t.Fatal("Couldn't enable the TPM:", err)
+	}
+	if _, err := GetRandom(f, 16); err != nil {
+		t.Fatal("GetRandom failed on a TPM that was enabled again:", err)
+	}
+	flags, err := GetPermanentFlags(f)
+	if err != nil {
+		t.Fatal("Couldn't read the permanent flags:", err)
+	}
+	if flags.Disable {
+		t.Fatal("The disable flag is still set after OwnerSetDisable(false)")
+	}
+}
+
+func TestReadyHardware(t *testing.T) {
+	rwc := openTPMOrSkip(t)
+	defer rwc.Close()
+
+	if err := Ready(rwc); err != nil {
+		t.Fatal("Ready failed:", err)
+	}
+}
+
+// osapTamperer is a fake TPM that flips a bit of the EvenOSAP in every OSAP
+// response, as a transport that binds sessions to the wrong entity might.
+type osapTamperer struct {
+	*testtpm.Fake
+	osap bool
+}
+
+func (o *osapTamperer) Write(p []byte) (int, error) {
+	o.osap = len(p) >= commandHeaderSize && Ordinal(binary.BigEndian.Uint32(p[6:])) == OrdOSAP
+	return o.Fake.Write(p)
+}
+
+func (o *osapTamperer) Read(p []byte) (int, error) {
+	n, err := o.Fake.Read(p)
+	// The EvenOSAP follows the auth handle and the NonceEven.
+	if off := commandHeaderSize + 4 + 20; o.osap && err == nil && n > off {
+		p[off] ^= 1
+	}
+	return n, err
+}
+
+func TestOSAPSessionWrongEntity(t *testing.T) {
+	srkAuth := make([]byte, 20)
+	rw := &osapTamperer{Fake: testtpm.NewFake()}
+	s, err := OpenOSAPSession(rw, EntitySRK, khSRK, srkAuth)
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+	defer s.Close(rw)
+
+	_, err = s.Seal(rw, LocZero, []int{17}, []byte("secret"), srkAuth)
+	if !errors.Is(err, ErrOSAPEntity) {
+		t.Fatalf("Seal in a tampered session returned %v, want %v", err, ErrOSAPEntity)
+	}
+	if !errors.Is(err, tpmError(errAuthFail)) {
+		t.Fatalf("Seal in a tampered session returned %v, want it to wrap %v", err, tpmError(errAuthFail))
+	}
+
+	// An untampered session seals, and later auth failures aren't blamed on
+	// the entity.
+	f := testtpm.NewFake()
+	s, err = OpenOSAPSession(f, EntitySRK, khSRK, srkAuth)
+	if err != nil {
+		t.Fatal("Couldn't open an OSAP session:", err)
+	}
+	defer s.Close(f)
+	if _, err := s.Seal(f, LocZero, []int{17}, []byte("secret"), srkAuth); err != nil {
+		t.Fatal("Couldn't seal in the session:", err)
+	}
+	s.SharedSecret[0] ^= 1
+	if _, err := s.Seal(f, LocZero, []int{17}, []byte("secret"), srkAuth); err == nil || errors.Is(err, ErrOSAPEntity) {
+		t.Fatalf("Seal with a corrupted shared secret returned %v, want an auth failure without %v", err, ErrOSAPEntity)
+	}
+}
@@ -17,134 +17,101 @@ package tpm
 import (
 	"crypto"
 	"crypto/rsa"
-	"crypto/sha1"
-	"errors"
-	"math/big"
 
-	"github.com/google/go-tpm/tpmutil"
+	"github.com/google/go-tpm/tpm/verify"
 )
 
-// This file provides functions to extract a crypto/rsa public key from a key
-// blob or a TPM_KEY of the right type. It also provides a function for
-// verifying a quote value given a public key for the key it was signed with.
+// The functions in this file check the output of a TPM without talking to
+// one. They're implemented in package verify, which a verifier that never has a
+// TPM can import without the rest of this package, and are kept here under
+// their original names.
 
-// UnmarshalRSAPublicKey takes in a blob containing a serialized RSA TPM_KEY and
-// converts it to a crypto/rsa.PublicKey.
+// UnmarshalRSAPublicKey is verify.UnmarshalRSAPublicKey.
 func UnmarshalRSAPublicKey(keyBlob []byte) (*rsa.PublicKey, error) {
-	// Parse the blob as a key.
-	var k key
-	if _, err := tpmutil.Unpack(keyBlob, &k); err != nil {
-		return nil, err
-	}
-
-	return k.unmarshalRSAPublicKey()
-}
-
-// unmarshalRSAPublicKey unmarshals a TPM key into a crypto/rsa.PublicKey.
-func (k *key) unmarshalRSAPublicKey() (*rsa.PublicKey, error) {
-	// Currently, we only support algRSA
-	if k.AlgorithmParams.AlgID != AlgRSA {
-		return nil, errors.New("only TPM_ALG_RSA is supported")
-	}
-
-	// This means that k.AlgorithmsParams.Params is an rsaKeyParams, which is
-	// enough to create the exponent, and k.PubKey contains the key.
-	var rsakp rsaKeyParams
-	if _, err := tpmutil.Unpack(k.AlgorithmParams.Params, &rsakp); err != nil {
-		return nil, err
-	}
-
-	// Make sure that the exponent will fit into an int before using it blindly.
-	if len(rsakp.Exponent) > 4 {
-		return nil, errors.New("exponent value doesn't fit into an int")
-	}
-	pk := &rsa.PublicKey{
-		N: new(big.Int).SetBytes(k.PubKey),
-		// The exponent isn't set here, but it's fixed to 0x10001
-		E: 0x10001,
-	}
-	return pk, nil
-}
-
-// UnmarshalPubRSAPublicKey takes in a blob containing a serialized RSA
-// TPM_PUBKEY and converts it to a crypto/rsa.PublicKey.
+	return verify.UnmarshalRSAPublicKey(keyBlob)
+}
+
+// UnmarshalPubRSAPublicKey is verify.UnmarshalPubRSAPublicKey.
 func UnmarshalPubRSAPublicKey(keyBlob []byte) (*rsa.PublicKey, error) {
-	// Parse the blob as a key.
-	var pk pubKey
-	if _, err := tpmutil.Unpack(keyBlob, &pk); err != nil {
-		return nil, err
-	}
-
-	return pk.unmarshalRSAPublicKey()
-}
-
-// unmarshalRSAPublicKey unmarshals a TPM pub key into a crypto/rsa.PublicKey.
-// This is almost identical to the identically named function for a TPM key.
-func (pk *pubKey) unmarshalRSAPublicKey() (*rsa.PublicKey, error) {
-	// Currently, we only support AlgRSA
-	if pk.AlgorithmParams.AlgID != AlgRSA {
-		return nil, errors.New("only TPM_ALG_RSA is supported")
-	}
-
-	// This means that pk.AlgorithmsParams.Params is an rsaKeyParams, which is
-	// enough to create the exponent, and pk.Key contains the key.
-	var rsakp rsaKeyParams
-	if _, err := tpmutil.Unpack(pk.AlgorithmParams.Params, &rsakp); err != nil {
-		return nil, err
-	}
-
-	// Make sure that the exponent will fit into an int before using it blindly.
-	if len(rsakp.Exponent) > 4 {
-		return nil, errors.New("exponent value doesn't fit into an int")
-	}
-	rsapk := &rsa.PublicKey{
-		N: new(big.Int).SetBytes(pk.Key),
-		// The exponent isn't set here, but it's fixed to 0x10001
-		E: 0x10001,
-	}
-	return rsapk, nil
-}
-
-// NewQuoteInfo computes a quoteInfo structure for a given pair of data and PCR
-// values.
-func NewQuoteInfo(data []byte, pcrNums []int, pcrs []byte) ([]byte, error) {
-	// Compute the composite hash for these PCRs.
-	pcrSel, err := newPCRSelection(pcrNums)
-	if err != nil {
-		return nil, err
-	}
+	return verify.UnmarshalPubRSAPublicKey(keyBlob)
+}
+
+// MarshalPubKeyPKIX is verify.MarshalPubKeyPKIX.
+func MarshalPubKeyPKIX(keyBlob []byte) ([]byte, error) {
+	return verify.MarshalPubKeyPKIX(keyBlob)
+}
+
+// MarshalPubKeyPEM is verify.MarshalPubKeyPEM.
+func MarshalPubKeyPEM(keyBlob []byte) ([]byte, error) {
+	return verify.MarshalPubKeyPEM(keyBlob)
+}
+
+// PubKeyFingerprint is verify.PubKeyFingerprint.
+func PubKeyFingerprint(keyBlob []byte) ([20]byte, error) {
+	return verify.PubKeyFingerprint(keyBlob)
+}
 
-	comp, err := createPCRComposite(pcrSel.Mask, pcrs)
-	if err != nil {
-		return nil, err
-	}
+// PubKeyFingerprintFromRSA is verify.PubKeyFingerprintFromRSA.
+func PubKeyFingerprintFromRSA(pub *rsa.PublicKey) [20]byte {
+	return verify.PubKeyFingerprintFromRSA(pub)
+}
 
-	qi := &quoteInfo{
-		Version: quoteVersion,
-		Fixed:   fixedQuote,
-		Nonce:   sha1.Sum(data),
-	}
-	copy(qi.CompositeDigest[:], comp)
+// PubKeyFingerprintWithHash is verify.PubKeyFingerprintWithHash.
+func PubKeyFingerprintWithHash(keyBlob []byte, h crypto.Hash) ([]byte, error) {
+	return verify.PubKeyFingerprintWithHash(keyBlob, h)
+}
+
+// NewQuoteInfo is verify.NewQuoteInfo.
+func NewQuoteInfo(data []byte, pcrNums []int, pcrs []byte) ([]byte, error) {
+	return verify.NewQuoteInfo(data, pcrNums, pcrs)
+}
 
-	return tpmutil.Pack(qi)
+// NewQuoteInfoExternalData is verify.NewQuoteInfoExternalData.
+func NewQuoteInfoExternalData(externalData Nonce, pcrNums []int, pcrs []byte) ([]byte, error) {
+	return verify.NewQuoteInfoExternalData(externalData, pcrNums, pcrs)
 }
 
-// VerifyQuote verifies a quote against a given set of PCRs.
+// VerifyQuote is verify.VerifyQuote.
 func VerifyQuote(pk *rsa.PublicKey, data []byte, quote []byte, pcrNums []int, pcrs []byte) error {
-	p, err := NewQuoteInfo(data, pcrNums, pcrs)
-	if err != nil {
-		return err
-	}
+	return verify.VerifyQuote(pk, data, quote, pcrNums, pcrs)
+}
+
+// VerifyQuoteWithCert is verify.VerifyQuoteWithCert.
+func VerifyQuoteWithCert(certDER []byte, data []byte, quote []byte, pcrNums []int, pcrs []byte) error {
+	return verify.VerifyQuoteWithCert(certDER, data, quote, pcrNums, pcrs)
+}
+
+// VerifyQuoteExternalData is verify.VerifyQuoteExternalData.
+func VerifyQuoteExternalData(pk *rsa.PublicKey, externalData Nonce, quote []byte, pcrNums []int, pcrs []byte) error {
+	return verify.VerifyQuoteExternalData(pk, externalData, quote, pcrNums, pcrs)
+}
+
+// VerifyQuoteComposite is verify.VerifyQuoteComposite.
+func VerifyQuoteComposite(pk *rsa.PublicKey, externalData Nonce, quote []byte, pcrNums []int, composite []byte) error {
+	return verify.VerifyQuoteComposite(pk, externalData, quote, pcrNums, composite)
+}
+
+// VerifyQuoteWithScheme is verify.VerifyQuoteWithScheme.
+func VerifyQuoteWithScheme(pk *rsa.PublicKey, ss SigScheme, externalData Nonce, quote []byte, pcrNums []int, pcrs []byte) error {
+	return verify.VerifyQuoteWithScheme(pk, ss, externalData, quote, pcrNums, pcrs)
+}
 
-	s := sha1.Sum(p)
+// VerifyQuoteWithKeyBlob is verify.VerifyQuoteWithKeyBlob.
+func VerifyQuoteWithKeyBlob(keyBlob []byte, externalData Nonce, quote []byte, pcrNums []int, pcrs []byte) error {
+	return verify.VerifyQuoteWithKeyBlob(keyBlob, externalData, quote, pcrNums, pcrs)
+}
 
-	// Try to do a direct encryption to reverse the value and see if it's padded
-	// with PKCS1v1.5.
-	return rsa.VerifyPKCS1v15(pk, crypto.SHA1, s[:], quote)
+// VerifyQuote2 is verify.VerifyQuote2.
+func VerifyQuote2(pk *rsa.PublicKey, externalData Nonce, quote []byte, pcrNums []int, pcrs []byte, versionInfo []byte) error {
+	return verify.VerifyQuote2(pk, externalData, quote, pcrNums, pcrs, versionInfo)
 }
 
-// TODO(tmroeder): add VerifyQuote2 instead of VerifyQuote. This means I'll
-// probably have to look at the signature scheme and use that to choose how to
-// verify the signature, whether PKCS1v1.5 or OAEP. And this will have to be set
-// on the key before it's passed to ordQuote2
-// TODO(tmroeder): handle key12
+// VerifyIdentityBinding is verify.VerifyIdentityBinding.
+func VerifyIdentityBinding(aikBlob []byte, caKey crypto.PublicKey, label []byte, sig []byte) error {
+	return verify.VerifyIdentityBinding(aikBlob, caKey, label, sig)
+}
+
+// VerifyIdentityBindingChosenID is verify.VerifyIdentityBindingChosenID.
+func VerifyIdentityBindingChosenID(aikBlob []byte, chosenID Digest, sig []byte) error {
+	return verify.VerifyIdentityBindingChosenID(aikBlob, chosenID, sig)
+}
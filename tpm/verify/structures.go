@@ -0,0 +1,350 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// The structures and constants in this file are the TPM 1.2 structures that
+// the verification functions need. The exported ones are also the structures
+// that package tpm sends to and receives from a TPM, so that quoting and
+// verifying compute the same digests with the same code, while this package
+// doesn't depend on the code that talks to a TPM.
+
+// A Nonce is a 20-byte value.
+type Nonce [20]byte
+
+// A Digest is a 20-byte SHA1 value.
+type Digest [20]byte
+
+// PCRSize gives the fixed size (20 bytes) of a PCR.
+const PCRSize int = 20
+
+// SigScheme is the signature scheme of an RSA key.
+type SigScheme uint16
+
+// Signature schemes. All but SigSchemeRSASSAPKCS1v15INFO can be passed to
+// CreateWrapKeyWithSchemes in package tpm.
+const (
+	SigSchemeNone SigScheme = iota + 1
+	SigSchemeRSASSAPKCS1v15SHA1
+	SigSchemeRSASSAPKCS1v15DER
+	SigSchemeRSASSAPKCS1v15INFO
+)
+
+var sigSchemeNames = map[SigScheme]string{
+	SigSchemeNone:               "TPM_SS_NONE",
+	SigSchemeRSASSAPKCS1v15SHA1: "TPM_SS_RSASSAPKCS1v15_SHA1",
+	SigSchemeRSASSAPKCS1v15DER:  "TPM_SS_RSASSAPKCS1v15_DER",
+	SigSchemeRSASSAPKCS1v15INFO: "TPM_SS_RSASSAPKCS1v15_INFO",
+}
+
+// String returns the TPM_SIG_SCHEME name of the signature scheme.
+func (s SigScheme) String() string {
+	if n, ok := sigSchemeNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("SigScheme(0x%04x)", uint16(s))
+}
+
+const (
+	algRSA          uint32 = 0x00000001
+	esNone          uint16 = 0x0001
+	keyIdentity     uint16 = 0x0012
+	tagQuoteInfo2   uint16 = 0x0036
+	ordMakeIdentity uint32 = 0x00000079
+	structVersion   uint32 = 0x01010000
+	tagKey12        uint16 = 0x0028
+	locZero         byte   = 0x01
+	numPCRs                = 24
+)
+
+var (
+	fixedQuote  = [4]byte{'Q', 'U', 'O', 'T'}
+	fixedQuote2 = [4]byte{'Q', 'U', 'T', '2'}
+)
+
+// KeyParams is a TPM_KEY_PARMS, the parameters of a TPM key.
+type KeyParams struct {
+	AlgID     uint32
+	EncScheme uint16
+	SigScheme uint16
+	Params    tpmutil.U32Bytes // Serialized RSAKeyParams or symmetric key parameters.
+}
+
+// RSAKeyParams is a TPM_RSA_KEY_PARMS. It encodes the length of the RSA prime
+// in bits, the number of primes in its factored form, and the exponent used
+// for public-key encryption.
+type RSAKeyParams struct {
+	KeyLength uint32
+	NumPrimes uint32
+	Exponent  tpmutil.U32Bytes
+}
+
+// A Key is a TPM_KEY, or a TPM_KEY12 with its tag and fill bytes in place of
+// the version.
+type Key struct {
+	Version         uint32
+	KeyUsage        uint16
+	KeyFlags        uint32
+	AuthDataUsage   byte
+	AlgorithmParams KeyParams
+	PCRInfo         tpmutil.U32Bytes
+	PubKey          tpmutil.U32Bytes
+	EncData         tpmutil.U32Bytes
+}
+
+// RSAPublicKey returns the public key of an RSA key.
+func (k *Key) RSAPublicKey() (*rsa.PublicKey, error) {
+	return unmarshalRSAPublicKey(k.AlgorithmParams, k.PubKey)
+}
+
+// A PubKey is a TPM_PUBKEY.
+type PubKey struct {
+	AlgorithmParams KeyParams
+	Key             tpmutil.U32Bytes
+}
+
+// An identityContents is the TPM_IDENTITY_CONTENTS that MakeIdentity signs
+// with the new AIK.
+type identityContents struct {
+	Version           uint32
+	Ordinal           uint32
+	LabelPrivCADigest Digest
+	IdentityPubKey    PubKey
+}
+
+// A PCRMask is the bitmap of a TPM_PCR_SELECTION, with one bit for each of the
+// 24 PCRs.
+type PCRMask [3]byte
+
+// A pcrSelection is a TPM_PCR_SELECTION.
+type pcrSelection struct {
+	Size uint16
+	Mask PCRMask
+}
+
+// A pcrComposite stores a selection of PCRs with the selected PCR values.
+type pcrComposite struct {
+	Selection pcrSelection
+	Values    tpmutil.U32Bytes
+}
+
+// A pcrInfoShort is a TPM_PCR_INFO_SHORT.
+type pcrInfoShort struct {
+	PCRsAtRelease   pcrSelection
+	LocAtRelease    byte
+	DigestAtRelease Digest
+}
+
+// A quoteInfo structure is the structure signed by the TPM.
+type quoteInfo struct {
+	Version         uint32
+	Fixed           [4]byte
+	CompositeDigest Digest
+	Nonce           Nonce
+}
+
+// A quoteInfo2 structure is the structure signed by the TPM for Quote2.
+type quoteInfo2 struct {
+	Tag          uint16
+	Fixed        [4]byte
+	ExternalData Nonce
+	InfoShort    pcrInfoShort
+}
+
+// NewPCRMask creates a mask that selects the given PCRs. If any of them are out
+// of range, the error lists all of them. The mask is a bitmap, so neither the
+// order of pcrNums nor repeated indices make a difference: the TPM composes the
+// selected PCRs in increasing order, and so must everything that builds a
+// composite for the mask.
+func NewPCRMask(pcrNums []int) (PCRMask, error) {
+	var mask PCRMask
+	var bad []int
+	for _, i := range pcrNums {
+		if err := mask.Set(i); err != nil {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) > 0 {
+		return mask, fmt.Errorf("PCR indices %v are out of range [0, %d)", bad, numPCRs)
+	}
+	return mask, nil
+}
+
+// Set selects PCR i in the mask.
+func (pm *PCRMask) Set(i int) error {
+	if i < 0 || i >= numPCRs {
+		return errors.New("can't set PCR " + strconv.Itoa(i))
+	}
+	pm[i/8] |= 1 << uint(i%8)
+	return nil
+}
+
+// IsSet reports whether PCR i is selected in the mask.
+func (pm PCRMask) IsSet(i int) (bool, error) {
+	if i < 0 || i >= numPCRs {
+		return false, errors.New("can't check PCR " + strconv.Itoa(i))
+	}
+	n := byte(1 << uint(i%8))
+	return pm[i/8]&n == n, nil
+}
+
+// PCRs returns the PCRs selected in the mask, in increasing order.
+func (pm PCRMask) PCRs() []int {
+	var pcrs []int
+	for i := 0; i < 8*len(pm); i++ {
+		if pm[i/8]&(1<<uint(i%8)) != 0 {
+			pcrs = append(pcrs, i)
+		}
+	}
+	return pcrs
+}
+
+// PackPCRComposite serializes the TPM_PCR_COMPOSITE of the PCRs in mask with
+// the values pcrs. The values must be in increasing PCR order, as the TPM
+// returns them, whatever order the PCRs were listed in.
+func PackPCRComposite(mask PCRMask, pcrs []byte) ([]byte, error) {
+	if len(pcrs)%PCRSize != 0 {
+		return nil, fmt.Errorf("pcrs must be a multiple of %d", PCRSize)
+	}
+	if n := len(mask.PCRs()); len(pcrs) != n*PCRSize {
+		return nil, fmt.Errorf("got %d PCR values for %d distinct PCRs; pass one value for each PCR, in increasing PCR order", len(pcrs)/PCRSize, n)
+	}
+	return tpmutil.Pack(pcrComposite{
+		Selection: pcrSelection{3, mask},
+		Values:    pcrs,
+	})
+}
+
+// PCRCompositeDigest returns the SHA-1 hash of the TPM_PCR_COMPOSITE that
+// PackPCRComposite serializes, which is what a TPM quotes and seals to.
+func PCRCompositeDigest(mask PCRMask, pcrs []byte) (Digest, error) {
+	b, err := PackPCRComposite(mask, pcrs)
+	if err != nil {
+		return Digest{}, err
+	}
+	return sha1.Sum(b), nil
+}
+
+// parsePublicKey parses the key parameters and the public key of a serialized
+// TPM_KEY, TPM_KEY12 or TPM_PUBKEY. Commands return the public part of a key in
+// different structures, with different framing around the TPM_KEY_PARMS, so
+// the structure is told by its first four bytes: the version of a TPM_KEY, the
+// tag and fill bytes of a TPM_KEY12, or the algorithm of a TPM_PUBKEY. Any bytes
+// after the structure, such as the checksum that follows the TPM_PUBKEY in the
+// response to TPM_ReadPubek, are ignored.
+func parsePublicKey(blob []byte) (KeyParams, []byte, error) {
+	var first uint32
+	if _, err := tpmutil.Unpack(blob, &first); err != nil {
+		return KeyParams{}, nil, err
+	}
+	if first == structVersion || uint16(first>>16) == tagKey12 {
+		var k Key
+		if _, err := tpmutil.Unpack(blob, &k); err != nil {
+			return KeyParams{}, nil, err
+		}
+		return k.AlgorithmParams, k.PubKey, nil
+	}
+	var pk PubKey
+	if _, err := tpmutil.Unpack(blob, &pk); err != nil {
+		return KeyParams{}, nil, err
+	}
+	return pk.AlgorithmParams, pk.Key, nil
+}
+
+// unmarshalRSAPublicKey converts the parameters and modulus of an RSA key to
+// a crypto/rsa.PublicKey.
+func unmarshalRSAPublicKey(kp KeyParams, modulus []byte) (*rsa.PublicKey, error) {
+	// Currently, we only support algRSA
+	if kp.AlgID != algRSA {
+		return nil, errors.New("only TPM_ALG_RSA is supported")
+	}
+
+	// This means that kp.Params is an RSAKeyParams, which is enough to create
+	// the exponent.
+	var rsakp RSAKeyParams
+	if _, err := tpmutil.Unpack(kp.Params, &rsakp); err != nil {
+		return nil, err
+	}
+	if len(modulus) == 0 {
+		return nil, errors.New("the RSA public key has no modulus")
+	}
+
+	// An empty exponent stands for the default exponent, 2^16+1. Make sure
+	// that any other exponent will fit into an int before using it.
+	e := 0x10001
+	if len(rsakp.Exponent) > 0 {
+		if len(rsakp.Exponent) > 4 {
+			return nil, errors.New("exponent value doesn't fit into an int")
+		}
+		exp := new(big.Int).SetBytes(rsakp.Exponent)
+		if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent %v", exp)
+		}
+		e = int(exp.Int64())
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: e,
+	}, nil
+}
+
+// IdentityCADigest computes the labelPrivCADigest of MakeIdentity, which is
+// SHA1(label || TPM_PUBKEY of the privacy CA). It's all zeros if there is no
+// privacy CA.
+func IdentityCADigest(pk crypto.PublicKey, label []byte) (Digest, error) {
+	var caDigest Digest
+	if (pk != nil) != (label != nil) {
+		return caDigest, errors.New("inconsistent null values between the pk and the label")
+	}
+	if pk == nil {
+		return caDigest, nil
+	}
+
+	pkRSA, ok := pk.(*rsa.PublicKey)
+	if !ok {
+		return caDigest, errors.New("the provided Privacy CA public key was not an RSA key")
+	}
+	if pkRSA.N.BitLen() != 2048 {
+		return caDigest, errors.New("The provided Privacy CA RSA public key was not a 2048-bit key")
+	}
+	params, err := tpmutil.Pack(RSAKeyParams{
+		KeyLength: 2048,
+		NumPrimes: 2,
+		Exponent:  big.NewInt(int64(pkRSA.E)).Bytes(),
+	})
+	if err != nil {
+		return caDigest, err
+	}
+	fullpkb, err := tpmutil.Pack(PubKey{
+		AlgorithmParams: KeyParams{algRSA, esNone, uint16(SigSchemeRSASSAPKCS1v15SHA1), params},
+		Key:             pkRSA.N.Bytes(),
+	})
+	if err != nil {
+		return caDigest, err
+	}
+
+	return sha1.Sum(append(append([]byte(nil), label...), fullpkb...)), nil
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verify checks the output of a TPM 1.2 without talking to one. It
+// extracts the public keys of key blobs and verifies quotes and identity
+// bindings, so a remote attestation verifier can use it without importing the
+// code in package tpm that drives a TPM. Package tpm provides the same
+// functions under the same names.
+package verify
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// UnmarshalRSAPublicKey takes in a blob containing a serialized RSA TPM_KEY and
+// converts it to a crypto/rsa.PublicKey. It also accepts a TPM_KEY12, and a
+// TPM_PUBKEY like the ones returned by GetPubKey, OwnerReadPubEK and ReadPubEK.
+func UnmarshalRSAPublicKey(keyBlob []byte) (*rsa.PublicKey, error) {
+	kp, modulus, err := parsePublicKey(keyBlob)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalRSAPublicKey(kp, modulus)
+}
+
+// UnmarshalPubRSAPublicKey takes in a blob containing a serialized RSA
+// TPM_PUBKEY and converts it to a crypto/rsa.PublicKey. It accepts the same
+// structures as UnmarshalRSAPublicKey.
+func UnmarshalPubRSAPublicKey(keyBlob []byte) (*rsa.PublicKey, error) {
+	return UnmarshalRSAPublicKey(keyBlob)
+}
+
+// MarshalPubKeyPKIX takes in a blob containing a serialized RSA TPM_KEY, such
+// as an AIK blob, and converts its public key to a DER-encoded
+// SubjectPublicKeyInfo, which crypto/x509 can use to build a certificate or a
+// certificate request.
+func MarshalPubKeyPKIX(keyBlob []byte) ([]byte, error) {
+	pk, err := UnmarshalRSAPublicKey(keyBlob)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(pk)
+}
+
+// MarshalPubKeyPEM converts the public key of a serialized RSA TPM_KEY to a
+// SubjectPublicKeyInfo like MarshalPubKeyPKIX, but PEM-encoded as a PUBLIC
+// KEY block.
+func MarshalPubKeyPEM(keyBlob []byte) ([]byte, error) {
+	der, err := MarshalPubKeyPKIX(keyBlob)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// PubKeyFingerprint returns the SHA-1 hash of the DER-encoded
+// SubjectPublicKeyInfo of the public key in a serialized RSA TPM_KEY, such as
+// an AIK blob. It's a stable identifier for the key, so a verifier can index
+// quotes by AIK and notice when a machine presents a different AIK.
+func PubKeyFingerprint(keyBlob []byte) ([20]byte, error) {
+	pk, err := UnmarshalRSAPublicKey(keyBlob)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return PubKeyFingerprintFromRSA(pk), nil
+}
+
+// PubKeyFingerprintFromRSA returns the fingerprint of an RSA public key, as
+// computed by PubKeyFingerprint for a key blob that contains it.
+func PubKeyFingerprintFromRSA(pub *rsa.PublicKey) [20]byte {
+	// Marshaling only fails for key types that crypto/x509 doesn't know.
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	return sha1.Sum(der)
+}
+
+// PubKeyFingerprintWithHash is like PubKeyFingerprint, but hashes the
+// SubjectPublicKeyInfo with h, for verifiers that index keys by, e.g., their
+// SHA-256 fingerprint.
+func PubKeyFingerprintWithHash(keyBlob []byte, h crypto.Hash) ([]byte, error) {
+	if !h.Available() {
+		return nil, fmt.Errorf("hash function %v is not available", h)
+	}
+	der, err := MarshalPubKeyPKIX(keyBlob)
+	if err != nil {
+		return nil, err
+	}
+	hh := h.New()
+	hh.Write(der)
+	return hh.Sum(nil), nil
+}
+
+// NewQuoteInfo computes a quoteInfo structure for a given pair of data and PCR
+// values. The data is hashed with SHA-1 to form the externalData, matching
+// Quote.
+func NewQuoteInfo(data []byte, pcrNums []int, pcrs []byte) ([]byte, error) {
+	return NewQuoteInfoExternalData(sha1.Sum(data), pcrNums, pcrs)
+}
+
+// NewQuoteInfoExternalData computes a quoteInfo structure for a given
+// externalData and PCR values, matching QuoteExternalData.
+func NewQuoteInfoExternalData(externalData Nonce, pcrNums []int, pcrs []byte) ([]byte, error) {
+	// Compute the composite hash for these PCRs.
+	mask, err := NewPCRMask(pcrNums)
+	if err != nil {
+		return nil, err
+	}
+
+	comp, err := PCRCompositeDigest(mask, pcrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return tpmutil.Pack(quoteInfo{
+		Version:         structVersion,
+		Fixed:           fixedQuote,
+		CompositeDigest: comp,
+		Nonce:           externalData,
+	})
+}
+
+// VerifyQuote verifies a quote produced by Quote against a given set of PCRs.
+func VerifyQuote(pk *rsa.PublicKey, data []byte, quote []byte, pcrNums []int, pcrs []byte) error {
+	return VerifyQuoteExternalData(pk, sha1.Sum(data), quote, pcrNums, pcrs)
+}
+
+// VerifyQuoteWithCert verifies a quote produced by Quote like VerifyQuote,
+// with the public key from a DER-encoded X.509 certificate for the AIK, such as
+// one issued for the output of MarshalPubKeyPKIX. It only checks the quote: the
+// caller is responsible for checking that the certificate is trusted.
+func VerifyQuoteWithCert(certDER []byte, data []byte, quote []byte, pcrNums []int, pcrs []byte) error {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return err
+	}
+	pk, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("the certificate has a %T public key, want an RSA key", cert.PublicKey)
+	}
+	return VerifyQuote(pk, data, quote, pcrNums, pcrs)
+}
+
+// VerifyQuoteExternalData verifies a quote produced by QuoteExternalData
+// against a given set of PCRs.
+func VerifyQuoteExternalData(pk *rsa.PublicKey, externalData Nonce, quote []byte, pcrNums []int, pcrs []byte) error {
+	return VerifyQuoteWithScheme(pk, SigSchemeRSASSAPKCS1v15SHA1, externalData, quote, pcrNums, pcrs)
+}
+
+// VerifyQuoteComposite verifies a quote produced by QuoteComposite. Unlike
+// VerifyQuoteExternalData, it checks that the PCR selection the TPM signed is
+// exactly the set of PCRs in pcrNums, so a quote over a different set of PCRs
+// is rejected even if its signature is valid.
+func VerifyQuoteComposite(pk *rsa.PublicKey, externalData Nonce, quote []byte, pcrNums []int, composite []byte) error {
+	var pcrc pcrComposite
+	n, err := tpmutil.Unpack(composite, &pcrc)
+	if err != nil {
+		return err
+	}
+	if n != len(composite) {
+		return fmt.Errorf("got %d trailing bytes after the PCR composite", len(composite)-n)
+	}
+
+	mask, err := NewPCRMask(pcrNums)
+	if err != nil {
+		return err
+	}
+	if want := (pcrSelection{3, mask}); pcrc.Selection != want {
+		return fmt.Errorf("quote covers PCRs %v but you asked for %v", pcrc.Selection.Mask.PCRs(), mask.PCRs())
+	}
+	if n := len(mask.PCRs()); len(pcrc.Values) != n*PCRSize {
+		return fmt.Errorf("got %d bytes of PCR values for %d PCRs", len(pcrc.Values), n)
+	}
+
+	p, err := tpmutil.Pack(quoteInfo{
+		Version:         structVersion,
+		Fixed:           fixedQuote,
+		CompositeDigest: sha1.Sum(composite),
+		Nonce:           externalData,
+	})
+	if err != nil {
+		return err
+	}
+
+	return verifyQuoteInfo(pk, SigSchemeRSASSAPKCS1v15SHA1, p, quote)
+}
+
+// VerifyQuoteWithScheme verifies a quote produced by QuoteExternalData like
+// VerifyQuoteExternalData, but for a key with the signature scheme ss rather
+// than SigSchemeRSASSAPKCS1v15SHA1. TPM_Quote only accepts keys with these
+// schemes, and signs the SHA-1 digest of the quote info with a PKCS#1 v1.5
+// DigestInfo prefix for both:
+//
+//   - SigSchemeRSASSAPKCS1v15SHA1, the scheme of the AIKs that MakeIdentity
+//     creates and of the signing keys that CreateWrapKeyWithSchemes creates
+//     when passed this scheme.
+//   - SigSchemeRSASSAPKCS1v15INFO, which package tpm can't create keys with.
+//
+// Any other scheme is rejected. In particular, the TPM refuses to quote with a
+// SigSchemeRSASSAPKCS1v15DER key, like the keys CreateWrapKey and
+// CreateMigratableWrapKey create, with TPM_INAPPROPRIATE_SIG: such keys only
+// sign with TPM_Sign.
+func VerifyQuoteWithScheme(pk *rsa.PublicKey, ss SigScheme, externalData Nonce, quote []byte, pcrNums []int, pcrs []byte) error {
+	p, err := NewQuoteInfoExternalData(externalData, pcrNums, pcrs)
+	if err != nil {
+		return err
+	}
+
+	return verifyQuoteInfo(pk, ss, p, quote)
+}
+
+// VerifyQuoteWithKeyBlob verifies a quote like VerifyQuoteWithScheme, with the
+// public key and signature scheme of the key in keyBlob, a TPM_KEY like the
+// blobs returned by MakeIdentity and CreateWrapKey.
+func VerifyQuoteWithKeyBlob(keyBlob []byte, externalData Nonce, quote []byte, pcrNums []int, pcrs []byte) error {
+	var k Key
+	if _, err := tpmutil.Unpack(keyBlob, &k); err != nil {
+		return err
+	}
+	pk, err := unmarshalRSAPublicKey(k.AlgorithmParams, k.PubKey)
+	if err != nil {
+		return err
+	}
+	return VerifyQuoteWithScheme(pk, SigScheme(k.AlgorithmParams.SigScheme), externalData, quote, pcrNums, pcrs)
+}
+
+// verifyQuoteInfo checks that quote is a signature by pk, with the signature
+// scheme ss, over the serialized quoteInfo p.
+func verifyQuoteInfo(pk *rsa.PublicKey, ss SigScheme, p []byte, quote []byte) error {
+	s := sha1.Sum(p)
+
+	// Try to do a direct encryption to reverse the value and see if it's padded
+	// with PKCS1v1.5.
+	switch ss {
+	case SigSchemeRSASSAPKCS1v15SHA1, SigSchemeRSASSAPKCS1v15INFO:
+		return rsa.VerifyPKCS1v15(pk, crypto.SHA1, s[:], quote)
+	case SigSchemeRSASSAPKCS1v15DER:
+		return fmt.Errorf("a TPM doesn't quote with %v keys; they can only sign with TPM_Sign", ss)
+	default:
+		return fmt.Errorf("signature scheme %v can't be used for quotes", ss)
+	}
+}
+
+// VerifyIdentityBinding checks the identity binding returned by
+// MakeIdentityWithBinding: that sig is a signature by the AIK in aikBlob over
+// the TPM_IDENTITY_CONTENTS for that AIK, the privacy CA key caKey and label.
+// caKey and label must be the values passed to MakeIdentityWithBinding, and
+// both are nil if no privacy CA was given.
+func VerifyIdentityBinding(aikBlob []byte, caKey crypto.PublicKey, label []byte, sig []byte) error {
+	caDigest, err := IdentityCADigest(caKey, label)
+	if err != nil {
+		return err
+	}
+	return VerifyIdentityBindingChosenID(aikBlob, caDigest, sig)
+}
+
+// VerifyIdentityBindingChosenID checks the identity binding returned by
+// MakeIdentityWithChosenID like VerifyIdentityBinding, for the chosenID that
+// was passed to it.
+func VerifyIdentityBindingChosenID(aikBlob []byte, chosenID Digest, sig []byte) error {
+	var k Key
+	if _, err := tpmutil.Unpack(aikBlob, &k); err != nil {
+		return err
+	}
+	if k.KeyUsage != keyIdentity {
+		return fmt.Errorf("key usage 0x%x is not an identity key", k.KeyUsage)
+	}
+	aikPub, err := unmarshalRSAPublicKey(k.AlgorithmParams, k.PubKey)
+	if err != nil {
+		return err
+	}
+
+	contents, err := tpmutil.Pack(identityContents{
+		Version:           structVersion,
+		Ordinal:           ordMakeIdentity,
+		LabelPrivCADigest: chosenID,
+		IdentityPubKey: PubKey{
+			AlgorithmParams: k.AlgorithmParams,
+			Key:             k.PubKey,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	d := sha1.Sum(contents)
+	return rsa.VerifyPKCS1v15(aikPub, crypto.SHA1, d[:], sig)
+}
+
+// VerifyQuote2 verifies a quote produced by Quote2Values at locality 0, the
+// locality of the commands package tpm sends, against the PCR values and
+// version info that Quote2Values returned. pcrs holds the values of the PCRs
+// in pcrNums sorted by PCR index, each PCR once. Like VerifyQuote, it expects
+// a PKCS#1 v1.5 signature over the SHA-1 digest of the signed data.
+func VerifyQuote2(pk *rsa.PublicKey, externalData Nonce, quote []byte, pcrNums []int, pcrs []byte, versionInfo []byte) error {
+	mask, err := NewPCRMask(pcrNums)
+	if err != nil {
+		return err
+	}
+	d, err := PCRCompositeDigest(mask, pcrs)
+	if err != nil {
+		return err
+	}
+	qi, err := tpmutil.Pack(quoteInfo2{
+		Tag:          tagQuoteInfo2,
+		Fixed:        fixedQuote2,
+		ExternalData: externalData,
+		InfoShort: pcrInfoShort{
+			PCRsAtRelease:   pcrSelection{3, mask},
+			LocAtRelease:    locZero,
+			DigestAtRelease: d,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// With addVersion, the TPM signs the TPM_CAP_VERSION_INFO after the
+	// TPM_QUOTE_INFO2.
+	return verifyQuoteInfo(pk, SigSchemeRSASSAPKCS1v15SHA1, append(qi, versionInfo...), quote)
+}
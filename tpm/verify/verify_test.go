@@ -0,0 +1,156 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+func TestNoTPMDependency(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("No go tool; skipping test")
+	}
+	out, err := exec.Command(goTool, "list", "-deps", ".").Output()
+	if err != nil {
+		t.Fatal("Couldn't list the dependencies of package verify:", err)
+	}
+	for _, dep := range strings.Fields(string(out)) {
+		if dep == "github.com/google/go-tpm/tpm" {
+			t.Fatal("Package verify depends on package tpm")
+		}
+	}
+}
+
+func TestVerifyQuoteWithKeyBlob(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate a key:", err)
+	}
+	params, err := tpmutil.Pack(RSAKeyParams{KeyLength: 2048, NumPrimes: 2})
+	if err != nil {
+		t.Fatal("Couldn't pack the RSA key params:", err)
+	}
+	blob, err := tpmutil.Pack(Key{
+		Version:         structVersion,
+		KeyUsage:        keyIdentity,
+		AlgorithmParams: KeyParams{algRSA, esNone, uint16(SigSchemeRSASSAPKCS1v15SHA1), params},
+		PubKey:          priv.N.Bytes(),
+	})
+	if err != nil {
+		t.Fatal("Couldn't pack the key:", err)
+	}
+
+	nonce := Nonce{1, 2, 3}
+	pcrNums := []int{17, 18}
+	pcrs := make([]byte, len(pcrNums)*PCRSize)
+	qi, err := NewQuoteInfoExternalData(nonce, pcrNums, pcrs)
+	if err != nil {
+		t.Fatal("Couldn't create the quote info:", err)
+	}
+	d := sha1.Sum(qi)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA1, d[:])
+	if err != nil {
+		t.Fatal("Couldn't sign the quote info:", err)
+	}
+
+	if err := VerifyQuoteWithKeyBlob(blob, nonce, sig, pcrNums, pcrs); err != nil {
+		t.Fatal("The quote didn't verify:", err)
+	}
+	if err := VerifyQuoteWithKeyBlob(blob, Nonce{}, sig, pcrNums, pcrs); err == nil {
+		t.Fatal("The quote verified with the wrong nonce")
+	}
+}
+
+func TestUnmarshalRSAPublicKeyFramings(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate a key:", err)
+	}
+	mod := priv.N.Bytes()
+	pack := func(v ...interface{}) []byte {
+		t.Helper()
+		b, err := tpmutil.Pack(v...)
+		if err != nil {
+			t.Fatal("Couldn't pack a test blob:", err)
+		}
+		return b
+	}
+	aikParams := KeyParams{algRSA, esNone, uint16(SigSchemeRSASSAPKCS1v15SHA1), pack(RSAKeyParams{KeyLength: 2048, NumPrimes: 2})}
+	// The EK is an OAEP encryption key with no signature scheme, and some
+	// TPMs spell out the default exponent.
+	ekParams := KeyParams{algRSA, 0x0003, uint16(SigSchemeNone), pack(RSAKeyParams{KeyLength: 2048, NumPrimes: 2, Exponent: []byte{0x01, 0x00, 0x01}})}
+
+	for _, tt := range []struct {
+		name string
+		blob []byte
+		e    int
+	}{
+		{"TPM_KEY from MakeIdentity", pack(Key{Version: structVersion, KeyUsage: keyIdentity, AlgorithmParams: aikParams, PubKey: mod}), 0x10001},
+		{"TPM_KEY12", pack(Key{Version: uint32(tagKey12) << 16, KeyUsage: 0x0010, AlgorithmParams: aikParams, PubKey: mod}), 0x10001},
+		{"TPM_PUBKEY from GetPubKey", pack(PubKey{aikParams, mod}), 0x10001},
+		{"TPM_PUBKEY from OwnerReadInternalPub", pack(PubKey{ekParams, mod}), 0x10001},
+		{"TPM_ReadPubek response with checksum", pack(PubKey{ekParams, mod}, Digest{0xAA}), 0x10001},
+		{"TPM_PUBKEY with exponent 3", pack(PubKey{KeyParams{algRSA, esNone, uint16(SigSchemeNone), pack(RSAKeyParams{2048, 2, []byte{3}})}, mod}), 3},
+	} {
+		for _, f := range []func([]byte) (*rsa.PublicKey, error){UnmarshalRSAPublicKey, UnmarshalPubRSAPublicKey} {
+			pub, err := f(tt.blob)
+			if err != nil {
+				t.Errorf("%s: couldn't parse the public key: %v", tt.name, err)
+				continue
+			}
+			if pub.N.Cmp(priv.N) != 0 || pub.E != tt.e {
+				t.Errorf("%s: got a key with exponent %d and a different modulus, want exponent %d", tt.name, pub.E, tt.e)
+			}
+		}
+	}
+}
+
+func TestUnmarshalRSAPublicKeyErrors(t *testing.T) {
+	params, err := tpmutil.Pack(RSAKeyParams{2048, 2, []byte{0x01, 0x00, 0x00, 0x00, 0x01}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigExp, err := tpmutil.Pack(PubKey{KeyParams{algRSA, esNone, uint16(SigSchemeNone), params}, []byte{0xFF}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noModulus, err := tpmutil.Pack(PubKey{KeyParams{algRSA, esNone, uint16(SigSchemeNone), nil}, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes, err := tpmutil.Pack(PubKey{KeyParams{0x00000006, esNone, uint16(SigSchemeNone), nil}, []byte{0xFF}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, blob := range map[string][]byte{
+		"truncated":       {0x01, 0x01},
+		"5-byte exponent": bigExp,
+		"no modulus":      noModulus,
+		"AES key":         aes,
+	} {
+		if _, err := UnmarshalRSAPublicKey(blob); err == nil {
+			t.Errorf("%s: UnmarshalRSAPublicKey returned no error", name)
+		}
+	}
+}
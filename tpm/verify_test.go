@@ -0,0 +1,491 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// signQuoteInfo signs a serialized quoteInfo the way the TPM does for
+// TPM_SS_RSASSAPKCS1v15_SHA1 keys.
+func signQuoteInfo(t *testing.T, k *rsa.PrivateKey, qi []byte) []byte {
+	t.Helper()
+	d := sha1.Sum(qi)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA1, d[:])
+	if err != nil {
+		t.Fatal("Couldn't sign the quote info:", err)
+	}
+	return sig
+}
+
+func TestNewQuoteInfoHashesData(t *testing.T) {
+	data := []byte("some data to quote")
+	pcrNums := []int{17, 18}
+	pcrs := make([]byte, 2*PCRSize)
+
+	qi, err := NewQuoteInfo(data, pcrNums, pcrs)
+	if err != nil {
+		t.Fatal("Couldn't create quote info:", err)
+	}
+	qiExt, err := NewQuoteInfoExternalData(sha1.Sum(data), pcrNums, pcrs)
+	if err != nil {
+		t.Fatal("Couldn't create quote info:", err)
+	}
+	if !bytes.Equal(qi, qiExt) {
+		t.Fatal("NewQuoteInfo(data) differs from NewQuoteInfoExternalData(SHA1(data))")
+	}
+}
+
+func TestVerifyQuoteExternalData(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	pcrNums := []int{17}
+	pcrs := make([]byte, PCRSize)
+
+	// A 20-byte nonce passed as externalData must not be hashed again.
+	var nonce Nonce
+	copy(nonce[:], "01234567890123456789")
+	qi, err := NewQuoteInfoExternalData(nonce, pcrNums, pcrs)
+	if err != nil {
+		t.Fatal("Couldn't create quote info:", err)
+	}
+	sig := signQuoteInfo(t, k, qi)
+
+	if err := VerifyQuoteExternalData(&k.PublicKey, nonce, sig, pcrNums, pcrs); err != nil {
+		t.Fatal("Couldn't verify a quote over the external data:", err)
+	}
+	if err := VerifyQuote(&k.PublicKey, nonce[:], sig, pcrNums, pcrs); err == nil {
+		t.Fatal("VerifyQuote accepted a quote over unhashed external data")
+	}
+}
+
+func TestVerifyQuoteWithScheme(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	pcrNums := []int{17}
+	pcrs := make([]byte, PCRSize)
+	nonce := Nonce(sha1.Sum([]byte("nonce")))
+	qi, err := NewQuoteInfoExternalData(nonce, pcrNums, pcrs)
+	if err != nil {
+		t.Fatal("Couldn't create quote info:", err)
+	}
+	d := sha1.Sum(qi)
+
+	// The SHA1 scheme signs the digest with a DigestInfo prefix. A DER key
+	// would sign it as-is, but a TPM doesn't quote with DER keys.
+	sha1Sig := signQuoteInfo(t, k, qi)
+	derSig, err := rsa.SignPKCS1v15(rand.Reader, k, 0, d[:])
+	if err != nil {
+		t.Fatal("Couldn't sign the quote info without a prefix:", err)
+	}
+
+	for _, tt := range []struct {
+		ss      SigScheme
+		sig     []byte
+		wantErr bool
+	}{
+		{SigSchemeRSASSAPKCS1v15SHA1, sha1Sig, false},
+		{SigSchemeRSASSAPKCS1v15INFO, sha1Sig, false},
+		{SigSchemeRSASSAPKCS1v15DER, derSig, true},
+		{SigSchemeRSASSAPKCS1v15SHA1, derSig, true},
+		{SigSchemeRSASSAPKCS1v15DER, sha1Sig, true},
+		{SigSchemeNone, sha1Sig, true},
+	} {
+		err := VerifyQuoteWithScheme(&k.PublicKey, tt.ss, nonce, tt.sig, pcrNums, pcrs)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("VerifyQuoteWithScheme for scheme 0x%x returned %v, want error %t", uint16(tt.ss), err, tt.wantErr)
+		}
+	}
+
+	// With a key blob, the scheme comes from the blob.
+	for _, tt := range []struct {
+		ss      uint16
+		sig     []byte
+		wantErr bool
+	}{
+		{ssRSASaPKCS1v15SHA1, sha1Sig, false},
+		{ssRSASaPKCS1v15SHA1, derSig, true},
+		{ssRSASaPKCS1v15DER, derSig, true},
+		{ssRSASaPKCS1v15DER, sha1Sig, true},
+	} {
+		kb := testKey(t, keySigning, authAlways, &k.PublicKey)
+		kb.AlgorithmParams.SigScheme = tt.ss
+		keyBlob, err := tpmutil.Pack(kb)
+		if err != nil {
+			t.Fatal("Couldn't pack the key:", err)
+		}
+		err = VerifyQuoteWithKeyBlob(keyBlob, nonce, tt.sig, pcrNums, pcrs)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("VerifyQuoteWithKeyBlob for a key with scheme 0x%x returned %v, want error %t", tt.ss, err, tt.wantErr)
+		}
+	}
+}
+
+func TestVerifyQuoteData(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	data := []byte("some data to quote")
+	pcrNums := []int{17}
+	pcrs := make([]byte, PCRSize)
+
+	qi, err := NewQuoteInfo(data, pcrNums, pcrs)
+	if err != nil {
+		t.Fatal("Couldn't create quote info:", err)
+	}
+	sig := signQuoteInfo(t, k, qi)
+
+	if err := VerifyQuote(&k.PublicKey, data, sig, pcrNums, pcrs); err != nil {
+		t.Fatal("Couldn't verify a quote over the data:", err)
+	}
+	if err := VerifyQuoteExternalData(&k.PublicKey, sha1.Sum(data), sig, pcrNums, pcrs); err != nil {
+		t.Fatal("Couldn't verify a quote over the hashed data:", err)
+	}
+}
+
+// signComposite builds and signs a quoteInfo over the given PCR selection and
+// values, returning the serialized composite and the signature.
+func signComposite(t *testing.T, k *rsa.PrivateKey, nonce Nonce, pcrNums []int, pcrs []byte) ([]byte, []byte) {
+	t.Helper()
+	sel, err := newPCRSelection(pcrNums)
+	if err != nil {
+		t.Fatal("Couldn't create PCR selection:", err)
+	}
+	composite, err := tpmutil.Pack(pcrComposite{*sel, pcrs})
+	if err != nil {
+		t.Fatal("Couldn't pack the PCR composite:", err)
+	}
+	qi, err := tpmutil.Pack(&quoteInfo{
+		Version:         quoteVersion,
+		Fixed:           fixedQuote,
+		CompositeDigest: sha1.Sum(composite),
+		Nonce:           nonce,
+	})
+	if err != nil {
+		t.Fatal("Couldn't pack the quote info:", err)
+	}
+	return composite, signQuoteInfo(t, k, qi)
+}
+
+func TestVerifyQuoteComposite(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	var nonce Nonce
+	pcrNums := []int{17, 18}
+	pcrs := make([]byte, 2*PCRSize)
+	composite, sig := signComposite(t, k, nonce, pcrNums, pcrs)
+
+	if err := VerifyQuoteComposite(&k.PublicKey, nonce, sig, pcrNums, composite); err != nil {
+		t.Fatal("Couldn't verify a quote over the composite:", err)
+	}
+	// The composite digest is the same one NewQuoteInfoExternalData computes.
+	if err := VerifyQuoteExternalData(&k.PublicKey, nonce, sig, pcrNums, pcrs); err != nil {
+		t.Fatal("Couldn't verify a quote over the PCR values:", err)
+	}
+}
+
+func TestVerifyQuoteCompositeSelectionMismatch(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	var nonce Nonce
+	// The TPM signed a quote over PCRs 17 and 18, and the caller asked for
+	// PCRs 16 and 17. The signature itself is valid.
+	composite, sig := signComposite(t, k, nonce, []int{17, 18}, make([]byte, 2*PCRSize))
+
+	err = VerifyQuoteComposite(&k.PublicKey, nonce, sig, []int{16, 17}, composite)
+	if err == nil {
+		t.Fatal("VerifyQuoteComposite accepted a quote over the wrong PCRs")
+	}
+	if want := "quote covers PCRs [17 18] but you asked for [16 17]"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("VerifyQuoteComposite returned %q, want %q", err, want)
+	}
+}
+
+func TestVerifyQuoteValueCountMismatch(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	var nonce Nonce
+	if err := VerifyQuoteExternalData(&k.PublicKey, nonce, nil, []int{17, 18}, make([]byte, PCRSize)); err == nil {
+		t.Fatal("VerifyQuoteExternalData accepted one PCR value for two PCRs")
+	}
+}
+
+func TestVerifyIdentityBinding(t *testing.T) {
+	aik, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an AIK:", err)
+	}
+	ca, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate a privacy CA key:", err)
+	}
+	label := []byte("privacy CA label")
+
+	k := testKey(t, keyIdentity, authAlways, &aik.PublicKey)
+	aikBlob, err := tpmutil.Pack(k)
+	if err != nil {
+		t.Fatal("Couldn't pack the AIK:", err)
+	}
+
+	// Sign the identity contents the way the TPM does in MakeIdentity.
+	caPub, err := convertPubKey(&ca.PublicKey)
+	if err != nil {
+		t.Fatal("Couldn't convert the privacy CA key:", err)
+	}
+	caPubBytes, err := tpmutil.Pack(caPub)
+	if err != nil {
+		t.Fatal("Couldn't pack the privacy CA key:", err)
+	}
+	chosenID := Digest(sha1.Sum(append(label, caPubBytes...)))
+	contents, err := tpmutil.Pack(uint32(0x01010000), OrdMakeIdentity, chosenID, k.AlgorithmParams, k.PubKey)
+	if err != nil {
+		t.Fatal("Couldn't pack the identity contents:", err)
+	}
+	d := sha1.Sum(contents)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, aik, crypto.SHA1, d[:])
+	if err != nil {
+		t.Fatal("Couldn't sign the identity contents:", err)
+	}
+
+	if err := VerifyIdentityBinding(aikBlob, &ca.PublicKey, label, sig); err != nil {
+		t.Fatal("Couldn't verify the identity binding:", err)
+	}
+	if err := VerifyIdentityBinding(aikBlob, &ca.PublicKey, []byte("another label"), sig); err == nil {
+		t.Fatal("VerifyIdentityBinding accepted a binding for a different label")
+	}
+	if err := VerifyIdentityBinding(aikBlob, nil, nil, sig); err == nil {
+		t.Fatal("VerifyIdentityBinding accepted a binding without the privacy CA key")
+	}
+	if err := VerifyIdentityBindingChosenID(aikBlob, chosenID, sig); err != nil {
+		t.Fatal("Couldn't verify the identity binding for the chosen ID:", err)
+	}
+	if err := VerifyIdentityBindingChosenID(aikBlob, Digest{1}, sig); err == nil {
+		t.Fatal("VerifyIdentityBindingChosenID accepted a binding for a different chosen ID")
+	}
+}
+
+func TestMarshalPubKeyPKIX(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate a key:", err)
+	}
+	blob := testKeyBlob(t, keyIdentity, authAlways, &priv.PublicKey)
+
+	der, err := MarshalPubKeyPKIX(blob)
+	if err != nil {
+		t.Fatal("Couldn't marshal the public key:", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal("Couldn't parse the marshaled public key:", err)
+	}
+	if !priv.PublicKey.Equal(pub) {
+		t.Fatal("The marshaled public key doesn't match the key in the blob")
+	}
+
+	p, err := MarshalPubKeyPEM(blob)
+	if err != nil {
+		t.Fatal("Couldn't marshal the public key to PEM:", err)
+	}
+	block, rest := pem.Decode(p)
+	if block == nil || block.Type != "PUBLIC KEY" || len(rest) != 0 {
+		t.Fatalf("MarshalPubKeyPEM returned %q, want a single PUBLIC KEY block", p)
+	}
+	if !bytes.Equal(block.Bytes, der) {
+		t.Fatal("The PEM block doesn't contain the PKIX encoding of the key")
+	}
+}
+
+func TestMarshalPubKeyPKIXAIKBlob(t *testing.T) {
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+	der, err := MarshalPubKeyPKIX(blob)
+	if err != nil {
+		t.Fatal("Couldn't marshal the AIK public key:", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal("Couldn't parse the marshaled AIK public key:", err)
+	}
+	want, err := UnmarshalRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't extract an RSA key from the AIK blob:", err)
+	}
+	if !want.Equal(pub) {
+		t.Fatal("The marshaled AIK public key doesn't match the AIK blob")
+	}
+}
+
+func TestPubKeyFingerprint(t *testing.T) {
+	var prints [][20]byte
+	for i := 0; i < 2; i++ {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal("Couldn't generate a key:", err)
+		}
+		blob := testKeyBlob(t, keyIdentity, authAlways, &priv.PublicKey)
+
+		der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		if err != nil {
+			t.Fatal("Couldn't marshal the public key:", err)
+		}
+		fp, err := PubKeyFingerprint(blob)
+		if err != nil {
+			t.Fatal("Couldn't compute the fingerprint of the key blob:", err)
+		}
+		if want := sha1.Sum(der); fp != want {
+			t.Fatalf("PubKeyFingerprint returned % x, want % x", fp, want)
+		}
+		if rsaFP := PubKeyFingerprintFromRSA(&priv.PublicKey); rsaFP != fp {
+			t.Fatalf("PubKeyFingerprintFromRSA returned % x, want % x", rsaFP, fp)
+		}
+
+		fp256, err := PubKeyFingerprintWithHash(blob, crypto.SHA256)
+		if err != nil {
+			t.Fatal("Couldn't compute the SHA-256 fingerprint of the key blob:", err)
+		}
+		if want := sha256.Sum256(der); !bytes.Equal(fp256, want[:]) {
+			t.Fatalf("PubKeyFingerprintWithHash returned % x, want % x", fp256, want)
+		}
+		prints = append(prints, fp)
+	}
+	if prints[0] == prints[1] {
+		t.Fatal("Two different keys have the same fingerprint")
+	}
+
+	if _, err := PubKeyFingerprint([]byte{0x01}); err == nil {
+		t.Fatal("PubKeyFingerprint accepted a truncated key blob")
+	}
+}
+
+func TestPubKeyFingerprintAIKBlob(t *testing.T) {
+	blob, err := os.ReadFile("./aikblob")
+	if err != nil {
+		t.Skip("No aikblob file; skipping test")
+	}
+	fp, err := PubKeyFingerprint(blob)
+	if err != nil {
+		t.Fatal("Couldn't compute the fingerprint of the AIK blob:", err)
+	}
+	pk, err := UnmarshalRSAPublicKey(blob)
+	if err != nil {
+		t.Fatal("Couldn't extract an RSA key from the AIK blob:", err)
+	}
+	if want := PubKeyFingerprintFromRSA(pk); fp != want {
+		t.Fatalf("The AIK blob's fingerprint is % x, but its RSA key's is % x", fp, want)
+	}
+}
+
+func TestVerifyQuoteWithCert(t *testing.T) {
+	aik, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an AIK:", err)
+	}
+	ca, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate a CA key:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "AIK"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &aik.PublicKey, ca)
+	if err != nil {
+		t.Fatal("Couldn't create a certificate for the AIK:", err)
+	}
+
+	data := []byte("some data to quote")
+	pcrNums := []int{17}
+	pcrs := make([]byte, PCRSize)
+	qi, err := NewQuoteInfo(data, pcrNums, pcrs)
+	if err != nil {
+		t.Fatal("Couldn't create quote info:", err)
+	}
+	sig := signQuoteInfo(t, aik, qi)
+
+	if err := VerifyQuoteWithCert(certDER, data, sig, pcrNums, pcrs); err != nil {
+		t.Fatal("Couldn't verify the quote with the AIK certificate:", err)
+	}
+	if err := VerifyQuoteWithCert(certDER, []byte("other data"), sig, pcrNums, pcrs); err == nil {
+		t.Fatal("VerifyQuoteWithCert accepted a quote over different data")
+	}
+	if err := VerifyQuoteWithCert(certDER[1:], data, sig, pcrNums, pcrs); err == nil {
+		t.Fatal("VerifyQuoteWithCert accepted a malformed certificate")
+	}
+}
+
+func TestVerifyQuote2(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Couldn't generate an RSA key:", err)
+	}
+	nonce := Nonce(sha1.Sum([]byte("nonce")))
+	pcrs := bytes.Repeat([]byte{0x17}, PCRSize)
+	pcrs = append(pcrs, bytes.Repeat([]byte{0x18}, PCRSize)...)
+	versionInfo := []byte{0x00, 0x30, 0x01, 0x02}
+
+	// Build the TPM_QUOTE_INFO2 the way the TPM does for PCRs 17 and 18.
+	digest := sha1.Sum(append([]byte{0x00, 0x03, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x28}, pcrs...))
+	qi, err := tpmutil.Pack(uint16(0x0036), []byte("QUT2"), nonce, uint16(3), []byte{0x00, 0x00, 0x06}, LocZero, digest)
+	if err != nil {
+		t.Fatal("Couldn't pack the quote info:", err)
+	}
+
+	for _, tt := range []struct {
+		name        string
+		versionInfo []byte
+	}{
+		{"without version", nil},
+		{"with version", versionInfo},
+	} {
+		sig := signQuoteInfo(t, k, append(append([]byte(nil), qi...), tt.versionInfo...))
+		if err := VerifyQuote2(&k.PublicKey, nonce, sig, []int{18, 17}, pcrs, tt.versionInfo); err != nil {
+			t.Errorf("Couldn't verify a quote %s: %v", tt.name, err)
+		}
+		if err := VerifyQuote2(&k.PublicKey, nonce, sig, []int{17, 18}, pcrs[:PCRSize], tt.versionInfo); err == nil {
+			t.Errorf("VerifyQuote2 %s accepted too few PCR values", tt.name)
+		}
+		if err := VerifyQuote2(&k.PublicKey, Nonce{}, sig, []int{17, 18}, pcrs, tt.versionInfo); err == nil {
+			t.Errorf("VerifyQuote2 %s accepted the wrong nonce", tt.name)
+		}
+	}
+}
@@ -49,7 +49,8 @@ func packWithHeader(ch commandHeader, cmd ...interface{}) ([]byte, error) {
 
 // Pack encodes a set of elements into a single byte array, using
 // encoding/binary. This means that all the elements must be encodeable
-// according to the rules of encoding/binary.
+// according to the rules of encoding/binary. Integers of every fixed size,
+// including the 64-bit tick and counter values, are encoded big-endian.
 //
 // It has one difference from encoding/binary: it encodes byte slices with a
 // prepended length, to match how the TPM encodes variable-length arrays. If
@@ -335,6 +335,39 @@ func TestPartialUnpack(t *testing.T) {
 	}
 }
 
+func TestEncodingUint64(t *testing.T) {
+	type ticks struct {
+		Current int64
+		Rate    uint64
+		Nonce   uint32
+	}
+	subTests := []struct {
+		decoded interface{}
+		encoded []byte
+	}{
+		{uint64(0x0102030405060708), []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{int64(-2), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}},
+		{ticks{0x0102030405060708, 1, 2}, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2}},
+	}
+	for _, st := range subTests {
+		packed, err := Pack(st.decoded)
+		if err != nil {
+			t.Fatalf("Pack(%#v) failed: %v", st.decoded, err)
+		}
+		if !bytes.Equal(packed, st.encoded) {
+			t.Fatalf("Pack(%#v): got %#v, want %#v", st.decoded, packed, st.encoded)
+		}
+
+		out := reflect.New(reflect.TypeOf(st.decoded))
+		if _, err := Unpack(st.encoded, out.Interface()); err != nil {
+			t.Fatalf("Unpack(%#v) failed: %v", st.encoded, err)
+		}
+		if got := out.Elem().Interface(); !reflect.DeepEqual(got, st.decoded) {
+			t.Fatalf("Unpack(%#v): got %#v, want %#v", st.encoded, got, st.decoded)
+		}
+	}
+}
+
 func TestUnpackHandlesArea(t *testing.T) {
 	buf := []byte{
 		0, 2,
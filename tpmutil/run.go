@@ -18,6 +18,7 @@ package tpmutil
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"time"
@@ -29,6 +30,13 @@ import (
 // returning a header and a body in separate responses.
 const maxTPMResponse = 4096
 
+// MaxResponseSize is the largest response, in bytes, that RunCommandRaw will
+// accept. The size declared in a response header is checked against it before
+// any buffer is allocated for the rest of the response, so a broken or
+// malicious transport can't make RunCommandRaw allocate arbitrary amounts of
+// memory.
+var MaxResponseSize uint32 = 4 << 20
+
 // RunCommandRaw executes the given raw command and returns the raw response.
 // Does not check the response code except to execute retry logic.
 func RunCommandRaw(rw io.ReadWriter, inb []byte) ([]byte, error) {
@@ -42,7 +50,7 @@ func RunCommandRaw(rw io.ReadWriter, inb []byte) ([]byte, error) {
 	var outb []byte
 
 	for {
-		if _, err := rw.Write(inb); err != nil {
+		if err := writeAll(rw, inb); err != nil {
 			return nil, err
 		}
 
@@ -67,6 +75,18 @@ func RunCommandRaw(rw io.ReadWriter, inb []byte) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+		if rh.Size > MaxResponseSize {
+			return nil, fmt.Errorf("response header declares %d bytes, more than the maximum of %d", rh.Size, MaxResponseSize)
+		}
+		// Transports that don't return the whole response in one Read, such
+		// as sockets, need the rest of it read separately.
+		if int(rh.Size) > len(outb) {
+			rest := make([]byte, int(rh.Size)-len(outb))
+			if _, err := io.ReadFull(rw, rest); err != nil {
+				return nil, fmt.Errorf("couldn't read the remaining %d bytes of the response: %v", len(rest), err)
+			}
+			outb = append(outb, rest...)
+		}
 
 		// If TPM is busy, retry the command after waiting a few ms.
 		if rh.Res == RCRetry {
@@ -85,6 +105,23 @@ func RunCommandRaw(rw io.ReadWriter, inb []byte) ([]byte, error) {
 	return outb, nil
 }
 
+// writeAll writes all of b to w. Transports such as sockets may accept a
+// command a few bytes at a time, so it keeps writing the rest until it has all
+// been written or w stops accepting it.
+func writeAll(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
 // RunCommand executes cmd with given tag and arguments. Returns TPM response
 // body (without response header) and response code from the header. Returned
 // error may be nil if response code is not RCSuccess; caller should check
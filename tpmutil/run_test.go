@@ -0,0 +1,122 @@
+// Copyright (c) 2018, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmutil
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// chunkedRW answers every command with a fixed response, returned at most
+// chunk bytes per Read like a socket might.
+type chunkedRW struct {
+	resp  []byte
+	chunk int
+}
+
+func (c *chunkedRW) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *chunkedRW) Read(p []byte) (int, error) {
+	if len(c.resp) == 0 {
+		return 0, io.EOF
+	}
+	n := c.chunk
+	if n > len(p) {
+		n = len(p)
+	}
+	n = copy(p[:n], c.resp)
+	c.resp = c.resp[n:]
+	return n, nil
+}
+
+func TestRunCommandRawHugeResponseSize(t *testing.T) {
+	resp, err := Pack(responseHeader{Tag(0x8001), 0xFFFFFFF0, RCSuccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RunCommandRaw(&chunkedRW{resp, len(resp)}, []byte{0})
+	if err == nil || !strings.Contains(err.Error(), "maximum") {
+		t.Fatalf("RunCommandRaw returned error %v, want an error about the maximum response size", err)
+	}
+}
+
+func TestRunCommandRawChunkedResponse(t *testing.T) {
+	body := bytes.Repeat([]byte{0xAB}, 100)
+	resp, err := Pack(responseHeader{Tag(0x8001), uint32(10 + len(body)), RCSuccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = append(resp, body...)
+
+	got, err := RunCommandRaw(&chunkedRW{append([]byte(nil), resp...), 16}, []byte{0})
+	if err != nil {
+		t.Fatal("RunCommandRaw failed on a chunked response:", err)
+	}
+	if !bytes.Equal(got, resp) {
+		t.Fatalf("RunCommandRaw returned % x, want % x", got, resp)
+	}
+}
+
+func TestRunCommandRawTruncatedResponse(t *testing.T) {
+	resp, err := Pack(responseHeader{Tag(0x8001), 100, RCSuccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RunCommandRaw(&chunkedRW{resp, len(resp)}, []byte{0}); err == nil {
+		t.Fatal("RunCommandRaw accepted a response shorter than its declared size")
+	}
+}
+
+// trickleRW accepts at most chunk bytes per Write and answers with a fixed
+// response.
+type trickleRW struct {
+	chunkedRW
+	written []byte
+	chunk   int
+}
+
+func (t *trickleRW) Write(p []byte) (int, error) {
+	n := t.chunk
+	if n > len(p) {
+		n = len(p)
+	}
+	t.written = append(t.written, p[:n]...)
+	return n, nil
+}
+
+func TestRunCommandRawShortWrites(t *testing.T) {
+	resp, err := Pack(responseHeader{Tag(0x8001), 10, RCSuccess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := bytes.Repeat([]byte{0x01, 0x02, 0x03}, 33)
+	rw := &trickleRW{chunkedRW: chunkedRW{resp, len(resp)}, chunk: 7}
+	if _, err := RunCommandRaw(rw, cmd); err != nil {
+		t.Fatal("RunCommandRaw failed on a transport with short writes:", err)
+	}
+	if !bytes.Equal(rw.written, cmd) {
+		t.Fatalf("RunCommandRaw wrote % x, want % x", rw.written, cmd)
+	}
+
+	// A transport that stops accepting bytes is an error.
+	rw = &trickleRW{chunkedRW: chunkedRW{resp, len(resp)}, chunk: 0}
+	if _, err := RunCommandRaw(rw, cmd); err != io.ErrShortWrite {
+		t.Fatalf("RunCommandRaw returned error %v, want %v", err, io.ErrShortWrite)
+	}
+}